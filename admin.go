@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Ingest settings kept in the database, so they can be changed through the
+// admin API (/admin/..., admin-scoped keys) or the admin command without
+// editing files or restarting; ingest picks them up on its next poll.
+//
+//   - geofences: named polygons. When any are enabled, or GEOFENCES_FILE
+//     has some, only incidents inside one are ingested, and each is
+//     tagged with the names of the geofences it is in.
+//   - ingest_event_types: when not empty, replaces INGEST_EVENT_TYPES.
+//   - notification_rules: routing rules, as in NOTIFY_RULES_FILE.
+
+// geofence is a named area, stored as a GeoJSON Polygon or MultiPolygon.
+type geofence struct {
+	Name      string          `json:"name"`
+	Geometry  geoJSONGeometry `json:"geometry"`
+	Enabled   bool            `json:"enabled"`
+	UpdatedAt time.Time       `json:"updated_at"`
+
+	polys []polygon
+	box   bbox
+}
+
+// geofenceInput is what the API and CLI accept: a geometry, or a bbox
+// (min lon, min lat, max lon, max lat) to turn into one.
+type geofenceInput struct {
+	Geometry *geoJSONGeometry `json:"geometry"`
+	BBox     []float64        `json:"bbox"`
+	Enabled  *bool            `json:"enabled"`
+}
+
+func (in geofenceInput) geofence(name string) (geofence, error) {
+	g := geofence{Name: name, Enabled: in.Enabled == nil || *in.Enabled}
+	switch {
+	case in.Geometry != nil && in.BBox != nil:
+		return g, errors.New("give a geometry or a bbox, not both")
+	case in.Geometry != nil:
+		g.Geometry = *in.Geometry
+	case len(in.BBox) == 4:
+		minLon, minLat, maxLon, maxLat := in.BBox[0], in.BBox[1], in.BBox[2], in.BBox[3]
+		if minLon >= maxLon || minLat >= maxLat {
+			return g, errors.New("bbox must be min lon, min lat, max lon, max lat")
+		}
+		coords, _ := json.Marshal([][][]float64{{{minLon, minLat}, {maxLon, minLat}, {maxLon, maxLat}, {minLon, maxLat}, {minLon, minLat}}})
+		g.Geometry = geoJSONGeometry{Type: "Polygon", Coordinates: coords}
+	default:
+		return g, errors.New("a geometry or a four-number bbox is required")
+	}
+	return g, g.prepare()
+}
+
+// prepare decodes the geometry for containment tests.
+func (g *geofence) prepare() error {
+	polys, err := g.Geometry.polygons()
+	if err != nil {
+		return fmt.Errorf("geofence %q: %w", g.Name, err)
+	}
+	if len(polys) == 0 || len(polys[0]) == 0 || len(polys[0][0]) < 4 {
+		return fmt.Errorf("geofence %q has no usable ring", g.Name)
+	}
+	g.polys, g.box = polys, polygonsBBox(polys)
+	return nil
+}
+
+func (g *geofence) contains(pt LatLon) bool {
+	if !g.box.contains(pt) {
+		return false
+	}
+	for _, p := range g.polys {
+		if p.contains(pt) {
+			return true
+		}
+	}
+	return false
+}
+
+func listGeofences(ctx context.Context, db *sql.DB, enabledOnly bool) ([]geofence, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, geometry, enabled, updated_at FROM geofences WHERE enabled OR NOT $1 ORDER BY name`, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fences []geofence
+	for rows.Next() {
+		var g geofence
+		var geometry []byte
+		if err := rows.Scan(&g.Name, &geometry, &g.Enabled, &g.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(geometry, &g.Geometry); err != nil {
+			return nil, fmt.Errorf("geofence %q has an invalid geometry: %w", g.Name, err)
+		}
+		if err := g.prepare(); err != nil {
+			return nil, err
+		}
+		fences = append(fences, g)
+	}
+	return fences, rows.Err()
+}
+
+func saveGeofence(ctx context.Context, db *sql.DB, g geofence) error {
+	geometry, err := json.Marshal(g.Geometry)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO geofences (name, geometry, enabled) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET geometry = EXCLUDED.geometry, enabled = EXCLUDED.enabled, updated_at = now()`,
+		g.Name, geometry, g.Enabled)
+	return err
+}
+
+func listIngestEventTypes(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT event_type FROM ingest_event_types ORDER BY event_type`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var types []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, rows.Err()
+}
+
+// notificationRule is a row of notification_rules.
+type notificationRule struct {
+	Name       string          `json:"name"`
+	Definition json.RawMessage `json:"definition"`
+	Enabled    bool            `json:"enabled"`
+	Priority   int             `json:"priority"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// notificationRuleInput is what the API and CLI accept for a rule.
+type notificationRuleInput struct {
+	Definition json.RawMessage `json:"definition"`
+	Enabled    *bool           `json:"enabled"`
+	Priority   *int            `json:"priority"`
+}
+
+func (in notificationRuleInput) rule(name string) (notificationRule, error) {
+	nr := notificationRule{Name: name, Definition: in.Definition, Enabled: in.Enabled == nil || *in.Enabled, Priority: 100}
+	if in.Priority != nil {
+		nr.Priority = *in.Priority
+	}
+	var r RoutingRule
+	if err := json.Unmarshal(in.Definition, &r); err != nil {
+		return nr, fmt.Errorf("invalid definition: %w", err)
+	}
+	r.Name = name
+	return nr, r.prepare()
+}
+
+func listNotificationRules(ctx context.Context, db *sql.DB) ([]notificationRule, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, definition, enabled, priority, updated_at FROM notification_rules ORDER BY priority, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []notificationRule
+	for rows.Next() {
+		var r notificationRule
+		if err := rows.Scan(&r.Name, &r.Definition, &r.Enabled, &r.Priority, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func saveNotificationRule(ctx context.Context, db *sql.DB, r notificationRule) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO notification_rules (name, definition, enabled, priority) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE SET definition = EXCLUDED.definition, enabled = EXCLUDED.enabled,
+			priority = EXCLUDED.priority, updated_at = now()`,
+		r.Name, []byte(r.Definition), r.Enabled, r.Priority)
+	return err
+}
+
+// adminTables are what the delete endpoints and commands may remove from,
+// with the key column.
+var adminTables = map[string]string{
+	"geofences":          "name",
+	"ingest_event_types": "event_type",
+	"notification_rules": "name",
+}
+
+// deleteAdminRow deletes one setting, reporting whether it existed.
+func deleteAdminRow(ctx context.Context, db *sql.DB, table, key string) (bool, error) {
+	res, err := db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE %s = $1`, table, adminTables[table]), key)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ingestFilter decides which feed incidents a run keeps.
+type ingestFilter struct {
+	eventTypes []string
+	geofences  []geofence
+	perSource  sourceFilter
+}
+
+// loadIngestFilter reads the current event types, the geofences from
+// GEOFENCES_FILE and the database, and source's county and route lists.
+func loadIngestFilter(ctx context.Context, cfg *Config, db *sql.DB, source string) (*ingestFilter, error) {
+	types, err := listIngestEventTypes(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("could not load ingest event types: %w", err)
+	}
+	if len(types) == 0 {
+		types = cfg.IngestEventTypes
+	}
+	fences, err := readGeofencesFile(cfg.GeofencesFile)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := listGeofences(ctx, db, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not load geofences: %w", err)
+	}
+	perSource, err := readSourceFilter(cfg.IngestFiltersFile, source)
+	if err != nil {
+		return nil, err
+	}
+	return &ingestFilter{eventTypes: types, geofences: append(fences, stored...), perSource: perSource}, nil
+}
+
+// readGeofencesFile reads GEOFENCES_FILE: {"name": {"bbox": [...]} or
+// {"geometry": {...}}, ...}.
+func readGeofencesFile(path string) ([]geofence, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read geofences: %w", err)
+	}
+	var inputs map[string]geofenceInput
+	if err := json.Unmarshal(raw, &inputs); err != nil {
+		return nil, fmt.Errorf("could not parse geofences %s: %w", path, err)
+	}
+	var fences []geofence
+	for name, in := range inputs {
+		g, err := in.geofence(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if g.Enabled {
+			fences = append(fences, g)
+		}
+	}
+	sort.Slice(fences, func(i, j int) bool { return fences[i].Name < fences[j].Name })
+	return fences, nil
+}
+
+func (f *ingestFilter) allows(incident Incident) bool {
+	if !containsFold(f.eventTypes, incident.IncidentType) || !f.perSource.allows(incident) {
+		return false
+	}
+	return len(f.geofences) == 0 || len(f.geofencesAt(LatLon{Lat: incident.Latitude, Lon: incident.Longitude})) > 0
+}
+
+// geofencesAt names the geofences containing pt, each once.
+func (f *ingestFilter) geofencesAt(pt LatLon) []string {
+	var names []string
+	for i := range f.geofences {
+		if f.geofences[i].contains(pt) && !containsFold(names, f.geofences[i].Name) {
+			names = append(names, f.geofences[i].Name)
+		}
+	}
+	return names
+}
+
+// Admin endpoints. Each kind has GET /admin/<kind>, PUT /admin/<kind>/{key}
+// to create or replace one and DELETE /admin/<kind>/{key}.
+
+func (s *server) adminRoutes(mux *http.ServeMux) {
+	admin := func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, s.requireScope(scopeAdmin, h))
+	}
+	admin("GET /admin/geofences", s.handleListGeofences)
+	admin("PUT /admin/geofences/{key}", s.handlePutGeofence)
+	admin("DELETE /admin/geofences/{key}", s.handleAdminDelete("geofences"))
+	admin("GET /admin/event-types", s.handleListEventTypes)
+	admin("PUT /admin/event-types/{key}", s.handlePutEventType)
+	admin("DELETE /admin/event-types/{key}", s.handleAdminDelete("ingest_event_types"))
+	admin("GET /admin/notification-rules", s.handleListNotificationRules)
+	admin("PUT /admin/notification-rules/{key}", s.handlePutNotificationRule)
+	admin("DELETE /admin/notification-rules/{key}", s.handleAdminDelete("notification_rules"))
+	admin("GET /admin/runs", s.handleListRuns)
+	admin("GET /admin/quarantine", s.handleListQuarantine)
+	admin("GET /admin/duplicates", s.handleListDuplicates)
+	admin("POST /admin/duplicates/{id}/dismiss", s.handleDismissDuplicate)
+	admin("POST /admin/merges", s.handleMerge)
+}
+
+// writeAdminJSON is writeJSON without the caching, since these change.
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logFor("admin").Error("Error encoding JSON", "err", err)
+	}
+}
+
+// readAdminInput decodes a request body of at most 1 MiB.
+func readAdminInput(r *http.Request, v interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return nil
+}
+
+func (s *server) handleListGeofences(w http.ResponseWriter, r *http.Request) {
+	fences, err := listGeofences(r.Context(), s.db, false)
+	if err != nil {
+		logFor("admin").Error("Error listing geofences", "err", err)
+		http.Error(w, "could not load geofences", http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"geofences": fences})
+}
+
+func (s *server) handlePutGeofence(w http.ResponseWriter, r *http.Request) {
+	var in geofenceInput
+	if err := readAdminInput(r, &in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g, err := in.geofence(r.PathValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveGeofence(r.Context(), s.db, g); err != nil {
+		logFor("admin").Error("Error saving geofence", "geofence", g.Name, "err", err)
+		http.Error(w, "could not save geofence", http.StatusInternalServerError)
+		return
+	}
+	logFor("admin").Info("Geofence saved", "geofence", g.Name, "by", adminName(r))
+	writeAdminJSON(w, http.StatusOK, g)
+}
+
+func (s *server) handleListEventTypes(w http.ResponseWriter, r *http.Request) {
+	types, err := listIngestEventTypes(r.Context(), s.db)
+	if err != nil {
+		logFor("admin").Error("Error listing ingest event types", "err", err)
+		http.Error(w, "could not load event types", http.StatusInternalServerError)
+		return
+	}
+	// Say what ingest is actually using.
+	resp := map[string]interface{}{"event_types": types, "from": "database"}
+	if len(types) == 0 {
+		resp["event_types"], resp["from"] = s.cfg.IngestEventTypes, "config"
+	}
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+func (s *server) handlePutEventType(w http.ResponseWriter, r *http.Request) {
+	eventType := r.PathValue("key")
+	if _, err := s.db.ExecContext(r.Context(), `INSERT INTO ingest_event_types (event_type) VALUES ($1) ON CONFLICT DO NOTHING`, eventType); err != nil {
+		logFor("admin").Error("Error adding ingest event type", "event_type", eventType, "err", err)
+		http.Error(w, "could not save event type", http.StatusInternalServerError)
+		return
+	}
+	logFor("admin").Info("Ingest event type added", "event_type", eventType, "by", adminName(r))
+	writeAdminJSON(w, http.StatusOK, map[string]string{"event_type": eventType})
+}
+
+func (s *server) handleListNotificationRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := listNotificationRules(r.Context(), s.db)
+	if err != nil {
+		logFor("admin").Error("Error listing notification rules", "err", err)
+		http.Error(w, "could not load notification rules", http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"notification_rules": rules})
+}
+
+func (s *server) handlePutNotificationRule(w http.ResponseWriter, r *http.Request) {
+	var in notificationRuleInput
+	if err := readAdminInput(r, &in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule, err := in.rule(r.PathValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveNotificationRule(r.Context(), s.db, rule); err != nil {
+		logFor("admin").Error("Error saving notification rule", "rule", rule.Name, "err", err)
+		http.Error(w, "could not save notification rule", http.StatusInternalServerError)
+		return
+	}
+	logFor("admin").Info("Notification rule saved", "rule", rule.Name, "by", adminName(r))
+	writeAdminJSON(w, http.StatusOK, rule)
+}
+
+func (s *server) handleAdminDelete(table string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		found, err := deleteAdminRow(r.Context(), s.db, table, key)
+		if err != nil {
+			logFor("admin").Error("Error deleting", "key", key, "table", table, "err", err)
+			http.Error(w, "could not delete", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		logFor("admin").Info("Deleted", "key", key, "table", table, "by", adminName(r))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// adminName is who made a change, for the log.
+func adminName(r *http.Request) string {
+	k, _ := requestKey(r.Context())
+	return "key " + k.Name
+}
+
+// runAdmin is the CLI counterpart of the admin API:
+//
+//	admin geofences list
+//	admin geofences set NAME (-file polygon.geojson | -bbox minLon,minLat,maxLon,maxLat) [-disabled]
+//	admin geofences delete NAME
+//	admin event-types list
+//	admin event-types add TYPE...
+//	admin event-types remove TYPE...
+//	admin rules list
+//	admin rules set NAME -file rule.json [-priority N] [-disabled]
+//	admin rules delete NAME
+//
+// A geofence file is a GeoJSON geometry, or a Feature or the first feature
+// of a FeatureCollection; a rule file is a routing rule object.
+func runAdmin(cfg *Config, db *sql.DB, args []string) {
+	if len(args) < 2 {
+		log.Fatal("Usage: admin geofences|event-types|rules|runs|duplicates list|set|add|remove|delete|merge|dismiss ...")
+	}
+	ctx := context.Background()
+	kind, action, rest := args[0], args[1], args[2:]
+	switch kind + " " + action {
+	case "geofences list":
+		fences, err := listGeofences(ctx, db, false)
+		if err != nil {
+			log.Fatalf("Error listing geofences: %s", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tENABLED\tBOUNDS\tUPDATED")
+		for _, g := range fences {
+			fmt.Fprintf(tw, "%s\t%t\t%.4f,%.4f,%.4f,%.4f\t%s\n", g.Name, g.Enabled, g.box.MinLon, g.box.MinLat, g.box.MaxLon, g.box.MaxLat,
+				g.UpdatedAt.In(easternTime).Format("2006-01-02 15:04"))
+		}
+		tw.Flush()
+	case "geofences set":
+		fs := flag.NewFlagSet("admin geofences set", flag.ExitOnError)
+		file := fs.String("file", "", "GeoJSON polygon")
+		bboxFlag := fs.String("bbox", "", "minLon,minLat,maxLon,maxLat")
+		disabled := fs.Bool("disabled", false, "save without applying it")
+		name := adminKeyArg(fs, rest)
+		enabled := !*disabled
+		in := geofenceInput{Enabled: &enabled}
+		if *file != "" {
+			geometry, err := readGeofenceFile(*file)
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+			in.Geometry = geometry
+		}
+		if *bboxFlag != "" {
+			for _, part := range strings.Split(*bboxFlag, ",") {
+				n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+				if err != nil {
+					log.Fatalf("Error: invalid -bbox: %s", err)
+				}
+				in.BBox = append(in.BBox, n)
+			}
+		}
+		g, err := in.geofence(name)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		if err := saveGeofence(ctx, db, g); err != nil {
+			log.Fatalf("Error saving geofence: %s", err)
+		}
+		logFor("admin").Info("Saved geofence", "geofence", name)
+	case "event-types list":
+		types, err := listIngestEventTypes(ctx, db)
+		if err != nil {
+			log.Fatalf("Error listing event types: %s", err)
+		}
+		if len(types) == 0 {
+			logFor("admin").Info("None in the database; ingest uses INGEST_EVENT_TYPES", "event_types", strings.Join(cfg.IngestEventTypes, ", "))
+		}
+		for _, t := range types {
+			fmt.Println(t)
+		}
+	case "event-types add":
+		for _, t := range rest {
+			if _, err := db.ExecContext(ctx, `INSERT INTO ingest_event_types (event_type) VALUES ($1) ON CONFLICT DO NOTHING`, t); err != nil {
+				log.Fatalf("Error adding %q: %s", t, err)
+			}
+		}
+	case "event-types remove":
+		for _, t := range rest {
+			if found, err := deleteAdminRow(ctx, db, "ingest_event_types", t); err != nil {
+				log.Fatalf("Error removing %q: %s", t, err)
+			} else if !found {
+				logFor("admin").Info("Not in the list", "event_type", t)
+			}
+		}
+	case "rules list":
+		rules, err := listNotificationRules(ctx, db)
+		if err != nil {
+			log.Fatalf("Error listing rules: %s", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tENABLED\tPRIORITY\tDEFINITION")
+		for _, r := range rules {
+			fmt.Fprintf(tw, "%s\t%t\t%d\t%s\n", r.Name, r.Enabled, r.Priority, r.Definition)
+		}
+		tw.Flush()
+	case "rules set":
+		fs := flag.NewFlagSet("admin rules set", flag.ExitOnError)
+		file := fs.String("file", "", "routing rule JSON")
+		priority := fs.Int("priority", 100, "lower runs first")
+		disabled := fs.Bool("disabled", false, "save without applying it")
+		name := adminKeyArg(fs, rest)
+		if *file == "" {
+			log.Fatal("Error: -file is required")
+		}
+		definition, err := os.ReadFile(*file)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		enabled := !*disabled
+		rule, err := notificationRuleInput{Definition: definition, Enabled: &enabled, Priority: priority}.rule(name)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		if err := saveNotificationRule(ctx, db, rule); err != nil {
+			log.Fatalf("Error saving rule: %s", err)
+		}
+		logFor("admin").Info("Saved notification rule", "rule", name)
+	case "geofences delete", "rules delete":
+		table := map[string]string{"geofences": "geofences", "rules": "notification_rules"}[kind]
+		if len(rest) != 1 {
+			log.Fatalf("Usage: admin %s delete NAME", kind)
+		}
+		found, err := deleteAdminRow(ctx, db, table, rest[0])
+		if err != nil {
+			log.Fatalf("Error deleting %s: %s", rest[0], err)
+		}
+		if !found {
+			log.Fatalf("Error: no %s named %q", kind, rest[0])
+		}
+	case "runs list":
+		fs := flag.NewFlagSet("admin runs list", flag.ExitOnError)
+		source := fs.String("source", "", "only this source's runs")
+		limit := fs.Int("limit", 20, "how many runs to show")
+		fs.Parse(rest)
+		runs, err := listIngestRuns(ctx, db, *source, *limit)
+		if err != nil {
+			log.Fatalf("Error listing runs: %s", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "STARTED\tSOURCE\tOUTCOME\tDURATION\tFETCHED\tSAVED\tCREATED\tUPDATED\tCLEARED\tERRORS")
+		for _, r := range runs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", r.StartedAt.In(easternTime).Format("2006-01-02 15:04:05"), r.Source, r.Outcome,
+				(time.Duration(r.DurationMS) * time.Millisecond).String(), r.Fetched, r.Saved, r.Created, r.Updated, r.Cleared, r.Errors)
+		}
+		tw.Flush()
+	case "duplicates list":
+		fs := flag.NewFlagSet("admin duplicates list", flag.ExitOnError)
+		status := fs.String("status", "pending", "pending, merged, dismissed, or empty for all")
+		limit := fs.Int("limit", 50, "how many to show")
+		fs.Parse(rest)
+		suggestions, err := listDuplicateSuggestions(ctx, db, *status, *limit)
+		if err != nil {
+			log.Fatalf("Error listing duplicates: %s", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tINCIDENT\tOTHER\tDISTANCE\tSTART GAP\tSTATUS\tSUGGESTED")
+		for _, d := range suggestions {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%.0f m\t%s\t%s\t%s\n", d.ID, d.Incident, d.Other, d.DistanceM,
+				(time.Duration(d.StartGap) * time.Second).String(), d.Status, d.CreatedAt.In(easternTime).Format("2006-01-02 15:04"))
+		}
+		tw.Flush()
+	case "duplicates merge":
+		fs := flag.NewFlagSet("admin duplicates merge", flag.ExitOnError)
+		reason := fs.String("reason", "", "why, for the record")
+		fs.Parse(rest)
+		if fs.NArg() != 2 {
+			log.Fatal("Usage: admin duplicates merge [-reason text] SURVIVOR DUPLICATE (each source:source_id)")
+		}
+		survivor, err := parseIncidentKey(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		duplicate, err := parseIncidentKey(fs.Arg(1))
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		mergedFrom, err := mergeIncidents(ctx, db, survivor, duplicate, "cli", *reason)
+		if err != nil {
+			log.Fatalf("Error merging: %s", err)
+		}
+		fmt.Printf("%s now merges %s\n", survivor, strings.Join(mergedFrom, ", "))
+	case "duplicates dismiss":
+		for _, arg := range rest {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				log.Fatalf("Error: invalid suggestion ID %q", arg)
+			}
+			if found, err := dismissDuplicateSuggestion(ctx, db, id); err != nil {
+				log.Fatalf("Error dismissing %d: %s", id, err)
+			} else if !found {
+				logFor("admin").Info("No pending suggestion", "id", id)
+			}
+		}
+	default:
+		log.Fatalf("Unknown admin command %q", kind+" "+action)
+	}
+}
+
+// adminKeyArg parses "NAME [flags]" or "[flags] NAME".
+func adminKeyArg(fs *flag.FlagSet, args []string) string {
+	var name string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if name == "" && fs.NArg() == 1 {
+		name = fs.Arg(0)
+	}
+	if name == "" {
+		log.Fatalf("Usage: admin ... %s NAME [flags]", fs.Name())
+	}
+	return name
+}
+
+// readGeofenceFile reads a geometry, Feature or FeatureCollection.
+func readGeofenceFile(path string) (*geoJSONGeometry, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var probe struct {
+		Type     string           `json:"type"`
+		Geometry *geoJSONGeometry `json:"geometry"`
+		Features []geoJSONFeature `json:"features"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	switch probe.Type {
+	case "Feature":
+		if probe.Geometry == nil {
+			return nil, fmt.Errorf("%s: feature has no geometry", path)
+		}
+		return probe.Geometry, nil
+	case "FeatureCollection":
+		if len(probe.Features) == 0 {
+			return nil, fmt.Errorf("%s has no features", path)
+		}
+		return &probe.Features[0].Geometry, nil
+	}
+	var g geoJSONGeometry
+	if err := json.Unmarshal(raw, &g); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	return &g, nil
+}
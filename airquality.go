@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// AirQuality is the current AirNow observation nearest an incident. When a
+// reporting area publishes several pollutants, the worst (highest AQI) wins,
+// which is how AirNow itself reports the overall AQI.
+type AirQuality struct {
+	AQI           int    `json:"aqi"`
+	Category      string `json:"category"`
+	Parameter     string `json:"parameter"`
+	ReportingArea string `json:"reporting_area"`
+	Observed      string `json:"observed"`
+}
+
+// airNowEnricher records the current AQI at each incident. AirNow allows
+// 500 requests an hour, so readings are cached in memory per ~10 km grid
+// cell for an hour; neighbouring incidents share one reporting area anyway.
+type airNowEnricher struct {
+	baseURL  string
+	apiKey   string
+	distance int
+	client   *http.Client
+	limiter  *rateLimiter
+
+	mu    sync.Mutex
+	cache map[string]airNowCacheEntry
+}
+
+type airNowCacheEntry struct {
+	reading *AirQuality
+	fetched time.Time
+}
+
+func newAirNowEnricher(cfg *Config) *airNowEnricher {
+	return &airNowEnricher{
+		baseURL:  firstNonEmpty(cfg.AirNowURL, "https://www.airnowapi.org"),
+		apiKey:   cfg.AirNowAPIKey,
+		distance: cfg.AirNowDistanceMiles,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		limiter:  newRateLimiter(2),
+		cache:    map[string]airNowCacheEntry{},
+	}
+}
+
+func (e *airNowEnricher) Name() string { return "air-quality" }
+
+func (e *airNowEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	key := fmt.Sprintf("%.1f,%.1f", incident.Latitude, incident.Longitude)
+	e.mu.Lock()
+	entry, ok := e.cache[key]
+	e.mu.Unlock()
+	if ok && time.Since(entry.fetched) < time.Hour {
+		metricCacheLookups.inc("air-quality", "hit")
+		incident.AirQuality = entry.reading
+		return nil
+	}
+	metricCacheLookups.inc("air-quality", "miss")
+
+	reading, err := e.fetch(ctx, incident.Latitude, incident.Longitude)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.cache[key] = airNowCacheEntry{reading: reading, fetched: time.Now()}
+	e.mu.Unlock()
+	incident.AirQuality = reading
+	return nil
+}
+
+func (e *airNowEnricher) fetch(ctx context.Context, lat, lon float64) (*AirQuality, error) {
+	q := url.Values{}
+	q.Set("format", "application/json")
+	q.Set("latitude", fmt.Sprintf("%.4f", lat))
+	q.Set("longitude", fmt.Sprintf("%.4f", lon))
+	q.Set("distance", fmt.Sprint(e.distance))
+	q.Set("API_KEY", e.apiKey)
+	obsURL := e.baseURL + "/aq/observation/latLong/current/?" + q.Encode()
+
+	var observations []struct {
+		DateObserved  string `json:"DateObserved"`
+		HourObserved  int    `json:"HourObserved"`
+		LocalTimeZone string `json:"LocalTimeZone"`
+		ReportingArea string `json:"ReportingArea"`
+		ParameterName string `json:"ParameterName"`
+		AQI           int    `json:"AQI"`
+		Category      struct {
+			Name string `json:"Name"`
+		} `json:"Category"`
+	}
+	if err := getJSON(ctx, e.client, e.limiter, obsURL, &observations); err != nil {
+		return nil, fmt.Errorf("AirNow observation request failed: %w", err)
+	}
+
+	var worst *AirQuality
+	for _, o := range observations {
+		if o.AQI < 0 || (worst != nil && o.AQI <= worst.AQI) {
+			continue
+		}
+		worst = &AirQuality{
+			AQI:           o.AQI,
+			Category:      o.Category.Name,
+			Parameter:     o.ParameterName,
+			ReportingArea: o.ReportingArea,
+			Observed:      fmt.Sprintf("%s %02d:00 %s", o.DateObserved, o.HourObserved, o.LocalTimeZone),
+		}
+	}
+	// A nil reading is cached too, so areas with no monitor aren't re-queried.
+	return worst, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// analyticsSource is the source of the events the analytics jobs send,
+// so routing rules can pick them out.
+const analyticsSource = "analytics"
+
+// analyticsJob is one analytics job, configured from its flags. run does
+// one pass, publishing what it finds to sinks.
+type analyticsJob func(ctx context.Context, sinks *sinkDispatcher) error
+
+// runAnalytics runs an analytics job over the stored incidents:
+//
+//	analytics hotspots [-window 6h] [-radius 1500] [-min-incidents 4]
+//	analytics anomalies
+//	analytics summaries [-date YYYY-MM-DD]
+//	analytics overdue
+//	analytics risk [-retrain]
+//
+// A job runs once, or with -interval until interrupted. What it finds is
+// sent through the notification rules and sinks as an incident whose
+// source is "analytics".
+func runAnalytics(cfg *Config, db *sql.DB, args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: analytics hotspots|anomalies|summaries|overdue|risk [-interval d] ...")
+	}
+	name, args := args[0], args[1:]
+	fs := flag.NewFlagSet("analytics "+name, flag.ExitOnError)
+	interval := fs.Duration("interval", 0, "run this often instead of once")
+	var job analyticsJob
+	switch name {
+	case "hotspots":
+		job = hotspotJob(cfg, db, fs)
+	case "anomalies":
+		job = anomalyJob(cfg, db)
+	case "summaries":
+		job = summaryJob(cfg, db, fs)
+	case "overdue":
+		job = overdueJob(cfg, db)
+	case "risk":
+		job = riskJob(cfg, db, fs)
+	default:
+		log.Fatalf("Unknown analytics job %q (expected hotspots, anomalies, summaries, overdue or risk)", name)
+	}
+	fs.Parse(args)
+
+	sinks, err := newNotifier(cfg, db, nil)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	defer sinks.Close()
+	logger := logFor("analytics")
+	runOnce := func(ctx context.Context) error {
+		err := job(ctx, sinks)
+		if err != nil {
+			logger.Error("Analytics job failed", "job", name, "err", err)
+		}
+		sinks.Flush()
+		return err
+	}
+
+	if *interval <= 0 {
+		if err := runOnce(context.Background()); err != nil {
+			sinks.Close()
+			os.Exit(1)
+		}
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	logger.Info("Running analytics job", "job", name, "interval", interval.String())
+	for {
+		runOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// analyticsEvent is a finding as an incident event: kind is its event type
+// ("Hotspot") and id tells it apart from the others of its kind.
+func analyticsEvent(change ChangeType, kind, id string, at LatLon, county, road, summary string, details map[string]interface{}) IncidentEvent {
+	status := StatusActive
+	if change == ChangeCleared {
+		status = StatusCleared
+	}
+	return IncidentEvent{
+		Change:     change,
+		OccurredAt: time.Now().UTC(),
+		Incident: IncidentPayload{
+			Source:         analyticsSource,
+			SourceID:       topicSegment(kind) + "-" + id,
+			EventType:      kind,
+			Status:         status,
+			Address:        summary,
+			County:         county,
+			RoadNormalized: road,
+			Latitude:       at.Lat,
+			Longitude:      at.Lon,
+			StartTime:      time.Now().UTC(),
+			Summary:        summary,
+			Details:        details,
+		},
+	}
+}
+
+// mostCommon is the most frequent non-empty value, ties going to the
+// first alphabetically.
+func mostCommon(values []string) string {
+	counts := map[string]int{}
+	for _, v := range values {
+		if v != "" {
+			counts[v]++
+		}
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
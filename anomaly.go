@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Anomaly detection compares each county's incidents over the last hour
+// with its baseline: the mean count for that hour of that day of the week
+// (Eastern) over the last ANOMALY_BASELINE_WEEKS weeks. A county at
+// ANOMALY_MULTIPLE times its baseline or more, with at least
+// ANOMALY_MIN_INCIDENTS incidents, is an "Anomaly" event for the
+// notification rules and sinks, once per county and hour. A snow squall
+// shows up this way before the weather alert does. The baselines are kept
+// in incident_baselines and refreshed hourly.
+//
+// With ANOMALY_DETECTION on, ingest checks after every successful run;
+// "analytics anomalies" does the same on its own schedule.
+
+// anomalyDetector holds the settings and what has been flagged.
+type anomalyDetector struct {
+	db           *sql.DB
+	multiple     float64
+	minIncidents int
+	weeks        int
+
+	mu          sync.Mutex
+	refreshedAt time.Time
+	// flagged is county and hour slot for everything already notified.
+	flagged map[string]bool
+}
+
+func newAnomalyDetector(cfg *Config, db *sql.DB) *anomalyDetector {
+	return &anomalyDetector{db: db, multiple: cfg.AnomalyMultiple, minIncidents: cfg.AnomalyMinIncidents,
+		weeks: cfg.AnomalyBaselineWeeks, flagged: map[string]bool{}}
+}
+
+// countyAnomaly is a county running above its baseline.
+type countyAnomaly struct {
+	County   string
+	Count    int
+	Baseline float64
+	At       LatLon
+}
+
+// refreshBaselines recomputes incident_baselines from the stored incidents.
+func (d *anomalyDetector) refreshBaselines(ctx context.Context) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM incident_baselines`); err != nil {
+		return fmt.Errorf("could not clear baselines: %w", err)
+	}
+	// Casting to timestamptz reads a plain timestamp column as UTC, the
+	// session zone, so this works for either column type.
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO incident_baselines (county_name, dow, hour, mean_count)
+		SELECT county_name,
+			extract(isodow FROM timestamp::timestamptz AT TIME ZONE 'America/New_York')::int,
+			extract(hour FROM timestamp::timestamptz AT TIME ZONE 'America/New_York')::int,
+			count(*)::float8 / $1
+		FROM unified_incidents
+		WHERE timestamp >= date_trunc('hour', now()) - make_interval(weeks => $1)
+			AND timestamp < date_trunc('hour', now()) AND county_name IS NOT NULL
+		GROUP BY 1, 2, 3`, d.weeks); err != nil {
+		return fmt.Errorf("could not compute baselines: %w", err)
+	}
+	return tx.Commit()
+}
+
+// check refreshes the baselines if they are an hour old and publishes an
+// event for each county newly above its baseline.
+func (d *anomalyDetector) check(ctx context.Context, sinks *sinkDispatcher) ([]countyAnomaly, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.refreshedAt) >= time.Hour {
+		if err := d.refreshBaselines(ctx); err != nil {
+			return nil, err
+		}
+		d.refreshedAt = time.Now()
+	}
+	now := time.Now().In(easternTime)
+	slot := now.Format("2006-01-02T15")
+	dow := int(now.Weekday())
+	if dow == 0 {
+		dow = 7
+	}
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT i.county_name, count(*), coalesce(max(b.mean_count), 0), avg(i.latitude), avg(i.longitude)
+		FROM unified_incidents i
+		LEFT JOIN incident_baselines b ON b.county_name = i.county_name AND b.dow = $1 AND b.hour = $2
+		WHERE i.timestamp >= now() - interval '1 hour' AND i.county_name IS NOT NULL
+		GROUP BY i.county_name`, dow, now.Hour())
+	if err != nil {
+		return nil, fmt.Errorf("could not count recent incidents: %w", err)
+	}
+	defer rows.Close()
+	var found []countyAnomaly
+	for rows.Next() {
+		var a countyAnomaly
+		if err := rows.Scan(&a.County, &a.Count, &a.Baseline, &a.At.Lat, &a.At.Lon); err != nil {
+			return nil, err
+		}
+		// A county with no history has a baseline of zero; it still needs
+		// ANOMALY_MIN_INCIDENTS.
+		if a.Count < d.minIncidents || float64(a.Count) < d.multiple*a.Baseline {
+			continue
+		}
+		found = append(found, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for k := range d.flagged {
+		if !strings.HasSuffix(k, "/"+slot) {
+			delete(d.flagged, k)
+		}
+	}
+	for _, a := range found {
+		key := a.County + "/" + slot
+		if d.flagged[key] {
+			continue
+		}
+		d.flagged[key] = true
+		logFor("analytics").Warn("Incident count above baseline", "county", a.County, "count", a.Count, "baseline", a.Baseline)
+		summary := fmt.Sprintf("%d incidents in %s County in the last hour, against %.1f usual for a %s at this hour",
+			a.Count, a.County, a.Baseline, now.Weekday())
+		details := map[string]interface{}{"count": a.Count, "baseline": a.Baseline, "multiple": d.multiple, "hour": slot}
+		sinks.Publish(analyticsEvent(ChangeCreated, "Anomaly", topicSegment(a.County)+"-"+slot, a.At, a.County, "", summary, details))
+	}
+	return found, nil
+}
+
+func anomalyJob(cfg *Config, db *sql.DB) analyticsJob {
+	detector := newAnomalyDetector(cfg, db)
+	return func(ctx context.Context, sinks *sinkDispatcher) error {
+		found, err := detector.check(ctx, sinks)
+		if err != nil {
+			return err
+		}
+		logFor("analytics").Info("Checked incident counts against baselines", "anomalies", len(found))
+		return nil
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// The JSON API over unified_incidents, so front-ends don't need database
+// credentials.
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+type incidentList struct {
+	Incidents []IncidentPayload `json:"incidents"`
+	Count     int               `json:"count"`
+	Limit     int               `json:"limit"`
+	Offset    int               `json:"offset"`
+}
+
+// handleIncidents lists incidents, newest first, with the usual filters
+// (county, road, event_type or type, status, bbox, since, until) and
+// limit/offset paging.
+func (s *server) handleIncidents(w http.ResponseWriter, r *http.Request) {
+	f, err := parseIncidentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Limit == 0 {
+		f.Limit = apiDefaultLimit
+	}
+	if f.Limit > apiMaxLimit {
+		f.Limit = apiMaxLimit
+	}
+	incidents, err := queryIncidents(r.Context(), s.db, f)
+	if err != nil {
+		logFor("api").Error("Error listing incidents", "err", err)
+		http.Error(w, "could not load incidents", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "application/json", incidentList{Incidents: incidents, Count: len(incidents), Limit: f.Limit, Offset: f.Offset})
+}
+
+// handleSearch is a full-text search (?q=) over road, type, reason,
+// location and summary, best match first, over all incidents unless
+// ?status= says otherwise. The other incident filters apply too.
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	f, err := parseIncidentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Search == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	if f.Limit == 0 {
+		f.Limit = apiDefaultLimit
+	}
+	if f.Limit > apiMaxLimit {
+		f.Limit = apiMaxLimit
+	}
+	incidents, err := queryIncidents(r.Context(), s.db, f)
+	if err != nil {
+		logFor("api").Error("Error searching incidents", "err", err)
+		http.Error(w, "could not search incidents", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "application/json", incidentList{Incidents: incidents, Count: len(incidents), Limit: f.Limit, Offset: f.Offset})
+}
+
+// handleIncident returns one incident with its details.
+func (s *server) handleIncident(w http.ResponseWriter, r *http.Request) {
+	f := incidentFilter{Source: r.PathValue("source"), SourceID: r.PathValue("id"), Limit: 1, WithDetails: true}
+	incidents, err := queryIncidents(r.Context(), s.db, f)
+	if err != nil {
+		logFor("api").Error("Error loading incident", "err", err)
+		http.Error(w, "could not load incident", http.StatusInternalServerError)
+		return
+	}
+	if len(incidents) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, "application/json", incidents[0])
+}
+
+// incidentChangeRecord is a row of incident_history.
+type incidentChangeRecord struct {
+	Change    string          `json:"change"`
+	ChangedAt time.Time       `json:"changed_at"`
+	Patch     json.RawMessage `json:"patch,omitempty"`
+	// ChangedBy and Note are set on changes made by hand.
+	ChangedBy string `json:"changed_by,omitempty"`
+	Note      string `json:"note,omitempty"`
+}
+
+type incidentHistory struct {
+	Source   string                 `json:"source"`
+	SourceID string                 `json:"source_id"`
+	Changes  []incidentChangeRecord `json:"changes"`
+}
+
+// handleIncidentHistory lists an incident's changes, oldest first, each
+// update with the JSON Patch of its details.
+func (s *server) handleIncidentHistory(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT change, changed_at, patch, coalesce(changed_by, ''), coalesce(note, '') FROM incident_history
+		WHERE source = $1 AND source_id = $2
+		ORDER BY changed_at, id`, r.PathValue("source"), r.PathValue("id"))
+	if err != nil {
+		logFor("api").Error("Error loading incident history", "err", err)
+		http.Error(w, "could not load history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	changes := []incidentChangeRecord{}
+	for rows.Next() {
+		var c incidentChangeRecord
+		var patch []byte
+		if err := rows.Scan(&c.Change, &c.ChangedAt, &patch, &c.ChangedBy, &c.Note); err != nil {
+			logFor("api").Error("Error loading incident history", "err", err)
+			http.Error(w, "could not load history", http.StatusInternalServerError)
+			return
+		}
+		c.Patch = patch
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		logFor("api").Error("Error loading incident history", "err", err)
+		http.Error(w, "could not load history", http.StatusInternalServerError)
+		return
+	}
+	if len(changes) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, "application/json", incidentHistory{Source: r.PathValue("source"), SourceID: r.PathValue("id"), Changes: changes})
+}
+
+// statsSummary is a snapshot of what's going on now and over the last day.
+type statsSummary struct {
+	GeneratedAt    time.Time      `json:"generated_at"`
+	Active         int            `json:"active"`
+	Started24h     int            `json:"started_24h"`
+	Cleared24h     int            `json:"cleared_24h"`
+	LanesClosed    int            `json:"lanes_closed"`
+	ActiveByType   map[string]int `json:"active_by_event_type"`
+	ActiveByCounty map[string]int `json:"active_by_county"`
+	// ActiveBySeverity is keyed by normalized severity, "0" for unknown.
+	ActiveBySeverity map[string]int `json:"active_by_severity"`
+}
+
+func (s *server) handleStatsSummary(w http.ResponseWriter, r *http.Request) {
+	summary, err := s.loadStatsSummary(r.Context())
+	if err != nil {
+		logFor("api").Error("Error building stats summary", "err", err)
+		http.Error(w, "could not build summary", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "application/json", summary)
+}
+
+func (s *server) loadStatsSummary(ctx context.Context) (*statsSummary, error) {
+	summary := &statsSummary{
+		GeneratedAt:      time.Now().UTC(),
+		ActiveByType:     map[string]int{},
+		ActiveByCounty:   map[string]int{},
+		ActiveBySeverity: map[string]int{},
+	}
+	if err := s.db.QueryRowContext(ctx, `
+		SELECT count(*) FILTER (WHERE status = 'active'),
+			count(*) FILTER (WHERE timestamp > now() - interval '24 hours'),
+			count(*) FILTER (WHERE cleared_at > now() - interval '24 hours'),
+			coalesce(sum(lanes_closed) FILTER (WHERE status = 'active'), 0)
+		FROM unified_incidents`).Scan(&summary.Active, &summary.Started24h, &summary.Cleared24h, &summary.LanesClosed); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT event_type, coalesce(county_name, ''), coalesce(normalized_severity, 0)::text, count(*)
+		FROM unified_incidents
+		WHERE status = 'active'
+		GROUP BY 1, 2, 3`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventType, county, severity string
+		var n int
+		if err := rows.Scan(&eventType, &county, &severity, &n); err != nil {
+			return nil, err
+		}
+		summary.ActiveByType[eventType] += n
+		if county != "" {
+			summary.ActiveByCounty[county] += n
+		}
+		summary.ActiveBySeverity[severity] += n
+	}
+	return summary, rows.Err()
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// API keys for serve. Keys live in the api_keys table, stored as SHA-256
+// hashes, and can also be given in API_KEYS for setups without a CLI
+// step. Each has a scope, read or admin, and a per-minute request limit
+// (zero for API_RATE_PER_MINUTE). With API_AUTH off, requests need no
+// key but a key that is sent is still checked and limited.
+
+const (
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+
+	apiKeyRefresh = time.Minute
+)
+
+type apiKey struct {
+	Name      string
+	Scope     string
+	PerMinute int
+}
+
+// allows reports whether the key may use an endpoint needing scope.
+func (k apiKey) allows(scope string) bool {
+	return k.Scope == scopeAdmin || k.Scope == scope
+}
+
+// hashAPIKey is how keys are stored and looked up.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAPIKeys reads API_KEYS entries, each "name:key:scope" with an
+// optional ":per-minute", into keys by hash.
+func parseAPIKeys(entries []string) (map[string]apiKey, error) {
+	keys := map[string]apiKey{}
+	for _, entry := range entries {
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 4 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid API_KEYS entry for %q: want name:key:scope[:per-minute]", parts[0])
+		}
+		k := apiKey{Name: parts[0], Scope: parts[2]}
+		if k.Scope != scopeRead && k.Scope != scopeAdmin {
+			return nil, fmt.Errorf("API key %s: scope must be %s or %s", k.Name, scopeRead, scopeAdmin)
+		}
+		if len(parts) == 4 {
+			n, err := strconv.Atoi(parts[3])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("API key %s: invalid per-minute limit %q", k.Name, parts[3])
+			}
+			k.PerMinute = n
+		}
+		keys[hashAPIKey(parts[1])] = k
+	}
+	return keys, nil
+}
+
+// apiKeyStore resolves keys, caching the table for apiKeyRefresh so a
+// revoke takes effect within a minute, and keeps each key's rate limit.
+type apiKeyStore struct {
+	cfg *Config
+	db  *sql.DB
+
+	mu       sync.Mutex
+	keys     map[string]apiKey
+	loadedAt time.Time
+	used     map[string]bool
+	buckets  map[string]*tokenBucket
+}
+
+func newAPIKeyStore(cfg *Config, db *sql.DB) *apiKeyStore {
+	return &apiKeyStore{cfg: cfg, db: db, used: map[string]bool{}, buckets: map[string]*tokenBucket{}}
+}
+
+// lookup returns the key's details, or false if it isn't a current key.
+func (s *apiKeyStore) lookup(ctx context.Context, key string) (apiKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil || time.Since(s.loadedAt) > apiKeyRefresh {
+		if err := s.refresh(ctx); err != nil {
+			if s.keys == nil {
+				return apiKey{}, false, err
+			}
+			// Keep going on the keys we have.
+			logFor("api").Error("Error refreshing API keys", "err", err)
+		}
+	}
+	k, ok := s.keys[hashAPIKey(key)]
+	if ok {
+		s.used[k.Name] = true
+	}
+	return k, ok, nil
+}
+
+// refresh reloads the keys, recording which were used since the last
+// refresh. Called with mu held.
+func (s *apiKeyStore) refresh(ctx context.Context) error {
+	keys, err := parseAPIKeys(s.cfg.APIKeys)
+	if err != nil {
+		return err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT name, key_hash, scope, rate_per_minute FROM api_keys WHERE revoked_at IS NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k apiKey
+		var hash string
+		if err := rows.Scan(&k.Name, &hash, &k.Scope, &k.PerMinute); err != nil {
+			return err
+		}
+		keys[hash] = k
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.keys, s.loadedAt = keys, time.Now()
+
+	if len(s.used) > 0 {
+		var names []string
+		for name := range s.used {
+			names = append(names, name)
+		}
+		if _, err := s.db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = now() WHERE name = ANY($1)`, pq.Array(names)); err != nil {
+			logFor("api").Error("Error recording API key use", "err", err)
+		}
+		s.used = map[string]bool{}
+	}
+	return nil
+}
+
+// allow takes one request from the key's budget, returning how long to
+// wait if it's spent.
+func (s *apiKeyStore) allow(k apiKey) (bool, time.Duration) {
+	perMinute := k.PerMinute
+	if perMinute == 0 {
+		perMinute = s.cfg.APIRatePerMinute
+	}
+	if perMinute <= 0 {
+		return true, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.buckets[k.Name]
+	if b == nil || b.perMinute != perMinute {
+		b = &tokenBucket{perMinute: perMinute, tokens: float64(perMinute), last: time.Now()}
+		s.buckets[k.Name] = b
+	}
+	return b.take(time.Now())
+}
+
+// tokenBucket allows perMinute requests a minute, in bursts of up to a
+// minute's worth.
+type tokenBucket struct {
+	perMinute int
+	tokens    float64
+	last      time.Time
+}
+
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	rate := float64(b.perMinute) / 60
+	b.tokens = math.Min(float64(b.perMinute), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// requestAPIKey finds the key in the Authorization bearer token, the
+// X-API-Key header or, for browsers' EventSource and WebSocket, the
+// api_key query parameter.
+func requestAPIKey(r *http.Request) string {
+	if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(v)
+	}
+	if v := r.Header.Get("X-API-Key"); v != "" {
+		return v
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+type apiKeyContextKey struct{}
+
+// requestKey returns the key that authenticated the request, if any.
+func requestKey(ctx context.Context) (apiKey, bool) {
+	k, ok := ctx.Value(apiKeyContextKey{}).(apiKey)
+	return k, ok
+}
+
+// publicPath reports whether a path is served without a key: the
+// dashboard's static files, which then call the API with one, and the API
+// description and its docs page.
+func publicPath(path string) bool {
+	return path == "/" || strings.HasPrefix(path, "/dashboard/") || path == "/openapi.json" || strings.HasPrefix(path, "/docs/")
+}
+
+// authenticate checks the request's API key and rate limit before
+// passing it on.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(r)
+		if key == "" {
+			if s.cfg.APIAuth && !publicPath(r.URL.Path) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="ncdot-incidents"`)
+				http.Error(w, "API key required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		k, ok, err := s.keys.lookup(r.Context(), key)
+		if err != nil {
+			logFor("api").Error("Error loading API keys", "err", err)
+			http.Error(w, "could not check API key", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if rec, ok := w.(*statusRecorder); ok {
+			rec.key = k.Name
+		}
+		if ok, wait := s.keys.allow(k); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k)))
+	})
+}
+
+// requireScope limits a handler to keys with scope. Without API_AUTH,
+// keyless requests are let through to read endpoints as before; admin
+// endpoints always need a key.
+func (s *server) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k, ok := requestKey(r.Context())
+		if !ok && !s.cfg.APIAuth && scope == scopeRead {
+			next(w, r)
+			return
+		}
+		if !ok || !k.allows(scope) {
+			http.Error(w, "this key may not use this endpoint", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// logRequests logs each request with its status, time taken and key.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK, key: "-"}
+		next.ServeHTTP(rec, r)
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		logFor("http").Info("Request", "remote", host, "method", r.Method, "path", r.URL.Path, "status", rec.status,
+			"duration", time.Since(start).Round(time.Millisecond).String(), "key", rec.key)
+	})
+}
+
+// statusRecorder notes the response status and the key authenticate
+// found, passing through the streaming interfaces the stream handlers
+// need.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	key    string
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking unsupported")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// runAPIKey manages the api_keys table:
+//
+//	apikey create -name NAME [-scope read|admin] [-rate N]
+//	apikey list
+//	apikey revoke NAME
+func runAPIKey(cfg *Config, db *sql.DB, args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: apikey create|list|revoke")
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ExitOnError)
+		name := fs.String("name", "", "name identifying the key's holder")
+		scope := fs.String("scope", scopeRead, "read or admin")
+		rate := fs.Int("rate", 0, "requests per minute; 0 for API_RATE_PER_MINUTE")
+		fs.Parse(args[1:])
+		if *name == "" {
+			log.Fatal("Error: -name is required")
+		}
+		if *scope != scopeRead && *scope != scopeAdmin {
+			log.Fatalf("Error: -scope must be %s or %s", scopeRead, scopeAdmin)
+		}
+		secret := make([]byte, 24)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Error generating key: %s", err)
+		}
+		key := "ncdot_" + hex.EncodeToString(secret)
+		if _, err := db.ExecContext(ctx, `INSERT INTO api_keys (name, key_hash, scope, rate_per_minute) VALUES ($1, $2, $3, $4)`,
+			*name, hashAPIKey(key), *scope, *rate); err != nil {
+			log.Fatalf("Error creating key: %s", err)
+		}
+		// Only the hash is kept, so this is the one chance to copy it.
+		fmt.Println(key)
+	case "list":
+		rows, err := db.QueryContext(ctx, `SELECT name, scope, rate_per_minute, created_at, last_used_at, revoked_at FROM api_keys ORDER BY name`)
+		if err != nil {
+			log.Fatalf("Error listing keys: %s", err)
+		}
+		defer rows.Close()
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSCOPE\tPER MINUTE\tCREATED\tLAST USED\tREVOKED")
+		stamp := func(t sql.NullTime) string {
+			if !t.Valid {
+				return "-"
+			}
+			return t.Time.In(easternTime).Format("2006-01-02 15:04")
+		}
+		for rows.Next() {
+			var name, scope string
+			var rate int
+			var created time.Time
+			var used, revoked sql.NullTime
+			if err := rows.Scan(&name, &scope, &rate, &created, &used, &revoked); err != nil {
+				log.Fatalf("Error listing keys: %s", err)
+			}
+			perMinute := strconv.Itoa(rate)
+			if rate == 0 {
+				perMinute = "default"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", name, scope, perMinute, created.In(easternTime).Format("2006-01-02 15:04"), stamp(used), stamp(revoked))
+		}
+		if err := rows.Err(); err != nil {
+			log.Fatalf("Error listing keys: %s", err)
+		}
+		tw.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			log.Fatal("Usage: apikey revoke NAME")
+		}
+		res, err := db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = now() WHERE name = $1 AND revoked_at IS NULL`, args[1])
+		if err != nil {
+			log.Fatalf("Error revoking key: %s", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Fatalf("Error: no active key named %q", args[1])
+		}
+		logFor("admin").Info("Revoked; serve stops accepting it within the refresh interval", "key", args[1], "refresh", apiKeyRefresh.String())
+	default:
+		log.Fatalf("Unknown apikey command %q (expected create, list or revoke)", args[0])
+	}
+}
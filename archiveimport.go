@@ -0,0 +1,338 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runImport loads NCDOT's historical incident archives (TIMS exports) into
+// unified_incidents, so analytics have years of history to work from:
+//
+//	import [-batch 500] [-weather] tims-2019.csv.gz tims-2020.json ...
+//
+// JSON archives are arrays of feed records; CSV archives have a header row
+// of the feed's field names (id, latitude, incidentType, start, ...), in
+// any case. Either may be gzipped. Records go through the same
+// validation, normalization and enrichment as live ones, except weather,
+// which NWS can only give for now (-weather to run it anyway). They are
+// stored as cleared, with history of their own left out, and never replace
+// an incident already in the table. Each batch is written in one
+// transaction.
+func runImport(cfg *Config, db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	batchSize := fs.Int("batch", 500, "records per transaction")
+	withWeather := fs.Bool("weather", false, "look up (current) weather for each record too")
+	fs.Parse(args)
+	if fs.NArg() == 0 || *batchSize < 1 {
+		log.Fatal("Usage: import [-batch N] [-weather] FILE...")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx = withNWSBudget(ctx, newRequestBudget(cfg.NWSRequestBudget))
+	logger := logFor("import")
+
+	all, err := buildEnrichers(cfg, db)
+	if err != nil {
+		log.Fatalf("Error building enrichers: %s", err)
+	}
+	var enrichers []Enricher
+	for _, e := range all {
+		if e.Name() != "weather" || *withWeather {
+			enrichers = append(enrichers, e)
+		}
+	}
+	redaction, err := readDetailsRedaction(cfg.RedactionFile, "NCDOT", cfg.RedactionHashKey)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	im := &archiveImporter{
+		db:        db,
+		enrichers: enrichers,
+		redaction: redaction,
+		validator: newIncidentValidator(cfg),
+		workers:   max(cfg.IngestWorkers, 1),
+		batchSize: *batchSize,
+	}
+	start := time.Now()
+	for _, file := range fs.Args() {
+		if err := im.importFile(ctx, file); err != nil {
+			log.Fatalf("Error importing %s: %s", file, err)
+		}
+		logger.Info("Imported archive", "file", file, "read", im.read, "inserted", im.inserted, "existing", im.existing, "rejected", im.rejected)
+	}
+	logger.Info("Import complete", "read", im.read, "inserted", im.inserted, "existing", im.existing, "rejected", im.rejected,
+		"duration", time.Since(start).Round(time.Second).String())
+}
+
+type archiveImporter struct {
+	db        *sql.DB
+	enrichers []Enricher
+	redaction *detailsRedaction
+	validator *incidentValidator
+	workers   int
+	batchSize int
+
+	// Running totals across files.
+	read, inserted, existing, rejected int
+}
+
+func (im *archiveImporter) importFile(ctx context.Context, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	name := strings.ToLower(file)
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r, name = gz, strings.TrimSuffix(name, ".gz")
+	}
+
+	// Records are streamed in and written a batch at a time, so an archive
+	// of any size fits in memory.
+	batch := make([]Incident, 0, im.batchSize)
+	add := func(incident Incident) error {
+		batch = append(batch, incident)
+		if len(batch) < im.batchSize {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := im.importBatch(ctx, batch)
+		batch = batch[:0]
+		return err
+	}
+	switch filepath.Ext(name) {
+	case ".json":
+		err = eachIncident(r, "NCDOT", add, func(rejectedRecord) { im.rejected++ })
+		if err != nil {
+			return fmt.Errorf("decoding JSON: %w", err)
+		}
+	case ".csv":
+		if err := eachCSVIncident(r, add, &im.rejected); err != nil {
+			return err
+		}
+	default:
+		return errors.New("expected a .csv or .json file, optionally .gz")
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return im.importBatch(ctx, batch)
+}
+
+// importBatch enriches a batch on the worker pool and writes it in one
+// transaction.
+func (im *archiveImporter) importBatch(ctx context.Context, batch []Incident) error {
+	im.read += len(batch)
+	incidents := make([]*UnifiedIncident, 0, len(batch))
+	for _, record := range batch {
+		if err := im.validator.check(record); err != nil {
+			logFor("import").Debug("Rejected archive record", "incident_id", record.ID, "reason", err)
+			im.rejected++
+			continue
+		}
+		u, err := normalizeIncident(record)
+		if err != nil {
+			logFor("import").Debug("Rejected archive record", "incident_id", record.ID, "reason", err)
+			im.rejected++
+			continue
+		}
+		u.Redaction = im.redaction
+		incidents = append(incidents, &u)
+	}
+
+	next := make(chan *UnifiedIncident)
+	var wg sync.WaitGroup
+	for range im.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range next {
+				runEnrichers(ctx, im.enrichers, u)
+			}
+		}()
+	}
+	for _, u := range incidents {
+		next <- u
+	}
+	close(next)
+	wg.Wait()
+
+	tx, err := im.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, u := range incidents {
+		inserted, err := insertArchivedIncident(ctx, tx, u)
+		if err != nil {
+			return fmt.Errorf("incident %s: %w", u.SourceID, err)
+		}
+		if inserted {
+			im.inserted++
+		} else {
+			im.existing++
+		}
+	}
+	return tx.Commit()
+}
+
+// insertArchivedIncident inserts u as a cleared incident, unless it is
+// already stored. It reports whether it was inserted.
+func insertArchivedIncident(ctx context.Context, tx *sql.Tx, u *UnifiedIncident) (bool, error) {
+	cols, err := u.columns()
+	if err != nil {
+		return false, err
+	}
+	clearedAt := u.EndTime
+	if clearedAt.IsZero() {
+		if t, err := parseFeedTime(u.SourceUpdated); err == nil && !t.IsZero() {
+			clearedAt = t
+		} else {
+			clearedAt = u.Timestamp
+		}
+	}
+	names := make([]string, len(cols))
+	placeholders := make([]string, len(cols))
+	args := make([]interface{}, len(cols))
+	for i, c := range cols {
+		names[i], placeholders[i], args[i] = c.name, fmt.Sprintf("$%d", i+1), c.value
+		switch c.name {
+		case "status":
+			args[i] = StatusCleared
+		case "cleared_at":
+			args[i] = clearedAt.UTC()
+		case "first_seen_at":
+			args[i] = u.Timestamp.UTC()
+		}
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO unified_incidents (`+strings.Join(names, ", ")+`)
+		VALUES (`+strings.Join(placeholders, ", ")+`)
+		ON CONFLICT (source, source_id) DO NOTHING`, args...)
+	if err != nil {
+		return false, err
+	}
+	// An incident already stored keeps its route impacts too.
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if u.RouteImpacts != nil {
+		if err := saveRouteImpacts(tx, u); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// eachCSVIncident reads a CSV archive whose header names Incident's JSON
+// fields, handing each row to fn. Columns it doesn't know are ignored;
+// rows with a value that doesn't fit its field are counted in rejected and
+// skipped.
+func eachCSVIncident(r io.Reader, fn func(Incident) error, rejected *int) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("reading CSV header: %w", err)
+	}
+	// Field index in Incident for each column, -1 for unknown ones.
+	fieldsByTag := map[string]int{}
+	t := reflect.TypeOf(Incident{})
+	for i := range t.NumField() {
+		fieldsByTag[strings.ToLower(t.Field(i).Tag.Get("json"))] = i
+	}
+	columns := make([]int, len(header))
+	known := false
+	for i, h := range header {
+		idx, ok := fieldsByTag[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))]
+		if !ok {
+			idx = -1
+		}
+		columns[i] = idx
+		known = known || ok
+	}
+	if !known {
+		return errors.New("the CSV header names none of the feed's fields")
+	}
+
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading CSV: %w", err)
+		}
+		var incident Incident
+		v := reflect.ValueOf(&incident).Elem()
+		for i, value := range row {
+			if i >= len(columns) || columns[i] < 0 {
+				continue
+			}
+			if err = setCSVField(v.Field(columns[i]), strings.TrimSpace(value)); err != nil {
+				err = fmt.Errorf("%s: %w", header[i], err)
+				break
+			}
+		}
+		if err != nil {
+			logFor("import").Debug("Rejected archive row", "line", line, "reason", err)
+			*rejected++
+			continue
+		}
+		if err := fn(incident); err != nil {
+			return err
+		}
+	}
+}
+
+func setCSVField(field reflect.Value, value string) error {
+	if value == "" {
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		field.SetBool(b)
+	}
+	return nil
+}
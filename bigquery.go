@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bigQueryAPI = "https://bigquery.googleapis.com/bigquery/v2"
+
+// bigQueryFields is the incident_events table schema. Columns may only be
+// added, and as NULLABLE, to keep existing tables loadable.
+var bigQueryFields = []map[string]string{
+	{"name": "change", "type": "STRING", "mode": "REQUIRED"},
+	{"name": "occurred_at", "type": "TIMESTAMP", "mode": "REQUIRED"},
+	{"name": "source", "type": "STRING", "mode": "REQUIRED"},
+	{"name": "source_id", "type": "STRING", "mode": "REQUIRED"},
+	{"name": "source_updated", "type": "STRING", "mode": "NULLABLE"},
+	{"name": "event_type", "type": "STRING", "mode": "NULLABLE"},
+	{"name": "status", "type": "STRING", "mode": "NULLABLE"},
+	{"name": "county", "type": "STRING", "mode": "NULLABLE"},
+	{"name": "city", "type": "STRING", "mode": "NULLABLE"},
+	{"name": "road", "type": "STRING", "mode": "NULLABLE"},
+	{"name": "direction", "type": "STRING", "mode": "NULLABLE"},
+	{"name": "address", "type": "STRING", "mode": "NULLABLE"},
+	{"name": "location", "type": "GEOGRAPHY", "mode": "NULLABLE"},
+	{"name": "latitude", "type": "FLOAT64", "mode": "NULLABLE"},
+	{"name": "longitude", "type": "FLOAT64", "mode": "NULLABLE"},
+	{"name": "start_time", "type": "TIMESTAMP", "mode": "NULLABLE"},
+	{"name": "end_time", "type": "TIMESTAMP", "mode": "NULLABLE"},
+	{"name": "severity", "type": "INT64", "mode": "NULLABLE"},
+	{"name": "normalized_severity", "type": "INT64", "mode": "NULLABLE"},
+	{"name": "risk_score", "type": "FLOAT64", "mode": "NULLABLE"},
+	{"name": "lanes_closed", "type": "INT64", "mode": "NULLABLE"},
+	{"name": "lanes_total", "type": "INT64", "mode": "NULLABLE"},
+	{"name": "summary", "type": "STRING", "mode": "NULLABLE"},
+	{"name": "details", "type": "JSON", "mode": "NULLABLE"},
+}
+
+// bigQuerySink streams incident events into a BigQuery table, creating it
+// (partitioned by day of start_time) if it doesn't exist. Rows carry the
+// same insert ID as the NATS message ID, so BigQuery drops the duplicates
+// a retry would otherwise leave.
+type bigQuerySink struct {
+	project, dataset, table string
+	tokens                  *googleTokenSource
+	client                  *http.Client
+
+	mu           sync.Mutex
+	tableCreated bool
+}
+
+func newBigQuerySink(cfg *Config) (*bigQuerySink, error) {
+	tokens, err := loadGoogleTokenSource(cfg.BigQueryCredentialsFile, "https://www.googleapis.com/auth/bigquery")
+	if err != nil {
+		return nil, err
+	}
+	return &bigQuerySink{
+		project: cfg.BigQueryProject,
+		dataset: cfg.BigQueryDataset,
+		table:   cfg.BigQueryTable,
+		tokens:  tokens,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *bigQuerySink) Name() string { return "bigquery " + s.dataset + "." + s.table }
+
+func bigQueryRow(event IncidentEvent) (map[string]interface{}, error) {
+	p := event.Incident
+	details, err := json.Marshal(p.Details)
+	if err != nil {
+		return nil, err
+	}
+	row := map[string]interface{}{
+		"change":              string(event.Change),
+		"occurred_at":         event.OccurredAt.UTC().Format(time.RFC3339Nano),
+		"source":              p.Source,
+		"source_id":           p.SourceID,
+		"source_updated":      p.SourceUpdated,
+		"event_type":          p.EventType,
+		"status":              p.Status,
+		"county":              p.County,
+		"city":                p.City,
+		"road":                firstNonEmpty(p.RoadNormalized, p.Road),
+		"direction":           p.Direction,
+		"address":             p.Address,
+		"location":            fmt.Sprintf("POINT(%f %f)", p.Longitude, p.Latitude),
+		"latitude":            p.Latitude,
+		"longitude":           p.Longitude,
+		"start_time":          p.StartTime.UTC().Format(time.RFC3339Nano),
+		"severity":            p.Severity,
+		"normalized_severity": p.NormalizedSeverity,
+		"risk_score":          p.RiskScore,
+		"lanes_closed":        p.LanesClosed,
+		"lanes_total":         p.LanesTotal,
+		"summary":             p.Summary,
+		"details":             string(details),
+	}
+	if p.EndTime != nil {
+		row["end_time"] = p.EndTime.UTC().Format(time.RFC3339Nano)
+	}
+	return row, nil
+}
+
+func (s *bigQuerySink) Publish(ctx context.Context, event IncidentEvent) error {
+	if err := s.ensureTable(ctx); err != nil {
+		return err
+	}
+	row, err := bigQueryRow(event)
+	if err != nil {
+		return permanentError{err}
+	}
+	body := map[string]interface{}{
+		"rows": []interface{}{map[string]interface{}{"insertId": event.ID, "json": row}},
+	}
+	var result struct {
+		InsertErrors []struct {
+			Errors []struct {
+				Reason  string `json:"reason"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	path := fmt.Sprintf("/projects/%s/datasets/%s/tables/%s/insertAll", s.project, s.dataset, s.table)
+	if _, err := s.call(ctx, path, body, &result); err != nil {
+		return err
+	}
+	if len(result.InsertErrors) > 0 && len(result.InsertErrors[0].Errors) > 0 {
+		e := result.InsertErrors[0].Errors[0]
+		return permanentError{fmt.Errorf("bigquery rejected the row (%s): %s", e.Reason, e.Message)}
+	}
+	return nil
+}
+
+func (s *bigQuerySink) ensureTable(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tableCreated {
+		return nil
+	}
+	body := map[string]interface{}{
+		"tableReference":   map[string]string{"projectId": s.project, "datasetId": s.dataset, "tableId": s.table},
+		"schema":           map[string]interface{}{"fields": bigQueryFields},
+		"timePartitioning": map[string]string{"type": "DAY", "field": "start_time"},
+		"clustering":       map[string]interface{}{"fields": []string{"county", "event_type"}},
+	}
+	status, err := s.call(ctx, fmt.Sprintf("/projects/%s/datasets/%s/tables", s.project, s.dataset), body, nil)
+	if err != nil && status != http.StatusConflict {
+		return fmt.Errorf("could not create table %s: %w", s.table, err)
+	}
+	s.tableCreated = true
+	return nil
+}
+
+// call POSTs a JSON request to the BigQuery API and decodes the response
+// into out, if given. It returns the HTTP status alongside any error.
+func (s *bigQuerySink) call(ctx context.Context, path string, body, out interface{}) (int, error) {
+	token, err := s.tokens.token(ctx)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, permanentError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", bigQueryAPI+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("bigquery request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != 200 {
+		err := fmt.Errorf("bigquery returned %s: %s", resp.Status, truncate(string(respBody), 200))
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusNotFound, http.StatusForbidden:
+			return resp.StatusCode, permanentError{err}
+		}
+		return resp.StatusCode, err
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to unmarshal bigquery response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// googleTokenSource gets OAuth access tokens for a service account by the
+// JWT bearer grant, caching each until shortly before it expires.
+type googleTokenSource struct {
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+	scope    string
+	client   *http.Client
+
+	mu      sync.Mutex
+	access  string
+	expires time.Time
+}
+
+// loadGoogleTokenSource reads a service account key file as downloaded
+// from the Cloud console.
+func loadGoogleTokenSource(path, scope string) (*googleTokenSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sa struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if sa.Type != "service_account" {
+		return nil, fmt.Errorf("%s: not a service account key", path)
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private key is not RSA", path)
+	}
+	return &googleTokenSource{
+		email:    sa.ClientEmail,
+		key:      key,
+		tokenURI: firstNonEmpty(sa.TokenURI, "https://oauth2.googleapis.com/token"),
+		scope:    scope,
+		client:   &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+func (g *googleTokenSource) token(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.access != "" && time.Now().Before(g.expires) {
+		return g.access, nil
+	}
+
+	now := time.Now()
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   g.email,
+		"scope": g.scope,
+		"aud":   g.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, g.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", g.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to unmarshal token response: %w", err)
+	}
+	if resp.StatusCode != 200 || result.AccessToken == "" {
+		// A rejected key stays rejected.
+		return "", permanentError{errors.New("token request refused: " + firstNonEmpty(result.Error, resp.Status))}
+	}
+	g.access = result.AccessToken
+	g.expires = now.Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return g.access, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+//go:generate sh fetch-boundaries.sh
+
+//go:embed boundaries
+var embeddedBoundaries embed.FS
+
+// ncCounties lists North Carolina's counties in NCDOT CountyID order
+// (alphabetical, 1 = Alamance, 100 = Yancey).
+var ncCounties = [...]string{
+	"Alamance", "Alexander", "Alleghany", "Anson", "Ashe", "Avery", "Beaufort", "Bertie", "Bladen", "Brunswick",
+	"Buncombe", "Burke", "Cabarrus", "Caldwell", "Camden", "Carteret", "Caswell", "Catawba", "Chatham", "Cherokee",
+	"Chowan", "Clay", "Cleveland", "Columbus", "Craven", "Cumberland", "Currituck", "Dare", "Davidson", "Davie",
+	"Duplin", "Durham", "Edgecombe", "Forsyth", "Franklin", "Gaston", "Gates", "Graham", "Granville", "Greene",
+	"Guilford", "Halifax", "Harnett", "Haywood", "Henderson", "Hertford", "Hoke", "Hyde", "Iredell", "Jackson",
+	"Johnston", "Jones", "Lee", "Lenoir", "Lincoln", "McDowell", "Macon", "Madison", "Martin", "Mecklenburg",
+	"Mitchell", "Montgomery", "Moore", "Nash", "New Hanover", "Northampton", "Onslow", "Orange", "Pamlico", "Pasquotank",
+	"Pender", "Perquimans", "Person", "Pitt", "Polk", "Randolph", "Richmond", "Robeson", "Rockingham", "Rowan",
+	"Rutherford", "Sampson", "Scotland", "Stanly", "Stokes", "Surry", "Swain", "Transylvania", "Tyrrell", "Union",
+	"Vance", "Wake", "Warren", "Washington", "Watauga", "Wayne", "Wilkes", "Wilson", "Yadkin", "Yancey",
+}
+
+// canonicalCountyName strips the " County" suffix and normalizes case so
+// feed and boundary names compare equal.
+func canonicalCountyName(name string) string {
+	name = strings.TrimSpace(name)
+	name = strings.TrimSuffix(strings.TrimSuffix(name, " County"), " COUNTY")
+	return strings.ToLower(name)
+}
+
+// ncCountyID returns the NCDOT CountyID for a county name, or 0.
+func ncCountyID(name string) int {
+	key := canonicalCountyName(name)
+	for i, c := range ncCounties {
+		if strings.ToLower(c) == key {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Location validation outcomes stored in county_validation / city_validation.
+const (
+	ValidationOK         = "ok"
+	ValidationFilled     = "filled"
+	ValidationCorrected  = "corrected"
+	ValidationUnverified = "unverified"
+)
+
+// boundaryArea is one named polygon set (a county or a municipality).
+type boundaryArea struct {
+	name  string
+	id    int
+	polys []polygon
+	box   bbox
+}
+
+// BoundarySet answers "which area contains this point".
+type BoundarySet struct {
+	areas []boundaryArea
+}
+
+// Find returns the area containing pt, if any.
+func (b *BoundarySet) Find(pt LatLon) (*boundaryArea, bool) {
+	if b == nil {
+		return nil, false
+	}
+	for i := range b.areas {
+		a := &b.areas[i]
+		if !a.box.contains(pt) {
+			continue
+		}
+		for _, p := range a.polys {
+			if p.contains(pt) {
+				return a, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// loadBoundarySet reads polygons from path, or from the embedded copy at
+// embeddedName when path is empty. It returns (nil, nil) if neither exists.
+func loadBoundarySet(path, embeddedName string, nameKeys []string, withCountyID bool) (*BoundarySet, error) {
+	var fc *geoJSONFeatureCollection
+	var err error
+	if path != "" {
+		fc, err = loadGeoJSON(path)
+	} else {
+		var raw []byte
+		raw, err = fs.ReadFile(embeddedBoundaries, embeddedName)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err == nil {
+			fc, err = parseGeoJSON(embeddedName, raw)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	set := &BoundarySet{}
+	for i := range fc.Features {
+		f := &fc.Features[i]
+		polys, err := f.Geometry.polygons()
+		if err != nil {
+			return nil, fmt.Errorf("boundary feature %d: %w", i, err)
+		}
+		var name string
+		for _, key := range nameKeys {
+			if name = f.stringProp(key); name != "" {
+				break
+			}
+		}
+		area := boundaryArea{name: name, polys: polys, box: polygonsBBox(polys)}
+		if withCountyID {
+			area.id = int(f.floatProp("county_id", float64(ncCountyID(name))))
+		}
+		set.areas = append(set.areas, area)
+	}
+	return set, nil
+}
+
+// locationValidationEnricher checks the feed's county and city against the
+// boundary polygons, filling blanks and correcting mismatches. The feed's
+// original values are kept in details so corrections can be audited.
+type locationValidationEnricher struct {
+	counties       *BoundarySet
+	municipalities *BoundarySet
+}
+
+func newLocationValidationEnricher(cfg *Config) (*locationValidationEnricher, error) {
+	counties, err := loadBoundarySet(cfg.CountyBoundariesFile, "boundaries/counties.geojson",
+		[]string{"CountyName", "CO_NAME", "NAME", "name"}, true)
+	if err != nil {
+		return nil, err
+	}
+	municipalities, err := loadBoundarySet(cfg.MunicipalBoundariesFile, "boundaries/municipalities.geojson",
+		[]string{"MunicipalBoundaryName", "MB_NAME", "NAME", "name"}, false)
+	if err != nil {
+		return nil, err
+	}
+	if counties == nil && municipalities == nil {
+		logFor("enrich").Warn("No county or municipal boundaries available; location validation disabled",
+			"hint", "run go generate, or set COUNTY_BOUNDARIES_FILE and MUNICIPAL_BOUNDARIES_FILE")
+		return nil, nil
+	}
+	return &locationValidationEnricher{counties: counties, municipalities: municipalities}, nil
+}
+
+func (e *locationValidationEnricher) Name() string { return "location-validation" }
+
+func (e *locationValidationEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	pt := LatLon{Lat: incident.Latitude, Lon: incident.Longitude}
+	v := &LocationValidation{
+		FeedCounty: incident.CountyName,
+		FeedCity:   incident.City,
+		County:     ValidationUnverified,
+		City:       ValidationUnverified,
+	}
+
+	if county, ok := e.counties.Find(pt); ok {
+		switch {
+		case incident.CountyName == "":
+			v.County = ValidationFilled
+		case canonicalCountyName(incident.CountyName) != canonicalCountyName(county.name):
+			v.County = ValidationCorrected
+		default:
+			v.County = ValidationOK
+		}
+		incident.CountyName = strings.TrimSuffix(county.name, " County")
+		if county.id != 0 {
+			incident.CountyID = county.id
+		}
+	}
+
+	// Points outside every municipality are unincorporated; the feed's city
+	// there is usually the nearest town, so leave it alone.
+	if city, ok := e.municipalities.Find(pt); ok {
+		switch {
+		case incident.City == "":
+			v.City = ValidationFilled
+		case !strings.EqualFold(strings.TrimSpace(incident.City), city.name):
+			v.City = ValidationCorrected
+		default:
+			v.City = ValidationOK
+		}
+		incident.City = city.name
+	}
+
+	incident.LocationValidation = v
+	return nil
+}
+
+// LocationValidation records the outcome of boundary validation.
+type LocationValidation struct {
+	County     string `json:"county"`
+	City       string `json:"city"`
+	FeedCounty string `json:"feed_county,omitempty"`
+	FeedCity   string `json:"feed_city,omitempty"`
+}
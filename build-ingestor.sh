@@ -2,5 +2,5 @@ set -e
 echo ">>> Pulling latest changes from the Git repository..."
 git pull
 echo ">>> Building the Go application..."
-go build -o ncdot-ingester main.go
+go build -o ncdot-ingester .
 echo ">>> Build complete! Binary 'ncdot-ingester' is ready."
\ No newline at end of file
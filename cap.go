@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// capTimeLayout is the CAP 1.2 dateTime form: no fractional seconds and an
+// explicit offset.
+const capTimeLayout = "2006-01-02T15:04:05-07:00"
+
+type capAlert struct {
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:emergency:cap:1.2 alert"`
+	Identifier string   `xml:"identifier"`
+	Sender     string   `xml:"sender"`
+	Sent       string   `xml:"sent"`
+	Status     string   `xml:"status"`
+	MsgType    string   `xml:"msgType"`
+	Scope      string   `xml:"scope"`
+	References string   `xml:"references,omitempty"`
+	Info       capInfo  `xml:"info"`
+}
+
+type capInfo struct {
+	Language     string         `xml:"language"`
+	Category     string         `xml:"category"`
+	Event        string         `xml:"event"`
+	ResponseType string         `xml:"responseType"`
+	Urgency      string         `xml:"urgency"`
+	Severity     string         `xml:"severity"`
+	Certainty    string         `xml:"certainty"`
+	Effective    string         `xml:"effective"`
+	SenderName   string         `xml:"senderName"`
+	Headline     string         `xml:"headline"`
+	Description  string         `xml:"description"`
+	Instruction  string         `xml:"instruction,omitempty"`
+	Web          string         `xml:"web"`
+	Parameters   []capParameter `xml:"parameter"`
+	Area         capArea        `xml:"area"`
+}
+
+type capParameter struct {
+	ValueName string `xml:"valueName"`
+	Value     string `xml:"value"`
+}
+
+type capArea struct {
+	AreaDesc string `xml:"areaDesc"`
+	Circle   string `xml:"circle"`
+}
+
+// capSeverity maps the normalized 1–5 severity onto CAP's scale.
+func capSeverity(normalized int) string {
+	switch {
+	case normalized >= 5:
+		return "Extreme"
+	case normalized == 4:
+		return "Severe"
+	case normalized == 3:
+		return "Moderate"
+	case normalized >= 1:
+		return "Minor"
+	}
+	return "Unknown"
+}
+
+// capSink emits CAP 1.2 alerts for high-severity incidents, POSTed to an
+// endpoint and/or written as files to a directory. Once an incident has
+// been alerted, its later changes follow as Update messages referencing the
+// previous one, and its clearance as an all-clear.
+type capSink struct {
+	db          *sql.DB
+	sender      string
+	url         string
+	dir         string
+	minSeverity int
+	client      *http.Client
+}
+
+func newCAPSink(db *sql.DB, cfg *Config) *capSink {
+	return &capSink{
+		db:          db,
+		sender:      cfg.CAPSender,
+		url:         cfg.CAPURL,
+		dir:         cfg.CAPDir,
+		minSeverity: cfg.CAPMinSeverity,
+		client:      &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *capSink) Name() string { return "cap" }
+
+func (s *capSink) Publish(ctx context.Context, event IncidentEvent) error {
+	p := event.Incident
+	previous, err := loadNotificationMessage(s.db, s.Name(), p)
+	if err != nil {
+		return err
+	}
+	if previous == nil && (event.Change == ChangeCleared || p.NormalizedSeverity < s.minSeverity) {
+		return nil
+	}
+
+	alert := s.alert(event)
+	if previous != nil {
+		alert.MsgType = "Update"
+		alert.References = s.sender + "," + previous.MessageID
+	}
+	out, err := xml.MarshalIndent(alert, "", "  ")
+	if err != nil {
+		return permanentError{err}
+	}
+	out = append([]byte(xml.Header), out...)
+
+	if s.dir != "" {
+		if err := writeFileAtomic(filepath.Join(s.dir, alert.Identifier+".xml"), out); err != nil {
+			return err
+		}
+	}
+	if s.url != "" {
+		if err := s.post(ctx, out); err != nil {
+			return err
+		}
+	}
+	// The next message references this one by identifier and sent time.
+	return saveNotificationMessage(s.db, s.Name(), p, notificationMessage{Channel: s.sender, MessageID: alert.Identifier + "," + alert.Sent})
+}
+
+func (s *capSink) alert(event IncidentEvent) capAlert {
+	p := event.Incident
+	sent := event.OccurredAt.In(easternTime)
+	areaDesc := p.Address
+	if p.County != "" {
+		areaDesc += ", " + p.County + " County"
+	}
+	info := capInfo{
+		Language:     "en-US",
+		Category:     "Transport",
+		Event:        p.EventType,
+		ResponseType: "Avoid",
+		Urgency:      "Immediate",
+		Severity:     capSeverity(p.NormalizedSeverity),
+		Certainty:    "Observed",
+		Effective:    sent.Format(capTimeLayout),
+		SenderName:   "NC traffic incident feed (" + p.Source + ")",
+		Headline:     truncate(incidentTitle(p), 160),
+		Description:  incidentDescription(p),
+		Instruction:  "Avoid the area if possible and expect delays.",
+		Web:          mapURL(p.Latitude, p.Longitude),
+		Parameters: []capParameter{
+			{ValueName: "LanesClosed", Value: lanesLabel(p)},
+			{ValueName: "SourceIncidentID", Value: p.Source + ":" + p.SourceID},
+		},
+		Area: capArea{
+			AreaDesc: areaDesc,
+			// A 0.5 km circle around the incident.
+			Circle: fmt.Sprintf("%.5f,%.5f 0.5", p.Latitude, p.Longitude),
+		},
+	}
+	if event.Change == ChangeCleared {
+		info.ResponseType = "AllClear"
+		info.Urgency = "Past"
+		info.Severity = "Minor"
+		info.Headline = truncate("Cleared: "+incidentTitle(p), 160)
+		info.Instruction = ""
+	}
+	return capAlert{
+		Identifier: fmt.Sprintf("%s-%s-%d", strings.ToLower(p.Source), p.SourceID, event.OccurredAt.Unix()),
+		Sender:     s.sender,
+		Sent:       sent.Format(capTimeLayout),
+		Status:     "Actual",
+		MsgType:    "Alert",
+		Scope:      "Public",
+		Info:       info,
+	}
+}
+
+func (s *capSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/cap+xml; charset=utf-8")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("CAP endpoint request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err = fmt.Errorf("CAP endpoint returned %s: %s", resp.Status, truncate(string(respBody), 200))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// writeFileAtomic writes through a temporary file so a directory watcher
+// never picks up a half-written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Unified event types. NCDOT's own incident types are used as the canonical
+// spelling so existing dashboards keep working.
+const (
+	EventVehicleCrash    = "Vehicle Crash"
+	EventDisabledVehicle = "Disabled Vehicle"
+	EventConstruction    = "Road Construction"
+	EventRoadClosure     = "Road Closure"
+	EventWeather         = "Weather Event"
+	EventDebris          = "Debris"
+	EventVehicleFire     = "Vehicle Fire"
+	EventHazmat          = "Hazardous Materials"
+	EventCongestion      = "Congestion"
+	EventSpecialEvent    = "Special Event"
+	EventPoliceActivity  = "Police Activity"
+	EventOther           = "Other"
+)
+
+// unifiedEventTypes are the types above.
+var unifiedEventTypes = []string{
+	EventVehicleCrash, EventDisabledVehicle, EventConstruction, EventRoadClosure, EventWeather, EventDebris,
+	EventVehicleFire, EventHazmat, EventCongestion, EventSpecialEvent, EventPoliceActivity, EventOther,
+}
+
+// Classification is an event type inferred from free text.
+type Classification struct {
+	EventType  string  `json:"event_type"`
+	Confidence float64 `json:"confidence"`
+	Method     string  `json:"method"`
+}
+
+// classifierRule adds weight to an event type when its pattern matches.
+type classifierRule struct {
+	EventType string  `json:"event_type"`
+	Pattern   string  `json:"pattern"`
+	Weight    float64 `json:"weight"`
+	re        *regexp.Regexp
+}
+
+var defaultClassifierRules = []classifierRule{
+	{EventType: EventVehicleCrash, Pattern: `(?i)\b(crash|collision|wreck|accident|rollover|overturned|jackknifed?|mva|pi crash|hit and run)\b`, Weight: 2},
+	{EventType: EventDisabledVehicle, Pattern: `(?i)\b(disabled|stalled|broke(n)? down|flat tire|out of gas|abandoned)\b`, Weight: 2},
+	{EventType: EventConstruction, Pattern: `(?i)\b(construction|work ?zone|paving|resurfacing|bridge work|maintenance|utility work|striping|lane shift)\b`, Weight: 2},
+	{EventType: EventRoadClosure, Pattern: `(?i)\b(road closed|closure|all lanes closed|detour)\b`, Weight: 1},
+	{EventType: EventWeather, Pattern: `(?i)\b(flood(ing|ed)?|ice|icy|snow|downed tree|tree down|fog|high water|black ice|wind damage)\b`, Weight: 2},
+	{EventType: EventDebris, Pattern: `(?i)\b(debris|object in road|ladder|tire in road|spilled load|animal in road)\b`, Weight: 2},
+	{EventType: EventVehicleFire, Pattern: `(?i)\b(vehicle fire|car fire|truck fire|on fire|fire)\b`, Weight: 2},
+	{EventType: EventHazmat, Pattern: `(?i)\b(hazmat|haz-mat|chemical|fuel spill|diesel spill|hazardous)\b`, Weight: 3},
+	{EventType: EventCongestion, Pattern: `(?i)\b(congestion|heavy traffic|delays?|backed up|slow traffic)\b`, Weight: 1},
+	{EventType: EventSpecialEvent, Pattern: `(?i)\b(special event|parade|concert|game day|festival|race)\b`, Weight: 2},
+	{EventType: EventPoliceActivity, Pattern: `(?i)\b(police activity|law enforcement|pursuit|shooting|investigation)\b`, Weight: 2},
+}
+
+// Classifier maps free-text incident descriptions to the unified taxonomy.
+type Classifier interface {
+	Classify(ctx context.Context, text string) (Classification, error)
+}
+
+// ruleClassifier scores each event type by the weights of its matching
+// rules. Confidence is the winner's share of the total score, so text that
+// matches several types comes out less certain.
+type ruleClassifier struct {
+	rules []classifierRule
+}
+
+func newRuleClassifier(path string) (*ruleClassifier, error) {
+	rules := defaultClassifierRules
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read classifier rules: %w", err)
+		}
+		rules = nil
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			return nil, fmt.Errorf("could not parse classifier rules %s: %w", path, err)
+		}
+	}
+
+	c := &ruleClassifier{}
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid classifier pattern for %q: %w", r.EventType, err)
+		}
+		if r.Weight == 0 {
+			r.Weight = 1
+		}
+		r.re = re
+		c.rules = append(c.rules, r)
+	}
+	return c, nil
+}
+
+func (c *ruleClassifier) Classify(ctx context.Context, text string) (Classification, error) {
+	scores := map[string]float64{}
+	total := 0.0
+	for _, r := range c.rules {
+		if n := len(r.re.FindAllStringIndex(text, -1)); n > 0 {
+			scores[r.EventType] += r.Weight * float64(n)
+			total += r.Weight * float64(n)
+		}
+	}
+	best, bestScore := EventOther, 0.0
+	for eventType, score := range scores {
+		if score > bestScore || (score == bestScore && eventType < best) {
+			best, bestScore = eventType, score
+		}
+	}
+	if total == 0 {
+		return Classification{EventType: EventOther, Confidence: 0, Method: "rules"}, nil
+	}
+	// A single weak match shouldn't read as certainty.
+	confidence := bestScore / total * math.Min(1, 0.5+bestScore/4)
+	return Classification{EventType: best, Confidence: math.Round(confidence*100) / 100, Method: "rules"}, nil
+}
+
+// modelClassifier calls an external text-classification service:
+//
+//	POST {"text": "..."}  ->  {"event_type": "Vehicle Crash", "confidence": 0.93}
+type modelClassifier struct {
+	url    string
+	client *http.Client
+}
+
+func (c *modelClassifier) Classify(ctx context.Context, text string) (Classification, error) {
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return Classification{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(payload))
+	if err != nil {
+		return Classification{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Classification{}, fmt.Errorf("classifier model request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Classification{}, err
+	}
+	if resp.StatusCode != 200 {
+		return Classification{}, fmt.Errorf("classifier model returned %s", resp.Status)
+	}
+	var result Classification
+	if err := json.Unmarshal(body, &result); err != nil {
+		return Classification{}, fmt.Errorf("failed to unmarshal classifier model response: %w", err)
+	}
+	result.Method = "model"
+	return result, nil
+}
+
+// hybridClassifier runs the rules first and only consults the model when
+// the rules aren't confident, keeping model calls (and cost) down.
+type hybridClassifier struct {
+	rules     Classifier
+	model     Classifier
+	threshold float64
+}
+
+func (c *hybridClassifier) Classify(ctx context.Context, text string) (Classification, error) {
+	result, err := c.rules.Classify(ctx, text)
+	if err != nil || c.model == nil || result.Confidence >= c.threshold {
+		return result, err
+	}
+	modelResult, err := c.model.Classify(ctx, text)
+	if err != nil {
+		// The rules answer is still usable.
+		return result, nil
+	}
+	if modelResult.Confidence > result.Confidence {
+		return modelResult, nil
+	}
+	return result, nil
+}
+
+func newClassifier(cfg *Config) (Classifier, error) {
+	rules, err := newRuleClassifier(cfg.ClassifierRulesFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &hybridClassifier{rules: rules, threshold: cfg.ClassifierThreshold}
+	if cfg.ClassifierModelURL != "" {
+		c.model = &modelClassifier{url: cfg.ClassifierModelURL, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return c, nil
+}
+
+// classifyEnricher replaces free-text event types, and ones outside the
+// taxonomy that event_type_mappings doesn't cover, with a unified one.
+// NCDOT's types mostly are the taxonomy and are left alone.
+type classifyEnricher struct {
+	classifier Classifier
+}
+
+func (e *classifyEnricher) Name() string { return "classify" }
+
+func (e *classifyEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	if !incident.EventTypeFreeText || incident.EventTypeMapped {
+		return nil
+	}
+	if incident.RawEventType == "" {
+		incident.RawEventType = incident.EventType
+	}
+	text := strings.TrimSpace(incident.RawEventType + ". " + incident.ProblemDetail)
+	result, err := e.classifier.Classify(ctx, text)
+	if err != nil {
+		return err
+	}
+	incident.EventType = result.EventType
+	incident.Classification = &result
+	return nil
+}
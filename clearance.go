@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Clearance time is from when an incident started, the earlier of the
+// feed's start time and when ingest first saw it, to when it cleared.
+// GET /stats/clearance gives its distribution by event type and by road
+// over a window (the last 30 days unless since= says otherwise; the other
+// incident filters apply too), and lists the active incidents open longer
+// than their CLEARANCE_SLA.
+//
+// CLEARANCE_SLA is a list of event type (or raw event type) = duration,
+// with "*" for any other unplanned type: "Vehicle Crash=90m,*=4h". With it
+// set, ingest flags each active incident past its threshold once, after
+// every run: overdue_at is set on the incident and an "Overdue" event goes
+// to the notification rules and sinks. "analytics overdue" does the same
+// on its own schedule.
+
+// clearanceStartSQL is when an incident started, for clearance times.
+// Casting to timestamptz reads a plain timestamp column as UTC, the session
+// zone, so this works for either column type.
+const clearanceStartSQL = `least(timestamp::timestamptz, coalesce(first_seen_at, timestamp::timestamptz))`
+
+const clearanceDefaultWindow = 30 * 24 * time.Hour
+
+// clearanceMaxGroups caps each breakdown, busiest first.
+const clearanceMaxGroups = 50
+
+// parseClearanceSLA parses CLEARANCE_SLA entries, keyed by lowercased
+// event type.
+func parseClearanceSLA(entries []string) (map[string]time.Duration, error) {
+	sla := map[string]time.Duration{}
+	for _, entry := range entries {
+		eventType, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid clearance SLA %q (expected event type=duration)", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid clearance SLA for %s: %q", eventType, value)
+		}
+		sla[strings.ToLower(strings.TrimSpace(eventType))] = d
+	}
+	return sla, nil
+}
+
+// clearanceSLA is the threshold for an incident, if it has one. "*"
+// doesn't cover planned event types; they need their own entry.
+func clearanceSLA(cfg *Config, eventType, rawEventType string) (time.Duration, bool) {
+	for _, t := range []string{eventType, rawEventType} {
+		if d, ok := cfg.ClearanceSLA[strings.ToLower(t)]; ok && t != "" {
+			return d, true
+		}
+	}
+	if containsFold(cfg.PlannedEventTypes, eventType) || containsFold(cfg.PlannedEventTypes, rawEventType) {
+		return 0, false
+	}
+	d, ok := cfg.ClearanceSLA["*"]
+	return d, ok
+}
+
+// clearanceStats is the distribution of clearance times for one event
+// type or road.
+type clearanceStats struct {
+	Key         string  `json:"key"`
+	Cleared     int     `json:"cleared"`
+	MeanMinutes float64 `json:"mean_minutes"`
+	P50Minutes  float64 `json:"p50_minutes"`
+	P90Minutes  float64 `json:"p90_minutes"`
+	P95Minutes  float64 `json:"p95_minutes"`
+	MaxMinutes  float64 `json:"max_minutes"`
+	// Overdue is how many of them were flagged as past their SLA.
+	Overdue int `json:"overdue"`
+}
+
+// overdueIncident is an active incident open longer than its SLA.
+type overdueIncident struct {
+	Source      string     `json:"source"`
+	SourceID    string     `json:"source_id"`
+	EventType   string     `json:"event_type"`
+	Address     string     `json:"address"`
+	County      string     `json:"county,omitempty"`
+	Road        string     `json:"road,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	OpenMinutes float64    `json:"open_minutes"`
+	SLAMinutes  float64    `json:"sla_minutes"`
+	FlaggedAt   *time.Time `json:"flagged_at,omitempty"`
+
+	at LatLon
+}
+
+type clearanceReport struct {
+	Since       time.Time         `json:"since"`
+	Until       time.Time         `json:"until"`
+	ByEventType []clearanceStats  `json:"by_event_type"`
+	ByRoad      []clearanceStats  `json:"by_road"`
+	Overdue     []overdueIncident `json:"overdue"`
+}
+
+func (s *server) handleClearanceStats(w http.ResponseWriter, r *http.Request) {
+	f, err := parseIncidentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Status, f.Limit, f.Offset = "", 0, 0
+	if f.Until.IsZero() {
+		f.Until = time.Now().UTC()
+	}
+	if f.Since.IsZero() {
+		f.Since = f.Until.Add(-clearanceDefaultWindow)
+	}
+	resp := clearanceReport{Since: f.Since, Until: f.Until}
+	if resp.ByEventType, err = clearanceDistribution(r.Context(), s.db, f, "event_type"); err == nil {
+		resp.ByRoad, err = clearanceDistribution(r.Context(), s.db, f, "road_normalized")
+	}
+	if err == nil {
+		resp.Overdue, err = overdueIncidents(r.Context(), s.cfg, s.db)
+	}
+	if err != nil {
+		logFor("api").Error("Error building clearance stats", "err", err)
+		http.Error(w, "could not build clearance stats", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "application/json", resp)
+}
+
+// clearanceDistribution groups the cleared incidents matching f by the
+// column given.
+func clearanceDistribution(ctx context.Context, db *sql.DB, f incidentFilter, column string) ([]clearanceStats, error) {
+	where, args := f.where()
+	if where == "" {
+		where = "WHERE cleared_at IS NOT NULL"
+	} else {
+		where += " AND cleared_at IS NOT NULL"
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT key, count(*), avg(minutes),
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY minutes),
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY minutes),
+			percentile_cont(0.95) WITHIN GROUP (ORDER BY minutes),
+			max(minutes), count(*) FILTER (WHERE overdue)
+		FROM (
+			SELECT coalesce(`+column+`, 'unknown') AS key, overdue_at IS NOT NULL AS overdue,
+				extract(epoch FROM cleared_at - `+clearanceStartSQL+`) / 60 AS minutes
+			FROM unified_incidents `+where+`
+		) t
+		WHERE minutes >= 0
+		GROUP BY key
+		ORDER BY 2 DESC, 1
+		LIMIT `+fmt.Sprint(clearanceMaxGroups), args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute clearance times by %s: %w", column, err)
+	}
+	defer rows.Close()
+	round := func(v float64) float64 { return math.Round(v*10) / 10 }
+	stats := []clearanceStats{}
+	for rows.Next() {
+		var c clearanceStats
+		if err := rows.Scan(&c.Key, &c.Cleared, &c.MeanMinutes, &c.P50Minutes, &c.P90Minutes, &c.P95Minutes, &c.MaxMinutes, &c.Overdue); err != nil {
+			return nil, err
+		}
+		c.MeanMinutes, c.P50Minutes, c.P90Minutes = round(c.MeanMinutes), round(c.P50Minutes), round(c.P90Minutes)
+		c.P95Minutes, c.MaxMinutes = round(c.P95Minutes), round(c.MaxMinutes)
+		stats = append(stats, c)
+	}
+	return stats, rows.Err()
+}
+
+// overdueIncidents lists the active incidents past their SLA, longest
+// open first.
+func overdueIncidents(ctx context.Context, cfg *Config, db *sql.DB) ([]overdueIncident, error) {
+	overdue := []overdueIncident{}
+	if len(cfg.ClearanceSLA) == 0 {
+		return overdue, nil
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT source, source_id, event_type, coalesce(raw_event_type, ''), address, coalesce(county_name, ''),
+			coalesce(road_normalized, ''), latitude, longitude, `+clearanceStartSQL+`, overdue_at
+		FROM unified_incidents
+		WHERE status = 'active' AND timestamp <= now()
+		ORDER BY `+clearanceStartSQL)
+	if err != nil {
+		return nil, fmt.Errorf("could not load active incidents: %w", err)
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		var o overdueIncident
+		var rawEventType string
+		var flaggedAt sql.NullTime
+		if err := rows.Scan(&o.Source, &o.SourceID, &o.EventType, &rawEventType, &o.Address, &o.County,
+			&o.Road, &o.at.Lat, &o.at.Lon, &o.StartedAt, &flaggedAt); err != nil {
+			return nil, err
+		}
+		sla, ok := clearanceSLA(cfg, o.EventType, rawEventType)
+		open := now.Sub(o.StartedAt)
+		if !ok || open <= sla {
+			continue
+		}
+		o.OpenMinutes, o.SLAMinutes = math.Round(open.Minutes()), sla.Minutes()
+		if flaggedAt.Valid {
+			o.FlaggedAt = &flaggedAt.Time
+		}
+		overdue = append(overdue, o)
+	}
+	return overdue, rows.Err()
+}
+
+// flagOverdue marks the newly overdue incidents and publishes an event for
+// each.
+func flagOverdue(ctx context.Context, cfg *Config, db *sql.DB, sinks *sinkDispatcher) (int, error) {
+	overdue, err := overdueIncidents(ctx, cfg, db)
+	if err != nil {
+		return 0, err
+	}
+	flagged := 0
+	for _, o := range overdue {
+		if o.FlaggedAt != nil {
+			continue
+		}
+		res, err := db.ExecContext(ctx, `
+			UPDATE unified_incidents SET overdue_at = now()
+			WHERE source = $1 AND source_id = $2 AND overdue_at IS NULL`, o.Source, o.SourceID)
+		if err != nil {
+			return flagged, fmt.Errorf("could not flag %s %s: %w", o.Source, o.SourceID, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Another ingest got there first.
+			continue
+		}
+		flagged++
+		logFor("analytics").Warn("Incident past its clearance SLA", "source", o.Source, "source_id", o.SourceID,
+			"event_type", o.EventType, "open_minutes", o.OpenMinutes, "sla_minutes", o.SLAMinutes)
+		summary := fmt.Sprintf("%s open %.0f min, over its %.0f min target: %s", o.EventType, o.OpenMinutes, o.SLAMinutes, o.Address)
+		details := map[string]interface{}{
+			"source":       o.Source,
+			"source_id":    o.SourceID,
+			"started_at":   o.StartedAt,
+			"open_minutes": o.OpenMinutes,
+			"sla_minutes":  o.SLAMinutes,
+		}
+		sinks.Publish(analyticsEvent(ChangeCreated, "Overdue", topicSegment(o.Source)+"-"+o.SourceID, o.at, o.County, o.Road, summary, details))
+	}
+	return flagged, nil
+}
+
+func overdueJob(cfg *Config, db *sql.DB) analyticsJob {
+	return func(ctx context.Context, sinks *sinkDispatcher) error {
+		if len(cfg.ClearanceSLA) == 0 {
+			return fmt.Errorf("CLEARANCE_SLA is not set")
+		}
+		flagged, err := flagOverdue(ctx, cfg, db, sinks)
+		if err != nil {
+			return err
+		}
+		logFor("analytics").Info("Checked active incidents against clearance SLAs", "flagged", flagged)
+		return nil
+	}
+}
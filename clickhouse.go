@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clickHouseSchema is the event log table. Every incident event is a row;
+// ReplacingMergeTree keyed on the source's lastUpdate collapses re-sends of
+// the same version (after a retry or restart) while keeping each version,
+// so history queries can follow an incident through its updates.
+const clickHouseSchema = `CREATE TABLE IF NOT EXISTS %s (
+	change LowCardinality(String),
+	occurred_at DateTime64(3, 'UTC'),
+	last_update DateTime64(3, 'UTC'),
+	source LowCardinality(String),
+	source_id String,
+	event_type LowCardinality(String),
+	status LowCardinality(String),
+	county LowCardinality(String),
+	city String,
+	road String,
+	direction LowCardinality(String),
+	address String,
+	latitude Float64,
+	longitude Float64,
+	start_time DateTime64(3, 'UTC'),
+	end_time Nullable(DateTime64(3, 'UTC')),
+	severity UInt8,
+	normalized_severity UInt8,
+	risk_score Float32,
+	lanes_closed UInt8,
+	lanes_total UInt8,
+	summary String,
+	details String
+) ENGINE = ReplacingMergeTree
+PARTITION BY toYYYYMM(start_time)
+ORDER BY (source, source_id, last_update)`
+
+// clickHouseTime is the DateTime64 text format JSONEachRow parses by
+// default.
+const clickHouseTime = "2006-01-02 15:04:05.000"
+
+// clickHouseSink appends incident events to a ClickHouse table over the
+// HTTP interface. Inserts are async on the server side, so ClickHouse
+// batches them into parts rather than making one per event.
+type clickHouseSink struct {
+	url      string
+	table    string
+	user     string
+	password string
+	client   *http.Client
+
+	mu           sync.Mutex
+	tableCreated bool
+}
+
+func newClickHouseSink(cfg *Config) *clickHouseSink {
+	return &clickHouseSink{
+		url:      strings.TrimRight(cfg.ClickHouseURL, "/"),
+		table:    cfg.ClickHouseTable,
+		user:     cfg.ClickHouseUser,
+		password: cfg.ClickHousePassword,
+		client:   &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *clickHouseSink) Name() string { return "clickhouse " + s.table }
+
+// clickHouseRow is an incident event in the table's JSONEachRow form.
+type clickHouseRow struct {
+	Change             ChangeType `json:"change"`
+	OccurredAt         string     `json:"occurred_at"`
+	LastUpdate         string     `json:"last_update"`
+	Source             string     `json:"source"`
+	SourceID           string     `json:"source_id"`
+	EventType          string     `json:"event_type"`
+	Status             string     `json:"status"`
+	County             string     `json:"county"`
+	City               string     `json:"city"`
+	Road               string     `json:"road"`
+	Direction          string     `json:"direction"`
+	Address            string     `json:"address"`
+	Latitude           float64    `json:"latitude"`
+	Longitude          float64    `json:"longitude"`
+	StartTime          string     `json:"start_time"`
+	EndTime            *string    `json:"end_time"`
+	Severity           int        `json:"severity"`
+	NormalizedSeverity int        `json:"normalized_severity"`
+	RiskScore          float64    `json:"risk_score"`
+	LanesClosed        int        `json:"lanes_closed"`
+	LanesTotal         int        `json:"lanes_total"`
+	Summary            string     `json:"summary"`
+	Details            string     `json:"details"`
+}
+
+func clickHouseRecord(event IncidentEvent) (clickHouseRow, error) {
+	p := event.Incident
+	details, err := json.Marshal(p.Details)
+	if err != nil {
+		return clickHouseRow{}, err
+	}
+	// Clears usually carry no new lastUpdate, so they would replace the
+	// last active version; that's the state we want to keep anyway.
+	lastUpdate, err := time.Parse(time.RFC3339, p.SourceUpdated)
+	if err != nil {
+		lastUpdate = event.OccurredAt
+	}
+	row := clickHouseRow{
+		Change:             event.Change,
+		OccurredAt:         event.OccurredAt.UTC().Format(clickHouseTime),
+		LastUpdate:         lastUpdate.UTC().Format(clickHouseTime),
+		Source:             p.Source,
+		SourceID:           p.SourceID,
+		EventType:          p.EventType,
+		Status:             p.Status,
+		County:             p.County,
+		City:               p.City,
+		Road:               firstNonEmpty(p.RoadNormalized, p.Road),
+		Direction:          p.Direction,
+		Address:            p.Address,
+		Latitude:           p.Latitude,
+		Longitude:          p.Longitude,
+		StartTime:          p.StartTime.UTC().Format(clickHouseTime),
+		Severity:           p.Severity,
+		NormalizedSeverity: p.NormalizedSeverity,
+		RiskScore:          p.RiskScore,
+		LanesClosed:        p.LanesClosed,
+		LanesTotal:         p.LanesTotal,
+		Summary:            p.Summary,
+		Details:            string(details),
+	}
+	if p.EndTime != nil {
+		end := p.EndTime.UTC().Format(clickHouseTime)
+		row.EndTime = &end
+	}
+	return row, nil
+}
+
+func (s *clickHouseSink) Publish(ctx context.Context, event IncidentEvent) error {
+	if err := s.ensureTable(ctx); err != nil {
+		return err
+	}
+	row, err := clickHouseRecord(event)
+	if err != nil {
+		return permanentError{err}
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return permanentError{err}
+	}
+	params := url.Values{
+		"query":                 {"INSERT INTO " + s.table + " FORMAT JSONEachRow"},
+		"async_insert":          {"1"},
+		"wait_for_async_insert": {"1"},
+	}
+	return s.exec(ctx, params, data)
+}
+
+func (s *clickHouseSink) ensureTable(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tableCreated {
+		return nil
+	}
+	if err := s.exec(ctx, nil, []byte(fmt.Sprintf(clickHouseSchema, s.table))); err != nil {
+		return fmt.Errorf("could not create %s: %w", s.table, err)
+	}
+	s.tableCreated = true
+	return nil
+}
+
+// exec POSTs body to the HTTP interface, which runs it as the query or,
+// when params carries one, as that query's data.
+func (s *clickHouseSink) exec(ctx context.Context, params url.Values, body []byte) error {
+	u := s.url + "/"
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("clickhouse request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != 200 {
+		err := fmt.Errorf("clickhouse returned %s: %s", resp.Status, truncate(strings.TrimSpace(string(respBody)), 200))
+		// 400 is a query or data the server rejected outright.
+		if resp.StatusCode == http.StatusBadRequest {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,948 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings read from the environment (or .env file).
+type Config struct {
+	DatabaseHost     string
+	DatabasePort     string
+	DatabaseUsername string
+	DatabasePassword string
+	DatabaseName     string
+	// DatabaseSchema, if set, is where the tables live instead of the
+	// default search path; it is created if need be, with its own
+	// unified_incidents copied from public's.
+	DatabaseSchema string
+
+	// Profiles names the profiles an ingest daemon runs side by side, and
+	// Profile is the one this configuration is for (see profile.go).
+	Profiles []string
+	Profile  string
+
+	// DotURL is the feed URL, or several; FeedPageSize and FeedMaxPages
+	// apply to those that page (see feedfetch.go).
+	DotURL       string
+	FeedPageSize int
+	FeedMaxPages int
+
+	// SentryDSN enables reporting failed runs, undecodable feeds, rejected
+	// rows and panics to Sentry; each kind at most once per
+	// ErrorReportInterval.
+	SentryDSN           string
+	SentryEnvironment   string
+	ErrorReportInterval time.Duration
+
+	// LogFormat is "text" or "json"; LogLevel is the minimum level logged
+	// and LogLevels overrides it per component (see logging.go).
+	LogFormat string
+	LogLevel  slog.Level
+	LogLevels map[string]slog.Level
+
+	// IngestEventTypes are the NCDOT incident types saved; the rest of the
+	// feed is ignored. A non-empty ingest_event_types table overrides it.
+	IngestEventTypes []string
+
+	// GeofencesFile is a JSON object of named geofences, each a geometry
+	// or bbox as the admin API takes them (see geofenceInput). They apply
+	// alongside the enabled rows of the geofences table.
+	GeofencesFile string
+
+	// IngestFiltersFile holds per-source county and route lists and
+	// severity and lane thresholds (see sourcefilter.go).
+	IngestFiltersFile string
+
+	// RedactionFile lists, per source, details fields to drop or hash
+	// before they are stored or sent (see redaction.go); RedactionHashKey
+	// keys the hashes.
+	RedactionFile    string
+	RedactionHashKey string
+
+	// FeedAuthFile holds per-source credentials for protected feeds (see
+	// feedauth.go).
+	FeedAuthFile string
+
+	// PlannedEventTypes are the (raw or unified) event types treated as
+	// planned closures, which the calendar feed publishes.
+	PlannedEventTypes []string
+
+	// HTTPAddr is where serve listens.
+	HTTPAddr string
+	// GRPCAddr is where serve listens for gRPC; empty disables it.
+	GRPCAddr string
+	// MetricsAddr is where an ingest daemon serves its Prometheus
+	// metrics and /healthz and /readyz; empty disables them.
+	MetricsAddr string
+	// ReadyMaxPollAge is how long since the last successful run /readyz
+	// tolerates (three poll intervals when zero), and SourceStaleAfter how
+	// old a source's newest update may be (zero disables that check).
+	ReadyMaxPollAge  time.Duration
+	SourceStaleAfter time.Duration
+	// HeartbeatURL is pinged after each successful ingest run, and
+	// HeartbeatFailURL after a failed one (see heartbeat.go).
+	HeartbeatURL     string
+	HeartbeatFailURL string
+	// DebugEndpoints adds /debug/pprof and /debug/status to the metrics
+	// listener.
+	DebugEndpoints bool
+	// APIAuth makes serve require an API key (see apikeys.go). APIKeys
+	// adds "name:key:scope[:per-minute]" keys to those in the database,
+	// and APIRatePerMinute is the limit for keys without their own.
+	APIAuth          bool
+	APIKeys          []string
+	APIRatePerMinute int
+	// For running behind a reverse proxy (see middleware.go): origins
+	// allowed cross-origin ("*" for any), proxies whose X-Forwarded-*
+	// headers are believed, a path prefix to serve under, and gzip.
+	APICORSOrigins    []string
+	APITrustedProxies []netip.Prefix
+	APIBasePath       string
+	APIGzip           bool
+
+	// Geocoder selects the reverse-geocoding provider ("nominatim" or
+	// "census"); empty disables reverse geocoding.
+	Geocoder        string
+	GeocoderURL     string
+	GeocoderRate    float64
+	GeocodeCacheTTL time.Duration
+
+	// RoadNetworkFile is an Overpass JSON extract of OSM highways used to
+	// snap incidents to road segments; empty disables map matching.
+	RoadNetworkFile    string
+	RoadMatchMaxMeters float64
+
+	// RouteGeometryFile is a GeoJSON file of measured Interstate/US route
+	// centerlines used to compute mileposts; empty disables them.
+	RouteGeometryFile string
+	MilepostMaxMeters float64
+
+	// County and municipal boundary GeoJSON overriding the embedded copies.
+	CountyBoundariesFile    string
+	MunicipalBoundariesFile string
+
+	// Point-of-interest GeoJSON files for the proximity enricher.
+	HospitalsFile    string
+	FireStationsFile string
+	SchoolsFile      string
+	SchoolZoneMeters float64
+
+	// DetourRouter selects the routing engine ("osrm" or "valhalla") used
+	// to suggest detours around full closures; empty disables detours.
+	DetourRouter       string
+	DetourRouterURL    string
+	DetourOffsetMeters float64
+
+	// TrafficFlowProvider selects the live speed API ("tomtom" or "here");
+	// empty disables traffic-flow enrichment.
+	TrafficFlowProvider string
+	TrafficFlowAPIKey   string
+	TrafficFlowURL      string
+	TrafficFlowRate     float64
+
+	// AirNowAPIKey enables AirNow AQI enrichment.
+	AirNowAPIKey        string
+	AirNowURL           string
+	AirNowDistanceMiles int
+
+	// LLMAPIURL is the base URL of an OpenAI-compatible API (ending in /v1)
+	// used for incident summaries; empty disables them.
+	LLMAPIURL string
+	LLMAPIKey string
+	LLMModel  string
+
+	// Free-text event type classification. The built-in rules are used
+	// unless ClassifierRulesFile is set; ClassifierModelURL adds an ML
+	// fallback for text the rules score below ClassifierThreshold.
+	ClassifierRulesFile string
+	ClassifierModelURL  string
+	ClassifierThreshold float64
+
+	// WeatherGridDegrees is the cell size incidents are grouped by so that
+	// one NWS lookup serves every incident in the cell during a run.
+	WeatherGridDegrees float64
+
+	// WebhookURLs receive every new or changed incident, signed with
+	// WebhookSecret when it is set.
+	WebhookURLs   []string
+	WebhookSecret string
+
+	// SlackBotToken and SlackChannel enable Slack notifications for
+	// incidents matching the rules in SlackRulesFile (all, if unset).
+	SlackBotToken  string
+	SlackChannel   string
+	SlackRulesFile string
+
+	// NotifyRulesFile holds central routing rules (see RoutingRule), used
+	// alongside the enabled rows of the notification_rules table.
+	NotifyRulesFile string
+
+	// Discord notifications go to DiscordWebhookURL (every incident) and/or
+	// the per-channel routes in DiscordRoutesFile.
+	DiscordWebhookURL string
+	DiscordRoutesFile string
+
+	// StaticMapURL is an image URL template with {lat} and {lon}
+	// placeholders used for notification map thumbnails.
+	StaticMapURL string
+
+	// MapTileURL ({z}/{x}/{y} placeholders) switches notification maps to
+	// local rendering from tiles, attached to Discord messages, social
+	// posts and subscriber emails.
+	MapTileURL string
+
+	// MQTTURL (tcp:// or mqtts://, credentials in the URL) enables MQTT
+	// publishing. MQTTTopic may use {source}, {source_id}, {county} and
+	// {event_type}.
+	MQTTURL      string
+	MQTTClientID string
+	MQTTTopic    string
+	MQTTQoS      int
+
+	// Home Assistant sensors published over MQTT (see homeAssistant).
+	// Each is enabled by its own setting.
+	HADiscoveryPrefix string
+	HAStateTopic      string
+	HAHomeLat         float64
+	HAHomeLon         float64
+	HANearestMaxMiles float64
+	HACounty          string
+	HACommuteRoute    string
+
+	// KafkaRESTURL is a Confluent REST Proxy that incident events are
+	// produced through, Avro-encoded, to KafkaTopic.
+	KafkaRESTURL string
+	KafkaTopic   string
+
+	// NATSURL enables JetStream publishing on NATSSubject (which takes the
+	// same placeholders as MQTTTopic plus {change}). NATSStream, if set,
+	// makes the server reject messages that would land in another stream.
+	NATSURL     string
+	NATSSubject string
+	NATSStream  string
+
+	// OpenSearchURL enables indexing incidents into OpenSearch or
+	// Elasticsearch, in monthly indexes named OpenSearchIndexPrefix-YYYY.MM,
+	// authenticating with an API key or else a username and password.
+	OpenSearchURL         string
+	OpenSearchIndexPrefix string
+	OpenSearchUsername    string
+	OpenSearchPassword    string
+	OpenSearchAPIKey      string
+
+	// ClickHouseURL (the HTTP interface, e.g. http://host:8123) enables
+	// appending every incident event to ClickHouseTable, which is created
+	// if missing. It may be qualified with a database.
+	ClickHouseURL      string
+	ClickHouseTable    string
+	ClickHouseUser     string
+	ClickHousePassword string
+
+	// BigQueryProject and BigQueryDataset enable streaming incident events
+	// into BigQueryTable, authenticating with the service account key in
+	// BigQueryCredentialsFile (GOOGLE_APPLICATION_CREDENTIALS by default).
+	BigQueryProject         string
+	BigQueryDataset         string
+	BigQueryTable           string
+	BigQueryCredentialsFile string
+
+	// Incident counts are pushed as time series every TimeSeriesInterval
+	// to InfluxDB (InfluxURL, a v2 API) and/or a Prometheus remote-write
+	// endpoint (RemoteWriteURL), when either is set.
+	InfluxURL           string
+	InfluxToken         string
+	InfluxOrg           string
+	InfluxBucket        string
+	RemoteWriteURL      string
+	RemoteWriteUsername string
+	RemoteWritePassword string
+	TimeSeriesInterval  time.Duration
+
+	// GrafanaURL enables annotating GrafanaDashboardUID (or just panel
+	// GrafanaPanelID) with incidents matching GrafanaRulesFile (by
+	// default, full Interstate closures and winter weather).
+	GrafanaURL          string
+	GrafanaToken        string
+	GrafanaDashboardUID string
+	GrafanaPanelID      int
+	GrafanaRulesFile    string
+
+	// Twilio SMS alerts go to the numbers in SMSRecipientsFile for
+	// incidents matching SMSRulesFile (by default, fatality-level severity
+	// or a full Interstate closure).
+	TwilioAccountSID  string
+	TwilioAuthToken   string
+	TwilioFrom        string
+	SMSRecipientsFile string
+	SMSRulesFile      string
+
+	// PushTargetsFile lists per-person ntfy and Pushover subscriptions;
+	// Pushover targets also need PushoverAppToken.
+	PushTargetsFile  string
+	PushoverAppToken string
+
+	// Social posting to Mastodon and/or Bluesky for incidents matching
+	// SocialRulesFile (by default, normalized severity 4 and up). The
+	// templates are text/template strings over socialPostData.
+	MastodonInstance      string
+	MastodonToken         string
+	BlueskyService        string
+	BlueskyHandle         string
+	BlueskyAppPassword    string
+	SocialRulesFile       string
+	SocialTemplate        string
+	SocialClearedTemplate string
+	SocialMaxPerHour      int
+
+	// Outgoing mail, used by the digest command.
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// The digest command emails DigestRecipients at each of DigestTimes
+	// ("HH:MM", Eastern), covering the previous DigestLookback. Severe
+	// means a normalized severity of at least DigestMinSeverity; lane
+	// closures open longer than DigestLongOpen are listed separately.
+	DigestRecipients  []string
+	DigestTimes       []string
+	DigestLookback    time.Duration
+	DigestMinSeverity int
+	DigestLongOpen    time.Duration
+
+	// The summaries job reports each day and week to SummarySlackChannel
+	// (with SLACK_BOT_TOKEN) and SummaryRecipients.
+	SummarySlackChannel string
+	SummaryRecipients   []string
+
+	// CAP 1.2 alerts for incidents at or above CAPMinSeverity are POSTed
+	// to CAPURL and/or written to CAPDir, with CAPSender as the sender.
+	CAPURL         string
+	CAPDir         string
+	CAPSender      string
+	CAPMinSeverity int
+
+	// SubscriptionsEnabled sends alerts to the residents signed up in the
+	// subscribers tables, over whichever of SMTP, Twilio and Pushover are
+	// configured (ntfy needs nothing).
+	SubscriptionsEnabled bool
+
+	// PollInterval makes ingest run as a daemon, polling this often.
+	PollInterval time.Duration
+
+	// NotifyCooldowns are per-sink windows (keyed by sink name or glob)
+	// after which an alerting sink may be reminded of an incident that
+	// hasn't escalated, from NOTIFY_COOLDOWNS ("slack=30m,sms=2h").
+	NotifyCooldowns map[string]time.Duration
+
+	// Failed sink deliveries are retried with exponential backoff starting
+	// at SinkRetryBackoff, then dead-lettered after SinkMaxAttempts.
+	SinkMaxAttempts  int
+	SinkRetryBackoff time.Duration
+
+	// CABundle is a PEM file of extra trusted CAs. ContactEmail goes in
+	// the default User-Agent, and UserAgent replaces it (see
+	// httpclient.go).
+	CABundle     string
+	ContactEmail string
+	UserAgent    string
+	// NWSURL replaces the NWS API's base URL.
+	NWSURL string
+	// NWSRequestBudget caps the NWS requests, retries included, per ingest
+	// run and profile; zero is no cap.
+	NWSRequestBudget int
+
+	// Requests to the DOT feed and NWS time out after HTTPTimeout and are
+	// retried like sink deliveries; HTTPBreakerThreshold failures in a row
+	// stop requests to that host for HTTPBreakerCooldown (see
+	// httpclient.go).
+	HTTPTimeout          time.Duration
+	HTTPMaxAttempts      int
+	HTTPRetryBackoff     time.Duration
+	HTTPBreakerThreshold int
+	HTTPBreakerCooldown  time.Duration
+	// FeedTimeout, NWSPointsTimeout and NWSHourlyTimeout replace
+	// HTTPTimeout for those calls; each covers reading the body too.
+	FeedTimeout      time.Duration
+	NWSPointsTimeout time.Duration
+	NWSHourlyTimeout time.Duration
+	// DBStatementTimeout is Postgres's statement_timeout for every
+	// session; zero leaves the server's setting.
+	DBStatementTimeout time.Duration
+
+	// Feed records outside ValidateRegion or with a severity outside
+	// ValidateSeverityMin..Max are quarantined (see validate.go).
+	ValidateRegion      bbox
+	ValidateSeverityMin int
+	ValidateSeverityMax int
+
+	// The hotspots job clusters the incidents of the last HotspotWindow:
+	// HotspotMinIncidents within HotspotRadiusMeters make a hotspot.
+	HotspotWindow       time.Duration
+	HotspotRadiusMeters float64
+	HotspotMinIncidents int
+
+	// AnomalyDetection has ingest compare each county's last hour with
+	// its baseline after every run (see anomaly.go).
+	AnomalyDetection     bool
+	AnomalyMultiple      float64
+	AnomalyMinIncidents  int
+	AnomalyBaselineWeeks int
+
+	// ClearanceSLA is how long an active incident may stay open, by
+	// lowercased event type or "*" (see clearance.go).
+	ClearanceSLA map[string]time.Duration
+
+	// The risk job scores RiskSegmentMiles stretches of road for the next
+	// RiskHorizonHours hours, retraining every RiskRetrainInterval on the
+	// last RiskTrainingWeeks weeks (see riskmodel.go). RiskScoringURL
+	// hands the modelling to an external service.
+	RiskSegmentMiles    float64
+	RiskTrainingWeeks   int
+	RiskHorizonHours    int
+	RiskRetrainInterval time.Duration
+	RiskScoringURL      string
+
+	// The dedup stage suggests merging a new incident with an active one
+	// of the same type within DedupRadiusMeters that started within
+	// DedupWindow of it (see merge.go). Zero radius turns it off.
+	DedupRadiusMeters float64
+	DedupWindow       time.Duration
+
+	// SkipUnchanged skips enriching and saving active incidents whose
+	// source record hasn't changed since they were saved, so their
+	// enrichment (weather and the like) is only refreshed on a change.
+	SkipUnchanged bool
+
+	// IngestWorkers is how many incidents are enriched and saved at once.
+	// Each holds a database connection while it saves.
+	IngestWorkers int
+
+	// Faults to inject, for chaos testing (see faults.go).
+	FaultNWSDrop       float64
+	FaultDBDelay       time.Duration
+	FaultFeedMalformed float64
+
+	// FeedMaxBytes is the most of a (decompressed) feed that is read
+	// before giving up on it.
+	FeedMaxBytes int64
+}
+
+// loadConfig reads the configuration from the environment.
+func loadConfig() (*Config, error) {
+	cfg := &Config{
+		DatabaseHost:      getenv("DATABASE_HOST"),
+		DatabasePort:      getenv("DATABASE_PORT"),
+		DatabaseUsername:  getenv("DATABASE_USERNAME"),
+		DatabasePassword:  getenv("DATABASE_PASSWORD"),
+		DatabaseName:      getenv("DATABASE_NAME"),
+		DatabaseSchema:    getenv("DATABASE_SCHEMA"),
+		Profiles:          envList("PROFILES"),
+		DotURL:            getenv("DOT_URL"),
+		LogFormat:         envDefault("LOG_FORMAT", "text"),
+		SentryDSN:         getenv("SENTRY_DSN"),
+		HeartbeatURL:      getenv("HEARTBEAT_URL"),
+		CABundle:          getenv("CA_BUNDLE"),
+		UserAgent:         getenv("USER_AGENT"),
+		ContactEmail:      getenv("CONTACT_EMAIL"),
+		NWSURL:            strings.TrimSuffix(getenv("NWS_URL"), "/"),
+		HeartbeatFailURL:  getenv("HEARTBEAT_FAIL_URL"),
+		SentryEnvironment: envDefault("SENTRY_ENVIRONMENT", "production"),
+		IngestEventTypes:  envList("INGEST_EVENT_TYPES"),
+		GeofencesFile:     getenv("GEOFENCES_FILE"),
+		IngestFiltersFile: getenv("INGEST_FILTERS_FILE"),
+		RedactionFile:     getenv("REDACTION_FILE"),
+		FeedAuthFile:      getenv("FEED_AUTH_FILE"),
+		RedactionHashKey:  getenv("REDACTION_HASH_KEY"),
+		PlannedEventTypes: envList("PLANNED_EVENT_TYPES"),
+		HTTPAddr:          envDefault("HTTP_ADDR", ":8080"),
+		GRPCAddr:          getenv("GRPC_ADDR"),
+		MetricsAddr:       getenv("METRICS_ADDR"),
+		APIKeys:           envList("API_KEYS"),
+		APICORSOrigins:    envList("API_CORS_ORIGINS"),
+		APIBasePath:       normalizeBasePath(getenv("API_BASE_PATH")),
+		Geocoder:          getenv("GEOCODER"),
+		GeocoderURL:       getenv("GEOCODER_URL"),
+		RoadNetworkFile:   getenv("ROAD_NETWORK_FILE"),
+		RouteGeometryFile: getenv("ROUTE_GEOMETRY_FILE"),
+
+		CountyBoundariesFile:    getenv("COUNTY_BOUNDARIES_FILE"),
+		MunicipalBoundariesFile: getenv("MUNICIPAL_BOUNDARIES_FILE"),
+
+		HospitalsFile:    getenv("HOSPITALS_FILE"),
+		FireStationsFile: getenv("FIRE_STATIONS_FILE"),
+		SchoolsFile:      getenv("SCHOOLS_FILE"),
+
+		DetourRouter:    getenv("DETOUR_ROUTER"),
+		DetourRouterURL: getenv("DETOUR_ROUTER_URL"),
+
+		TrafficFlowProvider: getenv("TRAFFIC_FLOW_PROVIDER"),
+		TrafficFlowAPIKey:   getenv("TRAFFIC_FLOW_API_KEY"),
+		TrafficFlowURL:      getenv("TRAFFIC_FLOW_URL"),
+
+		AirNowAPIKey: getenv("AIRNOW_API_KEY"),
+		AirNowURL:    getenv("AIRNOW_URL"),
+
+		LLMAPIURL: getenv("LLM_API_URL"),
+		LLMAPIKey: getenv("LLM_API_KEY"),
+		LLMModel:  getenv("LLM_MODEL"),
+
+		ClassifierRulesFile: getenv("CLASSIFIER_RULES_FILE"),
+		ClassifierModelURL:  getenv("CLASSIFIER_MODEL_URL"),
+
+		WebhookURLs:   envList("WEBHOOK_URLS"),
+		WebhookSecret: getenv("WEBHOOK_SECRET"),
+
+		SlackBotToken:  getenv("SLACK_BOT_TOKEN"),
+		SlackChannel:   getenv("SLACK_CHANNEL"),
+		SlackRulesFile: getenv("SLACK_RULES_FILE"),
+
+		NotifyRulesFile: getenv("NOTIFY_RULES_FILE"),
+
+		DiscordWebhookURL: getenv("DISCORD_WEBHOOK_URL"),
+		DiscordRoutesFile: getenv("DISCORD_ROUTES_FILE"),
+		MQTTURL:           getenv("MQTT_URL"),
+		MQTTClientID:      envDefault("MQTT_CLIENT_ID", "ncdot-ingester"),
+		MQTTTopic:         envDefault("MQTT_TOPIC", "patrolx/incidents/{county}/{event_type}/{source_id}"),
+
+		HADiscoveryPrefix: envDefault("HA_DISCOVERY_PREFIX", "homeassistant"),
+		HAStateTopic:      envDefault("HA_STATE_TOPIC", "patrolx/homeassistant"),
+		HACounty:          getenv("HA_COUNTY"),
+		HACommuteRoute:    getenv("HA_COMMUTE_ROUTE"),
+
+		KafkaRESTURL: getenv("KAFKA_REST_URL"),
+		KafkaTopic:   envDefault("KAFKA_TOPIC", "patrolx.incidents"),
+
+		NATSURL:     getenv("NATS_URL"),
+		NATSSubject: envDefault("NATS_SUBJECT", "patrolx.incidents.{source}.{change}"),
+		NATSStream:  getenv("NATS_STREAM"),
+
+		OpenSearchURL:         getenv("OPENSEARCH_URL"),
+		OpenSearchIndexPrefix: envDefault("OPENSEARCH_INDEX_PREFIX", "patrolx-incidents"),
+		OpenSearchUsername:    getenv("OPENSEARCH_USERNAME"),
+		OpenSearchPassword:    getenv("OPENSEARCH_PASSWORD"),
+		OpenSearchAPIKey:      getenv("OPENSEARCH_API_KEY"),
+
+		ClickHouseURL:      getenv("CLICKHOUSE_URL"),
+		ClickHouseTable:    envDefault("CLICKHOUSE_TABLE", "incident_events"),
+		ClickHouseUser:     getenv("CLICKHOUSE_USER"),
+		ClickHousePassword: getenv("CLICKHOUSE_PASSWORD"),
+
+		BigQueryProject:         getenv("BIGQUERY_PROJECT"),
+		BigQueryDataset:         getenv("BIGQUERY_DATASET"),
+		BigQueryTable:           envDefault("BIGQUERY_TABLE", "incident_events"),
+		BigQueryCredentialsFile: envDefault("BIGQUERY_CREDENTIALS_FILE", getenv("GOOGLE_APPLICATION_CREDENTIALS")),
+
+		InfluxURL:           getenv("INFLUX_URL"),
+		InfluxToken:         getenv("INFLUX_TOKEN"),
+		InfluxOrg:           getenv("INFLUX_ORG"),
+		InfluxBucket:        envDefault("INFLUX_BUCKET", "patrolx"),
+		RemoteWriteURL:      getenv("REMOTE_WRITE_URL"),
+		RemoteWriteUsername: getenv("REMOTE_WRITE_USERNAME"),
+		RemoteWritePassword: getenv("REMOTE_WRITE_PASSWORD"),
+
+		GrafanaURL:          getenv("GRAFANA_URL"),
+		GrafanaToken:        getenv("GRAFANA_TOKEN"),
+		GrafanaDashboardUID: getenv("GRAFANA_DASHBOARD_UID"),
+		GrafanaRulesFile:    getenv("GRAFANA_RULES_FILE"),
+
+		TwilioAccountSID:  getenv("TWILIO_ACCOUNT_SID"),
+		TwilioAuthToken:   getenv("TWILIO_AUTH_TOKEN"),
+		TwilioFrom:        getenv("TWILIO_FROM"),
+		SMSRecipientsFile: getenv("SMS_RECIPIENTS_FILE"),
+		SMSRulesFile:      getenv("SMS_RULES_FILE"),
+
+		PushTargetsFile:  getenv("PUSH_TARGETS_FILE"),
+		PushoverAppToken: getenv("PUSHOVER_APP_TOKEN"),
+
+		MastodonInstance:      getenv("MASTODON_INSTANCE"),
+		MastodonToken:         getenv("MASTODON_TOKEN"),
+		BlueskyService:        envDefault("BLUESKY_SERVICE", "https://bsky.social"),
+		BlueskyHandle:         getenv("BLUESKY_HANDLE"),
+		BlueskyAppPassword:    getenv("BLUESKY_APP_PASSWORD"),
+		SocialRulesFile:       getenv("SOCIAL_RULES_FILE"),
+		SocialTemplate:        getenv("SOCIAL_TEMPLATE"),
+		SocialClearedTemplate: getenv("SOCIAL_CLEARED_TEMPLATE"),
+
+		SMTPHost:     getenv("SMTP_HOST"),
+		SMTPUsername: getenv("SMTP_USERNAME"),
+		SMTPPassword: getenv("SMTP_PASSWORD"),
+		SMTPFrom:     getenv("SMTP_FROM"),
+
+		DigestRecipients: envList("DIGEST_RECIPIENTS"),
+		DigestTimes:      envList("DIGEST_TIMES"),
+
+		SummarySlackChannel: getenv("SUMMARY_SLACK_CHANNEL"),
+		SummaryRecipients:   envList("SUMMARY_RECIPIENTS"),
+
+		MapTileURL: getenv("MAP_TILE_URL"),
+
+		CAPURL:       getenv("CAP_URL"),
+		CAPDir:       getenv("CAP_DIR"),
+		CAPSender:    envDefault("CAP_SENDER", "ncdot-ingester@localhost"),
+		StaticMapURL: envDefault("STATIC_MAP_URL", "https://staticmap.openstreetmap.de/staticmap.php?center={lat},{lon}&zoom=14&size=320x200&markers={lat},{lon},red-pushpin"),
+	}
+
+	var err error
+	if cfg.GeocoderRate, err = envFloat("GEOCODER_RATE", 1); err != nil {
+		return nil, err
+	}
+	if cfg.GeocodeCacheTTL, err = envDuration("GEOCODE_CACHE_TTL", 90*24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.RoadMatchMaxMeters, err = envFloat("ROAD_MATCH_MAX_METERS", 75); err != nil {
+		return nil, err
+	}
+	if cfg.MilepostMaxMeters, err = envFloat("MILEPOST_MAX_METERS", 200); err != nil {
+		return nil, err
+	}
+	if cfg.SchoolZoneMeters, err = envFloat("SCHOOL_ZONE_METERS", 300); err != nil {
+		return nil, err
+	}
+	if cfg.DetourOffsetMeters, err = envFloat("DETOUR_OFFSET_METERS", 2000); err != nil {
+		return nil, err
+	}
+	if cfg.TrafficFlowRate, err = envFloat("TRAFFIC_FLOW_RATE", 5); err != nil {
+		return nil, err
+	}
+	if cfg.AirNowDistanceMiles, err = envInt("AIRNOW_DISTANCE_MILES", 25); err != nil {
+		return nil, err
+	}
+	if cfg.ClassifierThreshold, err = envFloat("CLASSIFIER_THRESHOLD", 0.6); err != nil {
+		return nil, err
+	}
+	if cfg.WeatherGridDegrees, err = envFloat("WEATHER_GRID_DEGREES", 0.02); err != nil {
+		return nil, err
+	}
+	if cfg.MQTTQoS, err = envInt("MQTT_QOS", 1); err != nil {
+		return nil, err
+	}
+	if cfg.HAHomeLat, err = envFloat("HA_HOME_LAT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.HAHomeLon, err = envFloat("HA_HOME_LON", 0); err != nil {
+		return nil, err
+	}
+	if cfg.HANearestMaxMiles, err = envFloat("HA_NEAREST_MAX_MILES", 25); err != nil {
+		return nil, err
+	}
+	if cfg.SocialMaxPerHour, err = envInt("SOCIAL_MAX_PER_HOUR", 6); err != nil {
+		return nil, err
+	}
+	if cfg.SMTPPort, err = envInt("SMTP_PORT", 587); err != nil {
+		return nil, err
+	}
+	if cfg.DigestLookback, err = envDuration("DIGEST_LOOKBACK", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.DigestMinSeverity, err = envInt("DIGEST_MIN_SEVERITY", 4); err != nil {
+		return nil, err
+	}
+	if cfg.DigestLongOpen, err = envDuration("DIGEST_LONG_OPEN", 4*time.Hour); err != nil {
+		return nil, err
+	}
+	if len(cfg.DigestTimes) == 0 {
+		cfg.DigestTimes = []string{"07:00", "17:00"}
+	}
+	if len(cfg.IngestEventTypes) == 0 {
+		cfg.IngestEventTypes = []string{"Vehicle Crash", "Disabled Vehicle"}
+	}
+	if len(cfg.PlannedEventTypes) == 0 {
+		cfg.PlannedEventTypes = []string{"Construction", "Night Time Construction", "Weekend Construction", "Maintenance", "Bridge Maintenance", "Special Event"}
+	}
+	cfg.ValidateRegion = ncBBox
+	if v := envList("VALIDATE_BBOX"); len(v) > 0 {
+		if cfg.ValidateRegion, err = parseBBox(v); err != nil {
+			return nil, fmt.Errorf("VALIDATE_BBOX: %w", err)
+		}
+	}
+	if cfg.ValidateSeverityMin, err = envInt("VALIDATE_SEVERITY_MIN", 0); err != nil {
+		return nil, err
+	}
+	if cfg.ValidateSeverityMax, err = envInt("VALIDATE_SEVERITY_MAX", 3); err != nil {
+		return nil, err
+	}
+	if cfg.CAPMinSeverity, err = envInt("CAP_MIN_SEVERITY", 4); err != nil {
+		return nil, err
+	}
+	if cfg.SubscriptionsEnabled, err = envBool("SUBSCRIPTIONS_ENABLED", false); err != nil {
+		return nil, err
+	}
+	if cfg.DebugEndpoints, err = envBool("DEBUG_ENDPOINTS", false); err != nil {
+		return nil, err
+	}
+	if cfg.APIAuth, err = envBool("API_AUTH", false); err != nil {
+		return nil, err
+	}
+	if cfg.APIRatePerMinute, err = envInt("API_RATE_PER_MINUTE", 600); err != nil {
+		return nil, err
+	}
+	if _, err := parseAPIKeys(cfg.APIKeys); err != nil {
+		return nil, err
+	}
+	if cfg.APITrustedProxies, err = parseTrustedProxies(envList("API_TRUSTED_PROXIES")); err != nil {
+		return nil, err
+	}
+	if cfg.APIGzip, err = envBool("API_GZIP", true); err != nil {
+		return nil, err
+	}
+	if cfg.PollInterval, err = envDuration("POLL_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return nil, fmt.Errorf("LOG_FORMAT must be text or json")
+	}
+	if err := cfg.LogLevel.UnmarshalText([]byte(envDefault("LOG_LEVEL", "info"))); err != nil {
+		return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+	if cfg.LogLevels, err = parseLogLevels(envList("LOG_LEVELS")); err != nil {
+		return nil, err
+	}
+	if cfg.ReadyMaxPollAge, err = envDuration("READY_MAX_POLL_AGE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.SourceStaleAfter, err = envDuration("SOURCE_STALE_AFTER", 6*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.ErrorReportInterval, err = envDuration("ERROR_REPORT_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.TimeSeriesInterval, err = envDuration("TIMESERIES_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.TimeSeriesInterval <= 0 {
+		return nil, fmt.Errorf("TIMESERIES_INTERVAL must be positive")
+	}
+	if cfg.GrafanaPanelID, err = envInt("GRAFANA_PANEL_ID", 0); err != nil {
+		return nil, err
+	}
+	if cfg.NotifyCooldowns, err = parseCooldowns(envList("NOTIFY_COOLDOWNS")); err != nil {
+		return nil, err
+	}
+	if cfg.SinkMaxAttempts, err = envInt("SINK_MAX_ATTEMPTS", 5); err != nil {
+		return nil, err
+	}
+	if cfg.SinkRetryBackoff, err = envDuration("SINK_RETRY_BACKOFF", 2*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.HotspotWindow, err = envDuration("HOTSPOT_WINDOW", 6*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.HotspotRadiusMeters, err = envFloat("HOTSPOT_RADIUS_M", 1500); err != nil {
+		return nil, err
+	}
+	if cfg.HotspotMinIncidents, err = envInt("HOTSPOT_MIN_INCIDENTS", 4); err != nil {
+		return nil, err
+	}
+	if cfg.AnomalyDetection, err = envBool("ANOMALY_DETECTION", false); err != nil {
+		return nil, err
+	}
+	if cfg.AnomalyMultiple, err = envFloat("ANOMALY_MULTIPLE", 3); err != nil {
+		return nil, err
+	}
+	if cfg.AnomalyMinIncidents, err = envInt("ANOMALY_MIN_INCIDENTS", 3); err != nil {
+		return nil, err
+	}
+	if cfg.AnomalyBaselineWeeks, err = envInt("ANOMALY_BASELINE_WEEKS", 8); err != nil {
+		return nil, err
+	}
+	if cfg.AnomalyBaselineWeeks < 1 {
+		return nil, fmt.Errorf("ANOMALY_BASELINE_WEEKS must be at least 1")
+	}
+	if cfg.ClearanceSLA, err = parseClearanceSLA(envList("CLEARANCE_SLA")); err != nil {
+		return nil, err
+	}
+	if cfg.RiskSegmentMiles, err = envFloat("RISK_SEGMENT_MILES", 5); err != nil {
+		return nil, err
+	}
+	if !(cfg.RiskSegmentMiles > 0) {
+		return nil, fmt.Errorf("RISK_SEGMENT_MILES must be positive")
+	}
+	if cfg.RiskTrainingWeeks, err = envInt("RISK_TRAINING_WEEKS", 12); err != nil {
+		return nil, err
+	}
+	if cfg.RiskHorizonHours, err = envInt("RISK_HORIZON_HOURS", 6); err != nil {
+		return nil, err
+	}
+	if cfg.RiskTrainingWeeks < 1 || cfg.RiskHorizonHours < 1 {
+		return nil, fmt.Errorf("RISK_TRAINING_WEEKS and RISK_HORIZON_HOURS must be at least 1")
+	}
+	if cfg.RiskRetrainInterval, err = envDuration("RISK_RETRAIN_INTERVAL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	cfg.RiskScoringURL = strings.TrimSuffix(getenv("RISK_SCORING_URL"), "/")
+	if cfg.DedupRadiusMeters, err = envFloat("DEDUP_RADIUS_M", 250); err != nil {
+		return nil, err
+	}
+	if cfg.DedupWindow, err = envDuration("DEDUP_WINDOW", 30*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.SkipUnchanged, err = envBool("INGEST_SKIP_UNCHANGED", true); err != nil {
+		return nil, err
+	}
+	if cfg.IngestWorkers, err = envInt("INGEST_WORKERS", 8); err != nil {
+		return nil, err
+	}
+	if cfg.FeedPageSize, err = envInt("FEED_PAGE_SIZE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.FeedMaxPages, err = envInt("FEED_MAX_PAGES", 50); err != nil {
+		return nil, err
+	}
+	if cfg.FaultNWSDrop, err = envFloat("FAULT_NWS_DROP", 0); err != nil {
+		return nil, err
+	}
+	if cfg.FaultDBDelay, err = envDuration("FAULT_DB_DELAY", 0); err != nil {
+		return nil, err
+	}
+	if cfg.FaultFeedMalformed, err = envFloat("FAULT_FEED_MALFORMED", 0); err != nil {
+		return nil, err
+	}
+	feedMaxMB, err := envInt("FEED_MAX_MB", 64)
+	if err != nil {
+		return nil, err
+	}
+	cfg.FeedMaxBytes = int64(feedMaxMB) << 20
+	if cfg.HTTPTimeout, err = envDuration("HTTP_TIMEOUT", 15*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPMaxAttempts, err = envInt("HTTP_MAX_ATTEMPTS", 3); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPRetryBackoff, err = envDuration("HTTP_RETRY_BACKOFF", 500*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPBreakerThreshold, err = envInt("HTTP_BREAKER_THRESHOLD", 5); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPBreakerCooldown, err = envDuration("HTTP_BREAKER_COOLDOWN", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.NWSRequestBudget, err = envInt("NWS_REQUEST_BUDGET", 0); err != nil {
+		return nil, err
+	}
+	if cfg.FeedTimeout, err = envDuration("FEED_TIMEOUT", 60*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.NWSPointsTimeout, err = envDuration("NWS_POINTS_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.NWSHourlyTimeout, err = envDuration("NWS_HOURLY_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.DBStatementTimeout, err = envDuration("DB_STATEMENT_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.LLMAPIURL != "" && cfg.LLMModel == "" {
+		cfg.LLMModel = "gpt-4o-mini"
+	}
+
+	if cfg.DatabaseSchema != "" && !sqlIdentifier.MatchString(cfg.DatabaseSchema) {
+		return nil, fmt.Errorf("DATABASE_SCHEMA must be a lower-case identifier")
+	}
+	if cfg.SlackBotToken != "" && cfg.SlackChannel == "" {
+		return nil, fmt.Errorf("SLACK_CHANNEL must be set when SLACK_BOT_TOKEN is")
+	}
+	if cfg.GrafanaURL != "" && cfg.GrafanaDashboardUID == "" {
+		return nil, fmt.Errorf("GRAFANA_DASHBOARD_UID must be set when GRAFANA_URL is")
+	}
+	return cfg, nil
+}
+
+// homeAssistantEnabled reports whether any Home Assistant sensor is set up.
+func (c *Config) homeAssistantEnabled() bool {
+	return c.MQTTURL != "" && (c.HAHomeLat != 0 || c.HAHomeLon != 0 || c.HACounty != "" || c.HACommuteRoute != "")
+}
+
+// psqlInfo builds the lib/pq connection string.
+func (c *Config) psqlInfo() string {
+	info := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=require",
+		c.DatabaseHost, c.DatabasePort, c.DatabaseUsername, c.DatabasePassword, c.DatabaseName)
+	if c.DBStatementTimeout > 0 {
+		info += fmt.Sprintf(" statement_timeout=%d", c.DBStatementTimeout.Milliseconds())
+	}
+	if c.DatabaseSchema != "" {
+		info += " search_path=" + c.DatabaseSchema
+	}
+	return info
+}
+
+var sqlIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// getenv reads a setting. loadProfile points it at a profile's overrides
+// while it loads that profile.
+var getenv = os.Getenv
+
+func envDefault(key, def string) string {
+	if v := getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList splits a comma-separated variable, dropping empty entries.
+func envList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func envFloat(key string, def float64) (float64, error) {
+	v := getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return f, nil
+}
+
+func envInt(key string, def int) (int, error) {
+	v := getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return n, nil
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return d, nil
+}
+
+func envBool(key string, def bool) (bool, error) {
+	v := getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return b, nil
+}
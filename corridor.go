@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GET or POST /incidents/corridor returns the active incidents within a
+// buffer of a route, in order along it, for trip previews. The route is an
+// encoded polyline (polyline=, with precision=6 for Valhalla's) or the
+// name of a saved route (route=); buffer= is in meters, defaulting to the
+// saved route's or 150. POST takes the same as a JSON body, for polylines
+// too long for a URL. The usual incident filters apply.
+
+const (
+	corridorDefaultBuffer = 150
+	corridorMaxBuffer     = 5000
+)
+
+type corridorRequest struct {
+	Polyline  string  `json:"polyline"`
+	Precision int     `json:"precision"`
+	Route     string  `json:"route"`
+	Buffer    float64 `json:"buffer"`
+}
+
+type corridorIncident struct {
+	IncidentPayload
+	DistanceMeters float64 `json:"distance_m"`
+	// PositionMeters is how far along the route the incident sits.
+	PositionMeters float64 `json:"position_m"`
+}
+
+type corridorList struct {
+	Incidents    []corridorIncident `json:"incidents"`
+	Count        int                `json:"count"`
+	LengthMeters float64            `json:"route_length_m"`
+	BufferMeters float64            `json:"buffer_m"`
+}
+
+func (s *server) handleCorridor(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseIncidentFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := corridorRequest{Polyline: q.Get("polyline"), Route: q.Get("route")}
+	if v := q.Get("precision"); v != "" {
+		if req.Precision, err = strconv.Atoi(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid precision %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("buffer"); v != "" {
+		if req.Buffer, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid buffer %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	route, status, err := s.corridorRoute(r, req)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			logFor("api").Error("Error loading saved routes", "err", err)
+			err = fmt.Errorf("could not load saved routes")
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if route.BufferMeters <= 0 || route.BufferMeters > corridorMaxBuffer {
+		http.Error(w, fmt.Sprintf("buffer must be between 0 and %d meters", corridorMaxBuffer), http.StatusBadRequest)
+		return
+	}
+
+	switch f.Status {
+	case "":
+		f.Status = StatusActive
+	case "all":
+		f.Status = ""
+	}
+	// Narrow to the route's box in SQL, then measure each candidate.
+	box := polygonsBBox([]polygon{{route.Polyline}})
+	dLat := route.BufferMeters / earthRadiusMeters * 180 / math.Pi
+	dLon := dLat / math.Max(0.01, math.Cos((box.MinLat+box.MaxLat)/2*math.Pi/180))
+	f.BBox = []float64{box.MinLon - dLon, box.MinLat - dLat, box.MaxLon + dLon, box.MaxLat + dLat}
+	limit := f.Limit
+	if limit == 0 || limit > apiMaxLimit {
+		limit = apiMaxLimit
+	}
+	f.Limit, f.Offset = 0, 0
+
+	incidents, err := queryIncidents(r.Context(), s.db, f)
+	if err != nil {
+		logFor("api").Error("Error loading corridor incidents", "err", err)
+		http.Error(w, "could not load incidents", http.StatusInternalServerError)
+		return
+	}
+	resp := corridorList{Incidents: []corridorIncident{}, LengthMeters: math.Round(route.cumulative[len(route.cumulative)-1]), BufferMeters: route.BufferMeters}
+	for _, p := range incidents {
+		dist, position, ok := route.locate(LatLon{Lat: p.Latitude, Lon: p.Longitude})
+		if !ok || dist > route.BufferMeters {
+			continue
+		}
+		resp.Incidents = append(resp.Incidents, corridorIncident{IncidentPayload: p, DistanceMeters: math.Round(dist), PositionMeters: math.Round(position)})
+	}
+	sort.SliceStable(resp.Incidents, func(i, j int) bool {
+		return resp.Incidents[i].PositionMeters < resp.Incidents[j].PositionMeters
+	})
+	if len(resp.Incidents) > limit {
+		resp.Incidents = resp.Incidents[:limit]
+	}
+	resp.Count = len(resp.Incidents)
+	writeJSON(w, "application/json", resp)
+}
+
+// corridorRoute resolves the request to a measured route, with the HTTP
+// status to report if it can't.
+func (s *server) corridorRoute(r *http.Request, req corridorRequest) (*SavedRoute, int, error) {
+	route := &SavedRoute{BufferMeters: req.Buffer}
+	switch {
+	case req.Polyline != "" && req.Route != "":
+		return nil, http.StatusBadRequest, fmt.Errorf("give a polyline or a route, not both")
+	case req.Polyline != "":
+		precision := req.Precision
+		if precision == 0 {
+			precision = 5
+		}
+		if precision != 5 && precision != 6 {
+			return nil, http.StatusBadRequest, fmt.Errorf("precision must be 5 or 6")
+		}
+		pts, err := decodePolyline(req.Polyline, precision)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid polyline: %v", err)
+		}
+		route.Polyline = pts
+		if route.BufferMeters == 0 {
+			route.BufferMeters = corridorDefaultBuffer
+		}
+	case req.Route != "":
+		saved, err := loadSavedRoutes(s.db)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		for _, sr := range saved {
+			if strings.EqualFold(sr.Name, req.Route) {
+				route.Polyline = sr.Polyline
+				if route.BufferMeters == 0 {
+					route.BufferMeters = sr.BufferMeters
+				}
+			}
+		}
+		if route.Polyline == nil {
+			return nil, http.StatusNotFound, fmt.Errorf("no saved route %q with a polyline", req.Route)
+		}
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("polyline or route is required")
+	}
+	if len(route.Polyline) < 2 {
+		return nil, http.StatusBadRequest, fmt.Errorf("a route needs at least two points")
+	}
+	route.measure()
+	return route, http.StatusOK, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The wall-display dashboard under /dashboard/: a Leaflet map of the active
+// incidents that follows /stream. It only uses the public endpoints, so it
+// is served as plain static files from the binary.
+
+//go:embed web
+var webFiles embed.FS
+
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServerFS(files))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// With DEBUG_ENDPOINTS=true (or ingest -debug) the metrics listener also
+// serves the standard /debug/pprof profiles and /debug/status, a JSON
+// snapshot of goroutines, memory, sink queue depths and cache hit rates.
+// They're for chasing memory growth over a long storm, so keep the
+// listener off the public network.
+
+// debugStatus serves the debug endpoints for an ingest daemon.
+type debugStatus struct {
+	started time.Time
+	sinks   *sinkDispatcher
+}
+
+func newDebugStatus(sinks *sinkDispatcher) *debugStatus {
+	return &debugStatus{started: time.Now(), sinks: sinks}
+}
+
+func (d *debugStatus) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/status", d.handleStatus)
+}
+
+type cacheStatus struct {
+	Hits    float64 `json:"hits"`
+	Misses  float64 `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+func (d *debugStatus) handleStatus(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	caches := map[string]cacheStatus{}
+	for _, labels := range metricCacheLookups.labelValues() {
+		name := labels[0]
+		c := cacheStatus{Hits: metricCacheLookups.value(name, "hit"), Misses: metricCacheLookups.value(name, "miss")}
+		if total := c.Hits + c.Misses; total > 0 {
+			c.HitRate = c.Hits / total
+		}
+		caches[name] = c
+	}
+
+	ingestHealth.mu.Lock()
+	lastSuccess := ingestHealth.lastSuccess
+	ingestHealth.mu.Unlock()
+
+	status := map[string]interface{}{
+		"started":             d.started.Format(time.RFC3339),
+		"uptime":              time.Since(d.started).Round(time.Second).String(),
+		"go_version":          runtime.Version(),
+		"goroutines":          runtime.NumGoroutine(),
+		"last_successful_run": lastSuccess.Format(time.RFC3339),
+		"memory": map[string]interface{}{
+			"heap_alloc_bytes": mem.HeapAlloc,
+			"heap_inuse_bytes": mem.HeapInuse,
+			"heap_objects":     mem.HeapObjects,
+			"sys_bytes":        mem.Sys,
+			"gc_cycles":        mem.NumGC,
+			"gc_pause_total":   time.Duration(mem.PauseTotalNs).String(),
+			"next_gc_bytes":    mem.NextGC,
+		},
+		"sink_queues": d.sinks.queueDepths(),
+		"caches":      caches,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
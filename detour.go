@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Detour is a suggested route around a full closure.
+type Detour struct {
+	Router             string      `json:"router"`
+	Geometry           [][]float64 `json:"geometry"` // GeoJSON LineString coordinates
+	DistanceMeters     float64     `json:"distance_m"`
+	DurationSeconds    float64     `json:"duration_s"`
+	BaselineSeconds    float64     `json:"baseline_duration_s"`
+	AddedTravelSeconds float64     `json:"added_travel_s"`
+}
+
+// Router computes a route from origin to destination that avoids blocked,
+// along with the duration of the unobstructed route for comparison.
+type Router interface {
+	Name() string
+	Detour(ctx context.Context, origin, destination, blocked LatLon) (*Detour, error)
+}
+
+// newRouter builds the router selected by DETOUR_ROUTER.
+func newRouter(cfg *Config) (Router, error) {
+	client := &http.Client{Timeout: 15 * time.Second}
+	baseURL := strings.TrimSuffix(cfg.DetourRouterURL, "/")
+	if baseURL == "" {
+		return nil, fmt.Errorf("DETOUR_ROUTER_URL must be set when DETOUR_ROUTER is %q", cfg.DetourRouter)
+	}
+	switch strings.ToLower(cfg.DetourRouter) {
+	case "osrm":
+		return &osrmRouter{baseURL: baseURL, client: client}, nil
+	case "valhalla":
+		return &valhallaRouter{baseURL: baseURL, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown DETOUR_ROUTER %q (want osrm or valhalla)", cfg.DetourRouter)
+}
+
+// osrmRouter asks OSRM for alternatives and picks the one that stays
+// farthest from the closure, since OSRM cannot exclude arbitrary points.
+type osrmRouter struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (r *osrmRouter) Name() string { return "osrm" }
+
+func (r *osrmRouter) Detour(ctx context.Context, origin, destination, blocked LatLon) (*Detour, error) {
+	routeURL := fmt.Sprintf("%s/route/v1/driving/%.6f,%.6f;%.6f,%.6f?alternatives=3&overview=full&geometries=geojson",
+		r.baseURL, origin.Lon, origin.Lat, destination.Lon, destination.Lat)
+
+	var resp struct {
+		Code   string `json:"code"`
+		Routes []struct {
+			Distance float64 `json:"distance"`
+			Duration float64 `json:"duration"`
+			Geometry struct {
+				Coordinates [][]float64 `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"routes"`
+	}
+	if err := getJSON(ctx, r.client, newRateLimiter(0), routeURL, &resp); err != nil {
+		return nil, fmt.Errorf("OSRM route request failed: %w", err)
+	}
+	if resp.Code != "Ok" || len(resp.Routes) == 0 {
+		return nil, fmt.Errorf("OSRM returned no routes (code %q)", resp.Code)
+	}
+
+	// The fastest route is the baseline; it normally runs through the closure.
+	baseline := resp.Routes[0].Duration
+	best, bestClearance := -1, 0.0
+	for i, route := range resp.Routes {
+		clearance := minDistanceToLine(blocked, route.Geometry.Coordinates)
+		if clearance > bestClearance {
+			best, bestClearance = i, clearance
+		}
+	}
+	if best < 0 || bestClearance < 50 {
+		return nil, fmt.Errorf("OSRM found no alternative avoiding the closure")
+	}
+	route := resp.Routes[best]
+	return &Detour{
+		Router:             r.Name(),
+		Geometry:           route.Geometry.Coordinates,
+		DistanceMeters:     math.Round(route.Distance),
+		DurationSeconds:    math.Round(route.Duration),
+		BaselineSeconds:    math.Round(baseline),
+		AddedTravelSeconds: math.Round(route.Duration - baseline),
+	}, nil
+}
+
+// minDistanceToLine is the closest approach of a GeoJSON coordinate list to pt.
+func minDistanceToLine(pt LatLon, coords [][]float64) float64 {
+	pts := toLatLons(coords)
+	best := math.Inf(1)
+	for i := 1; i < len(pts); i++ {
+		if d, _ := pointSegmentDistance(pt, pts[i-1], pts[i]); d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// valhallaRouter uses Valhalla's exclude_locations to route around the
+// closure directly.
+type valhallaRouter struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (r *valhallaRouter) Name() string { return "valhalla" }
+
+type valhallaTrip struct {
+	Trip struct {
+		Legs []struct {
+			Shape string `json:"shape"`
+		} `json:"legs"`
+		Summary struct {
+			Length float64 `json:"length"` // kilometers
+			Time   float64 `json:"time"`   // seconds
+		} `json:"summary"`
+	} `json:"trip"`
+}
+
+func (r *valhallaRouter) route(ctx context.Context, origin, destination LatLon, exclude []LatLon) (*valhallaTrip, error) {
+	type loc struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	}
+	req := map[string]interface{}{
+		"locations": []loc{{origin.Lat, origin.Lon}, {destination.Lat, destination.Lon}},
+		"costing":   "auto",
+	}
+	if len(exclude) > 0 {
+		var ex []loc
+		for _, p := range exclude {
+			ex = append(ex, loc{p.Lat, p.Lon})
+		}
+		req["exclude_locations"] = ex
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", r.baseURL+"/route", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("valhalla returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var trip valhallaTrip
+	if err := json.Unmarshal(body, &trip); err != nil {
+		return nil, err
+	}
+	return &trip, nil
+}
+
+func (r *valhallaRouter) Detour(ctx context.Context, origin, destination, blocked LatLon) (*Detour, error) {
+	baseline, err := r.route(ctx, origin, destination, nil)
+	if err != nil {
+		return nil, fmt.Errorf("valhalla baseline route failed: %w", err)
+	}
+	detour, err := r.route(ctx, origin, destination, []LatLon{blocked})
+	if err != nil {
+		return nil, fmt.Errorf("valhalla detour route failed: %w", err)
+	}
+
+	var coords [][]float64
+	for _, leg := range detour.Trip.Legs {
+		pts, err := decodePolyline(leg.Shape, 6)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pts {
+			coords = append(coords, []float64{p.Lon, p.Lat})
+		}
+	}
+	return &Detour{
+		Router:             r.Name(),
+		Geometry:           coords,
+		DistanceMeters:     math.Round(detour.Trip.Summary.Length * 1000),
+		DurationSeconds:    math.Round(detour.Trip.Summary.Time),
+		BaselineSeconds:    math.Round(baseline.Trip.Summary.Time),
+		AddedTravelSeconds: math.Round(detour.Trip.Summary.Time - baseline.Trip.Summary.Time),
+	}, nil
+}
+
+// travelBearing maps an NCDOT direction ("N", "East", "SB", ...) to a
+// compass bearing. Loop directions and "All" have no single bearing.
+func travelBearing(direction string) (float64, bool) {
+	d := strings.ToUpper(strings.TrimSpace(direction))
+	if d == "" {
+		return 0, false
+	}
+	switch d[0] {
+	case 'N':
+		return 0, true
+	case 'E':
+		return 90, true
+	case 'S':
+		return 180, true
+	case 'W':
+		return 270, true
+	}
+	return 0, false
+}
+
+// detourEnricher computes a detour for full closures: it routes from a
+// point upstream of the closure to one downstream, avoiding the closure.
+type detourEnricher struct {
+	router       Router
+	offsetMeters float64
+}
+
+func (e *detourEnricher) Name() string { return "detour" }
+
+func (e *detourEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	if incident.LanesTotal == 0 || incident.LanesClosed < incident.LanesTotal {
+		return nil
+	}
+	bearing, ok := travelBearing(incident.Direction)
+	if !ok {
+		return nil
+	}
+	blocked := LatLon{Lat: incident.Latitude, Lon: incident.Longitude}
+	origin := destinationPoint(blocked, bearing+180, e.offsetMeters)
+	destination := destinationPoint(blocked, bearing, e.offsetMeters)
+
+	detour, err := e.router.Detour(ctx, origin, destination, blocked)
+	if err != nil {
+		return err
+	}
+	incident.Detour = detour
+	return nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Digest is the content of one email digest.
+type Digest struct {
+	Since, Until time.Time
+
+	Total     int
+	Corridors []DigestCorridor
+	Severe    []DigestIncident
+	LongOpen  []DigestIncident
+	Weather   DigestWeather
+}
+
+// DigestCorridor is a road ranked by incident count.
+type DigestCorridor struct {
+	Road      string
+	Incidents int
+	Active    int
+}
+
+// DigestIncident is one incident listed in the digest.
+type DigestIncident struct {
+	EventType string
+	Road      string
+	County    string
+	Address   string
+	Severity  int
+	Started   time.Time
+	Lanes     string
+	Summary   string
+	MapURL    string
+}
+
+// DigestWeather says how many of the period's incidents happened in
+// adverse weather, with the most common conditions.
+type DigestWeather struct {
+	Adverse    int
+	Conditions []string
+}
+
+// buildDigest gathers the digest for incidents that started in [since, until).
+func buildDigest(db *sql.DB, since, until time.Time, minSeverity int, longOpen time.Duration) (*Digest, error) {
+	d := &Digest{Since: since, Until: until}
+
+	if err := db.QueryRow(`SELECT count(*) FROM unified_incidents WHERE timestamp >= $1 AND timestamp < $2`,
+		since, until).Scan(&d.Total); err != nil {
+		return nil, fmt.Errorf("could not count incidents: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT road_normalized, count(*), count(*) FILTER (WHERE status = 'active')
+		FROM unified_incidents
+		WHERE timestamp >= $1 AND timestamp < $2 AND road_normalized IS NOT NULL
+		GROUP BY road_normalized
+		ORDER BY count(*) DESC, road_normalized
+		LIMIT 5`, since, until)
+	if err != nil {
+		return nil, fmt.Errorf("could not rank corridors: %w", err)
+	}
+	for rows.Next() {
+		var c DigestCorridor
+		if err := rows.Scan(&c.Road, &c.Incidents, &c.Active); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.Corridors = append(d.Corridors, c)
+	}
+	rows.Close()
+
+	const incidentColumns = `event_type, coalesce(road_normalized, ''), coalesce(county_name, ''), address,
+		coalesce(normalized_severity, 0), timestamp, coalesce(lanes_closed, 0), coalesce(lanes_total, 0),
+		coalesce(summary, ''), latitude, longitude`
+
+	if d.Severe, err = queryDigestIncidents(db, `
+		SELECT `+incidentColumns+` FROM unified_incidents
+		WHERE timestamp >= $1 AND timestamp < $2 AND normalized_severity >= $3
+		ORDER BY normalized_severity DESC, timestamp DESC
+		LIMIT 20`, since, until, minSeverity); err != nil {
+		return nil, err
+	}
+	if d.LongOpen, err = queryDigestIncidents(db, `
+		SELECT `+incidentColumns+` FROM unified_incidents
+		WHERE status = 'active' AND lanes_closed > 0 AND timestamp < $1
+		ORDER BY timestamp
+		LIMIT 20`, until.Add(-longOpen)); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT weather_forecast, count(*) FROM unified_incidents
+		WHERE timestamp >= $1 AND timestamp < $2 AND weather_forecast IS NOT NULL
+		GROUP BY weather_forecast`, since, until)
+	if err != nil {
+		return nil, fmt.Errorf("could not summarize weather: %w", err)
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var forecast string
+		var n int
+		if err := rows.Scan(&forecast, &n); err != nil {
+			return nil, err
+		}
+		if weatherRiskFactor(&WeatherData{ShortForecast: forecast}) > 1 {
+			d.Weather.Adverse += n
+			counts[forecast] = n
+		}
+	}
+	for f := range counts {
+		d.Weather.Conditions = append(d.Weather.Conditions, f)
+	}
+	sort.Slice(d.Weather.Conditions, func(i, j int) bool {
+		return counts[d.Weather.Conditions[i]] > counts[d.Weather.Conditions[j]]
+	})
+	if len(d.Weather.Conditions) > 3 {
+		d.Weather.Conditions = d.Weather.Conditions[:3]
+	}
+	return d, rows.Err()
+}
+
+func queryDigestIncidents(db *sql.DB, query string, args ...interface{}) ([]DigestIncident, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query digest incidents: %w", err)
+	}
+	defer rows.Close()
+
+	var incidents []DigestIncident
+	for rows.Next() {
+		var i DigestIncident
+		var closed, total int
+		var lat, lon float64
+		if err := rows.Scan(&i.EventType, &i.Road, &i.County, &i.Address, &i.Severity, &i.Started,
+			&closed, &total, &i.Summary, &lat, &lon); err != nil {
+			return nil, err
+		}
+		i.Lanes = lanesLabel(IncidentPayload{LanesClosed: closed, LanesTotal: total})
+		i.MapURL = mapURL(lat, lon)
+		incidents = append(incidents, i)
+	}
+	return incidents, rows.Err()
+}
+
+var digestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"local": localTimeLabel,
+	"join":  strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html><body style="font-family: sans-serif; color: #222;">
+<h2>Traffic incident digest</h2>
+<p>{{.Total}} incidents from {{local .Since}} to {{local .Until}}.
+{{- if .Weather.Adverse}} {{.Weather.Adverse}} happened in adverse weather ({{join .Weather.Conditions ", "}}).{{end}}</p>
+
+{{if .Corridors}}<h3>Top corridors</h3>
+<table cellpadding="4">
+<tr><th align="left">Road</th><th>Incidents</th><th>Still active</th></tr>
+{{range .Corridors}}<tr><td>{{.Road}}</td><td align="center">{{.Incidents}}</td><td align="center">{{.Active}}</td></tr>
+{{end}}</table>{{end}}
+
+<h3>New severe incidents</h3>
+{{if .Severe}}<ul>
+{{range .Severe}}<li><a href="{{.MapURL}}">{{.EventType}}{{if .Road}} on {{.Road}}{{end}}</a>{{if .County}}, {{.County}} County{{end}}
+ (severity {{.Severity}}/5, lanes {{.Lanes}}, started {{local .Started}})<br>{{if .Summary}}{{.Summary}}{{else}}{{.Address}}{{end}}</li>
+{{end}}</ul>{{else}}<p>None.</p>{{end}}
+
+<h3>Long-running lane closures still open</h3>
+{{if .LongOpen}}<ul>
+{{range .LongOpen}}<li><a href="{{.MapURL}}">{{.EventType}}{{if .Road}} on {{.Road}}{{end}}</a>{{if .County}}, {{.County}} County{{end}}
+ (lanes {{.Lanes}}, open since {{local .Started}})<br>{{.Address}}</li>
+{{end}}</ul>{{else}}<p>None.</p>{{end}}
+</body></html>
+`))
+
+// sendDigest renders the digest and emails it to every recipient.
+func sendDigest(cfg *Config, d *Digest) error {
+	var body bytes.Buffer
+	if err := digestTemplate.Execute(&body, d); err != nil {
+		return fmt.Errorf("could not render digest: %w", err)
+	}
+	subject := fmt.Sprintf("Traffic digest: %d incidents, %d severe", d.Total, len(d.Severe))
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.DigestRecipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n")
+	msg.Write(body.Bytes())
+
+	return sendMail(cfg, cfg.DigestRecipients, msg.Bytes())
+}
+
+// sendMail delivers through the configured SMTP server: STARTTLS on the
+// submission port, implicit TLS on 465.
+func sendMail(cfg *Config, to []string, msg []byte) error {
+	addr := net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort))
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	if cfg.SMTPPort != 465 {
+		return smtp.SendMail(addr, auth, cfg.SMTPFrom, to, msg)
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: cfg.SMTPHost})
+	if err != nil {
+		return fmt.Errorf("could not connect to SMTP server: %w", err)
+	}
+	c, err := smtp.NewClient(conn, cfg.SMTPHost)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.SMTPFrom); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// nextDigestTime returns the first of the daily "HH:MM" times (Eastern)
+// after now.
+func nextDigestTime(times []string, now time.Time) (time.Time, error) {
+	local := now.In(easternTime)
+	var next time.Time
+	for _, hhmm := range times {
+		t, err := time.ParseInLocation("15:04", hhmm, easternTime)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid DIGEST_TIMES entry %q: %w", hhmm, err)
+		}
+		candidate := time.Date(local.Year(), local.Month(), local.Day(), t.Hour(), t.Minute(), 0, 0, easternTime)
+		if !candidate.After(now) {
+			candidate = candidate.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || candidate.Before(next) {
+			next = candidate
+		}
+	}
+	if next.IsZero() {
+		return next, fmt.Errorf("DIGEST_TIMES is empty")
+	}
+	return next, nil
+}
+
+// runDigest implements the digest command. With -now it sends one digest
+// covering the lookback window and exits; otherwise it stays running and
+// sends one at each of DIGEST_TIMES.
+func runDigest(cfg *Config, db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	now := fs.Bool("now", false, "send one digest immediately and exit")
+	fs.Parse(args)
+
+	if cfg.SMTPHost == "" || cfg.SMTPFrom == "" || len(cfg.DigestRecipients) == 0 {
+		log.Fatalf("Error: SMTP_HOST, SMTP_FROM and DIGEST_RECIPIENTS must be set for digests")
+	}
+
+	send := func() {
+		until := time.Now()
+		d, err := buildDigest(db, until.Add(-cfg.DigestLookback), until, cfg.DigestMinSeverity, cfg.DigestLongOpen)
+		if err != nil {
+			logFor("digest").Error("Error building digest", "err", err)
+			return
+		}
+		if err := sendDigest(cfg, d); err != nil {
+			logFor("digest").Error("Error sending digest", "err", err)
+			return
+		}
+		logFor("digest").Info("Digest sent", "recipients", len(cfg.DigestRecipients), "incidents", d.Total, "severe", len(d.Severe))
+	}
+
+	if *now {
+		send()
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	for {
+		next, err := nextDigestTime(cfg.DigestTimes, time.Now())
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		logFor("digest").Info("Next digest scheduled", "at", localTimeLabel(next))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+			send()
+		}
+	}
+}
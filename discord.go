@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DiscordRoute sends incidents matching its rule to one channel's webhook,
+// so a server can have e.g. a #wake-county and an #i-40 channel:
+//
+//	[
+//	  {"name": "wake", "webhook_url": "https://discord.com/api/webhooks/...", "counties": ["Wake"]},
+//	  {"name": "i-40", "webhook_url": "https://discord.com/api/webhooks/...", "roads": ["I-40"]}
+//	]
+type DiscordRoute struct {
+	NotifyRule
+	WebhookURL string `json:"webhook_url"`
+}
+
+func loadDiscordRoutes(path string) ([]DiscordRoute, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read Discord routes: %w", err)
+	}
+	var routes []DiscordRoute
+	if err := json.Unmarshal(raw, &routes); err != nil {
+		return nil, fmt.Errorf("could not parse Discord routes %s: %w", path, err)
+	}
+	for i, r := range routes {
+		if r.Name == "" || r.WebhookURL == "" {
+			return nil, fmt.Errorf("Discord route %d needs a name and webhook_url", i+1)
+		}
+	}
+	return routes, nil
+}
+
+// discordSink posts an embed for each matching incident through a channel
+// webhook and edits that message as the incident changes, striking it
+// through once it clears.
+//
+// With a local map renderer the map is uploaded with the message as an
+// attachment; otherwise the STATIC_MAP_URL image is linked as a thumbnail.
+type discordSink struct {
+	db           *sql.DB
+	route        DiscordRoute
+	staticMapURL string
+	maps         *mapImager
+	client       *http.Client
+}
+
+func newDiscordSink(db *sql.DB, route DiscordRoute, staticMapURL string, maps *mapImager) *discordSink {
+	return &discordSink{db: db, route: route, staticMapURL: staticMapURL, maps: maps, client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (s *discordSink) Name() string { return "discord " + s.route.Name }
+func (s *discordSink) alerts()      {}
+
+func (s *discordSink) Publish(ctx context.Context, event IncidentEvent) error {
+	p := event.Incident
+	posted, err := loadNotificationMessage(s.db, s.Name(), p)
+	if err != nil {
+		return err
+	}
+	if posted == nil && (event.Change == ChangeCleared || (event.Rule == "" && !s.route.Matches(event))) {
+		return nil
+	}
+	msg := discordMessage{Embeds: []discordEmbed{s.embed(event)}}
+	var image []byte
+	if s.maps != nil && s.maps.renderer != nil && event.Change != ChangeCleared {
+		if image, err = s.maps.Image(ctx, p); err != nil {
+			logFor("sinks").Warn("Could not render map", "sink", s.Name(), "err", err)
+		} else {
+			msg.Embeds[0].Thumbnail = nil
+			msg.Embeds[0].Image = &discordImage{URL: "attachment://map.png"}
+			msg.Embeds[0].Footer.Text += " · " + mapAttribution
+			msg.Attachments = []discordAttachment{{ID: 0, Filename: "map.png"}}
+		}
+	}
+
+	if posted != nil {
+		return s.send(ctx, "PATCH", s.route.WebhookURL+"/messages/"+posted.MessageID, msg, image, nil)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := s.send(ctx, "POST", s.route.WebhookURL+"?wait=true", msg, image, &created); err != nil {
+		return err
+	}
+	return saveNotificationMessage(s.db, s.Name(), p, notificationMessage{Channel: s.route.Name, MessageID: created.ID})
+}
+
+type discordMessage struct {
+	Embeds      []discordEmbed      `json:"embeds"`
+	Attachments []discordAttachment `json:"attachments,omitempty"`
+}
+
+type discordAttachment struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename"`
+}
+
+type discordEmbed struct {
+	Title       string              `json:"title"`
+	URL         string              `json:"url,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Color       int                 `json:"color"`
+	Fields      []discordEmbedField `json:"fields,omitempty"`
+	Thumbnail   *discordImage       `json:"thumbnail,omitempty"`
+	Image       *discordImage       `json:"image,omitempty"`
+	Footer      *discordFooter      `json:"footer,omitempty"`
+	Timestamp   string              `json:"timestamp,omitempty"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordImage struct {
+	URL string `json:"url"`
+}
+
+type discordFooter struct {
+	Text string `json:"text"`
+}
+
+// Embed colors by normalized severity, green through red; cleared
+// incidents go grey.
+var discordSeverityColors = []int{0x2ecc71, 0x2ecc71, 0xf1c40f, 0xe67e22, 0xe74c3c, 0x992d22}
+
+const discordClearedColor = 0x95a5a6
+
+func (s *discordSink) embed(event IncidentEvent) discordEmbed {
+	p := event.Incident
+	e := discordEmbed{
+		Title:       truncate(incidentTitle(p), 256),
+		URL:         mapURL(p.Latitude, p.Longitude),
+		Description: truncate(firstNonEmpty(event.Message, incidentDescription(p)), 2000),
+		Color:       discordSeverityColors[max(0, min(5, p.NormalizedSeverity))],
+		Footer:      &discordFooter{Text: fmt.Sprintf("%s %s · %s", p.Source, p.SourceID, event.Change)},
+		Timestamp:   event.OccurredAt.Format(time.RFC3339),
+	}
+	if s.staticMapURL != "" {
+		e.Thumbnail = &discordImage{URL: staticMapImageURL(s.staticMapURL, p.Latitude, p.Longitude)}
+	}
+
+	if event.Change == ChangeCleared {
+		e.Title = "[Cleared] " + truncate(incidentTitle(p), 240)
+		e.Description = "~~" + truncate(incidentDescription(p), 1900) + "~~\nCleared at " + localTimeLabel(event.OccurredAt)
+		e.Color = discordClearedColor
+		return e
+	}
+	e.Fields = []discordEmbedField{
+		{Name: "Road", Value: orDash(firstNonEmpty(p.RoadNormalized, p.Road)), Inline: true},
+		{Name: "Severity", Value: severityLabel(p), Inline: true},
+		{Name: "Lanes", Value: lanesLabel(p), Inline: true},
+		{Name: "Weather", Value: weatherLabel(p.Weather), Inline: true},
+		{Name: "Started", Value: localTimeLabel(p.StartTime), Inline: true},
+	}
+	return e
+}
+
+// send makes a webhook request, as multipart with the image attached if
+// there is one.
+func (s *discordSink) send(ctx context.Context, method, url string, msg discordMessage, image []byte, out interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return permanentError{err}
+	}
+	contentType := "application/json"
+	if image != nil {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		w.WriteField("payload_json", string(payload))
+		part, err := w.CreateFormFile("files[0]", "map.png")
+		if err != nil {
+			return permanentError{err}
+		}
+		part.Write(image)
+		w.Close()
+		payload, contentType = body.Bytes(), w.FormDataContentType()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("discord request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("discord returned %s: %s", resp.Status, truncate(string(body), 200))
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return err
+		}
+		return permanentError{err}
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("failed to unmarshal discord response: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Enricher adds derived or looked-up data to an incident before it is saved.
+// An enricher failing is never fatal: the incident is stored with whatever
+// the other enrichers produced.
+type Enricher interface {
+	Name() string
+	Enrich(ctx context.Context, incident *UnifiedIncident) error
+}
+
+// runEnrichers applies each enricher in order, logging failures.
+func runEnrichers(ctx context.Context, enrichers []Enricher, incident *UnifiedIncident) {
+	for _, e := range enrichers {
+		start := time.Now()
+		spanCtx, span := tracer.Start(ctx, "enrich "+e.Name())
+		err := e.Enrich(spanCtx, incident)
+		endSpan(span, err)
+		metricEnrichDuration.since(start, e.Name())
+		if err != nil {
+			metricEnrichErrors.inc(e.Name())
+			runLog(ctx, "enrich").Warn("Enrichment failed", "enricher", e.Name(), "source", incident.Source, "incident_id", incident.SourceID, "err", err)
+		}
+	}
+}
+
+// reporter is implemented by enrichers that have something to say in the
+// end-of-run report.
+type reporter interface {
+	Report() string
+}
+
+// runScoped is implemented by enrichers that keep per-run state; BeginRun
+// is called before each ingest run.
+type runScoped interface {
+	BeginRun()
+}
+
+// buildEnrichers assembles the enrichment pipeline from configuration.
+func buildEnrichers(cfg *Config, db *sql.DB) ([]Enricher, error) {
+	classifier, err := newClassifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	eventTypes, err := newEventTypeEnricher(db)
+	if err != nil {
+		return nil, err
+	}
+
+	enrichers := []Enricher{
+		timeEnricher{},
+		eventTypes,
+		&classifyEnricher{classifier: classifier},
+		roadNameEnricher{},
+		darknessEnricher{},
+		newWeatherEnricher(cfg.WeatherGridDegrees, nwsTimeouts{points: cfg.NWSPointsTimeout, hourly: cfg.NWSHourlyTimeout}),
+	}
+
+	validator, err := newLocationValidationEnricher(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if validator != nil {
+		enrichers = append(enrichers, validator)
+	}
+
+	if cfg.Geocoder != "" {
+		geocoder, err := newGeocoder(cfg)
+		if err != nil {
+			return nil, err
+		}
+		enrichers = append(enrichers, &geocodeEnricher{geocoder: geocoder, cache: &dbGeocodeCache{db: db}, ttl: cfg.GeocodeCacheTTL})
+	}
+
+	if cfg.RoadNetworkFile != "" {
+		network, err := loadRoadNetwork(cfg.RoadNetworkFile)
+		if err != nil {
+			return nil, err
+		}
+		enrichers = append(enrichers, &roadMatchEnricher{network: network, maxMeters: cfg.RoadMatchMaxMeters})
+	}
+
+	if cfg.RouteGeometryFile != "" {
+		routes, err := loadRouteGeometries(cfg.RouteGeometryFile)
+		if err != nil {
+			return nil, err
+		}
+		enrichers = append(enrichers, &milepostEnricher{routes: routes, maxMeters: cfg.MilepostMaxMeters})
+	}
+
+	proximity, err := newProximityEnricher(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if proximity != nil {
+		enrichers = append(enrichers, proximity)
+	}
+
+	if cfg.DetourRouter != "" {
+		router, err := newRouter(cfg)
+		if err != nil {
+			return nil, err
+		}
+		enrichers = append(enrichers, &detourEnricher{router: router, offsetMeters: cfg.DetourOffsetMeters})
+	}
+
+	if cfg.TrafficFlowProvider != "" {
+		provider, err := newTrafficFlowProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+		enrichers = append(enrichers, &trafficFlowEnricher{provider: provider})
+	}
+
+	if cfg.AirNowAPIKey != "" {
+		enrichers = append(enrichers, newAirNowEnricher(cfg))
+	}
+
+	routes, err := loadSavedRoutes(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) > 0 {
+		enrichers = append(enrichers, &routeImpactEnricher{routes: routes})
+	}
+
+	scale, err := loadSeverityScale(db)
+	if err != nil {
+		return nil, err
+	}
+	enrichers = append(enrichers, &riskEnricher{scale: scale})
+
+	// Summaries go last so they can use everything the others found.
+	if cfg.LLMAPIURL != "" {
+		enrichers = append(enrichers, newSummaryEnricher(cfg, db))
+	}
+
+	return enrichers, nil
+}
+
+// timeEnricher tags the incident with its traffic period and holiday flag.
+type timeEnricher struct{}
+
+func (timeEnricher) Name() string { return "time" }
+
+func (timeEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	incident.Period = classifyTime(incident.Timestamp)
+	return nil
+}
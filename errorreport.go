@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/lib/pq"
+)
+
+// Errors worth a person's attention (failed runs, feeds that won't
+// decode, rows Postgres rejects) and panics are reported to Sentry when
+// SENTRY_DSN is set, with an excerpt of the offending payload attached.
+// The same kind of error is reported at most once per
+// ERROR_REPORT_INTERVAL, with a count of how often it happened, so a
+// broken feed doesn't send an event every poll.
+
+// errorPayloadExcerpt is how much of a payload is attached.
+const errorPayloadExcerpt = 8 << 10
+
+var errorReports struct {
+	enabled  bool
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+	seen map[string]int
+}
+
+// setupErrorReporting starts the Sentry client if a DSN is configured.
+func setupErrorReporting(cfg *Config) error {
+	if cfg.SentryDSN == "" {
+		return nil
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:         cfg.SentryDSN,
+		Environment: cfg.SentryEnvironment,
+	})
+	if err != nil {
+		return err
+	}
+	errorReports.enabled = true
+	errorReports.interval = cfg.ErrorReportInterval
+	errorReports.last = map[string]time.Time{}
+	errorReports.seen = map[string]int{}
+	return nil
+}
+
+// feedDecodeError is a feed that wouldn't decode, with the body that
+// didn't.
+type feedDecodeError struct {
+	source string
+	body   []byte
+	err    error
+}
+
+func (e feedDecodeError) Error() string { return e.err.Error() }
+func (e feedDecodeError) Unwrap() error { return e.err }
+
+// errorKind groups an error for throttling and for Sentry's fingerprint.
+func errorKind(kind string, err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return kind + ":pq-" + string(pqErr.Code)
+	}
+	return kind
+}
+
+// reportError sends err to Sentry, unless its kind was reported within the
+// interval. payload, if any, is attached as an excerpt.
+func reportError(ctx context.Context, kind string, err error, tags map[string]string, payload []byte) {
+	if !errorReports.enabled || err == nil {
+		return
+	}
+	key := errorKind(kind, err)
+	errorReports.mu.Lock()
+	errorReports.seen[key]++
+	if time.Since(errorReports.last[key]) < errorReports.interval {
+		errorReports.mu.Unlock()
+		return
+	}
+	occurrences := errorReports.seen[key]
+	errorReports.last[key] = time.Now()
+	errorReports.seen[key] = 0
+	errorReports.mu.Unlock()
+
+	hub := sentry.CurrentHub().Clone()
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetFingerprint([]string{key})
+		scope.SetTag("kind", kind)
+		for k, v := range tags {
+			scope.SetTag(k, v)
+		}
+		if id, ok := ctx.Value(runIDKey{}).(string); ok {
+			scope.SetTag("run_id", id)
+		}
+		scope.SetExtra("occurrences_since_last_report", occurrences)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) {
+			scope.SetContext("postgres", sentry.Context{
+				"code":       string(pqErr.Code),
+				"condition":  pqErr.Code.Name(),
+				"table":      pqErr.Table,
+				"column":     pqErr.Column,
+				"constraint": pqErr.Constraint,
+				"detail":     pqErr.Detail,
+			})
+		}
+		if len(payload) > 0 {
+			scope.AddAttachment(&sentry.Attachment{
+				Filename:    "payload.txt",
+				ContentType: "text/plain",
+				Payload:     payload[:min(len(payload), errorPayloadExcerpt)],
+			})
+		}
+		hub.CaptureException(err)
+	})
+	// Runs are often one-shot from cron, so don't leave it queued.
+	hub.Flush(5 * time.Second)
+}
+
+// reportPanic sends a recovered panic to Sentry. The caller re-panics.
+func reportPanic(ctx context.Context, recovered interface{}) {
+	if !errorReports.enabled {
+		return
+	}
+	hub := sentry.CurrentHub().Clone()
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetLevel(sentry.LevelFatal)
+		if id, ok := ctx.Value(runIDKey{}).(string); ok {
+			scope.SetTag("run_id", id)
+		}
+		hub.Recover(recovered)
+	})
+	hub.Flush(5 * time.Second)
+}
+
+// incidentExcerpt is the source record of an incident, for attaching.
+func incidentExcerpt(u *UnifiedIncident) []byte {
+	data, err := json.MarshalIndent(u.Raw, "", "  ")
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+)
+
+// Each event sent to a sink carries an ID derived from the incident and the
+// version of it the event describes: a UUIDv5 of source, source_id, the
+// source's lastUpdate and the change. Re-ingesting the same feed, a
+// backfill say, produces the same IDs, so consumers can drop events they
+// have already seen. Clears, re-opens and hand edits also hash the time
+// they happened: an incident can drop out of the feed and come back, or be
+// corrected by an operator, without its lastUpdate moving, and each of
+// those is news. Webhooks send it as X-Ingester-Event-Id as well as in
+// the body, NATS as the message ID and Kafka as event_id.
+
+// eventIDNamespace is the UUIDv5 namespace of event IDs. Changing it
+// changes every ID.
+var eventIDNamespace = [16]byte{0x6b, 0x1e, 0x3f, 0x52, 0x0c, 0x8d, 0x4a, 0x27, 0x9e, 0x41, 0x5d, 0xa3, 0x70, 0x2f, 0xc6, 0x18}
+
+// eventID is the event's deterministic UUID. Events with no lastUpdate,
+// such as analytics findings, are keyed by incident and change alone.
+func eventID(event IncidentEvent) string {
+	p := event.Incident
+	// The stamp is normalized as at ingest: events built from the database
+	// carry the feed's raw lastUpdate.
+	version := p.SourceUpdated
+	if t, err := parseFeedTime(version); err == nil && !t.IsZero() {
+		version = t.Format(time.RFC3339)
+	}
+	parts := []string{p.Source, p.SourceID, version, string(event.Change)}
+	if event.Change == ChangeCleared || event.Reopened || event.ChangedBy != "" {
+		parts = append(parts, event.OccurredAt.UTC().Format(time.RFC3339Nano))
+	}
+	h := sha1.New()
+	h.Write(eventIDNamespace[:])
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// eventTypeEnricher maps each source's event type onto the unified
+// taxonomy using the event_type_mappings table. Types with no mapping pass
+// through unchanged (or go to the classifier for free-text sources) and are
+// listed in the run report so someone can add a row for them. The
+// mappings are reloaded at the start of each run, so rows added in the
+// meantime take effect without a restart: for new incidents, and for
+// existing ones the next time they are saved (with INGEST_SKIP_UNCHANGED,
+// once the source changes them). `enrich -enrichers event-type` brings the
+// rest up to date.
+type eventTypeEnricher struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	mappings map[string]map[string]string
+	unmapped map[string]int
+}
+
+func newEventTypeEnricher(db *sql.DB) (*eventTypeEnricher, error) {
+	mappings, err := loadEventTypeMappings(db)
+	if err != nil {
+		return nil, err
+	}
+	return &eventTypeEnricher{db: db, mappings: mappings, unmapped: map[string]int{}}, nil
+}
+
+// loadEventTypeMappings reads event_type_mappings, keyed by source and
+// lower-cased source type.
+func loadEventTypeMappings(db *sql.DB) (map[string]map[string]string, error) {
+	rows, err := db.Query(`SELECT source, source_event_type, unified_event_type FROM event_type_mappings`)
+	if err != nil {
+		return nil, fmt.Errorf("could not load event type mappings: %w", err)
+	}
+	defer rows.Close()
+
+	mappings := map[string]map[string]string{}
+	for rows.Next() {
+		var source, from, to string
+		if err := rows.Scan(&source, &from, &to); err != nil {
+			return nil, err
+		}
+		if mappings[source] == nil {
+			mappings[source] = map[string]string{}
+		}
+		mappings[source][strings.ToLower(from)] = to
+	}
+	return mappings, rows.Err()
+}
+
+func (e *eventTypeEnricher) Name() string { return "event-type" }
+
+// BeginRun starts a fresh unmapped tally and reloads the mappings, keeping
+// the old ones if that fails.
+func (e *eventTypeEnricher) BeginRun() {
+	mappings, err := loadEventTypeMappings(e.db)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.unmapped = map[string]int{}
+	if err != nil {
+		logFor("enrich").Warn("Keeping the previous event type mappings", "err", err)
+		return
+	}
+	e.mappings = mappings
+}
+
+func (e *eventTypeEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if unified, ok := e.mappings[incident.Source][strings.ToLower(incident.RawEventType)]; ok {
+		incident.EventType = unified
+		incident.EventTypeMapped = true
+		return nil
+	}
+	e.unmapped[incident.Source+": "+incident.RawEventType]++
+	return nil
+}
+
+// Report lists the event types seen this run that had no mapping.
+func (e *eventTypeEnricher) Report() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.unmapped) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(e.unmapped))
+	for k := range e.unmapped {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%q x%d", k, e.unmapped[k])
+	}
+	return "unmapped event types: " + strings.Join(parts, ", ")
+}
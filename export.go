@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type incidentFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []incidentFeature `json:"features"`
+}
+
+type incidentFeature struct {
+	Type       string             `json:"type"`
+	ID         string             `json:"id"`
+	Geometry   geoJSONPoint       `json:"geometry"`
+	Properties incidentProperties `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// incidentProperties is the payload with details left out unless they
+// were asked for.
+type incidentProperties struct {
+	IncidentPayload
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func incidentFeatures(incidents []IncidentPayload) incidentFeatureCollection {
+	fc := incidentFeatureCollection{Type: "FeatureCollection", Features: []incidentFeature{}}
+	for _, p := range incidents {
+		fc.Features = append(fc.Features, incidentFeature{
+			Type:       "Feature",
+			ID:         strings.ToLower(p.Source) + "-" + p.SourceID,
+			Geometry:   geoJSONPoint{Type: "Point", Coordinates: []float64{p.Longitude, p.Latitude}},
+			Properties: incidentProperties{IncidentPayload: p, Details: p.Details},
+		})
+	}
+	return fc
+}
+
+// exportColumn is one column of a tabular (CSV or Parquet) export. value
+// returns nil for a null.
+type exportColumn struct {
+	name  string
+	kind  columnKind
+	value func(p IncidentPayload) interface{}
+}
+
+// detailValue looks up a nested value in the details JSON.
+func detailValue(p IncidentPayload, path ...string) interface{} {
+	var v interface{} = p.Details
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func detailString(path ...string) func(IncidentPayload) interface{} {
+	return func(p IncidentPayload) interface{} {
+		if s, ok := detailValue(p, path...).(string); ok && s != "" {
+			return s
+		}
+		return nil
+	}
+}
+
+func detailFloat(path ...string) func(IncidentPayload) interface{} {
+	return func(p IncidentPayload) interface{} {
+		if n, ok := detailValue(p, path...).(float64); ok {
+			return n
+		}
+		return nil
+	}
+}
+
+func detailInt(path ...string) func(IncidentPayload) interface{} {
+	return func(p IncidentPayload) interface{} {
+		if n, ok := detailValue(p, path...).(float64); ok {
+			return int64(n)
+		}
+		return nil
+	}
+}
+
+func detailBool(path ...string) func(IncidentPayload) interface{} {
+	return func(p IncidentPayload) interface{} {
+		if b, ok := detailValue(p, path...).(bool); ok {
+			return b
+		}
+		return nil
+	}
+}
+
+// exportColumns are the tabular export's columns: the payload's typed
+// fields, then a selection flattened out of the details JSON.
+var exportColumns = []exportColumn{
+	{"source", kindString, func(p IncidentPayload) interface{} { return p.Source }},
+	{"source_id", kindString, func(p IncidentPayload) interface{} { return p.SourceID }},
+	{"event_type", kindString, func(p IncidentPayload) interface{} { return p.EventType }},
+	{"status", kindString, func(p IncidentPayload) interface{} { return p.Status }},
+	{"address", kindString, func(p IncidentPayload) interface{} { return p.Address }},
+	{"city", kindString, func(p IncidentPayload) interface{} { return p.City }},
+	{"county", kindString, func(p IncidentPayload) interface{} { return p.County }},
+	{"road", kindString, func(p IncidentPayload) interface{} { return p.Road }},
+	{"road_normalized", kindString, func(p IncidentPayload) interface{} { return p.RoadNormalized }},
+	{"direction", kindString, func(p IncidentPayload) interface{} { return p.Direction }},
+	{"latitude", kindFloat, func(p IncidentPayload) interface{} { return p.Latitude }},
+	{"longitude", kindFloat, func(p IncidentPayload) interface{} { return p.Longitude }},
+	{"start_time", kindTime, func(p IncidentPayload) interface{} { return p.StartTime }},
+	{"end_time", kindTime, func(p IncidentPayload) interface{} {
+		if p.EndTime == nil {
+			return nil
+		}
+		return *p.EndTime
+	}},
+	{"problem_detail", kindString, func(p IncidentPayload) interface{} { return p.ProblemDetail }},
+	{"severity", kindInt, func(p IncidentPayload) interface{} { return int64(p.Severity) }},
+	{"normalized_severity", kindInt, func(p IncidentPayload) interface{} { return int64(p.NormalizedSeverity) }},
+	{"risk_score", kindFloat, func(p IncidentPayload) interface{} { return p.RiskScore }},
+	{"lanes_closed", kindInt, func(p IncidentPayload) interface{} { return int64(p.LanesClosed) }},
+	{"lanes_total", kindInt, func(p IncidentPayload) interface{} { return int64(p.LanesTotal) }},
+	{"source_updated", kindString, func(p IncidentPayload) interface{} { return p.SourceUpdated }},
+	{"summary", kindString, func(p IncidentPayload) interface{} { return p.Summary }},
+	{"weather_temp", kindInt, func(p IncidentPayload) interface{} {
+		if p.Weather == nil {
+			return nil
+		}
+		return int64(p.Weather.Temperature)
+	}},
+	{"weather_wind_speed", kindString, func(p IncidentPayload) interface{} {
+		if p.Weather == nil {
+			return nil
+		}
+		return p.Weather.WindSpeed
+	}},
+	{"weather_forecast", kindString, func(p IncidentPayload) interface{} {
+		if p.Weather == nil {
+			return nil
+		}
+		return p.Weather.ShortForecast
+	}},
+	{"milepost_route", kindString, detailString("milepost", "route")},
+	{"milepost", kindFloat, detailFloat("milepost", "milepost")},
+	{"road_class", kindString, detailString("road_match", "road_class")},
+	{"speed_limit_mph", kindInt, detailInt("road_match", "speed_limit_mph")},
+	{"traffic_speed_ratio", kindFloat, detailFloat("traffic_flow", "speed_ratio")},
+	{"air_quality_aqi", kindInt, detailInt("air_quality", "aqi")},
+	{"classified_event_type", kindString, detailString("classification", "event_type")},
+	{"school_zone", kindBool, detailBool("proximity", "school_zone")},
+}
+
+func exportCSV(w io.Writer, incidents []IncidentPayload) error {
+	cw := csv.NewWriter(w)
+	header := make([]string, len(exportColumns))
+	for i, c := range exportColumns {
+		header[i] = c.name
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	record := make([]string, len(exportColumns))
+	for _, p := range incidents {
+		for i, c := range exportColumns {
+			switch v := c.value(p).(type) {
+			case nil:
+				record[i] = ""
+			case string:
+				record[i] = v
+			case int64:
+				record[i] = strconv.FormatInt(v, 10)
+			case float64:
+				record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				record[i] = strconv.FormatBool(v)
+			case time.Time:
+				record[i] = v.UTC().Format(time.RFC3339)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportParquet(w io.Writer, incidents []IncidentPayload) error {
+	columns := make([]parquetColumn, len(exportColumns))
+	for i, c := range exportColumns {
+		columns[i] = parquetColumn{name: c.name, kind: c.kind, values: make([]interface{}, len(incidents))}
+		for j, p := range incidents {
+			columns[i].values[j] = c.value(p)
+		}
+	}
+	return writeParquet(w, columns)
+}
+
+// exportFilter is parseIncidentFilter with active incidents as the default;
+// status=all lifts that.
+func exportFilter(q url.Values) (incidentFilter, error) {
+	f, err := parseIncidentFilter(q)
+	if err != nil {
+		return f, err
+	}
+	switch strings.ToLower(f.Status) {
+	case "":
+		f.Status = StatusActive
+	case "all":
+		f.Status = ""
+	case StatusActive, StatusCleared:
+		f.Status = strings.ToLower(f.Status)
+	default:
+		return f, fmt.Errorf("invalid status %q", f.Status)
+	}
+	f.WithDetails = q.Get("details") == "true" || q.Get("details") == "1"
+	return f, nil
+}
+
+// handleGeoJSON serves incidents as a GeoJSON FeatureCollection, active
+// ones unless ?status= says otherwise, with the usual incident filters.
+func (s *server) handleGeoJSON(w http.ResponseWriter, r *http.Request) {
+	f, err := exportFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	incidents, err := queryIncidents(r.Context(), s.db, f)
+	if err != nil {
+		logFor("api").Error("Error loading incidents for GeoJSON", "err", err)
+		http.Error(w, "could not load incidents", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "application/geo+json", incidentFeatures(incidents))
+}
+
+// runExport writes incidents to a file or stdout:
+//
+//	export -format geojson -county Wake -o wake.geojson
+//	export -format parquet -since 2024-01-01 -until 2024-07-01 -o h1.parquet
+//
+// GeoJSON defaults to active incidents, CSV and Parquet to all of them.
+func runExport(cfg *Config, db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "geojson", "output format: geojson, csv or parquet")
+	output := fs.String("o", "-", "file to write, or - for stdout")
+	// These mirror the HTTP filter parameters.
+	q := url.Values{}
+	for _, name := range []string{"county", "road", "event_type", "status", "bbox", "since", "until", "limit"} {
+		fs.Func(name, "filter by "+name+" (as the HTTP API's query parameter)", func(v string) error {
+			q.Set(name, v)
+			return nil
+		})
+	}
+	details := fs.Bool("details", false, "include the details JSON")
+	fs.Parse(args)
+	if *details {
+		q.Set("details", "true")
+	}
+	tabular := *format == "csv" || *format == "parquet"
+	if tabular && q.Get("status") == "" {
+		q.Set("status", "all")
+	}
+
+	f, err := exportFilter(q)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	// The tabular formats flatten columns out of the details.
+	f.WithDetails = f.WithDetails || tabular
+
+	var write func(io.Writer, []IncidentPayload) error
+	switch *format {
+	case "geojson":
+		write = func(w io.Writer, incidents []IncidentPayload) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(incidentFeatures(incidents))
+		}
+	case "csv":
+		write = exportCSV
+	case "parquet":
+		write = exportParquet
+	default:
+		log.Fatalf("Unknown export format %q", *format)
+	}
+
+	incidents, err := queryIncidents(context.Background(), db, f)
+	if err != nil {
+		log.Fatalf("Error exporting incidents: %s", err)
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+	}
+	w := bufio.NewWriter(out)
+	if err := write(w, incidents); err != nil {
+		log.Fatalf("Error writing export: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Error writing export: %s", err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalf("Error writing export: %s", err)
+	}
+	logFor("export").Info("Exported incidents", "count", len(incidents))
+}
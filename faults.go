@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Fault injection is for chaos testing: seeing retries, quarantine and
+// the sink outbox do their jobs before a storm needs them to. It is
+// configured with environment variables that aren't otherwise documented:
+//
+//	FAULT_NWS_DROP=0.2        a fifth of NWS requests get a 503
+//	FAULT_DB_DELAY=500ms      every incident upsert waits this long first
+//	FAULT_FEED_MALFORMED=0.5  half the feed fetches come back truncated
+//
+// A warning is logged at startup whenever any is set. Never set them in
+// production.
+
+// faultConfig is what to inject; the zero value injects nothing.
+type faultConfig struct {
+	nwsDrop       float64
+	dbDelay       time.Duration
+	feedMalformed float64
+}
+
+var faults faultConfig
+
+func (f faultConfig) active() bool {
+	return f.nwsDrop > 0 || f.dbDelay > 0 || f.feedMalformed > 0
+}
+
+// setupFaults turns on the configured faults. It must come before
+// setupHTTPClient, which puts faultTransport under the retries.
+func setupFaults(cfg *Config) {
+	faults = faultConfig{nwsDrop: cfg.FaultNWSDrop, dbDelay: cfg.FaultDBDelay, feedMalformed: cfg.FaultFeedMalformed}
+	if !faults.active() {
+		return
+	}
+	logFor("faults").Warn("Fault injection is on",
+		"nws_drop", faults.nwsDrop, "db_delay", faults.dbDelay.String(), "feed_malformed", faults.feedMalformed)
+}
+
+// faultTransport fails NWS requests below the retrying transport, so the
+// retries and breaker see them as real failures.
+type faultTransport struct {
+	next http.RoundTripper
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	nws, err := url.Parse(nwsBaseURL)
+	if err == nil && req.URL.Host == nws.Host && rand.Float64() < faults.nwsDrop {
+		logFor("faults").Debug("Dropping NWS request", "url", req.URL.String())
+		return &http.Response{
+			Status:     "503 Service Unavailable (injected)",
+			StatusCode: http.StatusServiceUnavailable,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+// delayDBWrite holds up an upsert by FAULT_DB_DELAY.
+func delayDBWrite() {
+	if faults.dbDelay > 0 {
+		time.Sleep(faults.dbDelay)
+	}
+}
+
+// malformFeed cuts a feed body off partway, FAULT_FEED_MALFORMED of the
+// time, leaving JSON that doesn't parse.
+func malformFeed(body io.ReadCloser) io.ReadCloser {
+	if faults.feedMalformed <= 0 || rand.Float64() >= faults.feedMalformed {
+		return body
+	}
+	defer body.Close()
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return io.NopCloser(bytes.NewReader(nil))
+	}
+	logFor("faults").Debug("Truncating the feed", "bytes", len(raw), "kept", len(raw)/2)
+	return io.NopCloser(bytes.NewReader(raw[:len(raw)/2]))
+}
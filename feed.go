@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Active-incident feeds for consumers that can't talk to the database or
+// the API: GET /feed.rss and /feed.atom, statewide or narrowed with
+// ?county= and/or ?road= (or any other incident filter). Items carry
+// GeoRSS points.
+
+const (
+	georssNS       = "http://www.georss.org/georss"
+	atomNS         = "http://www.w3.org/2005/Atom"
+	feedMaxEntries = 200
+)
+
+type rssFeed struct {
+	XMLName  xml.Name   `xml:"rss"`
+	Version  string     `xml:"version,attr"`
+	GeoRSSNS string     `xml:"xmlns:georss,attr"`
+	AtomNS   string     `xml:"xmlns:atom,attr"`
+	Channel  rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	TTL           int       `xml:"ttl"`
+	Self          atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Category    string  `xml:"category,omitempty"`
+	Point       string  `xml:"georss:point"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"feed"`
+	NS       string      `xml:"xmlns,attr"`
+	GeoRSSNS string      `xml:"xmlns:georss,attr"`
+	ID       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Updated  string      `xml:"updated"`
+	Link     atomLink    `xml:"link"`
+	Author   atomAuthor  `xml:"author"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Updated   string       `xml:"updated"`
+	Published string       `xml:"published"`
+	Link      atomLink     `xml:"link"`
+	Summary   string       `xml:"summary"`
+	Category  atomCategory `xml:"category"`
+	Point     string       `xml:"georss:point"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func feedTitle(f incidentFilter) string {
+	switch {
+	case f.County != "" && f.Road != "":
+		return fmt.Sprintf("Active incidents on %s in %s County", f.Road, f.County)
+	case f.County != "":
+		return "Active incidents in " + f.County + " County"
+	case f.Road != "":
+		return "Active incidents on " + f.Road
+	}
+	return "Active NC traffic incidents"
+}
+
+// feedIncidents loads the active incidents a feed request asks for.
+func (s *server) feedIncidents(w http.ResponseWriter, r *http.Request) (incidentFilter, []IncidentPayload, bool) {
+	f, err := parseIncidentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return f, nil, false
+	}
+	f.Status = StatusActive
+	if f.Limit == 0 || f.Limit > feedMaxEntries {
+		f.Limit = feedMaxEntries
+	}
+	incidents, err := queryIncidents(r.Context(), s.db, f)
+	if err != nil {
+		logFor("api").Error("Error loading feed incidents", "err", err)
+		http.Error(w, "could not load incidents", http.StatusInternalServerError)
+		return f, nil, false
+	}
+	return f, incidents, true
+}
+
+// requestURL reconstructs the URL a request was made to, for self links.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	// RequestURI, unlike URL, keeps any API_BASE_PATH prefix.
+	return scheme + "://" + r.Host + r.RequestURI
+}
+
+// incidentUpdated is the incident's last change as best we know it.
+func incidentUpdated(p IncidentPayload) time.Time {
+	if t, err := time.Parse(time.RFC3339, p.SourceUpdated); err == nil {
+		return t
+	}
+	return p.StartTime
+}
+
+func geoRSSPoint(p IncidentPayload) string {
+	return fmt.Sprintf("%.5f %.5f", p.Latitude, p.Longitude)
+}
+
+func feedDescription(p IncidentPayload) string {
+	return fmt.Sprintf("%s\nLanes %s · Severity %s", incidentDescription(p), lanesLabel(p), severityLabel(p))
+}
+
+func (s *server) handleRSS(w http.ResponseWriter, r *http.Request) {
+	f, incidents, ok := s.feedIncidents(w, r)
+	if !ok {
+		return
+	}
+	self := requestURL(r)
+	feed := rssFeed{
+		Version:  "2.0",
+		GeoRSSNS: georssNS,
+		AtomNS:   atomNS,
+		Channel: rssChannel{
+			Title:         feedTitle(f),
+			Link:          self,
+			Description:   feedTitle(f) + " from the NCDOT feed.",
+			LastBuildDate: time.Now().Format(time.RFC1123Z),
+			TTL:           5,
+			Self:          atomLink{Href: self, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	for _, p := range incidents {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       incidentTitle(p),
+			Link:        mapURL(p.Latitude, p.Longitude),
+			Description: feedDescription(p),
+			GUID:        rssGUID{Value: strings.ToLower(p.Source) + "-" + p.SourceID},
+			PubDate:     p.StartTime.Format(time.RFC1123Z),
+			Category:    p.EventType,
+			Point:       geoRSSPoint(p),
+		})
+	}
+	writeXML(w, "application/rss+xml; charset=utf-8", feed)
+}
+
+func (s *server) handleAtom(w http.ResponseWriter, r *http.Request) {
+	f, incidents, ok := s.feedIncidents(w, r)
+	if !ok {
+		return
+	}
+	updated := time.Time{}
+	for _, p := range incidents {
+		if t := incidentUpdated(p); t.After(updated) {
+			updated = t
+		}
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	self := requestURL(r)
+	feed := atomFeed{
+		NS:       atomNS,
+		GeoRSSNS: georssNS,
+		ID:       self,
+		Title:    feedTitle(f),
+		Updated:  updated.UTC().Format(time.RFC3339),
+		Link:     atomLink{Href: self, Rel: "self", Type: "application/atom+xml"},
+		Author:   atomAuthor{Name: "ncdot-ingester"},
+	}
+	for _, p := range incidents {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        fmt.Sprintf("urn:ncdot-ingester:incident:%s:%s", strings.ToLower(p.Source), p.SourceID),
+			Title:     incidentTitle(p),
+			Updated:   incidentUpdated(p).UTC().Format(time.RFC3339),
+			Published: p.StartTime.UTC().Format(time.RFC3339),
+			Link:      atomLink{Href: mapURL(p.Latitude, p.Longitude), Rel: "alternate"},
+			Summary:   feedDescription(p),
+			Category:  atomCategory{Term: p.EventType},
+			Point:     geoRSSPoint(p),
+		})
+	}
+	writeXML(w, "application/atom+xml; charset=utf-8", feed)
+}
+
+func writeXML(w http.ResponseWriter, contentType string, v interface{}) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		logFor("api").Error("Error encoding XML", "err", err)
+		http.Error(w, "could not encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
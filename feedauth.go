@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protected feeds (Waze CCP, agency CAD endpoints) are given credentials
+// in FEED_AUTH_FILE, per source or "*" for the rest:
+//
+//	{"NCDOT": {"type": "header", "header": "X-API-Key", "key": "${NCDOT_API_KEY}"},
+//	 "WAZE": {"type": "oauth2", "token_url": "https://…/token",
+//	          "client_id": "…", "client_secret": "${WAZE_SECRET}", "scopes": ["feed"]}}
+//
+// The types are "header" (key in header, X-API-Key by default), "bearer"
+// (token), "basic" (username and password) and "oauth2", the
+// client-credentials grant. OAuth tokens are kept until shortly before
+// they expire, or until the feed turns one down. ${VAR}s are filled in
+// from the environment, so the file needn't hold the secrets.
+
+// feedAuth is how to authenticate to one source's feed.
+type feedAuth struct {
+	Type         string   `json:"type"`
+	Header       string   `json:"header"`
+	Key          string   `json:"key"`
+	Token        string   `json:"token"`
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// readFeedAuth reads source's entry, or the "*" one, from FEED_AUTH_FILE.
+// It returns nil if the feed needs no credentials.
+func readFeedAuth(file, source string) (*feedAuth, error) {
+	if file == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read feed credentials: %w", err)
+	}
+	var all map[string]*feedAuth
+	if err := json.Unmarshal([]byte(os.ExpandEnv(string(raw))), &all); err != nil {
+		return nil, fmt.Errorf("could not parse feed credentials %s: %w", file, err)
+	}
+	a, ok := all[source]
+	if !ok {
+		a = all["*"]
+	}
+	if a == nil || a.Type == "" || a.Type == "none" {
+		return nil, nil
+	}
+	var missing string
+	switch a.Type {
+	case "header":
+		if a.Header == "" {
+			a.Header = "X-API-Key"
+		}
+		if a.Key == "" {
+			missing = "key"
+		}
+	case "bearer":
+		if a.Token == "" {
+			missing = "token"
+		}
+	case "basic":
+		if a.Username == "" {
+			missing = "username"
+		}
+	case "oauth2":
+		switch {
+		case a.TokenURL == "":
+			missing = "token_url"
+		case a.ClientID == "":
+			missing = "client_id"
+		}
+	default:
+		return nil, fmt.Errorf("%s: %s: unknown auth type %q (expected header, bearer, basic or oauth2)", file, source, a.Type)
+	}
+	if missing != "" {
+		return nil, fmt.Errorf("%s: %s: %s auth needs %s", file, source, a.Type, missing)
+	}
+	return a, nil
+}
+
+// apply adds the credentials to req, fetching an OAuth token first if
+// there's no good one.
+func (a *feedAuth) apply(ctx context.Context, req *http.Request) error {
+	if a == nil {
+		return nil
+	}
+	switch a.Type {
+	case "header":
+		req.Header.Set(a.Header, a.Key)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	case "basic":
+		req.SetBasicAuth(a.Username, a.Password)
+	case "oauth2":
+		token, err := oauthTokens.get(ctx, a)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// rejected is called when the feed answers 401, so the next request gets
+// a fresh token. It reports whether there's any point retrying.
+func (a *feedAuth) rejected() bool {
+	if a == nil || a.Type != "oauth2" {
+		return false
+	}
+	oauthTokens.forget(a)
+	return true
+}
+
+// oauthTokens caches client-credentials tokens across runs.
+var oauthTokens = &oauthTokenCache{tokens: map[string]oauthToken{}}
+
+type oauthTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]oauthToken
+}
+
+type oauthToken struct {
+	value   string
+	expires time.Time
+}
+
+// oauthRefreshMargin is how long before expiry a token is replaced.
+const oauthRefreshMargin = time.Minute
+
+func (c *oauthTokenCache) key(a *feedAuth) string {
+	return a.TokenURL + "\x00" + a.ClientID + "\x00" + strings.Join(a.Scopes, " ")
+}
+
+func (c *oauthTokenCache) forget(a *feedAuth) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, c.key(a))
+}
+
+// get returns a's current token, fetching a new one if needed. The lock is
+// held throughout so concurrent callers don't all fetch one.
+func (c *oauthTokenCache) get(ctx context.Context, a *feedAuth) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := c.key(a)
+	if t, ok := c.tokens[key]; ok && time.Until(t.expires) > oauthRefreshMargin {
+		return t.value, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching OAuth token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("OAuth token endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("decoding OAuth token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("OAuth token endpoint returned no access_token")
+	}
+	// Without an expiry, keep it until the feed refuses it.
+	expires := time.Now().Add(24 * time.Hour)
+	if token.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	c.tokens[key] = oauthToken{value: token.AccessToken, expires: expires}
+	return token.AccessToken, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The statewide feed is large and mostly unchanged between polls, so it
+// is fetched conditionally: the ETag and Last-Modified of the last feed a
+// run processed without errors are kept in feed_state, per profile, and
+// sent back, and a 304 ends the run early. It is also requested
+// compressed, and decoded as it streams in, one incident at a time, so
+// memory stays flat however big it gets; a body over FEED_MAX_MB (after
+// decompression) is refused.
+
+// DOT_URL may list several URLs, comma-separated, for a feed split across
+// endpoints, and a URL may page with {page} (counting from 1) and {offset}
+// (in records, FEED_PAGE_SIZE a page) placeholders. Pages are fetched
+// until one comes back empty or short of FEED_PAGE_SIZE; a URL with more
+// than FEED_MAX_PAGES fails the run, like any partial feed. The records are merged, keeping the latest of an incident
+// listed more than once. Only a single, unpaged URL is fetched
+// conditionally.
+
+// feedURLs splits DOT_URL into its URLs.
+func feedURLs(s string) []string {
+	var urls []string
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func pagedURL(u string) bool {
+	return strings.Contains(u, "{page}") || strings.Contains(u, "{offset}")
+}
+
+// expandPageURL fills in u's paging placeholders for page.
+func expandPageURL(u string, page, pageSize int) string {
+	return strings.NewReplacer(
+		"{page}", strconv.Itoa(page),
+		"{offset}", strconv.Itoa((page-1)*pageSize),
+	).Replace(u)
+}
+
+// newerIncident reports whether a is a later version of the incident than
+// b, by lastUpdate; on a tie the later record wins.
+func newerIncident(a, b Incident) bool {
+	ta, errA := parseFeedTime(a.LastUpdate)
+	tb, errB := parseFeedTime(b.LastUpdate)
+	if errA != nil || errB != nil {
+		return errA == nil
+	}
+	return !ta.Before(tb)
+}
+
+// errFeedNotModified means the feed hasn't changed since the last run.
+var errFeedNotModified = errors.New("feed not modified")
+
+// feedValidators are a response's cache validators.
+type feedValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// loadFeedValidators reads the validators profile ("" for none) last saved
+// for source.
+func loadFeedValidators(ctx context.Context, db *sql.DB, source, profile string) (feedValidators, error) {
+	var v feedValidators
+	err := db.QueryRowContext(ctx, `SELECT coalesce(etag, ''), coalesce(last_modified, '') FROM feed_state WHERE source = $1 AND profile = $2`,
+		source, profile).Scan(&v.ETag, &v.LastModified)
+	if err == sql.ErrNoRows {
+		return feedValidators{}, nil
+	}
+	return v, err
+}
+
+func saveFeedValidators(ctx context.Context, db *sql.DB, source, profile string, v feedValidators) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO feed_state (source, profile, etag, last_modified, updated_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), now())
+		ON CONFLICT (source, profile) DO UPDATE SET etag = EXCLUDED.etag, last_modified = EXCLUDED.last_modified, updated_at = now()`,
+		source, profile, v.ETag, v.LastModified)
+	return err
+}
+
+// conditional adds the validators to a request.
+func (v feedValidators) conditional(req *http.Request) {
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
+}
+
+func validatorsOf(resp *http.Response) feedValidators {
+	return feedValidators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+}
+
+// acceptCompressed asks for a compressed response. Setting it ourselves
+// turns off the transport's transparent gzip, so the body must go through
+// decodedBody.
+func acceptCompressed(req *http.Request) {
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+}
+
+// errFeedTooLarge is a feed body over the size limit.
+var errFeedTooLarge = errors.New("feed exceeds the maximum size")
+
+// feedReader reads a feed body up to a limit, hashing it and keeping the
+// start of it for error reports as it goes.
+type feedReader struct {
+	r       io.Reader
+	limit   int64
+	n       int64
+	hash    hash.Hash
+	excerpt []byte
+}
+
+func newFeedReader(r io.Reader, limit int64) *feedReader {
+	return &feedReader{r: r, limit: limit, hash: sha256.New()}
+}
+
+func (f *feedReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.n += int64(n)
+	if f.limit > 0 && f.n > f.limit {
+		return 0, fmt.Errorf("%w (%d bytes)", errFeedTooLarge, f.limit)
+	}
+	f.hash.Write(p[:n])
+	if room := errorPayloadExcerpt - len(f.excerpt); room > 0 {
+		f.excerpt = append(f.excerpt, p[:min(n, room)]...)
+	}
+	return n, err
+}
+
+// sum is the hex SHA-256 of what has been read.
+func (f *feedReader) sum() string {
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
+
+// decodeIncidentArray decodes a JSON array of incidents element by
+// element, then reads to the end so the whole body is hashed. A record
+// that is valid JSON but doesn't fit Incident (a string where a number
+// belongs, say) is rejected on its own; only broken JSON, which can't be
+// resynchronised, fails the lot.
+func decodeIncidentArray(r io.Reader, source string) ([]Incident, []rejectedRecord, error) {
+	var incidents []Incident
+	var rejected []rejectedRecord
+	err := eachIncident(r, source, func(incident Incident) error {
+		incidents = append(incidents, incident)
+		return nil
+	}, func(rec rejectedRecord) {
+		rejected = append(rejected, rec)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return incidents, rejected, nil
+}
+
+// eachIncident is decodeIncidentArray handing each record to fn, or to
+// reject, as it is decoded. It stops at fn's first error.
+func eachIncident(r io.Reader, source string, fn func(Incident) error, reject func(rejectedRecord)) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected an array of incidents, got %v", tok)
+	}
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("record %d: %w", i, err)
+		}
+		var incident Incident
+		if err := json.Unmarshal(raw, &incident); err != nil {
+			reject(rejectedRecord{Source: source, SourceID: rawRecordID(raw), Stage: quarantineDecode, Reason: err.Error(), Raw: raw})
+			continue
+		}
+		if err := fn(incident); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// decodedBody undoes the response's Content-Encoding.
+func decodedBody(resp *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		// "deflate" is meant to be zlib-wrapped, but plenty of servers
+		// send raw DEFLATE.
+		br := bufio.NewReader(resp.Body)
+		if head, err := br.Peek(2); err == nil && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The NCDOT feed isn't consistent about how it writes times. Seen so far:
+// RFC 3339 with an offset, the same without one, space-separated and
+// US-style local times, and .NET's "/Date(ms)/" with an optional offset.
+// Times without a zone are Eastern, as the TIMS system that produces the
+// feed keeps them.
+
+// feedTimeLayouts are the zoneless layouts, tried in order.
+var feedTimeLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04",
+	"01/02/2006 03:04:05 PM",
+	"1/2/2006 3:04:05 PM",
+	"1/2/2006 3:04 PM",
+	"01/02/2006 15:04:05",
+	"1/2/2006 15:04",
+}
+
+var dotNetDate = regexp.MustCompile(`^/Date\((-?\d+)([+-]\d{4})?\)/$`)
+
+// parseFeedTime parses a feed timestamp. An empty string is the zero time
+// and no error; anything unrecognised is an error.
+func parseFeedTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if m := dotNetDate.FindStringSubmatch(s); m != nil {
+		ms, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q: %w", s, err)
+		}
+		// The milliseconds are UTC; the offset, if any, is only the zone
+		// it was written in.
+		t := time.UnixMilli(ms).In(easternTime)
+		if m[2] != "" {
+			if zone, err := time.Parse("-0700", m[2]); err == nil {
+				t = t.In(zone.Location())
+			}
+		}
+		return t, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999-0700", "2006-01-02 15:04:05.999999999-07:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, easternTime); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", s)
+}
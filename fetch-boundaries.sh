@@ -0,0 +1,32 @@
+set -e
+# Refreshes the county and municipal boundaries embedded from boundaries/.
+# Needs curl, unzip and mapshaper (npm install -g mapshaper).
+YEAR=${YEAR:-2023}
+BASE=https://www2.census.gov/geo/tiger/GENZ$YEAR/shp
+DIR=$(cd "$(dirname "$0")" && pwd)/boundaries
+TMP=$(mktemp -d)
+trap 'rm -rf "$TMP"' EXIT
+
+echo ">>> Downloading $YEAR Census cartographic boundaries..."
+curl -fsSL -o "$TMP/county.zip" "$BASE/cb_${YEAR}_us_county_500k.zip"
+curl -fsSL -o "$TMP/place.zip" "$BASE/cb_${YEAR}_37_place_500k.zip"
+unzip -q -d "$TMP/county" "$TMP/county.zip"
+unzip -q -d "$TMP/place" "$TMP/place.zip"
+
+echo ">>> Simplifying North Carolina counties..."
+mapshaper "$TMP"/county/*.shp \
+	-filter "STATEFP == '37'" \
+	-simplify 10% keep-shapes \
+	-filter-fields NAME \
+	-o format=geojson precision=0.0001 "$DIR/counties.geojson"
+
+# Census places include unincorporated CDPs (LSAD 57); only cities, towns
+# and villages have limits the feed's city should match.
+echo ">>> Simplifying North Carolina municipalities..."
+mapshaper "$TMP"/place/*.shp \
+	-filter "LSAD != '57'" \
+	-simplify 10% keep-shapes \
+	-filter-fields NAME \
+	-o format=geojson precision=0.0001 "$DIR/municipalities.geojson"
+
+echo ">>> Boundaries written to $DIR."
@@ -0,0 +1,95 @@
+package main
+
+import "math"
+
+const earthRadiusMeters = 6371008.8
+
+// LatLon is a WGS84 coordinate.
+type LatLon struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// haversineMeters is the great-circle distance between two points.
+func haversineMeters(a, b LatLon) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// pointSegmentDistance returns the distance in meters from p to the segment
+// a-b and how far along the segment (0..1) the closest point lies. It uses
+// an equirectangular projection around p, which is accurate to well under
+// a meter over the few-kilometre distances we compare.
+func pointSegmentDistance(p, a, b LatLon) (float64, float64) {
+	cosLat := math.Cos(p.Lat * math.Pi / 180)
+	project := func(q LatLon) (float64, float64) {
+		return (q.Lon - p.Lon) * cosLat * math.Pi / 180 * earthRadiusMeters,
+			(q.Lat - p.Lat) * math.Pi / 180 * earthRadiusMeters
+	}
+	ax, ay := project(a)
+	bx, by := project(b)
+
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l2 := dx*dx + dy*dy; l2 > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l2))
+	}
+	cx, cy := ax+t*dx, ay+t*dy
+	return math.Hypot(cx, cy), t
+}
+
+// gridIndex buckets items into fixed-size lat/lon cells so nearest-neighbour
+// searches only look at nearby candidates.
+type gridIndex struct {
+	cellDeg float64
+	cells   map[[2]int][]int
+}
+
+func newGridIndex(cellDeg float64) *gridIndex {
+	return &gridIndex{cellDeg: cellDeg, cells: make(map[[2]int][]int)}
+}
+
+func (g *gridIndex) cell(p LatLon) [2]int {
+	return [2]int{int(math.Floor(p.Lat / g.cellDeg)), int(math.Floor(p.Lon / g.cellDeg))}
+}
+
+// insertBox adds item to every cell overlapped by the bounding box of pts.
+func (g *gridIndex) insertBox(item int, pts ...LatLon) {
+	if len(pts) == 0 {
+		return
+	}
+	lo, hi := g.cell(pts[0]), g.cell(pts[0])
+	for _, p := range pts[1:] {
+		c := g.cell(p)
+		lo[0], lo[1] = min(lo[0], c[0]), min(lo[1], c[1])
+		hi[0], hi[1] = max(hi[0], c[0]), max(hi[1], c[1])
+	}
+	for i := lo[0]; i <= hi[0]; i++ {
+		for j := lo[1]; j <= hi[1]; j++ {
+			key := [2]int{i, j}
+			g.cells[key] = append(g.cells[key], item)
+		}
+	}
+}
+
+// near returns the distinct items in the cell containing p and its eight
+// neighbours.
+func (g *gridIndex) near(p LatLon) []int {
+	c := g.cell(p)
+	seen := make(map[int]bool)
+	var items []int
+	for i := c[0] - 1; i <= c[0]+1; i++ {
+		for j := c[1] - 1; j <= c[1]+1; j++ {
+			for _, item := range g.cells[[2]int{i, j}] {
+				if !seen[item] {
+					seen[item] = true
+					items = append(items, item)
+				}
+			}
+		}
+	}
+	return items
+}
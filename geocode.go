@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GeocodeResult is the address information a reverse geocoder returns.
+type GeocodeResult struct {
+	Provider string `json:"provider"`
+	Address  string `json:"address,omitempty"`
+	City     string `json:"city,omitempty"`
+	County   string `json:"county,omitempty"`
+	State    string `json:"state,omitempty"`
+	Postcode string `json:"postcode,omitempty"`
+}
+
+// Geocoder turns coordinates into an address.
+type Geocoder interface {
+	Name() string
+	Reverse(ctx context.Context, lat, lon float64) (*GeocodeResult, error)
+}
+
+// newGeocoder builds the provider selected by GEOCODER.
+func newGeocoder(cfg *Config) (Geocoder, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	limiter := newRateLimiter(cfg.GeocoderRate)
+
+	switch strings.ToLower(cfg.Geocoder) {
+	case "nominatim":
+		baseURL := cfg.GeocoderURL
+		if baseURL == "" {
+			baseURL = "https://nominatim.openstreetmap.org"
+		}
+		return &nominatimGeocoder{baseURL: baseURL, client: client, limiter: limiter}, nil
+	case "census":
+		baseURL := cfg.GeocoderURL
+		if baseURL == "" {
+			baseURL = "https://geocoding.geo.census.gov"
+		}
+		return &censusGeocoder{baseURL: baseURL, client: client, limiter: limiter}, nil
+	default:
+		return nil, fmt.Errorf("unknown GEOCODER %q (want nominatim or census)", cfg.Geocoder)
+	}
+}
+
+// getJSON performs a rate-limited GET and decodes the JSON response into v.
+func getJSON(ctx context.Context, client *http.Client, limiter *rateLimiter, rawURL string, v interface{}) error {
+	if err := limiter.Wait(ctx); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("non-200 status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// nominatimGeocoder uses the OpenStreetMap Nominatim reverse endpoint. The
+// public instance allows at most one request per second.
+type nominatimGeocoder struct {
+	baseURL string
+	client  *http.Client
+	limiter *rateLimiter
+}
+
+func (g *nominatimGeocoder) Name() string { return "nominatim" }
+
+func (g *nominatimGeocoder) Reverse(ctx context.Context, lat, lon float64) (*GeocodeResult, error) {
+	reverseURL := fmt.Sprintf("%s/reverse?format=jsonv2&addressdetails=1&zoom=18&lat=%.6f&lon=%.6f", g.baseURL, lat, lon)
+
+	var resp struct {
+		Error   string `json:"error"`
+		Address struct {
+			HouseNumber string `json:"house_number"`
+			Road        string `json:"road"`
+			City        string `json:"city"`
+			Town        string `json:"town"`
+			Village     string `json:"village"`
+			Hamlet      string `json:"hamlet"`
+			County      string `json:"county"`
+			State       string `json:"state"`
+			Postcode    string `json:"postcode"`
+		} `json:"address"`
+	}
+	if err := getJSON(ctx, g.client, g.limiter, reverseURL, &resp); err != nil {
+		return nil, fmt.Errorf("nominatim reverse lookup failed: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("nominatim reverse lookup failed: %s", resp.Error)
+	}
+
+	a := resp.Address
+	return &GeocodeResult{
+		Provider: g.Name(),
+		Address:  strings.TrimSpace(a.HouseNumber + " " + a.Road),
+		City:     firstNonEmpty(a.City, a.Town, a.Village, a.Hamlet),
+		County:   a.County,
+		State:    a.State,
+		Postcode: a.Postcode,
+	}, nil
+}
+
+// censusGeocoder uses the US Census Bureau geographies endpoint. It has no
+// street addresses for coordinates, but is authoritative for county and
+// incorporated place.
+type censusGeocoder struct {
+	baseURL string
+	client  *http.Client
+	limiter *rateLimiter
+}
+
+func (g *censusGeocoder) Name() string { return "census" }
+
+func (g *censusGeocoder) Reverse(ctx context.Context, lat, lon float64) (*GeocodeResult, error) {
+	q := url.Values{}
+	q.Set("x", fmt.Sprintf("%.6f", lon))
+	q.Set("y", fmt.Sprintf("%.6f", lat))
+	q.Set("benchmark", "Public_AR_Current")
+	q.Set("vintage", "Current_Current")
+	q.Set("layers", "Counties,Incorporated Places,States")
+	q.Set("format", "json")
+	reverseURL := g.baseURL + "/geocoder/geographies/coordinates?" + q.Encode()
+
+	type geography struct {
+		Name     string `json:"NAME"`
+		BaseName string `json:"BASENAME"`
+	}
+	var resp struct {
+		Result struct {
+			Geographies map[string][]geography `json:"geographies"`
+		} `json:"result"`
+	}
+	if err := getJSON(ctx, g.client, g.limiter, reverseURL, &resp); err != nil {
+		return nil, fmt.Errorf("census reverse lookup failed: %w", err)
+	}
+
+	first := func(layer string) geography {
+		if gs := resp.Result.Geographies[layer]; len(gs) > 0 {
+			return gs[0]
+		}
+		return geography{}
+	}
+	result := &GeocodeResult{
+		Provider: g.Name(),
+		City:     first("Incorporated Places").BaseName,
+		County:   first("Counties").BaseName,
+		State:    first("States").Name,
+	}
+	if result.County == "" && result.State == "" {
+		return nil, errors.New("census reverse lookup returned no geographies")
+	}
+	return result, nil
+}
+
+// GeocodeCache stores reverse-geocode results so repeat locations don't hit
+// the provider again.
+type GeocodeCache interface {
+	Get(provider string, lat, lon float64, maxAge time.Duration) (*GeocodeResult, bool, error)
+	Put(provider string, lat, lon float64, result *GeocodeResult) error
+}
+
+// dbGeocodeCache keeps results in the geocode_cache table, keyed on
+// coordinates rounded to four decimal places (about 11 m).
+type dbGeocodeCache struct {
+	db *sql.DB
+}
+
+func geocodeKey(lat, lon float64) (string, string) {
+	return fmt.Sprintf("%.4f", lat), fmt.Sprintf("%.4f", lon)
+}
+
+func (c *dbGeocodeCache) Get(provider string, lat, lon float64, maxAge time.Duration) (*GeocodeResult, bool, error) {
+	latKey, lonKey := geocodeKey(lat, lon)
+	var raw []byte
+	err := c.db.QueryRow(`
+		SELECT result FROM geocode_cache
+		WHERE provider = $1 AND lat_key = $2 AND lon_key = $3 AND fetched_at > $4`,
+		provider, latKey, lonKey, time.Now().Add(-maxAge)).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var result GeocodeResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, false, err
+	}
+	return &result, true, nil
+}
+
+func (c *dbGeocodeCache) Put(provider string, lat, lon float64, result *GeocodeResult) error {
+	latKey, lonKey := geocodeKey(lat, lon)
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`
+		INSERT INTO geocode_cache (provider, lat_key, lon_key, result, fetched_at)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (provider, lat_key, lon_key) DO UPDATE SET
+			result = EXCLUDED.result,
+			fetched_at = EXCLUDED.fetched_at`,
+		provider, latKey, lonKey, raw)
+	return err
+}
+
+// geocodeEnricher fills address, city, and county when the source left them
+// blank. Incidents that already have all three are not looked up.
+type geocodeEnricher struct {
+	geocoder Geocoder
+	cache    GeocodeCache
+	ttl      time.Duration
+}
+
+func (e *geocodeEnricher) Name() string { return "geocode" }
+
+func (e *geocodeEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	if incident.Address != "" && incident.City != "" && incident.CountyName != "" {
+		return nil
+	}
+	if incident.Latitude == 0 && incident.Longitude == 0 {
+		return nil
+	}
+
+	result, err := e.lookup(ctx, incident.Latitude, incident.Longitude)
+	if err != nil {
+		return err
+	}
+	incident.Geocode = result
+	if incident.Address == "" {
+		incident.Address = result.Address
+	}
+	if incident.City == "" {
+		incident.City = result.City
+	}
+	if incident.CountyName == "" {
+		incident.CountyName = strings.TrimSuffix(result.County, " County")
+	}
+	return nil
+}
+
+func (e *geocodeEnricher) lookup(ctx context.Context, lat, lon float64) (*GeocodeResult, error) {
+	provider := e.geocoder.Name()
+	if e.cache != nil {
+		result, ok, err := e.cache.Get(provider, lat, lon, e.ttl)
+		if err != nil {
+			return nil, fmt.Errorf("geocode cache read failed: %w", err)
+		}
+		if ok {
+			metricCacheLookups.inc("geocode", "hit")
+			return result, nil
+		}
+		metricCacheLookups.inc("geocode", "miss")
+	}
+
+	result, err := e.geocoder.Reverse(ctx, lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	if e.cache != nil {
+		if err := e.cache.Put(provider, lat, lon, result); err != nil {
+			logFor("enrich").Warn("Could not cache geocode result", "provider", provider, "err", err)
+		}
+	}
+	return result, nil
+}
+
+// firstNonEmpty returns the first non-empty string.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Minimal GeoJSON types for the reference datasets the bot loads. Only the
+// geometry types we actually use are decoded.
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+}
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// loadGeoJSON reads a FeatureCollection from disk.
+func loadGeoJSON(path string) (*geoJSONFeatureCollection, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
+	}
+	return parseGeoJSON(path, raw)
+}
+
+// parseGeoJSON decodes a FeatureCollection; name is used in errors.
+func parseGeoJSON(name string, raw []byte) (*geoJSONFeatureCollection, error) {
+	var fc geoJSONFeatureCollection
+	if err := json.Unmarshal(raw, &fc); err != nil {
+		return nil, fmt.Errorf("could not parse GeoJSON %s: %w", name, err)
+	}
+	return &fc, nil
+}
+
+// stringProp returns a string property, formatting numbers if needed.
+func (f *geoJSONFeature) stringProp(key string) string {
+	switch v := f.Properties[key].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%v", v)
+	}
+	return ""
+}
+
+// floatProp returns a numeric property, or def if it is missing.
+func (f *geoJSONFeature) floatProp(key string, def float64) float64 {
+	if v, ok := f.Properties[key].(float64); ok {
+		return v
+	}
+	return def
+}
+
+func toLatLons(coords [][]float64) []LatLon {
+	pts := make([]LatLon, 0, len(coords))
+	for _, c := range coords {
+		if len(c) >= 2 {
+			pts = append(pts, LatLon{Lat: c[1], Lon: c[0]})
+		}
+	}
+	return pts
+}
+
+// point decodes a Point geometry.
+func (g *geoJSONGeometry) point() (LatLon, error) {
+	if g.Type != "Point" {
+		return LatLon{}, fmt.Errorf("expected Point geometry, got %s", g.Type)
+	}
+	var c []float64
+	if err := json.Unmarshal(g.Coordinates, &c); err != nil {
+		return LatLon{}, err
+	}
+	if len(c) < 2 {
+		return LatLon{}, fmt.Errorf("point has %d coordinates", len(c))
+	}
+	return LatLon{Lat: c[1], Lon: c[0]}, nil
+}
+
+// lines decodes a LineString or MultiLineString into its parts.
+func (g *geoJSONGeometry) lines() ([][]LatLon, error) {
+	switch g.Type {
+	case "LineString":
+		var c [][]float64
+		if err := json.Unmarshal(g.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		return [][]LatLon{toLatLons(c)}, nil
+	case "MultiLineString":
+		var c [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		parts := make([][]LatLon, len(c))
+		for i := range c {
+			parts[i] = toLatLons(c[i])
+		}
+		return parts, nil
+	}
+	return nil, fmt.Errorf("expected LineString geometry, got %s", g.Type)
+}
+
+// polygon is a GeoJSON polygon: an outer ring followed by any holes.
+type polygon [][]LatLon
+
+// polygons decodes a Polygon or MultiPolygon.
+func (g *geoJSONGeometry) polygons() ([]polygon, error) {
+	switch g.Type {
+	case "Polygon":
+		var c [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		return []polygon{toPolygon(c)}, nil
+	case "MultiPolygon":
+		var c [][][][]float64
+		if err := json.Unmarshal(g.Coordinates, &c); err != nil {
+			return nil, err
+		}
+		polys := make([]polygon, len(c))
+		for i := range c {
+			polys[i] = toPolygon(c[i])
+		}
+		return polys, nil
+	}
+	return nil, fmt.Errorf("expected Polygon geometry, got %s", g.Type)
+}
+
+func toPolygon(rings [][][]float64) polygon {
+	p := make(polygon, len(rings))
+	for i, r := range rings {
+		p[i] = toLatLons(r)
+	}
+	return p
+}
+
+// contains reports whether pt lies inside the outer ring and outside every hole.
+func (p polygon) contains(pt LatLon) bool {
+	if len(p) == 0 || !ringContains(p[0], pt) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if ringContains(hole, pt) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains is the even-odd ray casting test.
+func ringContains(ring []LatLon, pt LatLon) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > pt.Lat) != (b.Lat > pt.Lat) &&
+			pt.Lon < (b.Lon-a.Lon)*(pt.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// bbox is a lat/lon bounding box used to skip obviously distant polygons.
+type bbox struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+func (b bbox) contains(pt LatLon) bool {
+	return pt.Lat >= b.MinLat && pt.Lat <= b.MaxLat && pt.Lon >= b.MinLon && pt.Lon <= b.MaxLon
+}
+
+// polygonsBBox returns the bounding box of the outer rings.
+func polygonsBBox(polys []polygon) bbox {
+	b := bbox{MinLat: 90, MinLon: 180, MaxLat: -90, MaxLon: -180}
+	for _, p := range polys {
+		if len(p) == 0 {
+			continue
+		}
+		for _, pt := range p[0] {
+			b.MinLat, b.MaxLat = min(b.MinLat, pt.Lat), max(b.MaxLat, pt.Lat)
+			b.MinLon, b.MaxLon = min(b.MinLon, pt.Lon), max(b.MaxLon, pt.Lon)
+		}
+	}
+	return b
+}
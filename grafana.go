@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultGrafanaRules annotate the incidents that explain a dip on a
+// traffic-speed graph.
+var defaultGrafanaRules = NotifyRules{
+	{Name: "interstate-closure", Interstate: true, FullClosure: true},
+	{Name: "winter-weather", EventTypes: []string{EventWeather}, Weather: []string{"snow", "ice", "sleet", "freezing"}},
+}
+
+// grafanaSink adds an annotation to a Grafana dashboard (or one panel of
+// it) for each incident matching its rules, spanning from the incident's
+// start until it clears. Annotations are tagged with the incident's key,
+// so they are found again by tag rather than tracked in a table.
+type grafanaSink struct {
+	url          string
+	token        string
+	dashboardUID string
+	panelID      int
+	rules        NotifyRules
+	client       *http.Client
+}
+
+func newGrafanaSink(cfg *Config, rules NotifyRules) *grafanaSink {
+	if len(rules) == 0 {
+		rules = defaultGrafanaRules
+	}
+	return &grafanaSink{
+		url:          strings.TrimRight(cfg.GrafanaURL, "/"),
+		token:        cfg.GrafanaToken,
+		dashboardUID: cfg.GrafanaDashboardUID,
+		panelID:      cfg.GrafanaPanelID,
+		rules:        rules,
+		client:       &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *grafanaSink) Name() string { return "grafana" }
+
+func grafanaIncidentTag(p IncidentPayload) string {
+	return "incident:" + strings.ToLower(p.Source) + ":" + p.SourceID
+}
+
+func (s *grafanaSink) Publish(ctx context.Context, event IncidentEvent) error {
+	p := event.Incident
+	// A clear closes whatever annotation the incident got, whether or not
+	// the cleared incident still matches the rules.
+	if event.Change != ChangeCleared && !ruleMatches(s.rules, event) {
+		return nil
+	}
+	id, err := s.find(ctx, p)
+	if err != nil {
+		return err
+	}
+	text := fmt.Sprintf("<b>%s</b><br>%s<br>Lanes %s · Severity %s", incidentTitle(p), incidentDescription(p), lanesLabel(p), severityLabel(p))
+
+	switch {
+	case event.Change == ChangeCleared:
+		if id == 0 {
+			return nil
+		}
+		end := event.OccurredAt
+		if p.EndTime != nil {
+			end = *p.EndTime
+		}
+		return s.call(ctx, "PATCH", fmt.Sprintf("/api/annotations/%d", id), map[string]interface{}{"timeEnd": end.UnixMilli(), "text": text + "<br>Cleared"}, nil)
+	case id != 0:
+		return s.call(ctx, "PATCH", fmt.Sprintf("/api/annotations/%d", id), map[string]interface{}{"text": text}, nil)
+	}
+
+	rule, _ := s.rules.Match(event)
+	body := map[string]interface{}{
+		"dashboardUID": s.dashboardUID,
+		"time":         p.StartTime.UnixMilli(),
+		"tags":         []string{"patrolx", grafanaIncidentTag(p), firstNonEmpty(event.Rule, rule.Name), p.EventType},
+		"text":         text,
+	}
+	if s.panelID > 0 {
+		body["panelId"] = s.panelID
+	}
+	return s.call(ctx, "POST", "/api/annotations", body, nil)
+}
+
+// find returns the ID of the incident's annotation, or 0.
+func (s *grafanaSink) find(ctx context.Context, p IncidentPayload) (int64, error) {
+	q := url.Values{
+		"dashboardUID": {s.dashboardUID},
+		"tags":         {"patrolx", grafanaIncidentTag(p)},
+		"type":         {"annotation"},
+		"limit":        {"1"},
+	}
+	var found []struct {
+		ID int64 `json:"id"`
+	}
+	if err := s.call(ctx, "GET", "/api/annotations?"+q.Encode(), nil, &found); err != nil {
+		return 0, err
+	}
+	if len(found) == 0 {
+		return 0, nil
+	}
+	return found[0].ID, nil
+}
+
+func (s *grafanaSink) call(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return permanentError{err}
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.url+path, reader)
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("grafana request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		err := fmt.Errorf("grafana returned %s: %s", resp.Status, truncate(string(respBody), 200))
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+			return permanentError{err}
+		}
+		return err
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("failed to unmarshal grafana response: %w", err)
+		}
+	}
+	return nil
+}
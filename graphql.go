@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// The GraphQL API at /graphql, for consumers that want the nested
+// details in one round trip. Queries are plain POSTs (or GETs); the
+// incidentChanged subscription is served as Server-Sent Events to a request
+// that accepts text/event-stream, each result a "next" event.
+
+const graphQLSchema = `
+schema {
+	query: Query
+	subscription: Subscription
+}
+
+scalar Time
+
+type Query {
+	"Incidents, newest first, or best match first with search. bbox is [minLon, minLat, maxLon, maxLat]; since and until are RFC 3339 or YYYY-MM-DD."
+	incidents(county: String, road: String, eventType: String, status: String, bbox: [Float!],
+		since: String, until: String, search: String, limit: Int = 100, offset: Int = 0): [Incident!]!
+	incident(source: String!, sourceId: String!): Incident
+}
+
+type Subscription {
+	incidentChanged(county: String, road: String, eventType: String): IncidentChange!
+}
+
+type IncidentChange {
+	"created, updated or cleared"
+	change: String!
+	occurredAt: Time!
+	incident: Incident!
+}
+
+type Incident {
+	source: String!
+	sourceId: String!
+	eventType: String!
+	status: String!
+	address: String!
+	city: String
+	county: String
+	road: String
+	roadNormalized: String
+	direction: String
+	latitude: Float!
+	longitude: Float!
+	startTime: Time!
+	endTime: Time
+	problemDetail: String
+	severity: Int!
+	normalizedSeverity: Int!
+	riskScore: Float!
+	lanesClosed: Int!
+	lanesTotal: Int!
+	summary: String
+	weather: Weather
+	routeImpacts: [RouteImpact!]!
+	"The enrichment details as a JSON object."
+	details: String
+}
+
+type Weather {
+	temperature: Int!
+	windSpeed: String
+	shortForecast: String
+}
+
+type RouteImpact {
+	routeId: Int!
+	routeName: String!
+	score: Float!
+	distanceMeters: Float
+	"How far along the route the incident is; null when it matched by road name."
+	positionMeters: Float
+}
+`
+
+const graphQLMaxLimit = 1000
+
+type graphQLResolver struct {
+	s *server
+}
+
+func (s *server) graphQLSchema() *graphql.Schema {
+	return graphql.MustParseSchema(graphQLSchema, &graphQLResolver{s: s}, graphql.MaxDepth(8))
+}
+
+type incidentsArgs struct {
+	County, Road, EventType, Status, Since, Until, Search *string
+	Bbox                                                  *[]float64
+	Limit, Offset                                         int32
+}
+
+func (r *graphQLResolver) Incidents(ctx context.Context, args incidentsArgs) ([]*incidentResolver, error) {
+	q := url.Values{}
+	for key, v := range map[string]*string{"county": args.County, "road": args.Road, "event_type": args.EventType,
+		"status": args.Status, "since": args.Since, "until": args.Until, "q": args.Search} {
+		if v != nil {
+			q.Set(key, *v)
+		}
+	}
+	f, err := parseIncidentFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	if args.Bbox != nil {
+		if len(*args.Bbox) != 4 {
+			return nil, fmt.Errorf("bbox must be [minLon, minLat, maxLon, maxLat]")
+		}
+		f.BBox = *args.Bbox
+	}
+	f.Limit = int(args.Limit)
+	if f.Limit <= 0 || f.Limit > graphQLMaxLimit {
+		f.Limit = graphQLMaxLimit
+	}
+	if args.Offset > 0 {
+		f.Offset = int(args.Offset)
+	}
+	f.WithDetails = true
+	incidents, err := queryIncidents(ctx, r.s.db, f)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*incidentResolver, len(incidents))
+	for i := range incidents {
+		out[i] = &incidentResolver{s: r.s, p: incidents[i]}
+	}
+	return out, nil
+}
+
+func (r *graphQLResolver) Incident(ctx context.Context, args struct{ Source, SourceID string }) (*incidentResolver, error) {
+	incidents, err := queryIncidents(ctx, r.s.db, incidentFilter{Source: args.Source, SourceID: args.SourceID, Limit: 1, WithDetails: true})
+	if err != nil || len(incidents) == 0 {
+		return nil, err
+	}
+	return &incidentResolver{s: r.s, p: incidents[0]}, nil
+}
+
+func (r *graphQLResolver) IncidentChanged(ctx context.Context, args struct{ County, Road, EventType *string }) <-chan *incidentChangeResolver {
+	filter := streamFilter{}
+	if args.County != nil {
+		filter.county = *args.County
+	}
+	if args.Road != nil {
+		filter.road = *args.Road
+	}
+	if args.EventType != nil {
+		filter.eventType = *args.EventType
+	}
+	events, unsubscribe := r.s.hub.subscribe()
+	out := make(chan *incidentChangeResolver)
+	go func() {
+		defer close(out)
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if !filter.matches(event.Incident) {
+					continue
+				}
+				select {
+				case out <- &incidentChangeResolver{event: event, incident: &incidentResolver{s: r.s, p: event.Incident}}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+type incidentChangeResolver struct {
+	event    IncidentEvent
+	incident *incidentResolver
+}
+
+func (r *incidentChangeResolver) Change() string { return string(r.event.Change) }
+func (r *incidentChangeResolver) OccurredAt() graphql.Time {
+	return graphql.Time{Time: r.event.OccurredAt}
+}
+func (r *incidentChangeResolver) Incident() *incidentResolver { return r.incident }
+
+type incidentResolver struct {
+	s *server
+	p IncidentPayload
+}
+
+// optional maps "" to null.
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (r *incidentResolver) Source() string            { return r.p.Source }
+func (r *incidentResolver) SourceID() string          { return r.p.SourceID }
+func (r *incidentResolver) EventType() string         { return r.p.EventType }
+func (r *incidentResolver) Status() string            { return r.p.Status }
+func (r *incidentResolver) Address() string           { return r.p.Address }
+func (r *incidentResolver) City() *string             { return optional(r.p.City) }
+func (r *incidentResolver) County() *string           { return optional(r.p.County) }
+func (r *incidentResolver) Road() *string             { return optional(r.p.Road) }
+func (r *incidentResolver) RoadNormalized() *string   { return optional(r.p.RoadNormalized) }
+func (r *incidentResolver) Direction() *string        { return optional(r.p.Direction) }
+func (r *incidentResolver) Latitude() float64         { return r.p.Latitude }
+func (r *incidentResolver) Longitude() float64        { return r.p.Longitude }
+func (r *incidentResolver) StartTime() graphql.Time   { return graphql.Time{Time: r.p.StartTime} }
+func (r *incidentResolver) ProblemDetail() *string    { return optional(r.p.ProblemDetail) }
+func (r *incidentResolver) Severity() int32           { return int32(r.p.Severity) }
+func (r *incidentResolver) NormalizedSeverity() int32 { return int32(r.p.NormalizedSeverity) }
+func (r *incidentResolver) RiskScore() float64        { return r.p.RiskScore }
+func (r *incidentResolver) LanesClosed() int32        { return int32(r.p.LanesClosed) }
+func (r *incidentResolver) LanesTotal() int32         { return int32(r.p.LanesTotal) }
+func (r *incidentResolver) Summary() *string          { return optional(r.p.Summary) }
+func (r *incidentResolver) Weather() *weatherResolver { return newWeatherResolver(r.p.Weather) }
+func (r *incidentResolver) EndTime() *graphql.Time {
+	if r.p.EndTime == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *r.p.EndTime}
+}
+
+func (r *incidentResolver) Details(ctx context.Context) (*string, error) {
+	if r.p.Details == nil {
+		// Streamed events leave the details out.
+		incidents, err := queryIncidents(ctx, r.s.db, incidentFilter{Source: r.p.Source, SourceID: r.p.SourceID, Limit: 1, WithDetails: true})
+		if err != nil || len(incidents) == 0 {
+			return nil, err
+		}
+		r.p.Details = incidents[0].Details
+	}
+	out, err := json.Marshal(r.p.Details)
+	if err != nil {
+		return nil, err
+	}
+	details := string(out)
+	return &details, nil
+}
+
+func (r *incidentResolver) RouteImpacts(ctx context.Context) ([]*routeImpactResolver, error) {
+	impacts, err := loadRouteImpacts(ctx, r.s.db, r.p.Source, r.p.SourceID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*routeImpactResolver, len(impacts))
+	for i := range impacts {
+		out[i] = &routeImpactResolver{ri: impacts[i]}
+	}
+	return out, nil
+}
+
+type weatherResolver struct {
+	w *WeatherData
+}
+
+func newWeatherResolver(w *WeatherData) *weatherResolver {
+	if w == nil {
+		return nil
+	}
+	return &weatherResolver{w: w}
+}
+
+func (r *weatherResolver) Temperature() int32     { return int32(r.w.Temperature) }
+func (r *weatherResolver) WindSpeed() *string     { return optional(r.w.WindSpeed) }
+func (r *weatherResolver) ShortForecast() *string { return optional(r.w.ShortForecast) }
+
+type routeImpactResolver struct {
+	ri RouteImpact
+}
+
+func (r *routeImpactResolver) RouteID() int32    { return int32(r.ri.RouteID) }
+func (r *routeImpactResolver) RouteName() string { return r.ri.RouteName }
+func (r *routeImpactResolver) Score() float64    { return r.ri.Score }
+
+func (r *routeImpactResolver) DistanceMeters() *float64 {
+	if r.ri.PositionMeters < 0 {
+		return nil
+	}
+	return &r.ri.DistanceMeters
+}
+
+func (r *routeImpactResolver) PositionMeters() *float64 {
+	if r.ri.PositionMeters < 0 {
+		return nil
+	}
+	return &r.ri.PositionMeters
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func (s *server) handleGraphQL(schema *graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		if r.Method == http.MethodGet {
+			q := r.URL.Query()
+			req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+			if v := q.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					http.Error(w, "invalid variables: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			s.streamGraphQL(w, r, schema, req)
+			return
+		}
+		resp := schema.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+		out, err := json.Marshal(resp)
+		if err != nil {
+			logFor("api").Error("Error encoding GraphQL response", "err", err)
+			http.Error(w, "could not encode response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}
+}
+
+// streamGraphQL runs a subscription, writing each result as an SSE "next"
+// event until the client goes away.
+func (s *server) streamGraphQL(w http.ResponseWriter, r *http.Request, schema *graphql.Schema, req graphQLRequest) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	results, err := schema.Subscribe(r.Context(), req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case result, ok := <-results:
+			if !ok {
+				fmt.Fprint(w, "event: complete\ndata:\n\n")
+				flusher.Flush()
+				return
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				logFor("api").Error("Error encoding GraphQL result", "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
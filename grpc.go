@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"main.go/incidentpb"
+)
+
+// grpcServer implements incidentpb.IncidentService over the same store and
+// live stream as the HTTP API.
+type grpcServer struct {
+	incidentpb.UnimplementedIncidentServiceServer
+	s *server
+}
+
+func (g *grpcServer) ListIncidents(ctx context.Context, req *incidentpb.ListIncidentsRequest) (*incidentpb.ListIncidentsResponse, error) {
+	f := incidentFilter{
+		County:      req.County,
+		Road:        req.Road,
+		EventType:   req.EventType,
+		Status:      req.Status,
+		Limit:       int(req.Limit),
+		Offset:      int(req.Offset),
+		WithDetails: req.WithDetails,
+	}
+	if len(req.Bbox) > 0 {
+		if len(req.Bbox) != 4 {
+			return nil, status.Error(codes.InvalidArgument, "bbox must be min lon, min lat, max lon, max lat")
+		}
+		f.BBox = req.Bbox
+	}
+	if req.Since != nil {
+		f.Since = req.Since.AsTime()
+	}
+	if req.Until != nil {
+		f.Until = req.Until.AsTime()
+	}
+	if f.Limit <= 0 {
+		f.Limit = apiDefaultLimit
+	}
+	if f.Limit > apiMaxLimit {
+		f.Limit = apiMaxLimit
+	}
+	if f.Offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset must not be negative")
+	}
+
+	incidents, err := queryIncidents(ctx, g.s.db, f)
+	if err != nil {
+		logFor("grpc").Error("Error listing incidents over gRPC", "err", err)
+		return nil, status.Error(codes.Internal, "could not load incidents")
+	}
+	resp := &incidentpb.ListIncidentsResponse{}
+	for _, p := range incidents {
+		resp.Incidents = append(resp.Incidents, incidentProto(p, nil))
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) GetIncident(ctx context.Context, req *incidentpb.GetIncidentRequest) (*incidentpb.Incident, error) {
+	incidents, err := queryIncidents(ctx, g.s.db, incidentFilter{Source: req.Source, SourceID: req.SourceId, Limit: 1, WithDetails: true})
+	if err != nil {
+		logFor("grpc").Error("Error loading incident over gRPC", "err", err)
+		return nil, status.Error(codes.Internal, "could not load incident")
+	}
+	if len(incidents) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no incident %s/%s", req.Source, req.SourceId)
+	}
+	impacts, err := loadRouteImpacts(ctx, g.s.db, req.Source, req.SourceId)
+	if err != nil {
+		logFor("grpc").Error("Error loading route impacts over gRPC", "err", err)
+		return nil, status.Error(codes.Internal, "could not load incident")
+	}
+	return incidentProto(incidents[0], impacts), nil
+}
+
+func (g *grpcServer) WatchIncidents(req *incidentpb.WatchIncidentsRequest, stream incidentpb.IncidentService_WatchIncidentsServer) error {
+	filter := streamFilter{county: req.County, road: req.Road, eventType: req.EventType}
+	events, unsubscribe := g.s.hub.subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "fell too far behind the change stream")
+			}
+			if !filter.matches(event.Incident) {
+				continue
+			}
+			change := &incidentpb.IncidentChange{
+				Change:     changeTypeProto(event.Change),
+				OccurredAt: timestamppb.New(event.OccurredAt),
+				Incident:   incidentProto(event.Incident, nil),
+			}
+			if err := stream.Send(change); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func changeTypeProto(change ChangeType) incidentpb.ChangeType {
+	switch change {
+	case ChangeCreated:
+		return incidentpb.ChangeType_CHANGE_TYPE_CREATED
+	case ChangeUpdated:
+		return incidentpb.ChangeType_CHANGE_TYPE_UPDATED
+	case ChangeCleared:
+		return incidentpb.ChangeType_CHANGE_TYPE_CLEARED
+	}
+	return incidentpb.ChangeType_CHANGE_TYPE_UNSPECIFIED
+}
+
+func incidentProto(p IncidentPayload, impacts []RouteImpact) *incidentpb.Incident {
+	out := &incidentpb.Incident{
+		Source:             p.Source,
+		SourceId:           p.SourceID,
+		EventType:          p.EventType,
+		Status:             p.Status,
+		Address:            p.Address,
+		City:               p.City,
+		County:             p.County,
+		Road:               p.Road,
+		RoadNormalized:     p.RoadNormalized,
+		Direction:          p.Direction,
+		Latitude:           p.Latitude,
+		Longitude:          p.Longitude,
+		StartTime:          timestamppb.New(p.StartTime),
+		ProblemDetail:      p.ProblemDetail,
+		Severity:           int32(p.Severity),
+		NormalizedSeverity: int32(p.NormalizedSeverity),
+		RiskScore:          p.RiskScore,
+		LanesClosed:        int32(p.LanesClosed),
+		LanesTotal:         int32(p.LanesTotal),
+		SourceUpdated:      p.SourceUpdated,
+		Summary:            p.Summary,
+	}
+	if p.EndTime != nil {
+		out.EndTime = timestamppb.New(*p.EndTime)
+	}
+	if p.Weather != nil {
+		out.Weather = &incidentpb.Weather{Temperature: int32(p.Weather.Temperature), WindSpeed: p.Weather.WindSpeed, ShortForecast: p.Weather.ShortForecast}
+	}
+	for _, ri := range impacts {
+		pb := &incidentpb.RouteImpact{RouteId: int32(ri.RouteID), RouteName: ri.RouteName, Score: ri.Score}
+		if ri.PositionMeters >= 0 {
+			pb.DistanceM = &ri.DistanceMeters
+			pb.PositionM = &ri.PositionMeters
+		}
+		out.RouteImpacts = append(out.RouteImpacts, pb)
+	}
+	if p.Details != nil {
+		if details, err := json.Marshal(p.Details); err == nil {
+			out.DetailsJson = string(details)
+		}
+	}
+	return out
+}
+
+// grpcKey applies the HTTP API's key and rate-limit rules to a call,
+// taking the key from "authorization: Bearer" or "x-api-key" metadata.
+func (s *server) grpcKey(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key string
+	if v := md.Get("authorization"); len(v) > 0 {
+		key, _ = strings.CutPrefix(v[0], "Bearer ")
+	} else if v := md.Get("x-api-key"); len(v) > 0 {
+		key = v[0]
+	}
+	if key == "" {
+		if s.cfg.APIAuth {
+			return "-", status.Error(codes.Unauthenticated, "API key required")
+		}
+		return "-", nil
+	}
+	k, ok, err := s.keys.lookup(ctx, key)
+	if err != nil {
+		logFor("grpc").Error("Error loading API keys", "err", err)
+		return "-", status.Error(codes.Internal, "could not check API key")
+	}
+	if !ok {
+		return "-", status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	if ok, wait := s.keys.allow(k); !ok {
+		return k.Name, status.Errorf(codes.ResourceExhausted, "rate limit exceeded; retry in %s", wait.Round(time.Second))
+	}
+	return k.Name, nil
+}
+
+func (s *server) grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	name, err := s.grpcKey(ctx)
+	var resp interface{}
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	logFor("grpc").Info("Call", "method", info.FullMethod, "code", status.Code(err).String(),
+		"duration", time.Since(start).Round(time.Millisecond).String(), "key", name)
+	return resp, err
+}
+
+func (s *server) grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	name, err := s.grpcKey(ss.Context())
+	if err == nil {
+		err = handler(srv, ss)
+	}
+	logFor("grpc").Info("Stream", "method", info.FullMethod, "code", status.Code(err).String(),
+		"duration", time.Since(start).Round(time.Millisecond).String(), "key", name)
+	return err
+}
+
+// serveGRPC serves the incident service on addr until ctx is done.
+func (s *server) serveGRPC(ctx context.Context, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	gs := grpc.NewServer(grpc.UnaryInterceptor(s.grpcUnaryAuth), grpc.StreamInterceptor(s.grpcStreamAuth))
+	incidentpb.RegisterIncidentServiceServer(gs, &grpcServer{s: s})
+	go func() {
+		<-ctx.Done()
+		// Watch streams never finish on their own, so give the rest a
+		// moment and then cut them off.
+		done := make(chan struct{})
+		go func() {
+			gs.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			gs.Stop()
+		}
+	}()
+	logFor("grpc").Info("Serving gRPC", "addr", addr)
+	return gs.Serve(lis)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An ingest daemon serves /healthz and /readyz alongside /metrics.
+// /healthz only says the process is up. /readyz says it is actually
+// ingesting: Postgres answers, a run (see ingest_runs) succeeded within
+// READY_MAX_POLL_AGE (three poll intervals by default), and no source's
+// newest update is older than SOURCE_STALE_AFTER. Both answer 503 with the failing checks
+// when they fail.
+
+// sourceHealth is what the last successful fetch of a source looked like.
+type sourceHealth struct {
+	fetchedAt time.Time
+	incidents int
+	// newestUpdate is the latest update time the source reported on any
+	// of its incidents; zero if none parsed.
+	newestUpdate time.Time
+}
+
+var ingestHealth struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	sources     map[string]sourceHealth
+}
+
+// recordSourceFetch notes a successful fetch of a source's feed.
+func recordSourceFetch(source string, incidents []Incident) {
+	h := sourceHealth{fetchedAt: time.Now(), incidents: len(incidents)}
+	for _, incident := range incidents {
+		if t, err := parseFeedTime(incident.LastUpdate); err == nil && t.After(h.newestUpdate) {
+			h.newestUpdate = t
+		}
+	}
+	ingestHealth.mu.Lock()
+	defer ingestHealth.mu.Unlock()
+	if ingestHealth.sources == nil {
+		ingestHealth.sources = map[string]sourceHealth{}
+	}
+	ingestHealth.sources[source] = h
+}
+
+// recordRunSuccess notes a run that completed.
+func recordRunSuccess() {
+	ingestHealth.mu.Lock()
+	defer ingestHealth.mu.Unlock()
+	ingestHealth.lastSuccess = time.Now()
+}
+
+// readiness checks whether the daemon is keeping up.
+type readiness struct {
+	db *sql.DB
+	// maxPollAge is how long ago the last successful run may have been.
+	maxPollAge time.Duration
+	// staleAfter is how old a source's newest update may be; zero
+	// disables the check.
+	staleAfter time.Duration
+}
+
+func newReadiness(cfg *Config, db *sql.DB, interval time.Duration) *readiness {
+	r := &readiness{db: db, maxPollAge: cfg.ReadyMaxPollAge, staleAfter: cfg.SourceStaleAfter}
+	if r.maxPollAge <= 0 {
+		r.maxPollAge = 3 * interval
+	}
+	return r
+}
+
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (r *readiness) check(ctx context.Context) map[string]healthCheck {
+	checks := map[string]healthCheck{}
+
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := r.db.PingContext(pingCtx); err != nil {
+		checks["database"] = healthCheck{Detail: err.Error()}
+	} else {
+		checks["database"] = healthCheck{OK: true}
+	}
+
+	ingestHealth.mu.Lock()
+	lastSuccess := ingestHealth.lastSuccess
+	sources := make(map[string]sourceHealth, len(ingestHealth.sources))
+	for name, h := range ingestHealth.sources {
+		sources[name] = h
+	}
+	ingestHealth.mu.Unlock()
+	// ingest_runs survives restarts, so a daemon that just came back up
+	// is judged on its predecessor's last run.
+	if t, err := lastSuccessfulRun(pingCtx, r.db); err == nil && t.After(lastSuccess) {
+		lastSuccess = t
+	}
+
+	switch age := time.Since(lastSuccess); {
+	case lastSuccess.IsZero():
+		checks["last_poll"] = healthCheck{Detail: "no successful run yet"}
+	case age > r.maxPollAge:
+		checks["last_poll"] = healthCheck{Detail: "last successful run " + age.Round(time.Second).String() + " ago"}
+	default:
+		checks["last_poll"] = healthCheck{OK: true, Detail: age.Round(time.Second).String() + " ago"}
+	}
+
+	for name, h := range sources {
+		key := "source:" + name
+		switch age := time.Since(h.newestUpdate); {
+		case r.staleAfter <= 0 || h.newestUpdate.IsZero():
+			// An empty feed, or one without usable update times, isn't
+			// evidence of staleness.
+			checks[key] = healthCheck{OK: true}
+		case age > r.staleAfter:
+			checks[key] = healthCheck{Detail: "newest update " + age.Round(time.Minute).String() + " old"}
+		default:
+			checks[key] = healthCheck{OK: true, Detail: "newest update " + age.Round(time.Minute).String() + " old"}
+		}
+	}
+	return checks
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+func (rd *readiness) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := rd.check(r.Context())
+	status, code := "ok", http.StatusOK
+	var failing []string
+	for name, c := range checks {
+		if !c.OK {
+			failing = append(failing, name)
+		}
+	}
+	if len(failing) > 0 {
+		sort.Strings(failing)
+		status, code = "unavailable", http.StatusServiceUnavailable
+		logFor("metrics").Debug("Not ready", "failing", failing)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Heartbeats tell a dead man's switch (healthchecks.io, Dead Man's Snitch,
+// Cronitor...) that ingest is still running. HEARTBEAT_URL is pinged after
+// every successful run and HEARTBEAT_FAIL_URL (HEARTBEAT_URL + "/fail" by
+// default, as healthchecks.io expects; "none" to only ever ping on
+// success) after a failed one. The ping body is the run summary or error,
+// which healthchecks.io keeps with the ping.
+
+var heartbeatClient = &http.Client{Timeout: 10 * time.Second}
+
+// heartbeatFailURL is where failures are reported, empty for nowhere.
+func (c *Config) heartbeatFailURL() string {
+	switch c.HeartbeatFailURL {
+	case "none":
+		return ""
+	case "":
+		return strings.TrimRight(c.HeartbeatURL, "/") + "/fail"
+	}
+	return c.HeartbeatFailURL
+}
+
+// pingHeartbeat reports the outcome of a run. Failing to ping is only
+// logged: the switch going off is what tells someone.
+func pingHeartbeat(cfg *Config, run *ingestRun) {
+	if cfg.HeartbeatURL == "" {
+		return
+	}
+	url := cfg.HeartbeatURL
+	body := fmt.Sprintf("run %s: fetched %d, saved %d (%d created, %d updated, %d cleared), %d errors, %d quarantined in %dms\n",
+		run.RunID, run.Fetched, run.Saved, run.Created, run.Updated, run.Cleared, run.Errors, run.Quarantined, run.DurationMS)
+	if run.Outcome == "error" {
+		if url = cfg.heartbeatFailURL(); url == "" {
+			return
+		}
+		body = fmt.Sprintf("run %s failed: %s\n", run.RunID, run.Error)
+	}
+
+	// The run's context may already be cancelled if that's why it failed.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(body))
+	if err != nil {
+		logFor("ingest").Warn("Heartbeat ping failed", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := heartbeatClient.Do(req)
+	if err != nil {
+		logFor("ingest").Warn("Heartbeat ping failed", "err", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		logFor("ingest").Warn("Heartbeat ping failed", "status", resp.Status)
+	}
+}
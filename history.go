@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// GET /stats/location summarizes the incident history at a place: how many
+// incidents and how long they took to clear, by month of the year, day of
+// the week and hour of the day (Eastern), and by type. The place is a point
+// and radius (lat=, lon=, radius= in meters, default 250) or a stretch of
+// road (road= with milepost_from= and milepost_to=). since= and until=
+// bound the history; event_type= narrows it.
+
+const (
+	historyDefaultRadius = 250
+	historyMaxRadius     = 5000
+	historyMaxRows       = 100000
+)
+
+// historyBucket is the incidents falling in one month, weekday or hour.
+type historyBucket struct {
+	Count int `json:"count"`
+	// MeanMinutes is the mean time to clear of those that have cleared.
+	MeanMinutes *float64 `json:"mean_minutes"`
+
+	cleared int
+	total   float64
+}
+
+func (b *historyBucket) add(minutes float64, cleared bool) {
+	b.Count++
+	if cleared {
+		b.cleared++
+		b.total += minutes
+	}
+}
+
+func (b *historyBucket) finish() {
+	if b.cleared > 0 {
+		mean := math.Round(b.total/float64(b.cleared)*10) / 10
+		b.MeanMinutes = &mean
+	}
+}
+
+type durationSummary struct {
+	Cleared       int     `json:"cleared"`
+	MeanMinutes   float64 `json:"mean_minutes"`
+	MedianMinutes float64 `json:"median_minutes"`
+	P90Minutes    float64 `json:"p90_minutes"`
+}
+
+type locationHistory struct {
+	Location     map[string]interface{} `json:"location"`
+	Incidents    int                    `json:"incidents"`
+	First        *time.Time             `json:"first,omitempty"`
+	Last         *time.Time             `json:"last,omitempty"`
+	Duration     durationSummary        `json:"duration"`
+	MonthLabels  []string               `json:"month_labels"`
+	ByMonth      []historyBucket        `json:"by_month"`
+	WeekdayNames []string               `json:"day_of_week_labels"`
+	ByDayOfWeek  []historyBucket        `json:"by_day_of_week"`
+	ByHour       []historyBucket        `json:"by_hour"`
+	ByEventType  map[string]int         `json:"by_event_type"`
+	// Truncated is set when only the first historyMaxRows were counted.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func (s *server) handleLocationHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseIncidentFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Status, f.Limit, f.Offset = "", 0, 0
+	number := func(name string) (float64, bool, error) {
+		v := q.Get(name)
+		if v == "" {
+			return 0, false, nil
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return 0, false, fmt.Errorf("invalid %s %q", name, v)
+		}
+		return n, true, nil
+	}
+	lat, hasLat, errLat := number("lat")
+	lon, hasLon, errLon := number("lon")
+	radius, hasRadius, errRadius := number("radius")
+	from, hasFrom, errFrom := number("milepost_from")
+	to, hasTo, errTo := number("milepost_to")
+	for _, err := range []error{errLat, errLon, errRadius, errFrom, errTo} {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := locationHistory{
+		ByMonth:      make([]historyBucket, 12),
+		ByDayOfWeek:  make([]historyBucket, 7),
+		ByHour:       make([]historyBucket, 24),
+		ByEventType:  map[string]int{},
+		MonthLabels:  []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+		WeekdayNames: []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+	}
+	where, args := "", []interface{}(nil)
+	switch {
+	case hasLat && hasLon:
+		if !hasRadius {
+			radius = historyDefaultRadius
+		}
+		if radius <= 0 || radius > historyMaxRadius {
+			http.Error(w, fmt.Sprintf("radius must be between 0 and %d meters", historyMaxRadius), http.StatusBadRequest)
+			return
+		}
+		f.Near, f.RadiusMeters = &LatLon{Lat: lat, Lon: lon}, radius
+		where, args = f.where()
+		resp.Location = map[string]interface{}{"lat": lat, "lon": lon, "radius_m": radius}
+	case f.Road != "" && hasFrom && hasTo:
+		where, args = f.where()
+		where += numberPlaceholders(" AND milepost BETWEEN least(?, ?) AND greatest(?, ?)", len(args)+1)
+		args = append(args, from, to, from, to)
+		resp.Location = map[string]interface{}{"road": f.Road, "milepost_from": from, "milepost_to": to}
+	default:
+		http.Error(w, "give lat and lon, or road with milepost_from and milepost_to", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT timestamp, event_type,
+			extract(epoch FROM coalesce(cleared_at, CASE WHEN status = 'cleared' THEN end_time END) - timestamp) / 60
+		FROM unified_incidents `+where+`
+		ORDER BY timestamp
+		LIMIT `+strconv.Itoa(historyMaxRows+1), args...)
+	if err != nil {
+		logFor("api").Error("Error loading location history", "err", err)
+		http.Error(w, "could not load history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var durations []float64
+	for rows.Next() {
+		var start time.Time
+		var eventType string
+		var minutes *float64
+		if err := rows.Scan(&start, &eventType, &minutes); err != nil {
+			logFor("api").Error("Error loading location history", "err", err)
+			http.Error(w, "could not load history", http.StatusInternalServerError)
+			return
+		}
+		if resp.Incidents == historyMaxRows {
+			resp.Truncated = true
+			break
+		}
+		resp.Incidents++
+		if resp.First == nil {
+			resp.First = &start
+		}
+		resp.Last = &start
+		cleared := minutes != nil && *minutes >= 0
+		var m float64
+		if cleared {
+			m = *minutes
+			durations = append(durations, m)
+		}
+		local := start.In(easternTime)
+		resp.ByMonth[local.Month()-1].add(m, cleared)
+		resp.ByDayOfWeek[local.Weekday()].add(m, cleared)
+		resp.ByHour[local.Hour()].add(m, cleared)
+		resp.ByEventType[eventType]++
+	}
+	if err := rows.Err(); err != nil {
+		logFor("api").Error("Error loading location history", "err", err)
+		http.Error(w, "could not load history", http.StatusInternalServerError)
+		return
+	}
+	for _, buckets := range [][]historyBucket{resp.ByMonth, resp.ByDayOfWeek, resp.ByHour} {
+		for i := range buckets {
+			buckets[i].finish()
+		}
+	}
+	if len(durations) > 0 {
+		sort.Float64s(durations)
+		var total float64
+		for _, d := range durations {
+			total += d
+		}
+		round := func(v float64) float64 { return math.Round(v*10) / 10 }
+		resp.Duration = durationSummary{
+			Cleared:       len(durations),
+			MeanMinutes:   round(total / float64(len(durations))),
+			MedianMinutes: round(durations[len(durations)/2]),
+			P90Minutes:    round(durations[int(float64(len(durations)-1)*0.9)]),
+		}
+	}
+	writeJSON(w, "application/json", resp)
+}
@@ -0,0 +1,105 @@
+package main
+
+import "time"
+
+// holidayName reports whether the calendar date of t is a US federal or
+// North Carolina state holiday (either the actual date or its observed
+// weekday), returning the holiday's name.
+func holidayName(t time.Time) (string, bool) {
+	date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	// Observed dates can spill into the neighbouring year (New Year's Day on
+	// a Saturday is observed on December 31st), so check both.
+	for _, year := range []int{t.Year(), t.Year() + 1} {
+		for _, h := range holidaysForYear(year) {
+			if h.date.Equal(date) || h.observed.Equal(date) {
+				return h.name, true
+			}
+		}
+	}
+	return "", false
+}
+
+type holiday struct {
+	name     string
+	date     time.Time
+	observed time.Time
+}
+
+// holidaysForYear lists US federal holidays plus the extra days the State
+// of North Carolina gives its employees (Good Friday, the day after
+// Thanksgiving, and the extra Christmas days).
+func holidaysForYear(year int) []holiday {
+	fixed := func(name string, month time.Month, day int) holiday {
+		d := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		return holiday{name: name, date: d, observed: observedDate(d)}
+	}
+	floating := func(name string, d time.Time) holiday {
+		return holiday{name: name, date: d, observed: d}
+	}
+
+	easter := easterSunday(year)
+	thanksgiving := nthWeekday(year, time.November, time.Thursday, 4)
+
+	return []holiday{
+		fixed("New Year's Day", time.January, 1),
+		floating("Martin Luther King Jr. Day", nthWeekday(year, time.January, time.Monday, 3)),
+		floating("Presidents' Day", nthWeekday(year, time.February, time.Monday, 3)),
+		floating("Good Friday", easter.AddDate(0, 0, -2)),
+		floating("Memorial Day", lastWeekday(year, time.May, time.Monday)),
+		fixed("Juneteenth", time.June, 19),
+		fixed("Independence Day", time.July, 4),
+		floating("Labor Day", nthWeekday(year, time.September, time.Monday, 1)),
+		floating("Columbus Day", nthWeekday(year, time.October, time.Monday, 2)),
+		fixed("Veterans Day", time.November, 11),
+		floating("Thanksgiving Day", thanksgiving),
+		floating("Day After Thanksgiving", thanksgiving.AddDate(0, 0, 1)),
+		fixed("Christmas Eve", time.December, 24),
+		fixed("Christmas Day", time.December, 25),
+		fixed("Day After Christmas", time.December, 26),
+	}
+}
+
+// observedDate shifts a fixed-date holiday off the weekend the way the
+// federal calendar does: Saturday to Friday, Sunday to Monday.
+func observedDate(d time.Time) time.Time {
+	switch d.Weekday() {
+	case time.Saturday:
+		return d.AddDate(0, 0, -1)
+	case time.Sunday:
+		return d.AddDate(0, 0, 1)
+	}
+	return d
+}
+
+// nthWeekday returns the nth occurrence (1-based) of weekday in the month.
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	offset := (int(weekday) - int(first.Weekday()) + 7) % 7
+	return first.AddDate(0, 0, offset+7*(n-1))
+}
+
+// lastWeekday returns the last occurrence of weekday in the month.
+func lastWeekday(year int, month time.Month, weekday time.Weekday) time.Time {
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+	offset := (int(last.Weekday()) - int(weekday) + 7) % 7
+	return last.AddDate(0, 0, -offset)
+}
+
+// easterSunday computes Western Easter using the anonymous Gregorian algorithm.
+func easterSunday(year int) time.Time {
+	a := year % 19
+	b := year / 100
+	c := year % 100
+	d := b / 4
+	e := b % 4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i := c / 4
+	k := c % 4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// homeAssistant maintains a few summary sensors over MQTT and announces
+// them with Home Assistant's MQTT discovery, so they appear in HA without
+// any YAML:
+//
+//   - nearest incident: miles from HomeLat/HomeLon to the closest active
+//     incident
+//   - county incidents: active incidents in County
+//   - commute impact: the highest impact score on the saved route
+//     CommuteRoute
+//
+// Each sensor is only created when its setting is present. Sensors are
+// refreshed at the end of every run.
+type homeAssistant struct {
+	client          *mqttClient
+	discoveryPrefix string
+	stateTopic      string
+
+	home         *LatLon
+	nearestMiles float64
+	county       string
+	commuteRoute string
+}
+
+func newHomeAssistant(cfg *Config, client *mqttClient) *homeAssistant {
+	ha := &homeAssistant{
+		client:          client,
+		discoveryPrefix: cfg.HADiscoveryPrefix,
+		stateTopic:      cfg.HAStateTopic,
+		nearestMiles:    cfg.HANearestMaxMiles,
+		county:          cfg.HACounty,
+		commuteRoute:    cfg.HACommuteRoute,
+	}
+	if cfg.HAHomeLat != 0 || cfg.HAHomeLon != 0 {
+		ha.home = &LatLon{Lat: cfg.HAHomeLat, Lon: cfg.HAHomeLon}
+	}
+	return ha
+}
+
+// haSensor is one sensor's discovery settings and current value.
+type haSensor struct {
+	id         string
+	name       string
+	icon       string
+	unit       string
+	state      interface{}
+	attributes map[string]interface{}
+}
+
+// Update recomputes every configured sensor and publishes its discovery
+// config, state and attributes (all retained).
+func (ha *homeAssistant) Update(ctx context.Context, db *sql.DB) error {
+	defer ha.client.Close()
+
+	var sensors []haSensor
+	if ha.home != nil {
+		s, err := ha.nearestIncident(db)
+		if err != nil {
+			return err
+		}
+		sensors = append(sensors, s)
+	}
+	if ha.county != "" {
+		s, err := ha.countyIncidents(db)
+		if err != nil {
+			return err
+		}
+		sensors = append(sensors, s)
+	}
+	if ha.commuteRoute != "" {
+		s, err := ha.commuteImpact(db)
+		if err != nil {
+			return err
+		}
+		sensors = append(sensors, s)
+	}
+
+	for _, s := range sensors {
+		if err := ha.publish(ctx, s); err != nil {
+			return fmt.Errorf("could not publish Home Assistant sensor %s: %w", s.id, err)
+		}
+	}
+	return nil
+}
+
+func (ha *homeAssistant) publish(ctx context.Context, s haSensor) error {
+	base := ha.stateTopic + "/" + s.id
+	config := map[string]interface{}{
+		"name":                  s.name,
+		"unique_id":             "ncdot_ingester_" + s.id,
+		"object_id":             "ncdot_" + s.id,
+		"state_topic":           base + "/state",
+		"json_attributes_topic": base + "/attributes",
+		"icon":                  s.icon,
+		"device": map[string]interface{}{
+			"identifiers":  []string{"ncdot_ingester"},
+			"name":         "NCDOT Incidents",
+			"manufacturer": "patrolx",
+			"model":        "ncdot-ingester",
+		},
+	}
+	if s.unit != "" {
+		config["unit_of_measurement"] = s.unit
+		config["state_class"] = "measurement"
+	}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	attributesJSON, err := json.Marshal(s.attributes)
+	if err != nil {
+		return err
+	}
+	// HA reads "None" as an unknown state.
+	state := "None"
+	if s.state != nil {
+		state = fmt.Sprint(s.state)
+	}
+
+	configTopic := fmt.Sprintf("%s/sensor/ncdot_ingester/%s/config", ha.discoveryPrefix, s.id)
+	if err := ha.client.Publish(ctx, configTopic, configJSON, 1, true); err != nil {
+		return err
+	}
+	if err := ha.client.Publish(ctx, base+"/attributes", attributesJSON, 1, true); err != nil {
+		return err
+	}
+	return ha.client.Publish(ctx, base+"/state", []byte(state), 1, true)
+}
+
+// haIncident is the per-incident detail listed in sensor attributes.
+type haIncident struct {
+	EventType string  `json:"event_type"`
+	Road      string  `json:"road,omitempty"`
+	Address   string  `json:"address"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Miles     float64 `json:"miles,omitempty"`
+	Impact    float64 `json:"impact,omitempty"`
+}
+
+func (ha *homeAssistant) nearestIncident(db *sql.DB) (haSensor, error) {
+	s := haSensor{id: "nearest_incident", name: "Nearest incident", icon: "mdi:car-emergency", unit: "mi"}
+
+	// Prefilter with a bounding box a little larger than the radius.
+	deg := ha.nearestMiles * metersPerMile / 111000 * 1.2
+	lonDeg := deg / math.Max(0.2, math.Cos(ha.home.Lat*math.Pi/180))
+	rows, err := db.Query(`
+		SELECT event_type, coalesce(road_normalized, ''), address, latitude, longitude
+		FROM unified_incidents
+		WHERE status = 'active' AND latitude BETWEEN $1 AND $2 AND longitude BETWEEN $3 AND $4`,
+		ha.home.Lat-deg, ha.home.Lat+deg, ha.home.Lon-lonDeg, ha.home.Lon+lonDeg)
+	if err != nil {
+		return s, fmt.Errorf("could not query nearby incidents: %w", err)
+	}
+	defer rows.Close()
+
+	var nearest *haIncident
+	for rows.Next() {
+		var i haIncident
+		if err := rows.Scan(&i.EventType, &i.Road, &i.Address, &i.Latitude, &i.Longitude); err != nil {
+			return s, err
+		}
+		i.Miles = math.Round(haversineMeters(*ha.home, LatLon{Lat: i.Latitude, Lon: i.Longitude})/metersPerMile*10) / 10
+		if i.Miles <= ha.nearestMiles && (nearest == nil || i.Miles < nearest.Miles) {
+			nearest = &i
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+
+	s.attributes = map[string]interface{}{}
+	if nearest != nil {
+		s.state = nearest.Miles
+		s.attributes["incident"] = nearest
+		s.attributes["title"] = nearest.EventType + " " + firstNonEmpty(nearest.Road, nearest.Address)
+	}
+	return s, nil
+}
+
+func (ha *homeAssistant) countyIncidents(db *sql.DB) (haSensor, error) {
+	s := haSensor{id: "county_incidents", name: ha.county + " County incidents", icon: "mdi:road-variant", unit: "incidents"}
+	rows, err := db.Query(`
+		SELECT event_type, coalesce(road_normalized, ''), address, latitude, longitude
+		FROM unified_incidents
+		WHERE status = 'active' AND lower(county_name) = lower($1)
+		ORDER BY timestamp DESC`, ha.county)
+	if err != nil {
+		return s, fmt.Errorf("could not query county incidents: %w", err)
+	}
+	defer rows.Close()
+
+	incidents := []haIncident{}
+	for rows.Next() {
+		var i haIncident
+		if err := rows.Scan(&i.EventType, &i.Road, &i.Address, &i.Latitude, &i.Longitude); err != nil {
+			return s, err
+		}
+		incidents = append(incidents, i)
+	}
+	s.state = len(incidents)
+	s.attributes = map[string]interface{}{"county": ha.county, "incidents": incidents}
+	return s, rows.Err()
+}
+
+func (ha *homeAssistant) commuteImpact(db *sql.DB) (haSensor, error) {
+	s := haSensor{id: "commute_impact", name: "Commute impact", icon: "mdi:car-clock"}
+	rows, err := db.Query(`
+		SELECT u.event_type, coalesce(u.road_normalized, ''), u.address, u.latitude, u.longitude, i.impact_score
+		FROM incident_route_impacts i
+		JOIN saved_routes r ON r.id = i.route_id
+		JOIN unified_incidents u ON u.source = i.source AND u.source_id = i.source_id
+		WHERE r.name = $1 AND u.status = 'active'`, ha.commuteRoute)
+	if err != nil {
+		return s, fmt.Errorf("could not query commute impacts: %w", err)
+	}
+	defer rows.Close()
+
+	incidents := []haIncident{}
+	for rows.Next() {
+		var i haIncident
+		if err := rows.Scan(&i.EventType, &i.Road, &i.Address, &i.Latitude, &i.Longitude, &i.Impact); err != nil {
+			return s, err
+		}
+		incidents = append(incidents, i)
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+	sort.Slice(incidents, func(a, b int) bool { return incidents[a].Impact > incidents[b].Impact })
+
+	s.state = 0.0
+	if len(incidents) > 0 {
+		s.state = incidents[0].Impact
+	}
+	s.attributes = map[string]interface{}{"route": ha.commuteRoute, "incidents": incidents}
+	return s, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The hotspots job clusters the last few hours of unplanned incidents,
+// DBSCAN style: an incident with at least -min-incidents (itself
+// included) within -radius meters starts or grows a cluster. Each cluster
+// is a hotspot with a centroid, a count and its most common type, county
+// and road. A cluster that shares an incident with an open hotspot, or
+// whose centroid is within the radius of one, continues it; the others
+// are new, and are notified as a "Hotspot" event (black ice on a bridge,
+// say, long before anyone reports it as such). Open hotspots with no
+// cluster this time are closed, and notified as cleared.
+
+// hotspotIncident is an incident as the clustering sees it.
+type hotspotIncident struct {
+	key                     string
+	pt                      LatLon
+	eventType, county, road string
+}
+
+// hotspot is a row of the hotspots table.
+type hotspot struct {
+	ID           int64
+	Centroid     LatLon
+	Count        int
+	DominantType string
+	County       string
+	Road         string
+	IncidentKeys []string
+	FirstSeenAt  time.Time
+}
+
+func hotspotJob(cfg *Config, db *sql.DB, fs *flag.FlagSet) analyticsJob {
+	window := fs.Duration("window", cfg.HotspotWindow, "cluster incidents that started this recently")
+	radius := fs.Float64("radius", cfg.HotspotRadiusMeters, "neighbourhood radius in meters")
+	minIncidents := fs.Int("min-incidents", cfg.HotspotMinIncidents, "incidents within the radius that make a hotspot")
+	return func(ctx context.Context, sinks *sinkDispatcher) error {
+		incidents, err := recentUnplanned(ctx, db, time.Now().Add(-*window), cfg.PlannedEventTypes)
+		if err != nil {
+			return err
+		}
+		clusters := clusterIncidents(incidents, *radius, *minIncidents)
+		open, err := openHotspots(ctx, db)
+		if err != nil {
+			return err
+		}
+		var created int
+		continued := map[int64]bool{}
+		for _, members := range clusters {
+			h := summarizeCluster(members)
+			if prev := matchHotspot(open, h, *radius); prev != nil && !continued[prev.ID] {
+				h.ID, h.FirstSeenAt = prev.ID, prev.FirstSeenAt
+				continued[h.ID] = true
+				if err := updateHotspot(ctx, db, h); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := insertHotspot(ctx, db, &h); err != nil {
+				return err
+			}
+			created++
+			sinks.Publish(h.event(ChangeCreated, *window, *radius))
+		}
+		for _, h := range open {
+			if continued[h.ID] {
+				continue
+			}
+			if _, err := db.ExecContext(ctx, `UPDATE hotspots SET ended_at = now() WHERE id = $1`, h.ID); err != nil {
+				return fmt.Errorf("could not close hotspot %d: %w", h.ID, err)
+			}
+			sinks.Publish(h.event(ChangeCleared, *window, *radius))
+		}
+		logFor("analytics").Info("Hotspots updated", "incidents", len(incidents), "hotspots", len(clusters),
+			"new", created, "closed", len(open)-len(continued))
+		return nil
+	}
+}
+
+// recentUnplanned loads the incidents that started since then, leaving
+// out planned work and events.
+func recentUnplanned(ctx context.Context, db *sql.DB, since time.Time, planned []string) ([]hotspotIncident, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT source, source_id, latitude, longitude, event_type, coalesce(county_name, ''), coalesce(road_normalized, '')
+		FROM unified_incidents
+		WHERE timestamp >= $1 AND NOT (latitude = 0 AND longitude = 0)
+			AND NOT (event_type = ANY($2) OR coalesce(raw_event_type, '') = ANY($2))`,
+		since, pq.Array(planned))
+	if err != nil {
+		return nil, fmt.Errorf("could not load recent incidents: %w", err)
+	}
+	defer rows.Close()
+	var incidents []hotspotIncident
+	for rows.Next() {
+		var i hotspotIncident
+		var source, sourceID string
+		if err := rows.Scan(&source, &sourceID, &i.pt.Lat, &i.pt.Lon, &i.eventType, &i.county, &i.road); err != nil {
+			return nil, err
+		}
+		i.key = source + ":" + sourceID
+		incidents = append(incidents, i)
+	}
+	return incidents, rows.Err()
+}
+
+// clusterIncidents is DBSCAN over the incidents, by great-circle distance.
+// A few hundred incidents at most are recent, so comparing every pair is
+// fine. It returns the clusters; noise is left out.
+func clusterIncidents(incidents []hotspotIncident, radius float64, minIncidents int) [][]hotspotIncident {
+	neighbours := func(i int) []int {
+		var near []int
+		for j := range incidents {
+			if haversineMeters(incidents[i].pt, incidents[j].pt) <= radius {
+				near = append(near, j)
+			}
+		}
+		return near
+	}
+	const noise = -1
+	label := make([]int, len(incidents))
+	var clusters [][]hotspotIncident
+	for i := range incidents {
+		if label[i] != 0 {
+			continue
+		}
+		near := neighbours(i)
+		if len(near) < minIncidents {
+			label[i] = noise
+			continue
+		}
+		cluster := len(clusters) + 1
+		label[i] = cluster
+		for queue := near; len(queue) > 0; queue = queue[1:] {
+			j := queue[0]
+			if label[j] == noise {
+				// On the edge: in the cluster, but doesn't extend it.
+				label[j] = cluster
+			}
+			if label[j] != 0 {
+				continue
+			}
+			label[j] = cluster
+			if more := neighbours(j); len(more) >= minIncidents {
+				queue = append(queue, more...)
+			}
+		}
+		var members []hotspotIncident
+		for j := range incidents {
+			if label[j] == cluster {
+				members = append(members, incidents[j])
+			}
+		}
+		clusters = append(clusters, members)
+	}
+	return clusters
+}
+
+func summarizeCluster(members []hotspotIncident) hotspot {
+	h := hotspot{Count: len(members)}
+	var types, counties, roads []string
+	for _, m := range members {
+		h.Centroid.Lat += m.pt.Lat / float64(len(members))
+		h.Centroid.Lon += m.pt.Lon / float64(len(members))
+		types, counties, roads = append(types, m.eventType), append(counties, m.county), append(roads, m.road)
+		h.IncidentKeys = append(h.IncidentKeys, m.key)
+	}
+	h.DominantType, h.County, h.Road = mostCommon(types), mostCommon(counties), mostCommon(roads)
+	return h
+}
+
+// matchHotspot finds the open hotspot h continues, if any.
+func matchHotspot(open []hotspot, h hotspot, radius float64) *hotspot {
+	for i := range open {
+		for _, k := range h.IncidentKeys {
+			if containsFold(open[i].IncidentKeys, k) {
+				return &open[i]
+			}
+		}
+	}
+	for i := range open {
+		if haversineMeters(open[i].Centroid, h.Centroid) <= radius {
+			return &open[i]
+		}
+	}
+	return nil
+}
+
+func openHotspots(ctx context.Context, db *sql.DB) ([]hotspot, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, latitude, longitude, incident_count, dominant_type, coalesce(county_name, ''),
+			coalesce(road_normalized, ''), incident_ids, first_seen_at
+		FROM hotspots WHERE ended_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("could not load open hotspots: %w", err)
+	}
+	defer rows.Close()
+	var open []hotspot
+	for rows.Next() {
+		var h hotspot
+		if err := rows.Scan(&h.ID, &h.Centroid.Lat, &h.Centroid.Lon, &h.Count, &h.DominantType, &h.County,
+			&h.Road, pq.Array(&h.IncidentKeys), &h.FirstSeenAt); err != nil {
+			return nil, err
+		}
+		open = append(open, h)
+	}
+	return open, rows.Err()
+}
+
+func insertHotspot(ctx context.Context, db *sql.DB, h *hotspot) error {
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO hotspots (latitude, longitude, incident_count, dominant_type, county_name, road_normalized, incident_ids)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7)
+		RETURNING id, first_seen_at`,
+		h.Centroid.Lat, h.Centroid.Lon, h.Count, h.DominantType, h.County, h.Road, pq.Array(h.IncidentKeys)).Scan(&h.ID, &h.FirstSeenAt)
+	if err != nil {
+		return fmt.Errorf("could not save hotspot: %w", err)
+	}
+	return nil
+}
+
+func updateHotspot(ctx context.Context, db *sql.DB, h hotspot) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE hotspots SET latitude = $2, longitude = $3, incident_count = $4, dominant_type = $5,
+			county_name = NULLIF($6, ''), road_normalized = NULLIF($7, ''), incident_ids = $8, last_seen_at = now()
+		WHERE id = $1`,
+		h.ID, h.Centroid.Lat, h.Centroid.Lon, h.Count, h.DominantType, h.County, h.Road, pq.Array(h.IncidentKeys))
+	if err != nil {
+		return fmt.Errorf("could not update hotspot %d: %w", h.ID, err)
+	}
+	return nil
+}
+
+// event is the hotspot as a notification.
+func (h hotspot) event(change ChangeType, window time.Duration, radius float64) IncidentEvent {
+	summary := fmt.Sprintf("%d incidents within %.1f km in the last %gh, mostly %s", h.Count, radius/1000, window.Hours(), h.DominantType)
+	if h.Road != "" {
+		summary += " on " + h.Road
+	}
+	if h.County != "" {
+		summary += " in " + h.County + " County"
+	}
+	if change == ChangeCleared {
+		summary = "Hotspot over: " + summary
+	}
+	details := map[string]interface{}{
+		"incident_count": h.Count,
+		"dominant_type":  h.DominantType,
+		"incidents":      h.IncidentKeys,
+		"first_seen_at":  h.FirstSeenAt,
+	}
+	return analyticsEvent(change, "Hotspot", strconv.FormatInt(h.ID, 10), h.Centroid, h.County, h.Road, summary, details)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamClient is the HTTP client for the APIs ingest depends on: the
+// DOT feed and NWS. Each attempt gets HTTP_TIMEOUT, or the dependency's
+// own timeout (FEED_TIMEOUT, NWS_POINTS_TIMEOUT, NWS_HOURLY_TIMEOUT),
+// including reading the body; GETs that time out,
+// fail to connect or get a 5xx or 429 are retried up to HTTP_MAX_ATTEMPTS
+// times with exponential backoff and jitter, starting at
+// HTTP_RETRY_BACKOFF, or after the response's Retry-After if it has one
+// of up to a minute. After HTTP_BREAKER_THRESHOLD consecutive failures a
+// host's breaker opens and its requests fail immediately for
+// HTTP_BREAKER_COOLDOWN, after which one request is let through to see
+// whether it has recovered. A flapping API then costs a run seconds, not
+// minutes.
+var upstreamClient = &http.Client{Transport: newResilientTransport(http.DefaultTransport, defaultResilience)}
+
+// resilience is how hard a resilientTransport tries.
+type resilience struct {
+	timeout          time.Duration
+	maxAttempts      int
+	backoff          time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
+}
+
+var defaultResilience = resilience{
+	timeout:          15 * time.Second,
+	maxAttempts:      3,
+	backoff:          500 * time.Millisecond,
+	breakerThreshold: 5,
+	breakerCooldown:  time.Minute,
+}
+
+// Outbound HTTP goes through http.DefaultTransport, directly or via
+// upstreamClient, so HTTPS_PROXY, HTTP_PROXY and NO_PROXY apply to all of
+// it. CA_BUNDLE adds PEM certificates to the system roots, for proxies
+// that intercept TLS. NWS and Nominatim want a contact address in the
+// User-Agent: CONTACT_EMAIL puts one in the default, and USER_AGENT
+// replaces it altogether.
+
+// setupHTTPClient applies the CA bundle and User-Agent, and the configured
+// timeouts, retries and breaker to upstreamClient.
+func setupHTTPClient(cfg *Config) error {
+	switch {
+	case cfg.UserAgent != "":
+		userAgent = cfg.UserAgent
+	case cfg.ContactEmail != "":
+		userAgent = "(patrolx, " + cfg.ContactEmail + ")"
+	default:
+		logFor("http").Warn("No CONTACT_EMAIL or USER_AGENT set; NWS and Nominatim may refuse requests without a contact")
+	}
+	if cfg.NWSURL != "" {
+		nwsBaseURL = cfg.NWSURL
+	}
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return fmt.Errorf("CA_BUNDLE: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CA_BUNDLE: no certificates found in %s", cfg.CABundle)
+		}
+		transport := http.DefaultTransport.(*http.Transport)
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+	var next http.RoundTripper = http.DefaultTransport
+	if faults.nwsDrop > 0 {
+		next = &faultTransport{next: next}
+	}
+	next = &budgetTransport{next: next}
+	upstreamClient.Transport = newResilientTransport(next, resilience{
+		timeout:          cfg.HTTPTimeout,
+		maxAttempts:      max(1, cfg.HTTPMaxAttempts),
+		backoff:          cfg.HTTPRetryBackoff,
+		breakerThreshold: cfg.HTTPBreakerThreshold,
+		breakerCooldown:  cfg.HTTPBreakerCooldown,
+	})
+	return nil
+}
+
+// errCircuitOpen is returned without trying while a host's breaker is
+// open.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type resilientTransport struct {
+	next http.RoundTripper
+	opts resilience
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// breaker is one host's circuit breaker.
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	// probing is set while the one request after a cooldown is in flight.
+	probing bool
+}
+
+func newResilientTransport(next http.RoundTripper, opts resilience) *resilientTransport {
+	return &resilientTransport{next: next, opts: opts, breakers: map[string]*breaker{}}
+}
+
+// allow reports whether a request to host may go ahead.
+func (t *resilientTransport) allow(host string) bool {
+	if t.opts.breakerThreshold <= 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.breakers[host]
+	if b == nil || b.failures < t.opts.breakerThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates host's breaker with the outcome of a request.
+func (t *resilientTransport) record(host string, ok bool) {
+	if t.opts.breakerThreshold <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.breakers[host]
+	if b == nil {
+		b = &breaker{}
+		t.breakers[host] = b
+	}
+	b.probing = false
+	if ok {
+		if b.failures >= t.opts.breakerThreshold {
+			logFor("http").Info("Circuit breaker closed", "host", host)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= t.opts.breakerThreshold {
+		if b.failures == t.opts.breakerThreshold {
+			logFor("http").Warn("Circuit breaker opened", "host", host, "cooldown", t.opts.breakerCooldown.String())
+			metricBreakerTrips.inc(host)
+		}
+		b.openUntil = time.Now().Add(t.opts.breakerCooldown)
+	}
+}
+
+// release ends host's probe, if one is in flight, without counting its
+// outcome either way, so the next request can probe again.
+func (t *resilientTransport) release(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.breakers[host]; b != nil {
+		b.probing = false
+	}
+}
+
+// retryable reports whether a failed attempt is worth repeating.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	// Only requests without a body can be replayed as they are.
+	attempts := t.opts.maxAttempts
+	if req.Method != "GET" && req.Method != "HEAD" {
+		attempts = 1
+	}
+	wait := t.opts.backoff
+	for attempt := 1; ; attempt++ {
+		if !t.allow(host) {
+			return nil, fmt.Errorf("%s: %w", host, errCircuitOpen)
+		}
+		resp, err := t.attempt(req)
+		if errors.Is(err, errBudgetSpent) {
+			// Never sent, so nothing learned about the host.
+			t.release(host)
+			return nil, err
+		}
+		failed := retryable(resp, err)
+		// A cancelled run says nothing about the host, but mustn't leave
+		// its probe holding the breaker open.
+		if req.Context().Err() == nil {
+			t.record(host, !failed)
+		} else {
+			t.release(host)
+		}
+		if !failed || attempt >= attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		pause := wait/2 + rand.N(wait/2+1)
+		if d, ok := retryAfter(resp); ok {
+			// Asked to come back later than a run can wait: give up now
+			// rather than hammer the host.
+			if d > maxRetryAfter {
+				return resp, err
+			}
+			pause = d
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		metricHTTPRetries.inc(host)
+		logFor("http").Debug("Retrying request", "host", host, "attempt", attempt, "status", statusOf(resp), "err", err)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(pause):
+		}
+		wait = min(2*wait, 30*time.Second)
+	}
+}
+
+// maxRetryAfter is the longest Retry-After a retry waits out.
+const maxRetryAfter = time.Minute
+
+// retryAfter is how long a 429 or 503 response asks the client to wait,
+// from its Retry-After header in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(0, time.Until(t)), true
+	}
+	return 0, false
+}
+
+type requestBudgetKey struct{}
+
+// withRequestBudget charges every attempt at a request made with ctx,
+// retries included, to b. A nil b charges nothing.
+func withRequestBudget(ctx context.Context, b *requestBudget) context.Context {
+	if b == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestBudgetKey{}, b)
+}
+
+// budgetTransport refuses attempts once their request's budget is spent.
+// It sits beneath resilientTransport so that retries are charged too.
+type budgetTransport struct {
+	next http.RoundTripper
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if b, ok := req.Context().Value(requestBudgetKey{}).(*requestBudget); ok && !b.take() {
+		return nil, errBudgetSpent
+	}
+	return t.next.RoundTrip(req)
+}
+
+type attemptTimeoutKey struct{}
+
+// withAttemptTimeout overrides HTTP_TIMEOUT for upstream requests made
+// with ctx, for dependencies with timeouts of their own.
+func withAttemptTimeout(ctx context.Context, d time.Duration) context.Context {
+	if d <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, attemptTimeoutKey{}, d)
+}
+
+// attempt makes one try with the per-attempt timeout, which keeps running
+// until the response body is closed.
+func (t *resilientTransport) attempt(req *http.Request) (*http.Response, error) {
+	timeout := t.opts.timeout
+	if d, ok := req.Context().Value(attemptTimeoutKey{}).(time.Duration); ok {
+		timeout = d
+	}
+	if timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := t.next.RoundTrip(req.Clone(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func statusOf(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	return resp.Status
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// warnUnplannedIngest warns when ingest saves none of the planned event
+// types, which leaves the calendar empty: INGEST_EVENT_TYPES defaults to
+// crashes and disabled vehicles only.
+func (s *server) warnUnplannedIngest(ctx context.Context) {
+	types, err := listIngestEventTypes(ctx, s.db)
+	if err != nil {
+		logFor("api").Warn("Could not check the ingest event types", "err", err)
+		return
+	}
+	if len(types) == 0 {
+		types = s.cfg.IngestEventTypes
+	}
+	for _, t := range s.cfg.PlannedEventTypes {
+		if containsFold(types, t) {
+			return
+		}
+	}
+	logFor("api").Warn("No planned event types are ingested, so /calendar.ics will be empty; add some to INGEST_EVENT_TYPES or with admin event-types add",
+		"ingest_event_types", strings.Join(types, ", "), "planned_event_types", strings.Join(s.cfg.PlannedEventTypes, ", "))
+}
+
+// handleCalendar serves planned closures as an iCalendar feed that
+// Outlook or Google Calendar can subscribe to. ?county= and ?road= narrow
+// it to one county or route. It covers closures that haven't ended, plus
+// the last week's so they don't vanish the moment they finish; one that
+// clears early ends when it cleared.
+func (s *server) handleCalendar(w http.ResponseWriter, r *http.Request) {
+	county, road := r.URL.Query().Get("county"), r.URL.Query().Get("road")
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT source, source_id, event_type, address, latitude, longitude, timestamp,
+			CASE WHEN cleared_at < end_time THEN cleared_at ELSE end_time END,
+			coalesce(problem_detail, ''), coalesce(county_name, ''), coalesce(road_normalized, ''),
+			coalesce(lanes_closed, 0), coalesce(lanes_total, 0)
+		FROM unified_incidents
+		WHERE (event_type = ANY($1) OR raw_event_type = ANY($1))
+			AND end_time IS NOT NULL AND end_time > now() - interval '7 days'
+			AND ($2 = '' OR lower(county_name) = lower($2))
+			AND ($3 = '' OR lower(road_normalized) = lower($3))
+		ORDER BY timestamp`,
+		pq.Array(s.cfg.PlannedEventTypes), county, road)
+	if err != nil {
+		logFor("api").Error("Error querying planned closures", "err", err)
+		http.Error(w, "could not load closures", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	name := "NC planned lane closures"
+	switch {
+	case county != "" && road != "":
+		name = fmt.Sprintf("%s planned closures, %s County", road, county)
+	case county != "":
+		name = county + " County planned closures"
+	case road != "":
+		name = road + " planned closures"
+	}
+
+	var cal strings.Builder
+	icalLine(&cal, "BEGIN:VCALENDAR")
+	icalLine(&cal, "VERSION:2.0")
+	icalLine(&cal, "PRODID:-//ncdot-ingester//planned closures//EN")
+	icalLine(&cal, "CALSCALE:GREGORIAN")
+	icalLine(&cal, "METHOD:PUBLISH")
+	icalLine(&cal, "X-WR-CALNAME:"+icalEscape(name))
+	icalLine(&cal, "REFRESH-INTERVAL;VALUE=DURATION:PT1H")
+	icalLine(&cal, "X-PUBLISHED-TTL:PT1H")
+
+	stamp := icalTime(time.Now())
+	for rows.Next() {
+		var p IncidentPayload
+		var end time.Time
+		if err := rows.Scan(&p.Source, &p.SourceID, &p.EventType, &p.Address, &p.Latitude, &p.Longitude, &p.StartTime,
+			&end, &p.ProblemDetail, &p.County, &p.RoadNormalized, &p.LanesClosed, &p.LanesTotal); err != nil {
+			logFor("api").Error("Error reading planned closure", "err", err)
+			http.Error(w, "could not load closures", http.StatusInternalServerError)
+			return
+		}
+		if !end.After(p.StartTime) {
+			end = p.StartTime.Add(time.Hour)
+		}
+		description := fmt.Sprintf("%s\nLanes: %s\nMap: %s", orDash(p.ProblemDetail), lanesLabel(p), mapURL(p.Latitude, p.Longitude))
+
+		icalLine(&cal, "BEGIN:VEVENT")
+		icalLine(&cal, fmt.Sprintf("UID:%s-%s@ncdot-ingester", strings.ToLower(p.Source), p.SourceID))
+		icalLine(&cal, "DTSTAMP:"+stamp)
+		icalLine(&cal, "DTSTART:"+icalTime(p.StartTime))
+		icalLine(&cal, "DTEND:"+icalTime(end))
+		icalLine(&cal, "SUMMARY:"+icalEscape(incidentTitle(p)+" (lanes "+lanesLabel(p)+")"))
+		icalLine(&cal, "LOCATION:"+icalEscape(p.Address))
+		icalLine(&cal, fmt.Sprintf("GEO:%.5f;%.5f", p.Latitude, p.Longitude))
+		icalLine(&cal, "DESCRIPTION:"+icalEscape(description))
+		icalLine(&cal, "URL:"+mapURL(p.Latitude, p.Longitude))
+		icalLine(&cal, "TRANSP:TRANSPARENT")
+		icalLine(&cal, "END:VEVENT")
+	}
+	if err := rows.Err(); err != nil {
+		logFor("api").Error("Error reading planned closures", "err", err)
+		http.Error(w, "could not load closures", http.StatusInternalServerError)
+		return
+	}
+	icalLine(&cal, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	fmt.Fprint(w, cal.String())
+}
+
+func icalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func icalEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icalLine writes a content line, folded at 75 octets as RFC 5545 asks
+// (without splitting a UTF-8 sequence).
+func icalLine(b *strings.Builder, line string) {
+	// Continuation lines lose an octet to the leading space.
+	for limit := 75; len(line) > limit; limit = 74 {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line + "\r\n")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Incident struct matches the JSON data from the NCDOT feed.
+type Incident struct {
+	ID                    int     `json:"id"`
+	Latitude              float64 `json:"latitude"`
+	Longitude             float64 `json:"longitude"`
+	CommonName            string  `json:"commonName"`
+	Reason                string  `json:"reason"`
+	Condition             string  `json:"condition"`
+	IncidentType          string  `json:"incidentType"`
+	Severity              int     `json:"severity"`
+	Direction             string  `json:"direction"`
+	Location              string  `json:"location"`
+	CountyID              int     `json:"countyId"`
+	CountyName            string  `json:"countyName"`
+	City                  string  `json:"city"`
+	StartTime             string  `json:"start"`
+	EndTime               string  `json:"end"`
+	LastUpdate            string  `json:"lastUpdate"`
+	Road                  string  `json:"road"`
+	RouteID               int     `json:"routeId"`
+	LanesClosed           int     `json:"lanesClosed"`
+	LanesTotal            int     `json:"lanesTotal"`
+	Detour                string  `json:"detour"`
+	CrossStreetPrefix     string  `json:"crossStreetPrefix"`
+	CrossStreetNumber     int     `json:"crossStreetNumber"`
+	CrossStreetSuffix     string  `json:"crossStreetSuffix"`
+	CrossStreetCommonName string  `json:"crossStreetCommonName"`
+	Event                 string  `json:"event"`
+	CreatedFromConcurrent bool    `json:"createdFromConcurrent"`
+	MovableConstruction   string  `json:"movableConstruction"`
+	WorkZoneSpeedLimit    int     `json:"workZoneSpeedLimit"`
+}
+
+// UnifiedIncident is the normalized form of an incident from any source,
+// as written to the unified_incidents table. Enrichers fill in the optional
+// fields before it is saved.
+type UnifiedIncident struct {
+	Source    string
+	SourceID  string
+	EventType string
+	// RawEventType is the source's own type string. EventTypeFreeText marks
+	// a type that is free text, or not in the unified taxonomy, and needs
+	// classifying.
+	RawEventType      string
+	EventTypeFreeText bool
+	EventTypeMapped   bool
+	Address           string
+	City              string
+	CountyName        string
+	CountyID          int
+	Road              string
+	CommonName        string
+	Direction         string
+	RouteID           int
+	Latitude          float64
+	Longitude         float64
+	Timestamp         time.Time
+	ProblemDetail     string
+	Severity          int
+	LanesClosed       int
+	LanesTotal        int
+	// SourceUpdated is the source's own last-modified stamp, in RFC 3339.
+	SourceUpdated string
+	// EndTime is when the source expects the incident to end (planned
+	// work mostly); zero if it doesn't say.
+	EndTime time.Time
+
+	// Raw is the original source record, stored as details.raw_incident.
+	Raw interface{}
+
+	Weather   *WeatherData
+	Period    TimeClassification
+	Geocode   *GeocodeResult
+	RoadMatch *RoadMatch
+	Milepost  *MilepostResult
+
+	// RoadNormalized is the canonical route name (I-40); ExitNumber and
+	// ExitSuffix come from text like "Exit 289A".
+	RoadNormalized string
+	ExitNumber     int
+	ExitSuffix     string
+
+	LocationValidation *LocationValidation
+	Proximity          *Proximity
+
+	// RouteImpacts is nil when route impacts weren't computed, and empty
+	// when they were but no saved route is affected.
+	RouteImpacts []RouteImpact
+
+	Detour      *Detour
+	TrafficFlow *TrafficFlow
+	AirQuality  *AirQuality
+
+	// Summary is a one-sentence plain-English description for notifications.
+	Summary string
+
+	Classification *Classification
+
+	LightCondition string
+	Risk           *RiskScore
+
+	// Geofences names the ingest geofences the incident is in.
+	Geofences []string
+	// Profile is the ingest profile that last saw the incident, if it was
+	// ingested under PROFILES.
+	Profile string
+
+	// Redaction, if set, is applied to the details (see redaction.go).
+	Redaction *detailsRedaction
+
+	// DetailsPatch is what changed in the details, set by saveToUnifiedDB
+	// on an update.
+	DetailsPatch []jsonPatchOp
+	// Reopened is set by saveToUnifiedDB when a cleared incident is back in
+	// the feed.
+	Reopened bool
+}
+
+// normalizeIncident maps an NCDOT feed record onto the unified schema. It
+// fails if a timestamp can't be parsed, rather than guess at it; a
+// missing end or update time just means it isn't known.
+func normalizeIncident(incident Incident) (UnifiedIncident, error) {
+	startTime, err := parseFeedTime(incident.StartTime)
+	if err == nil && startTime.IsZero() {
+		err = fmt.Errorf("missing start time")
+	}
+	if err != nil {
+		return UnifiedIncident{}, fmt.Errorf("start: %w", err)
+	}
+	endTime, err := parseFeedTime(incident.EndTime)
+	if err != nil {
+		return UnifiedIncident{}, fmt.Errorf("end: %w", err)
+	}
+	lastUpdate, err := parseFeedTime(incident.LastUpdate)
+	if err != nil {
+		return UnifiedIncident{}, fmt.Errorf("lastUpdate: %w", err)
+	}
+	sourceUpdated := ""
+	if !lastUpdate.IsZero() {
+		sourceUpdated = lastUpdate.Format(time.RFC3339)
+	}
+
+	// NCDOT uses "reason" as the problem detail.
+	u := UnifiedIncident{
+		Source:        "NCDOT",
+		SourceID:      strconv.Itoa(incident.ID),
+		EventType:     incident.IncidentType,
+		RawEventType:  incident.IncidentType,
+		Address:       incident.Location,
+		City:          incident.City,
+		CountyName:    incident.CountyName,
+		CountyID:      incident.CountyID,
+		Road:          incident.Road,
+		CommonName:    incident.CommonName,
+		Direction:     incident.Direction,
+		RouteID:       incident.RouteID,
+		Latitude:      incident.Latitude,
+		Longitude:     incident.Longitude,
+		Timestamp:     startTime,
+		ProblemDetail: incident.Reason,
+		Severity:      incident.Severity,
+		LanesClosed:   incident.LanesClosed,
+		LanesTotal:    incident.LanesTotal,
+		SourceUpdated: sourceUpdated,
+		EndTime:       endTime,
+		Raw:           incident,
+	}
+	// Types NCDOT adds before the taxonomy knows them go to the classifier,
+	// unless event_type_mappings has them.
+	u.EventTypeFreeText = !containsFold(unifiedEventTypes, incident.IncidentType)
+	return u, nil
+}
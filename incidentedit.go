@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operators sometimes need to correct an incident by hand: clear a ghost
+// the source never cleared, or move one it put in the wrong place. Both go
+// into incident_history, as "cleared" and "edited" changes with who made
+// them and why, the edit with a JSON Patch of the fields, and go out to the
+// sinks as cleared and updated events carrying changed_by. The next ingest
+// still wins for what the feed sends: a closed incident still in the feed
+// comes back, and an edit to a column the upsert refreshes lasts until
+// the source changes the record.
+
+// editableFields maps what `incident set` accepts to the column and how to
+// parse a value for it.
+var editableFields = map[string]struct {
+	column string
+	parse  func(string) (interface{}, error)
+}{
+	"latitude":     {"latitude", parseLatitude},
+	"longitude":    {"longitude", parseLongitude},
+	"address":      {"address", parseText},
+	"city":         {"city", parseText},
+	"county":       {"county_name", parseText},
+	"road":         {"road_normalized", parseText},
+	"event_type":   {"event_type", parseText},
+	"lanes_closed": {"lanes_closed", parseCount},
+	"lanes_total":  {"lanes_total", parseCount},
+	"summary":      {"summary", parseText},
+	"end_time":     {"end_time", parseEditTime},
+}
+
+func parseText(v string) (interface{}, error) { return nullString(strings.TrimSpace(v)), nil }
+
+func parseCount(v string) (interface{}, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%q is not a count", v)
+	}
+	return n, nil
+}
+
+func parseLatitude(v string) (interface{}, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.Abs(f) > 90 {
+		return nil, fmt.Errorf("%q is not a latitude", v)
+	}
+	return f, nil
+}
+
+func parseLongitude(v string) (interface{}, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.Abs(f) > 180 {
+		return nil, fmt.Errorf("%q is not a longitude", v)
+	}
+	return f, nil
+}
+
+// parseEditTime takes RFC 3339, or "" to unset.
+func parseEditTime(v string) (interface{}, error) {
+	if v == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an RFC 3339 time", v)
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}, nil
+}
+
+// closeIncident clears an active incident by hand and publishes the
+// cleared event. It returns errIncidentNotFound if there's no such active
+// incident.
+func closeIncident(ctx context.Context, db *sql.DB, sinks *sinkDispatcher, key incidentKey, by, note string) error {
+	res, err := db.ExecContext(ctx, `
+		WITH cleared AS (
+			UPDATE unified_incidents SET status = 'cleared', cleared_at = now()
+			WHERE source = $1 AND source_id = $2 AND status = 'active'
+			RETURNING source, source_id
+		)
+		INSERT INTO incident_history (source, source_id, change, changed_by, note)
+		SELECT source, source_id, 'cleared', $3, NULLIF($4, '') FROM cleared`,
+		key.Source, key.SourceID, by, note)
+	if err != nil {
+		return fmt.Errorf("could not close incident: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errIncidentNotFound
+	}
+	logFor("admin").Info("Closed incident", "incident", key.String(), "by", by)
+	return publishEdit(ctx, db, sinks, key, ChangeCleared, nil, by)
+}
+
+// setIncidentFields sets fields (editableFields names to values) on an
+// incident, publishes the update and returns the patch recorded for it.
+func setIncidentFields(ctx context.Context, db *sql.DB, sinks *sinkDispatcher, key incidentKey, fields map[string]string, by, note string) ([]jsonPatchOp, error) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if _, ok := editableFields[name]; !ok {
+			known := make([]string, 0, len(editableFields))
+			for k := range editableFields {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("can't set %q (expected one of %s)", name, strings.Join(known, ", "))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sets := make([]string, 0, len(names))
+	olds := make([]string, 0, len(names))
+	args := []interface{}{key.Source, key.SourceID}
+	for _, name := range names {
+		field := editableFields[name]
+		value, err := field.parse(fields[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", field.column, len(args)))
+		olds = append(olds, fmt.Sprintf("'%s', %s", name, field.column))
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var before, after []byte
+	err = tx.QueryRowContext(ctx, `SELECT jsonb_build_object(`+strings.Join(olds, ", ")+`) FROM unified_incidents
+		WHERE source = $1 AND source_id = $2 FOR UPDATE`, key.Source, key.SourceID).Scan(&before)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errIncidentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load incident: %w", err)
+	}
+	if err := tx.QueryRowContext(ctx, `UPDATE unified_incidents SET `+strings.Join(sets, ", ")+`
+		WHERE source = $1 AND source_id = $2
+		RETURNING jsonb_build_object(`+strings.Join(olds, ", ")+`)`, args...).Scan(&after); err != nil {
+		return nil, fmt.Errorf("could not update incident: %w", err)
+	}
+	var oldValues, newValues interface{}
+	if err := json.Unmarshal(before, &oldValues); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(after, &newValues); err != nil {
+		return nil, err
+	}
+	patch := diffJSON(oldValues, newValues)
+	if len(patch) == 0 {
+		return patch, nil
+	}
+	rawPatch, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO incident_history (source, source_id, change, patch, changed_by, note)
+		VALUES ($1, $2, 'edited', $3, $4, NULLIF($5, ''))`, key.Source, key.SourceID, rawPatch, by, note); err != nil {
+		return nil, fmt.Errorf("could not record history: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	logFor("admin").Info("Edited incident", "incident", key.String(), "fields", strings.Join(names, ","), "by", by)
+	return patch, publishEdit(ctx, db, sinks, key, ChangeUpdated, patch, by)
+}
+
+// publishEdit sends the sinks the event for a hand edit, with the
+// incident as it now stands.
+func publishEdit(ctx context.Context, db *sql.DB, sinks *sinkDispatcher, key incidentKey, change ChangeType, patch []jsonPatchOp, by string) error {
+	incidents, err := queryIncidents(ctx, db, incidentFilter{Source: key.Source, SourceID: key.SourceID, Limit: 1, WithDetails: true})
+	if err != nil {
+		return fmt.Errorf("could not load incident to publish: %w", err)
+	}
+	if len(incidents) == 0 {
+		return errIncidentNotFound
+	}
+	sinks.Publish(IncidentEvent{Change: change, OccurredAt: time.Now().UTC(), Incident: incidents[0], ChangedBy: by, Patch: patch})
+	return nil
+}
+
+// runIncident closes or edits one incident:
+//
+//	incident close [-reason text] SOURCE ID
+//	incident set [-reason text] SOURCE ID field=value...
+func runIncident(cfg *Config, db *sql.DB, args []string) {
+	if len(args) < 1 {
+		log.Fatal("Usage: incident close|set [-by name] [-reason text] SOURCE ID [field=value...]")
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("incident "+action, flag.ExitOnError)
+	by := fs.String("by", firstNonEmpty(os.Getenv("USER"), "cli"), "who is making the change, for the record")
+	reason := fs.String("reason", "", "why, for the record")
+	fs.Parse(args[1:])
+	if fs.NArg() < 2 {
+		log.Fatal("Usage: incident close|set [-by name] [-reason text] SOURCE ID [field=value...]")
+	}
+	sinks, err := newNotifier(cfg, db, nil)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	defer sinks.Close()
+	ctx := context.Background()
+	key := incidentKey{Source: fs.Arg(0), SourceID: fs.Arg(1)}
+	switch action {
+	case "close":
+		if fs.NArg() != 2 {
+			log.Fatal("Usage: incident close [-by name] [-reason text] SOURCE ID")
+		}
+		if err := closeIncident(ctx, db, sinks, key, *by, *reason); errors.Is(err, errIncidentNotFound) {
+			log.Fatalf("Error: no active incident %s", key)
+		} else if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		fmt.Printf("Closed %s\n", key)
+	case "set":
+		fields := map[string]string{}
+		for _, arg := range fs.Args()[2:] {
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				log.Fatalf("Error: expected field=value, got %q", arg)
+			}
+			fields[name] = value
+		}
+		if len(fields) == 0 {
+			log.Fatal("Usage: incident set [-by name] [-reason text] SOURCE ID field=value...")
+		}
+		patch, err := setIncidentFields(ctx, db, sinks, key, fields, *by, *reason)
+		if errors.Is(err, errIncidentNotFound) {
+			log.Fatalf("Error: no incident %s", key)
+		} else if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		if len(patch) == 0 {
+			fmt.Printf("%s already had those values\n", key)
+			return
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(patch)
+	default:
+		log.Fatalf("Unknown incident command %q (expected close or set)", action)
+	}
+}
@@ -0,0 +1,5 @@
+// Package incidentpb is the generated protobuf and gRPC code for the
+// incident service in incidents.proto.
+package incidentpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative incidents.proto
@@ -0,0 +1,209 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: incidents.proto
+
+// The incident store's read API for internal services.
+
+package incidentpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	IncidentService_ListIncidents_FullMethodName  = "/ncdot.incidents.v1.IncidentService/ListIncidents"
+	IncidentService_GetIncident_FullMethodName    = "/ncdot.incidents.v1.IncidentService/GetIncident"
+	IncidentService_WatchIncidents_FullMethodName = "/ncdot.incidents.v1.IncidentService/WatchIncidents"
+)
+
+// IncidentServiceClient is the client API for IncidentService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IncidentServiceClient interface {
+	// ListIncidents returns incidents matching the filter, newest first.
+	ListIncidents(ctx context.Context, in *ListIncidentsRequest, opts ...grpc.CallOption) (*ListIncidentsResponse, error)
+	// GetIncident returns one incident with its details, or NOT_FOUND.
+	GetIncident(ctx context.Context, in *GetIncidentRequest, opts ...grpc.CallOption) (*Incident, error)
+	// WatchIncidents streams changes as they happen until the client cancels.
+	WatchIncidents(ctx context.Context, in *WatchIncidentsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[IncidentChange], error)
+}
+
+type incidentServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIncidentServiceClient(cc grpc.ClientConnInterface) IncidentServiceClient {
+	return &incidentServiceClient{cc}
+}
+
+func (c *incidentServiceClient) ListIncidents(ctx context.Context, in *ListIncidentsRequest, opts ...grpc.CallOption) (*ListIncidentsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListIncidentsResponse)
+	err := c.cc.Invoke(ctx, IncidentService_ListIncidents_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incidentServiceClient) GetIncident(ctx context.Context, in *GetIncidentRequest, opts ...grpc.CallOption) (*Incident, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Incident)
+	err := c.cc.Invoke(ctx, IncidentService_GetIncident_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incidentServiceClient) WatchIncidents(ctx context.Context, in *WatchIncidentsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[IncidentChange], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &IncidentService_ServiceDesc.Streams[0], IncidentService_WatchIncidents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchIncidentsRequest, IncidentChange]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type IncidentService_WatchIncidentsClient = grpc.ServerStreamingClient[IncidentChange]
+
+// IncidentServiceServer is the server API for IncidentService service.
+// All implementations must embed UnimplementedIncidentServiceServer
+// for forward compatibility.
+type IncidentServiceServer interface {
+	// ListIncidents returns incidents matching the filter, newest first.
+	ListIncidents(context.Context, *ListIncidentsRequest) (*ListIncidentsResponse, error)
+	// GetIncident returns one incident with its details, or NOT_FOUND.
+	GetIncident(context.Context, *GetIncidentRequest) (*Incident, error)
+	// WatchIncidents streams changes as they happen until the client cancels.
+	WatchIncidents(*WatchIncidentsRequest, grpc.ServerStreamingServer[IncidentChange]) error
+	mustEmbedUnimplementedIncidentServiceServer()
+}
+
+// UnimplementedIncidentServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedIncidentServiceServer struct{}
+
+func (UnimplementedIncidentServiceServer) ListIncidents(context.Context, *ListIncidentsRequest) (*ListIncidentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListIncidents not implemented")
+}
+func (UnimplementedIncidentServiceServer) GetIncident(context.Context, *GetIncidentRequest) (*Incident, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetIncident not implemented")
+}
+func (UnimplementedIncidentServiceServer) WatchIncidents(*WatchIncidentsRequest, grpc.ServerStreamingServer[IncidentChange]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchIncidents not implemented")
+}
+func (UnimplementedIncidentServiceServer) mustEmbedUnimplementedIncidentServiceServer() {}
+func (UnimplementedIncidentServiceServer) testEmbeddedByValue()                         {}
+
+// UnsafeIncidentServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IncidentServiceServer will
+// result in compilation errors.
+type UnsafeIncidentServiceServer interface {
+	mustEmbedUnimplementedIncidentServiceServer()
+}
+
+func RegisterIncidentServiceServer(s grpc.ServiceRegistrar, srv IncidentServiceServer) {
+	// If the following call pancis, it indicates UnimplementedIncidentServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&IncidentService_ServiceDesc, srv)
+}
+
+func _IncidentService_ListIncidents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListIncidentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncidentServiceServer).ListIncidents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IncidentService_ListIncidents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncidentServiceServer).ListIncidents(ctx, req.(*ListIncidentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncidentService_GetIncident_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetIncidentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncidentServiceServer).GetIncident(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IncidentService_GetIncident_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncidentServiceServer).GetIncident(ctx, req.(*GetIncidentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IncidentService_WatchIncidents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchIncidentsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(IncidentServiceServer).WatchIncidents(m, &grpc.GenericServerStream[WatchIncidentsRequest, IncidentChange]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type IncidentService_WatchIncidentsServer = grpc.ServerStreamingServer[IncidentChange]
+
+// IncidentService_ServiceDesc is the grpc.ServiceDesc for IncidentService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var IncidentService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ncdot.incidents.v1.IncidentService",
+	HandlerType: (*IncidentServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListIncidents",
+			Handler:    _IncidentService_ListIncidents_Handler,
+		},
+		{
+			MethodName: "GetIncident",
+			Handler:    _IncidentService_GetIncident_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchIncidents",
+			Handler:       _IncidentService_WatchIncidents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "incidents.proto",
+}
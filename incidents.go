@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// incidentFilter narrows a read-side query of unified_incidents. Zero
+// values don't filter.
+type incidentFilter struct {
+	Source    string
+	SourceID  string
+	County    string
+	Road      string
+	EventType string
+	Geofence  string
+	// EventTypes matches either the unified or the source's event type.
+	EventTypes []string
+	Status     string
+	// BBox is min lon, min lat, max lon, max lat.
+	BBox         []float64
+	Since, Until time.Time
+	// Search is a web-style full-text query ("jackknifed tractor trailer
+	// I-95", quoted phrases, -exclusions); results come best match first.
+	Search string
+	// Near limits to incidents within RadiusMeters of a point, nearest
+	// first.
+	Near         *LatLon
+	RadiusMeters float64
+	Limit        int
+	Offset       int
+	// WithDetails also loads the details JSON, which is large.
+	WithDetails bool
+}
+
+// parseIncidentFilter reads the filter from query parameters: county,
+// road, event_type (or type), geofence, status, bbox (minLon,minLat,maxLon,maxLat), since and
+// until (RFC 3339 or YYYY-MM-DD), q (full-text search), limit and offset.
+func parseIncidentFilter(q url.Values) (incidentFilter, error) {
+	f := incidentFilter{
+		County:    q.Get("county"),
+		Road:      q.Get("road"),
+		EventType: firstNonEmpty(q.Get("event_type"), q.Get("type")),
+		Geofence:  q.Get("geofence"),
+		Status:    q.Get("status"),
+		Search:    strings.TrimSpace(q.Get("q")),
+	}
+	if v := q.Get("bbox"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) != 4 {
+			return f, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+		}
+		for _, part := range parts {
+			n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return f, fmt.Errorf("invalid bbox: %w", err)
+			}
+			f.BBox = append(f.BBox, n)
+		}
+	}
+	var err error
+	if f.Since, err = parseTimeParam(q.Get("since")); err != nil {
+		return f, fmt.Errorf("invalid since: %w", err)
+	}
+	if f.Until, err = parseTimeParam(q.Get("until")); err != nil {
+		return f, fmt.Errorf("invalid until: %w", err)
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 0 {
+			return f, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if f.Offset, err = strconv.Atoi(v); err != nil || f.Offset < 0 {
+			return f, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	return f, nil
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", v, easternTime)
+}
+
+// where builds the filter's WHERE clause and arguments.
+func (f incidentFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, values ...interface{}) {
+		conds = append(conds, numberPlaceholders(cond, len(args)+1))
+		args = append(args, values...)
+	}
+	if f.Source != "" {
+		add("source = ?", f.Source)
+	}
+	if f.SourceID != "" {
+		add("source_id = ?", f.SourceID)
+	}
+	if f.County != "" {
+		add("lower(county_name) = lower(?)", f.County)
+	}
+	if f.Road != "" {
+		add("lower(road_normalized) = lower(?)", f.Road)
+	}
+	if f.EventType != "" {
+		add("lower(event_type) = lower(?)", f.EventType)
+	}
+	if f.Geofence != "" {
+		add("? = ANY(geofences)", f.Geofence)
+	}
+	if len(f.EventTypes) > 0 {
+		add("(event_type = ANY(?) OR raw_event_type = ANY(?))", pq.Array(f.EventTypes), pq.Array(f.EventTypes))
+	}
+	if f.Status != "" {
+		add("status = ?", f.Status)
+	}
+	if len(f.BBox) == 4 {
+		add("longitude BETWEEN ? AND ? AND latitude BETWEEN ? AND ?", f.BBox[0], f.BBox[2], f.BBox[1], f.BBox[3])
+	}
+	if !f.Since.IsZero() {
+		add("timestamp >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("timestamp < ?", f.Until)
+	}
+	if f.Search != "" {
+		add(searchSQL, f.Search)
+	}
+	if f.Near != nil {
+		// The box lets an index on latitude do the work before the exact
+		// distance.
+		dLat := f.RadiusMeters / earthRadiusMeters * 180 / math.Pi
+		dLon := dLat / math.Max(0.01, math.Cos(f.Near.Lat*math.Pi/180))
+		add("latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?", f.Near.Lat-dLat, f.Near.Lat+dLat, f.Near.Lon-dLon, f.Near.Lon+dLon)
+		add(distanceSQL+" <= ?", f.Near.Lat, f.Near.Lat, f.Near.Lon, f.RadiusMeters)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// searchSQL matches the search_vector column against a websearch query.
+const searchSQL = `search_vector @@ websearch_to_tsquery('english', ?)`
+
+// numberPlaceholders replaces each ? in s with $first, $first+1 and so on.
+func numberPlaceholders(s string, first int) string {
+	for n := first; strings.Contains(s, "?"); n++ {
+		s = strings.Replace(s, "?", "$"+strconv.Itoa(n), 1)
+	}
+	return s
+}
+
+// distanceSQL is the haversine distance in meters from the point whose
+// latitude, latitude again and longitude are bound to its placeholders.
+const distanceSQL = `(2 * 6371008.8 * asin(least(1, sqrt(
+	power(sin(radians(latitude - ?) / 2), 2) +
+	cos(radians(?)) * cos(radians(latitude)) * power(sin(radians(longitude - ?) / 2), 2)))))`
+
+// incidentColumns are what queryIncidents scans into an IncidentPayload.
+// Road, direction, the source severity and last-update stamp are only
+// kept in the raw record.
+const incidentColumns = `source, source_id, event_type, coalesce(status, 'active'), address,
+	coalesce(city, ''), coalesce(county_name, ''), coalesce(details->'raw_incident'->>'road', ''),
+	coalesce(road_normalized, ''), coalesce(details->'raw_incident'->>'direction', ''),
+	latitude, longitude, timestamp, coalesce(problem_detail, ''),
+	coalesce((details->'raw_incident'->>'severity')::int, 0), coalesce(normalized_severity, 0),
+	coalesce(risk_score, 0), coalesce(lanes_closed, 0), coalesce(lanes_total, 0),
+	coalesce(details->'raw_incident'->>'lastUpdate', ''), coalesce(summary, ''),
+	weather_temp, weather_wind_speed, weather_forecast, end_time, geofences, merged_from`
+
+// queryIncidents loads the incidents matching the filter, newest first
+// (nearest first with Near, best match first with Search).
+func queryIncidents(ctx context.Context, db *sql.DB, f incidentFilter) ([]IncidentPayload, error) {
+	where, args := f.where()
+	query := "SELECT " + incidentColumns
+	if f.WithDetails {
+		query += ", details"
+	}
+	order := "timestamp DESC"
+	switch {
+	case f.Near != nil:
+		order = numberPlaceholders(distanceSQL, len(args)+1)
+		args = append(args, f.Near.Lat, f.Near.Lat, f.Near.Lon)
+	case f.Search != "":
+		order = numberPlaceholders("ts_rank_cd(search_vector, websearch_to_tsquery('english', ?)) DESC, timestamp DESC", len(args)+1)
+		args = append(args, f.Search)
+	}
+	query += " FROM unified_incidents " + where + " ORDER BY " + order
+	if f.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(f.Limit)
+	}
+	if f.Offset > 0 {
+		query += " OFFSET " + strconv.Itoa(f.Offset)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query incidents: %w", err)
+	}
+	defer rows.Close()
+
+	incidents := []IncidentPayload{}
+	for rows.Next() {
+		var p IncidentPayload
+		var temp sql.NullInt32
+		var wind, forecast sql.NullString
+		var details []byte
+		var end sql.NullTime
+		dest := []interface{}{&p.Source, &p.SourceID, &p.EventType, &p.Status, &p.Address,
+			&p.City, &p.County, &p.Road, &p.RoadNormalized, &p.Direction,
+			&p.Latitude, &p.Longitude, &p.StartTime, &p.ProblemDetail,
+			&p.Severity, &p.NormalizedSeverity, &p.RiskScore, &p.LanesClosed, &p.LanesTotal,
+			&p.SourceUpdated, &p.Summary, &temp, &wind, &forecast, &end, pq.Array(&p.Geofences), pq.Array(&p.MergedFrom)}
+		if f.WithDetails {
+			dest = append(dest, &details)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if end.Valid {
+			p.EndTime = &end.Time
+		}
+		if temp.Valid || forecast.Valid {
+			p.Weather = &WeatherData{Temperature: int(temp.Int32), WindSpeed: wind.String, ShortForecast: forecast.String}
+		}
+		if len(details) > 0 {
+			if err := json.Unmarshal(details, &p.Details); err != nil {
+				return nil, fmt.Errorf("invalid details for %s %s: %w", p.Source, p.SourceID, err)
+			}
+		}
+		incidents = append(incidents, p)
+	}
+	return incidents, rows.Err()
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// runIngest fetches the NCDOT feed, enriches and saves the relevant
+// incidents, clears the ones that have gone, and notifies the sinks. It
+// runs once, or with -interval (POLL_INTERVAL) as a daemon polling until
+// interrupted. A daemon can also serve the HTTP API (-http), streaming its
+// changes live, and its own metrics (-metrics-addr).
+func runIngest(cfg *Config, db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	interval := fs.Duration("interval", cfg.PollInterval, "poll the feed this often instead of running once")
+	httpAddr := fs.String("http", "", "also serve the HTTP API on this address (daemon only)")
+	metricsAddr := fs.String("metrics-addr", cfg.MetricsAddr, "serve Prometheus metrics and health checks on this address (daemon only)")
+	debug := fs.Bool("debug", cfg.DebugEndpoints, "serve /debug/pprof and /debug/status with the metrics")
+	fs.Parse(args)
+
+	if len(cfg.Profiles) > 0 {
+		runProfiles(cfg, db, *interval, *metricsAddr, *httpAddr)
+		return
+	}
+	if cfg.DotURL == "" {
+		log.Fatalf("Error: DOT_URL must be set in your environment or .env file")
+	}
+
+	var api *server
+	var extra []Sink
+	if *httpAddr != "" && *interval > 0 {
+		api = newServer(cfg, db)
+		extra = append(extra, api.hub)
+	}
+	in, err := newIngester(cfg, db, extra...)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	sinks := in.sinks
+	defer sinks.Close()
+	stopTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Error configuring tracing: %s", err)
+	}
+	defer stopTracing(context.Background())
+
+	if *interval <= 0 {
+		if err := in.once(context.Background()); err != nil {
+			// Already logged with the run.
+			sinks.Close()
+			stopTracing(context.Background())
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if api != nil {
+		go func() {
+			if err := api.serve(ctx, *httpAddr); err != nil {
+				log.Fatalf("Error serving HTTP: %s", err)
+			}
+		}()
+	}
+	if *metricsAddr != "" {
+		var status *debugStatus
+		if *debug {
+			status = newDebugStatus(sinks)
+		}
+		go func() {
+			if err := serveMetrics(ctx, *metricsAddr, newReadiness(cfg, db, *interval), status); err != nil {
+				log.Fatalf("Error serving metrics: %s", err)
+			}
+		}()
+	}
+	if *debug && *metricsAddr == "" {
+		logFor("ingest").Warn("Debug endpoints need a metrics address (METRICS_ADDR or -metrics-addr); not serving them")
+	}
+	logFor("ingest").Info("Polling NC DOT", "interval", interval.String())
+	in.poll(ctx, *interval)
+	logFor("ingest").Info("Shutting down")
+}
+
+// ingester is one configuration's enrichers and sinks.
+type ingester struct {
+	cfg       *Config
+	db        *sql.DB
+	enrichers []Enricher
+	sinks     *sinkDispatcher
+	mqtt      *mqttClient
+	anomalies *anomalyDetector
+	nwsBudget *requestBudget
+}
+
+// newIngester builds cfg's enrichers and sinks, plus any extra sinks.
+func newIngester(cfg *Config, db *sql.DB, extra ...Sink) (*ingester, error) {
+	enrichers, err := buildEnrichers(cfg, db)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure enrichers: %w", err)
+	}
+	var mqtt *mqttClient
+	if cfg.MQTTURL != "" {
+		if mqtt, err = newMQTTClient(cfg.MQTTURL, cfg.MQTTClientID); err != nil {
+			return nil, fmt.Errorf("could not configure MQTT: %w", err)
+		}
+	}
+	sinks, err := newNotifier(cfg, db, mqtt, extra...)
+	if err != nil {
+		return nil, err
+	}
+	in := &ingester{cfg: cfg, db: db, enrichers: enrichers, sinks: sinks, mqtt: mqtt, nwsBudget: newRequestBudget(cfg.NWSRequestBudget)}
+	if cfg.AnomalyDetection {
+		in.anomalies = newAnomalyDetector(cfg, db)
+	}
+	return in, nil
+}
+
+// newNotifier builds the configured sinks, plus any extra ones, behind the
+// notification rules and throttle.
+func newNotifier(cfg *Config, db *sql.DB, mqtt *mqttClient, extra ...Sink) (*sinkDispatcher, error) {
+	sinkList, err := buildSinks(cfg, db, mqtt)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure sinks: %w", err)
+	}
+	router, err := loadRoutingRules(db, cfg.NotifyRulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load notification rules: %w", err)
+	}
+	return newSinkDispatcher(db, append(sinkList, extra...), router, newNotifyThrottle(db, cfg.NotifyCooldowns), cfg.SinkMaxAttempts, cfg.SinkRetryBackoff), nil
+}
+
+// once is a single poll of the feed, followed by the anomaly and
+// clearance SLA checks.
+func (in *ingester) once(ctx context.Context) error {
+	ctx = withNWSBudget(ctx, in.nwsBudget)
+	if err := ingestOnce(ctx, in.cfg, in.db, in.enrichers, in.sinks, in.mqtt); err != nil {
+		return err
+	}
+	if in.anomalies != nil {
+		if _, err := in.anomalies.check(ctx, in.sinks); err != nil {
+			runLog(ctx, "ingest").Warn("Anomaly check failed", "err", err)
+		}
+		in.sinks.Flush()
+	}
+	if len(in.cfg.ClearanceSLA) > 0 {
+		if _, err := flagOverdue(ctx, in.cfg, in.db, in.sinks); err != nil {
+			runLog(ctx, "ingest").Warn("Clearance SLA check failed", "err", err)
+		}
+		in.sinks.Flush()
+	}
+	return nil
+}
+
+// poll runs once every interval until ctx is done.
+func (in *ingester) poll(ctx context.Context, interval time.Duration) {
+	for {
+		// A failed run is logged with the run and retried next interval.
+		in.once(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ingestOnce is a single poll of the feed.
+func ingestOnce(ctx context.Context, cfg *Config, db *sql.DB, enrichers []Enricher, sinks *sinkDispatcher, mqtt *mqttClient) (err error) {
+	start := time.Now()
+	ctx, runID := withRunID(ctx)
+	ctx, span := tracer.Start(ctx, "ingest.run", trace.WithAttributes(attribute.String("run.id", runID)))
+	logger := runLog(ctx, "ingest")
+	run := &ingestRun{RunID: runID, Source: "NCDOT", StartedAt: start}
+	defer func() {
+		if r := recover(); r != nil {
+			reportPanic(ctx, r)
+			panic(r)
+		}
+		run.finish(err)
+		if recErr := recordIngestRun(db, run); recErr != nil {
+			logger.Warn("Could not record the run", "err", recErr)
+		}
+		pingHeartbeat(cfg, run)
+		endSpan(span, err)
+		metricRunDuration.since(start)
+		if err != nil {
+			metricRuns.inc("error")
+			logger.Error("Run failed", "err", err)
+			var decodeErr feedDecodeError
+			if errors.As(err, &decodeErr) {
+				reportError(ctx, "feed_decode", err, map[string]string{"source": decodeErr.source}, decodeErr.body)
+			} else {
+				reportError(ctx, "ingest_run", err, nil, nil)
+			}
+			return
+		}
+		metricRuns.inc("success")
+		metricLastSuccess.set(float64(time.Now().Unix()))
+		recordRunSuccess()
+	}()
+	for _, e := range enrichers {
+		if r, ok := e.(runScoped); ok {
+			r.BeginRun()
+		}
+	}
+	nwsBudgetFrom(ctx).reset()
+
+	// Pick up changes made through the admin API or command.
+	filter, err := loadIngestFilter(ctx, cfg, db, "NCDOT")
+	if err != nil {
+		return err
+	}
+	redaction, err := readDetailsRedaction(cfg.RedactionFile, "NCDOT", cfg.RedactionHashKey)
+	if err != nil {
+		return err
+	}
+	merged, err := mergedIncidentIDs(ctx, db, "NCDOT")
+	if err != nil {
+		return err
+	}
+	var knownHashes map[string]string
+	if cfg.SkipUnchanged {
+		if knownHashes, err = activeContentHashes(ctx, db, "NCDOT"); err != nil {
+			return err
+		}
+	}
+	if router, err := loadRoutingRules(db, cfg.NotifyRulesFile); err != nil {
+		logger.Warn("Keeping the previous notification rules", "err", err)
+	} else {
+		sinks.setRouter(router)
+	}
+
+	feed, err := fetchNCDOT(ctx, cfg, db, logger)
+	run.PayloadHash = feed.hash
+	if errors.Is(err, errFeedNotModified) {
+		logger.Info("Feed not modified since the last run", "source", "NCDOT")
+		run.Outcome = "unchanged"
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	allIncidents := feed.incidents
+	var mu sync.Mutex // guards run, incidentsSaved and changes
+	reject := func(rec rejectedRecord) {
+		logger.Warn("Quarantined feed record", "source", rec.Source, "incident_id", rec.SourceID, "stage", rec.Stage, "reason", rec.Reason)
+		rec.RunID = runID
+		if err := quarantine(ctx, db, rec); err != nil {
+			logger.Error("Error quarantining feed record", "source", rec.Source, "incident_id", rec.SourceID, "err", err)
+		}
+		mu.Lock()
+		run.Quarantined++
+		mu.Unlock()
+	}
+	for _, rec := range feed.rejected {
+		reject(rec)
+	}
+	run.Fetched = len(allIncidents)
+	span.SetAttributes(attribute.Int("incidents.fetched", len(allIncidents)))
+	logger.Info("Fetched NC DOT feed", "source", "NCDOT", "incidents", len(allIncidents))
+	metricFetched.add(float64(len(allIncidents)), "NCDOT")
+	recordSourceFetch("NCDOT", allIncidents)
+	validator := newIncidentValidator(cfg)
+	stmts := newUpsertStatements(db)
+	defer stmts.Close()
+	incidentsSaved := 0
+	changes := map[ChangeType]int{}
+	// Not nil: pq sends a nil slice as NULL, and nothing would be cleared.
+	seen := []string{}
+	skipped := 0
+
+	// Enrichment and the upsert run on INGEST_WORKERS goroutines, each with
+	// its own queue. Incidents go to a queue by ID, so if a feed repeats an
+	// incident its records are still saved in feed order.
+	process := func(unified UnifiedIncident) {
+		incidentCtx, incidentSpan := tracer.Start(ctx, "incident.process", incidentAttrs(unified.Source, unified.SourceID))
+		runEnrichers(incidentCtx, enrichers, &unified)
+		_, saveSpan := tracer.Start(incidentCtx, "db.upsert")
+		saveStart := time.Now()
+		change, err := saveWithRetry(incidentCtx, db, stmts, &unified)
+		metricDBWrite.since(saveStart)
+		saveSpan.SetAttributes(attribute.String("incident.change", string(change)))
+		endSpan(saveSpan, err)
+		incidentSpan.End()
+		if err != nil {
+			logger.Error("Error saving incident", "source", "NCDOT", "incident_id", unified.SourceID, "err", err)
+			metricSaveErrors.inc("NCDOT")
+			reportError(ctx, "db_write", err, map[string]string{"source": "NCDOT", "incident_id": unified.SourceID}, incidentExcerpt(&unified))
+			mu.Lock()
+			run.Errors++
+			mu.Unlock()
+			return
+		}
+		metricSaved.inc("NCDOT", string(change))
+		mu.Lock()
+		incidentsSaved++
+		changes[change]++
+		mu.Unlock()
+		if change == ChangeCreated {
+			if n, err := suggestDuplicates(ctx, cfg, db, &unified); err != nil {
+				logger.Warn("Dedup check failed", "source", "NCDOT", "incident_id", unified.SourceID, "err", err)
+			} else if n > 0 {
+				logger.Info("Possible duplicate", "source", "NCDOT", "incident_id", unified.SourceID, "matches", n)
+			}
+		}
+		if change != ChangeUnchanged {
+			sinks.Publish(newIncidentEvent(change, &unified))
+		}
+	}
+	workers := max(cfg.IngestWorkers, 1)
+	queues := make([]chan UnifiedIncident, workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan UnifiedIncident, 16)
+		wg.Add(1)
+		go func(queue <-chan UnifiedIncident) {
+			defer wg.Done()
+			for unified := range queue {
+				process(unified)
+			}
+		}(queues[i])
+	}
+
+	for _, incident := range allIncidents {
+		if filter.allows(incident) {
+			// Still in the feed, whatever is wrong with it, so not cleared.
+			seen = append(seen, strconv.Itoa(incident.ID))
+			if merged[strconv.Itoa(incident.ID)] {
+				continue
+			}
+			if err := validator.check(incident); err != nil {
+				raw, _ := json.Marshal(incident)
+				reject(rejectedRecord{Source: "NCDOT", SourceID: strconv.Itoa(incident.ID), Stage: quarantineValidation, Reason: err.Error(), Raw: raw})
+				continue
+			}
+			unified, err := normalizeIncident(incident)
+			if err != nil {
+				raw, _ := json.Marshal(incident)
+				reject(rejectedRecord{Source: "NCDOT", SourceID: strconv.Itoa(incident.ID), Stage: quarantineTimestamp, Reason: err.Error(), Raw: raw})
+				continue
+			}
+			// An active incident the feed hasn't changed needs neither
+			// enrichment nor a write.
+			if hash, ok := knownHashes[unified.SourceID]; ok {
+				if h, err := unified.contentHash(); err == nil && h == hash {
+					metricSaved.inc("NCDOT", string(ChangeUnchanged))
+					mu.Lock()
+					incidentsSaved++
+					changes[ChangeUnchanged]++
+					mu.Unlock()
+					skipped++
+					continue
+				}
+			}
+			unified.Geofences = filter.geofencesAt(LatLon{Lat: unified.Latitude, Lon: unified.Longitude})
+			unified.Redaction = redaction
+			unified.Profile = cfg.Profile
+			queues[uint(incident.ID)%uint(workers)] <- unified
+		}
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	// An empty feed is far more likely an upstream hiccup than every
+	// incident in the state clearing at once.
+	if len(allIncidents) > 0 {
+		_, clearSpan := tracer.Start(ctx, "incidents.clear")
+		cleared, err := clearMissingIncidents(db, "NCDOT", cfg.Profile, seen)
+		clearSpan.SetAttributes(attribute.Int("incidents.cleared", len(cleared)))
+		endSpan(clearSpan, err)
+		if err != nil {
+			logger.Error("Error clearing missing incidents", "source", "NCDOT", "err", err)
+			run.Errors++
+		}
+		for i := range cleared {
+			sinks.Publish(newIncidentEvent(ChangeCleared, &cleared[i]))
+		}
+		changes[ChangeCleared] = len(cleared)
+		metricSaved.add(float64(len(cleared)), "NCDOT", string(ChangeCleared))
+	}
+
+	// Only a feed that was processed without errors may be skipped next
+	// time.
+	if run.Errors == 0 {
+		if err := saveFeedValidators(ctx, db, "NCDOT", cfg.Profile, feed.validators); err != nil {
+			logger.Warn("Could not save the feed's validators", "source", "NCDOT", "err", err)
+		}
+	}
+
+	_, flushSpan := tracer.Start(ctx, "sinks.flush")
+	sinks.Flush()
+	flushSpan.End()
+	if cfg.homeAssistantEnabled() {
+		if err := newHomeAssistant(cfg, mqtt).Update(ctx, db); err != nil {
+			logger.Warn("Home Assistant update failed", "err", err)
+		}
+	}
+
+	run.Saved, run.Created, run.Updated, run.Cleared = incidentsSaved, changes[ChangeCreated], changes[ChangeUpdated], changes[ChangeCleared]
+	logger.Info("Run complete", "saved", incidentsSaved, "quarantined", run.Quarantined, "created", changes[ChangeCreated],
+		"updated", changes[ChangeUpdated], "cleared", changes[ChangeCleared], "skipped", skipped, "duration", time.Since(start).Round(time.Millisecond).String())
+	if line := sinks.Report(); line != "" {
+		logger.Info("Run report", "from", "sinks", "report", line)
+	}
+	for _, e := range enrichers {
+		if r, ok := e.(reporter); ok {
+			if line := r.Report(); line != "" {
+				logger.Info("Run report", "from", e.Name(), "report", line)
+			}
+		}
+	}
+	return nil
+}
+
+// feedPayload is a fetched feed.
+type feedPayload struct {
+	incidents []Incident
+	// rejected are the records that didn't decode.
+	rejected []rejectedRecord
+	// hash is a SHA-256 of the (decompressed) payload.
+	hash       string
+	validators feedValidators
+}
+
+// fetchNCDOT reads and decodes the NCDOT feed, from each of its URLs and
+// pages. It returns errFeedNotModified if the feed is the one the last
+// clean run processed.
+func fetchNCDOT(ctx context.Context, cfg *Config, db *sql.DB, logger *slog.Logger) (feed feedPayload, err error) {
+	ctx, span := tracer.Start(ctx, "feed.fetch", trace.WithAttributes(attribute.String("incident.source", "NCDOT")))
+	defer func() {
+		if errors.Is(err, errFeedNotModified) {
+			span.SetAttributes(attribute.Bool("feed.not_modified", true))
+			span.End()
+			return
+		}
+		endSpan(span, err)
+	}()
+
+	auth, err := readFeedAuth(cfg.FeedAuthFile, "NCDOT")
+	if err != nil {
+		return feed, err
+	}
+	urls := feedURLs(cfg.DotURL)
+	if len(urls) == 1 && !pagedURL(urls[0]) {
+		validators, err := loadFeedValidators(ctx, db, "NCDOT", cfg.Profile)
+		if err != nil {
+			logger.Warn("Could not load the feed's validators; fetching unconditionally", "source", "NCDOT", "err", err)
+		}
+		return fetchFeedPage(ctx, cfg, urls[0], auth, validators, logger)
+	}
+
+	// Any URL or page failing fails the run: a partial feed would clear
+	// the incidents on the pages that didn't come.
+	sums := sha256.New()
+	latest := map[int]int{}
+	for _, u := range urls {
+		if strings.Contains(u, "{offset}") && cfg.FeedPageSize <= 0 {
+			return feed, fmt.Errorf("DOT_URL %s pages by {offset} but FEED_PAGE_SIZE isn't set", u)
+		}
+		for page := 1; ; page++ {
+			part, err := fetchFeedPage(ctx, cfg, expandPageURL(u, page, cfg.FeedPageSize), auth, feedValidators{}, logger)
+			if err != nil {
+				return feed, err
+			}
+			sums.Write([]byte(part.hash))
+			feed.rejected = append(feed.rejected, part.rejected...)
+			for _, incident := range part.incidents {
+				i, dup := latest[incident.ID]
+				switch {
+				case !dup:
+					latest[incident.ID] = len(feed.incidents)
+					feed.incidents = append(feed.incidents, incident)
+				case newerIncident(incident, feed.incidents[i]):
+					feed.incidents[i] = incident
+				}
+			}
+			records := len(part.incidents) + len(part.rejected)
+			if !pagedURL(u) || records == 0 || (cfg.FeedPageSize > 0 && records < cfg.FeedPageSize) {
+				break
+			}
+			if page >= cfg.FeedMaxPages {
+				return feed, fmt.Errorf("%s still had records after FEED_MAX_PAGES (%d) pages", u, cfg.FeedMaxPages)
+			}
+		}
+	}
+	feed.hash = hex.EncodeToString(sums.Sum(nil))
+	return feed, nil
+}
+
+// fetchFeedPage fetches and decodes one feed URL, conditionally if
+// validators are set.
+func fetchFeedPage(ctx context.Context, cfg *Config, url string, auth *feedAuth, validators feedValidators, logger *slog.Logger) (feed feedPayload, err error) {
+	var resp *http.Response
+	for retried := false; ; retried = true {
+		req, err := http.NewRequestWithContext(withAttemptTimeout(ctx, cfg.FeedTimeout), "GET", url, nil)
+		if err != nil {
+			return feed, err
+		}
+		if err := auth.apply(ctx, req); err != nil {
+			return feed, fmt.Errorf("authenticating to NC DOT API: %w", err)
+		}
+		validators.conditional(req)
+		acceptCompressed(req)
+		if resp, err = upstreamClient.Do(req); err != nil {
+			return feed, fmt.Errorf("fetching data from NC DOT API: %w", err)
+		}
+		// An OAuth token can be revoked before it expires; one fresh
+		// token is worth a try.
+		if resp.StatusCode != http.StatusUnauthorized || retried || !auth.rejected() {
+			break
+		}
+		resp.Body.Close()
+		logger.Info("Feed refused its OAuth token; fetching a new one", "source", "NCDOT")
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return feed, errFeedNotModified
+	case resp.StatusCode != http.StatusOK:
+		return feed, fmt.Errorf("NC DOT API returned %s", resp.Status)
+	}
+	feed.validators = validatorsOf(resp)
+
+	decoded, err := decodedBody(resp)
+	if err != nil {
+		return feed, fmt.Errorf("reading response body: %w", err)
+	}
+	defer decoded.Close()
+	body := newFeedReader(malformFeed(decoded), cfg.FeedMaxBytes)
+	feed.incidents, feed.rejected, err = decodeIncidentArray(body, "NCDOT")
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("http.response.body.size", body.n))
+	feed.hash = body.sum()
+	if errors.Is(err, errFeedTooLarge) {
+		return feed, err
+	}
+	if err != nil {
+		logger.Debug("Start of the response from server", "body", string(body.excerpt))
+		return feed, feedDecodeError{source: "NCDOT", body: body.excerpt, err: fmt.Errorf("decoding JSON: %w", err)}
+	}
+	return feed, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPatchOp is one RFC 6902 operation. diffJSON puts a "test" of the old
+// value before each replace and remove, so a patch also says what a value
+// changed from: lanes closed 1→3 is
+//
+//	{"op": "test", "path": "/raw_incident/lanesClosed", "value": 1}
+//	{"op": "replace", "path": "/raw_incident/lanesClosed", "value": 3}
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// diffJSON is the patch turning old into new, both decoded JSON. Objects
+// are compared key by key and arrays of the same length element by
+// element; anything else that differs is replaced whole.
+func diffJSON(old, new interface{}) []jsonPatchOp {
+	ops := []jsonPatchOp{}
+	diffJSONAt("", old, new, &ops)
+	return ops
+}
+
+func diffJSONAt(path string, old, new interface{}, ops *[]jsonPatchOp) {
+	switch o := old.(type) {
+	case map[string]interface{}:
+		if n, ok := new.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(o)+len(n))
+			for k := range o {
+				keys = append(keys, k)
+			}
+			for k := range n {
+				if _, ok := o[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				p := path + "/" + escapeJSONPointer(k)
+				ov, inOld := o[k]
+				nv, inNew := n[k]
+				switch {
+				case !inNew:
+					*ops = append(*ops, patchOp("test", p, ov), jsonPatchOp{Op: "remove", Path: p})
+				case !inOld:
+					*ops = append(*ops, patchOp("add", p, nv))
+				default:
+					diffJSONAt(p, ov, nv, ops)
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if n, ok := new.([]interface{}); ok && len(n) == len(o) {
+			for i := range o {
+				diffJSONAt(path+"/"+strconv.Itoa(i), o[i], n[i], ops)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(old, new) {
+		*ops = append(*ops, patchOp("test", path, old), patchOp("replace", path, new))
+	}
+}
+
+func patchOp(op, path string, value interface{}) jsonPatchOp {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		raw = []byte("null")
+	}
+	return jsonPatchOp{Op: op, Path: path, Value: raw}
+}
+
+// escapeJSONPointer escapes a key for a JSON Pointer (RFC 6901).
+func escapeJSONPointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// incidentAvroSchema is the value schema for the Kafka topic. It is
+// registered through the REST Proxy, so consumers can decode with any
+// schema-registry-aware deserializer. Fields may only be added (with
+// defaults) to keep it backward compatible.
+const incidentAvroSchema = `{
+  "type": "record",
+  "name": "IncidentEvent",
+  "namespace": "org.patrolx.incidents",
+  "fields": [
+    {"name": "change", "type": {"type": "enum", "name": "ChangeType", "symbols": ["created", "updated", "cleared"]}},
+    {"name": "occurred_at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "source", "type": "string"},
+    {"name": "source_id", "type": "string"},
+    {"name": "event_type", "type": "string"},
+    {"name": "status", "type": "string"},
+    {"name": "address", "type": "string"},
+    {"name": "city", "type": ["null", "string"], "default": null},
+    {"name": "county", "type": ["null", "string"], "default": null},
+    {"name": "road", "type": ["null", "string"], "default": null},
+    {"name": "direction", "type": ["null", "string"], "default": null},
+    {"name": "latitude", "type": "double"},
+    {"name": "longitude", "type": "double"},
+    {"name": "start_time", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "severity", "type": "int"},
+    {"name": "normalized_severity", "type": ["null", "int"], "default": null},
+    {"name": "risk_score", "type": ["null", "double"], "default": null},
+    {"name": "lanes_closed", "type": "int"},
+    {"name": "lanes_total", "type": "int"},
+    {"name": "summary", "type": ["null", "string"], "default": null},
+    {"name": "details_json", "type": "string"},
+    {"name": "event_id", "type": "string", "default": ""}
+  ]
+}`
+
+// kafkaSink produces incident events to a Kafka topic through a Confluent
+// REST Proxy, which does the Avro encoding and schema registration. Records
+// are keyed by "source:source_id" so an incident's events stay in order on
+// one partition.
+type kafkaSink struct {
+	url    string
+	topic  string
+	client *http.Client
+
+	mu            sync.Mutex
+	valueSchemaID int
+}
+
+func newKafkaSink(restURL, topic string) *kafkaSink {
+	return &kafkaSink{url: strings.TrimRight(restURL, "/"), topic: topic, client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (s *kafkaSink) Name() string { return "kafka " + s.topic }
+
+// avroUnion wraps a value for a ["null", type] union in Avro's JSON
+// encoding, mapping zero values to null.
+func avroUnion(typ string, v interface{}, present bool) interface{} {
+	if !present {
+		return nil
+	}
+	return map[string]interface{}{typ: v}
+}
+
+func incidentAvroRecord(event IncidentEvent) (map[string]interface{}, error) {
+	p := event.Incident
+	details, err := json.Marshal(p.Details)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"change":              string(event.Change),
+		"occurred_at":         event.OccurredAt.UnixMilli(),
+		"source":              p.Source,
+		"source_id":           p.SourceID,
+		"event_type":          p.EventType,
+		"status":              p.Status,
+		"address":             p.Address,
+		"city":                avroUnion("string", p.City, p.City != ""),
+		"county":              avroUnion("string", p.County, p.County != ""),
+		"road":                avroUnion("string", firstNonEmpty(p.RoadNormalized, p.Road), p.RoadNormalized != "" || p.Road != ""),
+		"direction":           avroUnion("string", p.Direction, p.Direction != ""),
+		"latitude":            p.Latitude,
+		"longitude":           p.Longitude,
+		"start_time":          p.StartTime.UnixMilli(),
+		"severity":            p.Severity,
+		"normalized_severity": avroUnion("int", p.NormalizedSeverity, p.NormalizedSeverity > 0),
+		"risk_score":          avroUnion("double", p.RiskScore, p.NormalizedSeverity > 0),
+		"lanes_closed":        p.LanesClosed,
+		"lanes_total":         p.LanesTotal,
+		"summary":             avroUnion("string", p.Summary, p.Summary != ""),
+		"details_json":        string(details),
+		"event_id":            event.ID,
+	}, nil
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, event IncidentEvent) error {
+	record, err := incidentAvroRecord(event)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	// The schema is sent in full until the proxy hands back its registry
+	// ID, then referenced by ID.
+	s.mu.Lock()
+	schemaID := s.valueSchemaID
+	s.mu.Unlock()
+	body := map[string]interface{}{
+		"key_schema": `"string"`,
+		"records": []interface{}{
+			map[string]interface{}{"key": event.Incident.Source + ":" + event.Incident.SourceID, "value": record},
+		},
+	}
+	if schemaID > 0 {
+		body["value_schema_id"] = schemaID
+	} else {
+		body["value_schema"] = incidentAvroSchema
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url+"/topics/"+s.topic, bytes.NewReader(payload))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.avro.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kafka rest proxy request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		err := fmt.Errorf("kafka rest proxy returned %s: %s", resp.Status, truncate(string(respBody), 200))
+		// 422 means the record or schema was rejected.
+		if resp.StatusCode == http.StatusUnprocessableEntity {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	var result struct {
+		ValueSchemaID int `json:"value_schema_id"`
+		Offsets       []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("failed to unmarshal kafka rest proxy response: %w", err)
+	}
+	if result.ValueSchemaID > 0 {
+		s.mu.Lock()
+		s.valueSchemaID = result.ValueSchemaID
+		s.mu.Unlock()
+	}
+	for _, o := range result.Offsets {
+		if o.ErrorCode != nil {
+			return fmt.Errorf("kafka produce failed (code %d): %s", *o.ErrorCode, o.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GET /stats/corridors ranks roads by incidents and by lane-hours lost
+// over a window: the last 7 days unless since= and until= say otherwise.
+// Lane-hours are lanes closed times hours open, to clearance or now.
+// segment_miles= splits each road into milepost bands of that length, so
+// the ranking is by stretch of road; incidents with no milepost count as
+// the whole road. The other incident filters apply, and limit= (default
+// 10) is the length of each ranking.
+
+const (
+	leaderboardDefaultWindow = 7 * 24 * time.Hour
+	leaderboardDefaultLimit  = 10
+	leaderboardMaxLimit      = 100
+)
+
+// corridorRank is one road, or stretch of one, in the leaderboard.
+type corridorRank struct {
+	Road string `json:"road"`
+	// MilepostFrom and MilepostTo bound the stretch when segment_miles is
+	// given.
+	MilepostFrom *float64 `json:"milepost_from,omitempty"`
+	MilepostTo   *float64 `json:"milepost_to,omitempty"`
+	County       string   `json:"county,omitempty"`
+	Incidents    int      `json:"incidents"`
+	Active       int      `json:"active"`
+	LaneHours    float64  `json:"lane_hours"`
+	TopEventType string   `json:"top_event_type"`
+}
+
+type corridorLeaderboard struct {
+	Since        time.Time      `json:"since"`
+	Until        time.Time      `json:"until"`
+	SegmentMiles float64        `json:"segment_miles,omitempty"`
+	ByIncidents  []corridorRank `json:"by_incidents"`
+	ByLaneHours  []corridorRank `json:"by_lane_hours"`
+}
+
+func (s *server) handleCorridorStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseIncidentFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := f.Limit
+	if limit == 0 {
+		limit = leaderboardDefaultLimit
+	}
+	if limit > leaderboardMaxLimit {
+		limit = leaderboardMaxLimit
+	}
+	var segment float64
+	if v := q.Get("segment_miles"); v != "" {
+		if segment, err = strconv.ParseFloat(v, 64); err != nil || !(segment > 0) || math.IsInf(segment, 0) {
+			http.Error(w, fmt.Sprintf("invalid segment_miles %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	f.Status, f.Limit, f.Offset = "", 0, 0
+	if f.Until.IsZero() {
+		f.Until = time.Now().UTC()
+	}
+	if f.Since.IsZero() {
+		f.Since = f.Until.Add(-leaderboardDefaultWindow)
+	}
+	resp := corridorLeaderboard{Since: f.Since, Until: f.Until, SegmentMiles: segment}
+	if resp.ByIncidents, err = rankCorridors(r.Context(), s.db, f, segment, "incidents", limit); err == nil {
+		resp.ByLaneHours, err = rankCorridors(r.Context(), s.db, f, segment, "lane_hours", limit)
+	}
+	if err != nil {
+		logFor("api").Error("Error building corridor leaderboard", "err", err)
+		http.Error(w, "could not build leaderboard", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "application/json", resp)
+}
+
+// rankCorridors is the top roads (or stretches, with segment > 0) matching
+// f, ordered by incidents or lane_hours.
+func rankCorridors(ctx context.Context, db *sql.DB, f incidentFilter, segment float64, orderBy string, limit int) ([]corridorRank, error) {
+	where, args := f.where()
+	if where == "" {
+		where = "WHERE road_normalized IS NOT NULL"
+	} else {
+		where += " AND road_normalized IS NOT NULL"
+	}
+	band := "NULL::float8"
+	if segment > 0 {
+		band = "floor(milepost / " + strconv.FormatFloat(segment, 'f', -1, 64) + ")"
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT road_normalized, `+band+` AS band, mode() WITHIN GROUP (ORDER BY county_name),
+			count(*) AS incidents, count(*) FILTER (WHERE status = 'active'),
+			coalesce(sum(lanes_closed * greatest(0, extract(epoch FROM
+				coalesce(cleared_at, CASE WHEN status = 'cleared' THEN end_time END, now()) - timestamp::timestamptz)) / 3600), 0) AS lane_hours,
+			mode() WITHIN GROUP (ORDER BY event_type)
+		FROM unified_incidents `+where+`
+		GROUP BY 1, 2
+		ORDER BY `+orderBy+` DESC, 1, 2
+		LIMIT `+strconv.Itoa(limit), args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not rank corridors by %s: %w", orderBy, err)
+	}
+	defer rows.Close()
+	ranks := []corridorRank{}
+	for rows.Next() {
+		var c corridorRank
+		var band sql.NullFloat64
+		var county sql.NullString
+		if err := rows.Scan(&c.Road, &band, &county, &c.Incidents, &c.Active, &c.LaneHours, &c.TopEventType); err != nil {
+			return nil, err
+		}
+		if band.Valid {
+			from, to := band.Float64*segment, (band.Float64+1)*segment
+			c.MilepostFrom, c.MilepostTo = &from, &to
+		}
+		c.County = county.String
+		c.LaneHours = math.Round(c.LaneHours*10) / 10
+		ranks = append(ranks, c)
+	}
+	return ranks, rows.Err()
+}
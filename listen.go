@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// incidentChangesChannel is where the unified_incidents trigger announces
+// changes.
+const incidentChangesChannel = "unified_incidents_changes"
+
+// incidentChange is the NOTIFY payload: just the key and what happened,
+// since payloads are capped at 8000 bytes.
+type incidentChange struct {
+	Source   string     `json:"source"`
+	SourceID string     `json:"source_id"`
+	Change   ChangeType `json:"change"`
+}
+
+// listenIncidentChanges calls handle for each change announced on the
+// channel until ctx is done, reconnecting as needed. Changes made while
+// disconnected are lost.
+func listenIncidentChanges(ctx context.Context, cfg *Config, handle func(incidentChange)) error {
+	listener := pq.NewListener(cfg.psqlInfo(), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			logFor("listen").Warn("Lost the change listener's connection", "err", err)
+		case pq.ListenerEventReconnected:
+			logFor("listen").Warn("Change listener reconnected; changes in between were missed")
+		case pq.ListenerEventConnectionAttemptFailed:
+			logFor("listen").Warn("Change listener could not reconnect", "err", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(incidentChangesChannel); err != nil {
+		return fmt.Errorf("could not listen on %s: %w", incidentChangesChannel, err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-listener.Notify:
+			// nil marks a reconnect.
+			if n == nil {
+				continue
+			}
+			var change incidentChange
+			if err := json.Unmarshal([]byte(n.Extra), &change); err != nil {
+				logFor("listen").Warn("Ignoring malformed change notification", "payload", n.Extra, "err", err)
+				continue
+			}
+			handle(change)
+		case <-time.After(90 * time.Second):
+			// Notice a dead connection even when nothing is changing.
+			go listener.Ping()
+		}
+	}
+}
+
+// loadIncidentEvent turns a change notification into the event the sinks
+// would have seen, reading the incident's current row.
+func loadIncidentEvent(ctx context.Context, db *sql.DB, change incidentChange) (*IncidentEvent, error) {
+	incidents, err := queryIncidents(ctx, db, incidentFilter{Source: change.Source, SourceID: change.SourceID, Limit: 1})
+	if err != nil || len(incidents) == 0 {
+		return nil, err
+	}
+	event := IncidentEvent{Change: change.Change, OccurredAt: time.Now().UTC(), Incident: incidents[0]}
+	event.ID = eventID(event)
+	return &event, nil
+}
+
+// runListen writes a JSON line to stdout for each change to
+// unified_incidents, whoever made it, for other services to consume:
+// the key and change type, or with -full the whole event.
+func runListen(cfg *Config, db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("listen", flag.ExitOnError)
+	full := fs.Bool("full", false, "write each change as a full incident event")
+	fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	enc := json.NewEncoder(os.Stdout)
+	logFor("listen").Info("Listening for changes", "channel", incidentChangesChannel)
+	err := listenIncidentChanges(ctx, cfg, func(change incidentChange) {
+		var out interface{} = change
+		if *full {
+			event, err := loadIncidentEvent(ctx, db, change)
+			if err != nil {
+				logFor("listen").Error("Error loading incident", "source", change.Source, "incident_id", change.SourceID, "err", err)
+				return
+			}
+			if event == nil {
+				return
+			}
+			out = event
+		}
+		if err := enc.Encode(out); err != nil {
+			log.Fatalf("Error writing change: %s", err)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+}
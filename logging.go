@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logging goes through log/slog, as text or JSON (LOG_FORMAT) on stderr.
+// LOG_LEVEL sets the minimum level and LOG_LEVELS overrides it for
+// individual components, e.g. "sinks=debug,http=warn". A component is the
+// "component" attribute a logger is given by logFor; records logged with
+// it inline aren't filtered by it.
+
+// parseLogLevels parses LOG_LEVELS entries ("component=level").
+func parseLogLevels(entries []string) (map[string]slog.Level, error) {
+	levels := map[string]slog.Level{}
+	for _, e := range entries {
+		component, level, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("LOG_LEVELS entry %q must look like component=level", e)
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVELS entry %q: %w", e, err)
+		}
+		levels[strings.TrimSpace(component)] = l
+	}
+	return levels, nil
+}
+
+// componentHandler applies the per-component levels: a logger's level is
+// decided when its component attribute is attached.
+type componentHandler struct {
+	inner  slog.Handler
+	levels map[string]slog.Level
+	level  slog.Level
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.inner = h.inner.WithAttrs(attrs)
+	for _, a := range attrs {
+		if a.Key == "component" {
+			if l, ok := h.levels[a.Value.String()]; ok {
+				out.level = l
+			}
+		}
+	}
+	return &out
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	out := *h
+	out.inner = h.inner.WithGroup(name)
+	return &out
+}
+
+// setupLogging installs the configured handler as the default, which the
+// log package's functions then write through too.
+func setupLogging(cfg *Config) {
+	// The handler itself passes everything; componentHandler decides.
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug - 4}
+	var inner slog.Handler
+	if cfg.LogFormat == "json" {
+		inner = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		inner = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(&componentHandler{inner: inner, levels: cfg.LogLevels, level: cfg.LogLevel}))
+}
+
+// logFor returns the logger for a component.
+func logFor(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+type runIDKey struct{}
+
+// withRunID starts a run: a fresh ID that runLog attaches to everything
+// logged under ctx, so one ingest run's lines can be pulled out together.
+func withRunID(ctx context.Context) (context.Context, string) {
+	var b [6]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+	return context.WithValue(ctx, runIDKey{}, id), id
+}
+
+type profileKey struct{}
+
+// withProfile marks ctx as working for the named profile (see profile.go).
+func withProfile(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, profileKey{}, name)
+}
+
+// runLog is logFor plus the profile and run ID from ctx, if it has them,
+// and the trace ID when the run is being traced.
+func runLog(ctx context.Context, component string) *slog.Logger {
+	l := logFor(component)
+	if name, ok := ctx.Value(profileKey{}).(string); ok {
+		l = l.With("profile", name)
+	}
+	if id, ok := ctx.Value(runIDKey{}).(string); ok {
+		l = l.With("run_id", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	return l
+}
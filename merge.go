@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Duplicates slip through, the same crash reported twice or by two
+// sources. Merging one incident (the duplicate) into another (the
+// survivor) deletes the duplicate's row, keeping a snapshot of it in
+// incident_merges; adds its key, and those merged into it, to the
+// survivor's merged_from; takes the earlier first-seen time; and moves its
+// history, notification threads, route impacts and sends to the survivor
+// where the survivor has none of its own. Ingest skips merged incidents
+// from then on, so the duplicate doesn't come back with the next run. Only
+// the NCDOT ingest does that, so only NCDOT incidents can be the
+// duplicate; another source's would be back the next time it wrote.
+//
+// The dedup stage of ingest suggests merges: each new incident with an
+// active one of the same type within DEDUP_RADIUS_M that started within
+// DEDUP_WINDOW of it is saved to duplicate_suggestions, for an operator to
+// merge or dismiss through "admin duplicates" or /admin/duplicates.
+
+// incidentKey identifies an incident, written "source:source_id".
+type incidentKey struct {
+	Source   string `json:"source"`
+	SourceID string `json:"source_id"`
+}
+
+func (k incidentKey) String() string { return k.Source + ":" + k.SourceID }
+
+func parseIncidentKey(s string) (incidentKey, error) {
+	source, id, ok := strings.Cut(s, ":")
+	if !ok || source == "" || id == "" {
+		return incidentKey{}, fmt.Errorf("invalid incident %q (expected source:source_id)", s)
+	}
+	return incidentKey{Source: source, SourceID: id}, nil
+}
+
+// mergeMovedTables are the tables whose rows follow an incident into its
+// survivor, with the columns besides source and source_id in their key.
+// Where the survivor has a row with the same key, the duplicate's is
+// dropped; tables with no key keep every row.
+var mergeMovedTables = []struct {
+	table string
+	key   []string
+}{
+	{"incident_route_impacts", []string{"route_id"}},
+	{"notification_state", []string{"sink"}},
+	{"notification_messages", []string{"sink"}},
+	{"subscriber_sends", []string{"subscriber_id", "kind", "address"}},
+	{"sms_sends", nil},
+	{"sink_dead_letters", nil},
+	{"incident_history", nil},
+}
+
+var errIncidentNotFound = errors.New("no such incident")
+
+// errNotMergeable is returned for a duplicate ingest wouldn't keep merged.
+var errNotMergeable = errors.New("only NCDOT incidents can be merged away")
+
+// mergeIncidents merges duplicate into survivor. It returns the survivor's
+// merged_from.
+func mergeIncidents(ctx context.Context, db *sql.DB, survivor, duplicate incidentKey, mergedBy, reason string) ([]string, error) {
+	if survivor == duplicate {
+		return nil, fmt.Errorf("an incident can't be merged into itself")
+	}
+	if duplicate.Source != "NCDOT" {
+		return nil, fmt.Errorf("%w, not %s; merge it the other way round", errNotMergeable, duplicate)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var found int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM (
+			SELECT 1 FROM unified_incidents
+			WHERE (source = $1 AND source_id = $2) OR (source = $3 AND source_id = $4)
+			FOR UPDATE
+		) locked`, survivor.Source, survivor.SourceID, duplicate.Source, duplicate.SourceID).Scan(&found); err != nil {
+		return nil, err
+	}
+	if found != 2 {
+		return nil, fmt.Errorf("%s or %s: %w", survivor, duplicate, errIncidentNotFound)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO incident_merges (source, source_id, survivor_source, survivor_source_id, merged_by, reason, snapshot)
+		SELECT source, source_id, $3, $4, $5, NULLIF($6, ''), to_jsonb(u) - 'search_vector'
+		FROM unified_incidents u WHERE source = $1 AND source_id = $2`,
+		duplicate.Source, duplicate.SourceID, survivor.Source, survivor.SourceID, mergedBy, reason); err != nil {
+		return nil, fmt.Errorf("could not record the merge: %w", err)
+	}
+	// Earlier merges into the duplicate now point at the survivor.
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE incident_merges SET survivor_source = $3, survivor_source_id = $4
+		WHERE survivor_source = $1 AND survivor_source_id = $2`,
+		duplicate.Source, duplicate.SourceID, survivor.Source, survivor.SourceID); err != nil {
+		return nil, fmt.Errorf("could not update earlier merges: %w", err)
+	}
+	var mergedFrom []string
+	if err := tx.QueryRowContext(ctx, `
+		UPDATE unified_incidents s SET
+			merged_from = coalesce(s.merged_from, '{}') || $5::text || coalesce(d.merged_from, '{}'),
+			first_seen_at = least(s.first_seen_at, d.first_seen_at, d.timestamp::timestamptz)
+		FROM unified_incidents d
+		WHERE s.source = $1 AND s.source_id = $2 AND d.source = $3 AND d.source_id = $4
+		RETURNING s.merged_from`,
+		survivor.Source, survivor.SourceID, duplicate.Source, duplicate.SourceID, duplicate.String()).Scan(pq.Array(&mergedFrom)); err != nil {
+		return nil, fmt.Errorf("could not update %s: %w", survivor, err)
+	}
+	for _, t := range mergeMovedTables {
+		clash := ""
+		if len(t.key) > 0 {
+			clash = ` AND NOT EXISTS (SELECT 1 FROM ` + t.table + ` o WHERE o.source = $3 AND o.source_id = $4`
+			for _, k := range t.key {
+				clash += " AND o." + k + " = m." + k
+			}
+			clash += ")"
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE `+t.table+` m SET source = $3, source_id = $4
+			WHERE m.source = $1 AND m.source_id = $2`+clash,
+			duplicate.Source, duplicate.SourceID, survivor.Source, survivor.SourceID); err != nil {
+			return nil, fmt.Errorf("could not move %s: %w", t.table, err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+t.table+` WHERE source = $1 AND source_id = $2`,
+			duplicate.Source, duplicate.SourceID); err != nil {
+			return nil, fmt.Errorf("could not clear %s: %w", t.table, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE duplicate_suggestions SET status = 'merged', resolved_at = now()
+		WHERE status = 'pending' AND ((source = $1 AND source_id = $2) OR (other_source = $1 AND other_source_id = $2))
+			AND ((source = $3 AND source_id = $4) OR (other_source = $3 AND other_source_id = $4))`,
+		duplicate.Source, duplicate.SourceID, survivor.Source, survivor.SourceID); err != nil {
+		return nil, fmt.Errorf("could not resolve suggestions: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM duplicate_suggestions
+		WHERE status = 'pending' AND ((source = $1 AND source_id = $2) OR (other_source = $1 AND other_source_id = $2))`,
+		duplicate.Source, duplicate.SourceID); err != nil {
+		return nil, fmt.Errorf("could not resolve suggestions: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM unified_incidents WHERE source = $1 AND source_id = $2`,
+		duplicate.Source, duplicate.SourceID); err != nil {
+		return nil, fmt.Errorf("could not delete %s: %w", duplicate, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	logFor("admin").Info("Merged incidents", "survivor", survivor.String(), "duplicate", duplicate.String(), "by", mergedBy)
+	return mergedFrom, nil
+}
+
+// mergedIncidentIDs is the source IDs of a source's merged incidents, for
+// ingest to skip.
+func mergedIncidentIDs(ctx context.Context, db *sql.DB, source string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT source_id FROM incident_merges WHERE source = $1`, source)
+	if err != nil {
+		return nil, fmt.Errorf("could not load merged incidents: %w", err)
+	}
+	defer rows.Close()
+	ids := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// suggestDuplicates is the dedup stage: it saves a suggestion for each
+// active incident that looks like a duplicate of u. It returns how many
+// there were.
+func suggestDuplicates(ctx context.Context, cfg *Config, db *sql.DB, u *UnifiedIncident) (int, error) {
+	if cfg.DedupRadiusMeters <= 0 {
+		return 0, nil
+	}
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO duplicate_suggestions (source, source_id, other_source, other_source_id, distance_m, start_gap_seconds)
+		SELECT $1, $2, source, source_id, `+numberPlaceholders(distanceSQL, 7)+`,
+			abs(extract(epoch FROM timestamp::timestamptz - $6::timestamptz))
+		FROM unified_incidents
+		WHERE status = 'active' AND event_type = $3 AND NOT (source = $1 AND source_id = $2)
+			AND timestamp BETWEEN $6::timestamptz - make_interval(secs => $4) AND $6::timestamptz + make_interval(secs => $4)
+			AND `+numberPlaceholders(distanceSQL, 7)+` <= $5
+		ON CONFLICT DO NOTHING`,
+		u.Source, u.SourceID, u.EventType, cfg.DedupWindow.Seconds(), cfg.DedupRadiusMeters, u.Timestamp.UTC(),
+		u.Latitude, u.Latitude, u.Longitude)
+	if err != nil {
+		return 0, fmt.Errorf("could not look for duplicates: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// duplicateSuggestion is a pair of incidents that may be the same one.
+type duplicateSuggestion struct {
+	ID         int64       `json:"id"`
+	Incident   incidentKey `json:"incident"`
+	Other      incidentKey `json:"other"`
+	DistanceM  float64     `json:"distance_m"`
+	StartGap   float64     `json:"start_gap_seconds"`
+	Status     string      `json:"status"`
+	CreatedAt  time.Time   `json:"created_at"`
+	ResolvedAt *time.Time  `json:"resolved_at,omitempty"`
+}
+
+func listDuplicateSuggestions(ctx context.Context, db *sql.DB, status string, limit int) ([]duplicateSuggestion, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, source, source_id, other_source, other_source_id, distance_m, start_gap_seconds, status, created_at, resolved_at
+		FROM duplicate_suggestions
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at DESC
+		LIMIT $2`, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not list duplicate suggestions: %w", err)
+	}
+	defer rows.Close()
+	suggestions := []duplicateSuggestion{}
+	for rows.Next() {
+		var d duplicateSuggestion
+		var resolved sql.NullTime
+		if err := rows.Scan(&d.ID, &d.Incident.Source, &d.Incident.SourceID, &d.Other.Source, &d.Other.SourceID,
+			&d.DistanceM, &d.StartGap, &d.Status, &d.CreatedAt, &resolved); err != nil {
+			return nil, err
+		}
+		if resolved.Valid {
+			d.ResolvedAt = &resolved.Time
+		}
+		suggestions = append(suggestions, d)
+	}
+	return suggestions, rows.Err()
+}
+
+func dismissDuplicateSuggestion(ctx context.Context, db *sql.DB, id int64) (bool, error) {
+	res, err := db.ExecContext(ctx, `
+		UPDATE duplicate_suggestions SET status = 'dismissed', resolved_at = now() WHERE id = $1 AND status = 'pending'`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *server) handleListDuplicates(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	} else if status == "all" {
+		status = ""
+	}
+	suggestions, err := listDuplicateSuggestions(r.Context(), s.db, status, 500)
+	if err != nil {
+		logFor("admin").Error("Error listing duplicate suggestions", "err", err)
+		http.Error(w, "could not load duplicate suggestions", http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"suggestions": suggestions})
+}
+
+func (s *server) handleDismissDuplicate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	found, err := dismissDuplicateSuggestion(r.Context(), s.db, id)
+	if err != nil {
+		logFor("admin").Error("Error dismissing duplicate suggestion", "err", err)
+		http.Error(w, "could not dismiss the suggestion", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mergeInput is the body of POST /admin/merges.
+type mergeInput struct {
+	Survivor  string `json:"survivor"`
+	Duplicate string `json:"duplicate"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (s *server) handleMerge(w http.ResponseWriter, r *http.Request) {
+	var in mergeInput
+	if err := readAdminInput(r, &in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	survivor, err := parseIncidentKey(in.Survivor)
+	if err != nil {
+		http.Error(w, "survivor: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	duplicate, err := parseIncidentKey(in.Duplicate)
+	if err != nil {
+		http.Error(w, "duplicate: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if survivor == duplicate {
+		http.Error(w, "survivor and duplicate are the same incident", http.StatusBadRequest)
+		return
+	}
+	mergedBy := "api"
+	if key, ok := requestKey(r.Context()); ok {
+		mergedBy = "api:" + key.Name
+	}
+	mergedFrom, err := mergeIncidents(r.Context(), s.db, survivor, duplicate, mergedBy, in.Reason)
+	switch {
+	case errors.Is(err, errIncidentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errNotMergeable):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		logFor("admin").Error("Error merging incidents", "err", err)
+		http.Error(w, "could not merge the incidents", http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"survivor": survivor, "merged_from": mergedFrom})
+}
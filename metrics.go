@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ingestor's own metrics, in the Prometheus text format on /metrics of
+// METRICS_ADDR. The registry is deliberately small: labelled counters,
+// gauges and histograms, which is all the exposition format needs.
+
+var (
+	metricRuns = newCounter("patrolx_ingest_runs_total",
+		"Ingest runs by result (success or error).", "result")
+	metricLastSuccess = newGauge("patrolx_ingest_last_success_timestamp_seconds",
+		"Unix time the last ingest run completed successfully.")
+	metricRunDuration = newHistogram("patrolx_ingest_run_duration_seconds",
+		"Duration of ingest runs.", []float64{1, 2.5, 5, 10, 20, 40, 60, 120, 300})
+	metricFetched = newCounter("patrolx_incidents_fetched_total",
+		"Incidents read from each source's feed.", "source")
+	metricSaved = newCounter("patrolx_incidents_saved_total",
+		"Incidents saved, by source and change.", "source", "change")
+	metricSaveErrors = newCounter("patrolx_incidents_save_errors_total",
+		"Incidents that could not be saved.", "source")
+	metricQuarantined = newCounter("patrolx_incidents_quarantined_total",
+		"Feed records quarantined, by source and stage.", "source", "stage")
+	metricDBWrite = newHistogram("patrolx_db_write_duration_seconds",
+		"Duration of incident upserts.", []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1})
+	metricEnrichDuration = newHistogram("patrolx_enrich_duration_seconds",
+		"Duration of each enricher per incident.", []float64{.0001, .001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10}, "enricher")
+	metricEnrichErrors = newCounter("patrolx_enrich_errors_total",
+		"Enrichment failures, by enricher.", "enricher")
+	metricNWSRequests = newCounter("patrolx_nws_requests_total",
+		"National Weather Service lookups by result (ok or error).", "result")
+	metricSinkDeliveries = newCounter("patrolx_sink_deliveries_total",
+		"Sink deliveries by result (delivered, suppressed or failed).", "sink", "result")
+	metricHTTPRetries = newCounter("patrolx_http_retries_total",
+		"Upstream requests retried, by host.", "host")
+	metricBreakerTrips = newCounter("patrolx_http_breaker_trips_total",
+		"Times a host's circuit breaker opened.", "host")
+	metricCacheLookups = newCounter("patrolx_cache_lookups_total",
+		"Cache lookups by cache and result (hit or miss).", "cache", "result")
+)
+
+// metricFamily is one named metric with all its label combinations.
+type metricFamily interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	metricsMu       sync.Mutex
+	metricsRegistry []metricFamily
+)
+
+func registerMetric(m metricFamily) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsRegistry = append(metricsRegistry, m)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString renders {a="x",b="y"}, with extra appended as is.
+func labelString(names, values []string, extra string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// scalarMetric is a counter or gauge.
+type scalarMetric struct {
+	metricName, help, kind string
+	labels                 []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newScalar(kind, name, help string, labels []string) *scalarMetric {
+	m := &scalarMetric{metricName: name, help: help, kind: kind, labels: labels, values: map[string]float64{}, keys: map[string][]string{}}
+	registerMetric(m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *scalarMetric {
+	return newScalar("counter", name, help, labels)
+}
+
+func newGauge(name, help string, labels ...string) *scalarMetric {
+	return newScalar("gauge", name, help, labels)
+}
+
+func (m *scalarMetric) name() string { return m.metricName }
+
+func (m *scalarMetric) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] += v
+	m.keys[key] = labelValues
+}
+
+func (m *scalarMetric) inc(labelValues ...string) { m.add(1, labelValues...) }
+
+func (m *scalarMetric) set(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = v
+	m.keys[key] = labelValues
+}
+
+// value is the current value for the labels, zero if never set.
+func (m *scalarMetric) value(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[strings.Join(labelValues, "\xff")]
+}
+
+// labelValues lists the label combinations seen so far.
+func (m *scalarMetric) labelValues() [][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([][]string, 0, len(m.keys))
+	for _, v := range m.keys {
+		out = append(out, v)
+	}
+	return out
+}
+
+func (m *scalarMetric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.metricName, m.help, m.metricName, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.metricName, labelString(m.labels, m.keys[k], ""), formatMetricValue(m.values[k]))
+	}
+}
+
+// histogramMetric counts observations into cumulative buckets.
+type histogramMetric struct {
+	metricName, help string
+	buckets          []float64
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramMetric {
+	m := &histogramMetric{metricName: name, help: help, buckets: buckets, labels: labels, series: map[string]*histogramSeries{}}
+	registerMetric(m)
+	return m
+}
+
+func (m *histogramMetric) name() string { return m.metricName }
+
+func (m *histogramMetric) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// since observes the seconds elapsed since start.
+func (m *histogramMetric) since(start time.Time, labelValues ...string) {
+	m.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (m *histogramMetric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.metricName, m.help, m.metricName)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.metricName, labelString(m.labels, s.labelValues, `le="`+formatMetricValue(b)+`"`), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.metricName, labelString(m.labels, s.labelValues, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.metricName, labelString(m.labels, s.labelValues, ""), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.metricName, labelString(m.labels, s.labelValues, ""), s.count)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	families := append([]metricFamily(nil), metricsRegistry...)
+	metricsMu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name() < families[j].name() })
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range families {
+		m.write(w)
+	}
+}
+
+// serveMetrics serves /metrics, and the health checks (see health.go), on
+// addr until ctx is done. A non-nil debug adds the debug endpoints (see
+// debug.go).
+func serveMetrics(ctx context.Context, addr string, ready *readiness, debug *debugStatus) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", ready.handleReadyz)
+	if debug != nil {
+		debug.register(mux)
+	}
+	httpServer := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+	logFor("metrics").Info("Serving metrics", "addr", addr)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const metersPerMile = 1609.344
+
+// MilepostResult is the linear reference computed for an incident.
+type MilepostResult struct {
+	Route          string  `json:"route"`
+	Milepost       float64 `json:"milepost"`
+	DistanceMeters float64 `json:"distance_m"`
+}
+
+// routeLine is one measured route geometry. cum[i] is the distance in
+// meters from the start of the line to points[i].
+type routeLine struct {
+	routeID   string
+	name      string
+	startMile float64
+	points    []LatLon
+	cum       []float64
+}
+
+// RouteGeometries holds measured Interstate and US route centerlines.
+type RouteGeometries struct {
+	byRouteID map[string][]*routeLine
+	byName    map[string][]*routeLine
+}
+
+// loadRouteGeometries reads a GeoJSON FeatureCollection of route
+// centerlines. Each feature is a LineString (or MultiLineString whose parts
+// are in order) drawn in the direction mileposts increase, with properties:
+//
+//	route_id        NCDOT RouteID the geometry belongs to
+//	name            signed route name, e.g. "I-40" or "US-70"
+//	start_milepost  milepost at the first vertex (default 0)
+func loadRouteGeometries(path string) (*RouteGeometries, error) {
+	fc, err := loadGeoJSON(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rg := &RouteGeometries{byRouteID: map[string][]*routeLine{}, byName: map[string][]*routeLine{}}
+	for i := range fc.Features {
+		f := &fc.Features[i]
+		parts, err := f.Geometry.lines()
+		if err != nil {
+			return nil, fmt.Errorf("route geometry feature %d: %w", i, err)
+		}
+		line := &routeLine{
+			routeID:   f.stringProp("route_id"),
+			name:      f.stringProp("name"),
+			startMile: f.floatProp("start_milepost", 0),
+		}
+		for _, part := range parts {
+			for j, p := range part {
+				d := 0.0
+				if j > 0 {
+					d = line.cum[len(line.cum)-1] + haversineMeters(part[j-1], p)
+				} else if len(line.cum) > 0 {
+					d = line.cum[len(line.cum)-1]
+				}
+				line.points = append(line.points, p)
+				line.cum = append(line.cum, d)
+			}
+		}
+		if len(line.points) < 2 {
+			continue
+		}
+		if line.routeID != "" {
+			rg.byRouteID[line.routeID] = append(rg.byRouteID[line.routeID], line)
+		}
+		if key := routeNameKey(line.name); key != "" {
+			rg.byName[key] = append(rg.byName[key], line)
+		}
+	}
+	return rg, nil
+}
+
+// routeNameKey canonicalizes a route name for lookup ("I 40" == "i-40").
+func routeNameKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(name))
+}
+
+// isMilepostRoute reports whether a road is an Interstate or US route,
+// the only roads NCDOT posts mile markers on.
+func isMilepostRoute(road string) bool {
+	key := routeNameKey(road)
+	return strings.HasPrefix(key, "I") && len(key) > 1 && key[1] >= '0' && key[1] <= '9' ||
+		strings.HasPrefix(key, "US") && len(key) > 2 && key[2] >= '0' && key[2] <= '9'
+}
+
+// Locate projects p onto the route's geometry and returns its milepost.
+func (rg *RouteGeometries) Locate(routeID, road string, p LatLon, maxMeters float64) (*MilepostResult, bool) {
+	lines := rg.byRouteID[routeID]
+	if len(lines) == 0 {
+		lines = rg.byName[routeNameKey(road)]
+	}
+
+	var best *MilepostResult
+	for _, line := range lines {
+		for i := 1; i < len(line.points); i++ {
+			d, t := pointSegmentDistance(p, line.points[i-1], line.points[i])
+			if d > maxMeters || (best != nil && d >= best.DistanceMeters) {
+				continue
+			}
+			along := line.cum[i-1] + t*(line.cum[i]-line.cum[i-1])
+			best = &MilepostResult{
+				Route:          firstNonEmpty(line.name, road),
+				Milepost:       line.startMile + along/metersPerMile,
+				DistanceMeters: d,
+			}
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	best.Milepost = math.Round(best.Milepost*10) / 10
+	best.DistanceMeters = math.Round(best.DistanceMeters*10) / 10
+	return best, true
+}
+
+// milepostEnricher computes the approximate mile marker for incidents on
+// Interstates and US routes.
+type milepostEnricher struct {
+	routes    *RouteGeometries
+	maxMeters float64
+}
+
+func (e *milepostEnricher) Name() string { return "milepost" }
+
+func (e *milepostEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	road := firstNonEmpty(incident.RoadNormalized, incident.Road)
+	if !isMilepostRoute(road) {
+		return nil
+	}
+	routeID := ""
+	if incident.RouteID != 0 {
+		routeID = fmt.Sprint(incident.RouteID)
+	}
+	result, ok := e.routes.Locate(routeID, road, LatLon{Lat: incident.Latitude, Lon: incident.Longitude}, e.maxMeters)
+	if !ok {
+		return nil
+	}
+	incident.Milepost = result
+	return nil
+}
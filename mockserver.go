@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runMockServer stands in for the NCDOT feed and the NWS API, serving
+// recorded payloads so the whole pipeline can be run end to end against
+// known data:
+//
+//	mock-server -fixtures testdata/storm -addr :8089 -latency 200ms -error-rate 0.05
+//	DOT_URL=http://localhost:8089/ncdot NWS_URL=http://localhost:8089 ingest
+//
+// The fixtures directory holds ncdot.json, the feed as NCDOT serves it,
+// and optionally nws-hourly.json, an NWS hourly forecast response; without
+// one every point gets the same mild forecast. The feed answers
+// conditional requests like the real one. -latency (plus up to -jitter)
+// delays every response, and -error-rate of them fail with a 503, chosen
+// with -seed so a run can be repeated exactly.
+func runMockServer(args []string) {
+	fs := flag.NewFlagSet("mock-server", flag.ExitOnError)
+	addr := fs.String("addr", ":8089", "address to serve on")
+	dir := fs.String("fixtures", "", "directory of recorded payloads")
+	latency := fs.Duration("latency", 0, "delay before every response")
+	jitter := fs.Duration("jitter", 0, "extra random delay, up to this much")
+	errorRate := fs.Float64("error-rate", 0, "fraction of requests answered with a 503")
+	seed := fs.Uint64("seed", 1, "seed for jitter and errors")
+	fs.Parse(args)
+	if *dir == "" {
+		log.Fatalf("Usage: mock-server -fixtures DIR [-addr :8089] [-latency D] [-jitter D] [-error-rate F] [-seed N]")
+	}
+	if *errorRate < 0 || *errorRate > 1 {
+		log.Fatalf("Error: -error-rate must be between 0 and 1")
+	}
+	m, err := loadMockFixtures(*dir)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	m.latency, m.jitter, m.errorRate = *latency, *jitter, *errorRate
+	m.rng = rand.New(rand.NewPCG(*seed, *seed))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	httpServer := &http.Server{Addr: *addr, Handler: m.routes(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+	logFor("mock").Info("Serving fixtures", "addr", *addr, "fixtures", *dir)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Error serving HTTP: %s", err)
+	}
+}
+
+// mockServer is the state behind mock-server.
+type mockServer struct {
+	feed     []byte
+	feedETag string
+	hourly   []byte
+
+	latency, jitter time.Duration
+	errorRate       float64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// mockHourly is the forecast served when there's no nws-hourly.json.
+const mockHourly = `{"properties": {"periods": [
+  {"startTime": "2024-01-01T00:00:00Z", "temperature": 55, "windSpeed": "5 mph", "shortForecast": "Partly Cloudy", "icon": ""}
+]}}`
+
+func loadMockFixtures(dir string) (*mockServer, error) {
+	m := &mockServer{}
+	var err error
+	if m.feed, err = os.ReadFile(filepath.Join(dir, "ncdot.json")); err != nil {
+		return nil, fmt.Errorf("could not read the feed fixture: %w", err)
+	}
+	if !json.Valid(m.feed) {
+		return nil, fmt.Errorf("%s: not valid JSON", filepath.Join(dir, "ncdot.json"))
+	}
+	sum := sha256.Sum256(m.feed)
+	m.feedETag = `"` + hex.EncodeToString(sum[:8]) + `"`
+	m.hourly, err = os.ReadFile(filepath.Join(dir, "nws-hourly.json"))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		m.hourly = []byte(mockHourly)
+	case err != nil:
+		return nil, fmt.Errorf("could not read the forecast fixture: %w", err)
+	}
+	return m, nil
+}
+
+func (m *mockServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ncdot", m.handleFeed)
+	mux.HandleFunc("GET /points/{point}", m.handlePoints)
+	mux.HandleFunc("GET /gridpoints/{office}/{xy}/forecast/hourly", m.handleHourly)
+	return m.misbehave(mux)
+}
+
+// misbehave delays and fails requests as configured.
+func (m *mockServer) misbehave(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		delay := m.latency
+		if m.jitter > 0 {
+			delay += time.Duration(m.rng.Int64N(int64(m.jitter)))
+		}
+		fail := m.rng.Float64() < m.errorRate
+		m.mu.Unlock()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+		logFor("mock").Debug("Request", "method", r.Method, "path", r.URL.Path, "delay", delay.String(), "fail", fail)
+		if fail {
+			http.Error(w, "injected failure", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *mockServer) handleFeed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", m.feedETag)
+	if r.Header.Get("If-None-Match") == m.feedETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(m.feed)
+}
+
+// handlePoints answers /points/{lat},{lon} with a forecast URL back on
+// this server.
+func (m *mockServer) handlePoints(w http.ResponseWriter, r *http.Request) {
+	lat, lon, ok := strings.Cut(r.PathValue("point"), ",")
+	if !ok {
+		http.Error(w, "expected /points/{lat},{lon}", http.StatusBadRequest)
+		return
+	}
+	if _, err := strconv.ParseFloat(lat, 64); err != nil {
+		http.Error(w, "invalid latitude", http.StatusBadRequest)
+		return
+	}
+	if _, err := strconv.ParseFloat(lon, 64); err != nil {
+		http.Error(w, "invalid longitude", http.StatusBadRequest)
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	var resp NWSPointsResponse
+	resp.Properties.ForecastHourly = scheme + "://" + r.Host + "/gridpoints/MOCK/1,1/forecast/hourly"
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (m *mockServer) handleHourly(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Write(m.hourly)
+}
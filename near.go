@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// GET /incidents/near?lat=&lon=&radius= answers "what's around me": active
+// incidents within radius meters (default 10 km), nearest first, each with
+// its distance. With heading (degrees clockwise from north) it keeps only
+// those within 60° either side of it, i.e. ahead of a driver going that
+// way. The usual incident filters apply; status=all includes cleared ones.
+
+const (
+	nearDefaultRadius = 10000
+	nearMaxRadius     = 100000
+	nearAheadDegrees  = 60
+)
+
+type nearbyIncident struct {
+	IncidentPayload
+	DistanceMeters float64 `json:"distance_m"`
+	// BearingDegrees is the direction from the query point.
+	BearingDegrees float64 `json:"bearing_deg"`
+}
+
+type nearbyList struct {
+	Incidents    []nearbyIncident `json:"incidents"`
+	Count        int              `json:"count"`
+	RadiusMeters float64          `json:"radius_m"`
+}
+
+func (s *server) handleIncidentsNear(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseIncidentFilter(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	floatParam := func(name string, def float64) (float64, error) {
+		v := q.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return 0, fmt.Errorf("invalid %s %q", name, v)
+		}
+		return n, nil
+	}
+	lat, errLat := floatParam("lat", math.NaN())
+	lon, errLon := floatParam("lon", math.NaN())
+	if errLat != nil || errLon != nil || math.IsNaN(lat) || math.IsNaN(lon) || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		http.Error(w, "lat and lon are required", http.StatusBadRequest)
+		return
+	}
+	radius, err := floatParam("radius", nearDefaultRadius)
+	if err != nil || radius <= 0 || radius > nearMaxRadius {
+		http.Error(w, fmt.Sprintf("radius must be between 0 and %d meters", nearMaxRadius), http.StatusBadRequest)
+		return
+	}
+	heading, err := floatParam("heading", math.NaN())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch f.Status {
+	case "":
+		f.Status = StatusActive
+	case "all":
+		f.Status = ""
+	}
+	origin := LatLon{Lat: lat, Lon: lon}
+	f.Near, f.RadiusMeters = &origin, radius
+	if f.Limit == 0 {
+		f.Limit = apiDefaultLimit
+	}
+	if f.Limit > apiMaxLimit {
+		f.Limit = apiMaxLimit
+	}
+	limit := f.Limit
+	if !math.IsNaN(heading) {
+		// Some of the nearest will be behind; filter a full page.
+		f.Limit, f.Offset = apiMaxLimit, 0
+	}
+
+	incidents, err := queryIncidents(r.Context(), s.db, f)
+	if err != nil {
+		logFor("api").Error("Error finding nearby incidents", "err", err)
+		http.Error(w, "could not load incidents", http.StatusInternalServerError)
+		return
+	}
+	resp := nearbyList{Incidents: []nearbyIncident{}, RadiusMeters: radius}
+	for _, p := range incidents {
+		pt := LatLon{Lat: p.Latitude, Lon: p.Longitude}
+		n := nearbyIncident{IncidentPayload: p, DistanceMeters: math.Round(haversineMeters(origin, pt)), BearingDegrees: math.Round(initialBearing(origin, pt))}
+		if !math.IsNaN(heading) && angleBetween(heading, n.BearingDegrees) > nearAheadDegrees {
+			continue
+		}
+		if len(resp.Incidents) == limit {
+			break
+		}
+		resp.Incidents = append(resp.Incidents, n)
+	}
+	resp.Count = len(resp.Incidents)
+	writeJSON(w, "application/json", resp)
+}
+
+// initialBearing is the compass direction from a towards b, 0–360.
+func initialBearing(a, b LatLon) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// angleBetween is the smaller angle between two compass directions.
+func angleBetween(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 360)
+	return math.Min(d, 360-d)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Helpers shared by the chat-style notification sinks.
+
+// incidentTitle is the one-line headline for a notification, e.g.
+// "Vehicle Crash on I-40 W in Wake County".
+func incidentTitle(p IncidentPayload) string {
+	var b strings.Builder
+	b.WriteString(p.EventType)
+	if road := firstNonEmpty(p.RoadNormalized, p.Road); road != "" {
+		b.WriteString(" on " + road)
+		if p.Direction != "" {
+			b.WriteString(" " + p.Direction)
+		}
+	}
+	if p.County != "" {
+		b.WriteString(" in " + p.County + " County")
+	}
+	return b.String()
+}
+
+// incidentDescription prefers the LLM summary and falls back to the
+// address and problem detail.
+func incidentDescription(p IncidentPayload) string {
+	if p.Summary != "" {
+		return p.Summary
+	}
+	if p.ProblemDetail != "" {
+		return p.Address + ". " + p.ProblemDetail
+	}
+	return p.Address
+}
+
+func mapURL(lat, lon float64) string {
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.5f&mlon=%.5f#map=15/%.5f/%.5f", lat, lon, lat, lon)
+}
+
+func severityLabel(p IncidentPayload) string {
+	if p.NormalizedSeverity > 0 {
+		return fmt.Sprintf("%d/5 (risk %.1f)", p.NormalizedSeverity, p.RiskScore)
+	}
+	return fmt.Sprintf("%d", p.Severity)
+}
+
+func lanesLabel(p IncidentPayload) string {
+	switch {
+	case p.LanesTotal == 0:
+		return "unknown"
+	case p.fullClosure():
+		return fmt.Sprintf("all %d closed", p.LanesTotal)
+	}
+	return fmt.Sprintf("%d of %d closed", p.LanesClosed, p.LanesTotal)
+}
+
+func weatherLabel(w *WeatherData) string {
+	if w == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d°F, %s, wind %s", w.Temperature, w.ShortForecast, w.WindSpeed)
+}
+
+func localTimeLabel(t time.Time) string {
+	return t.In(easternTime).Format("3:04 PM Mon Jan 2")
+}
+
+// staticMapImageURL fills the {lat} and {lon} placeholders of a static map
+// URL template.
+func staticMapImageURL(template string, lat, lon float64) string {
+	return strings.NewReplacer("{lat}", fmt.Sprintf("%.5f", lat), "{lon}", fmt.Sprintf("%.5f", lon)).Replace(template)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "—"
+	}
+	return s
+}
+
+// notificationMessage remembers the message a sink posted for an incident
+// so follow-ups can be threaded under it or edit it in place.
+type notificationMessage struct {
+	Channel   string
+	MessageID string
+}
+
+func loadNotificationMessage(db *sql.DB, sink string, p IncidentPayload) (*notificationMessage, error) {
+	var m notificationMessage
+	err := db.QueryRow(`
+		SELECT channel, message_id FROM notification_messages
+		WHERE sink = $1 AND source = $2 AND source_id = $3`,
+		sink, p.Source, p.SourceID).Scan(&m.Channel, &m.MessageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load notification message: %w", err)
+	}
+	return &m, nil
+}
+
+func saveNotificationMessage(db *sql.DB, sink string, p IncidentPayload, m notificationMessage) error {
+	_, err := db.Exec(`
+		INSERT INTO notification_messages (sink, source, source_id, channel, message_id)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (sink, source, source_id) DO UPDATE SET channel = EXCLUDED.channel, message_id = EXCLUDED.message_id`,
+		sink, p.Source, p.SourceID, m.Channel, m.MessageID)
+	if err != nil {
+		return fmt.Errorf("could not save notification message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// The OpenAPI 3 description of the HTTP API, at /openapi.json, with
+// Swagger UI at /docs/. It's built from apiOperations and the Go response
+// types themselves, so it can't drift from what the handlers encode;
+// apiOperations must be kept in step with routes.
+
+//go:embed apidocs
+var apiDocsFiles embed.FS
+
+// apiOperation describes one route for the spec.
+type apiOperation struct {
+	Method, Path string
+	Summary      string
+	Tag          string
+	Params       []apiParam
+	// Response is a value of the JSON response type; nil for other
+	// content, described by ContentType.
+	Response    interface{}
+	ContentType string
+	// Body is a value of the JSON request body type, if any.
+	Body  interface{}
+	Admin bool
+}
+
+type apiParam struct {
+	Name, In, Type, Description string
+}
+
+var (
+	incidentFilterParams = []apiParam{
+		{"county", "query", "string", "County name"},
+		{"road", "query", "string", "Normalized road name, e.g. I-40"},
+		{"event_type", "query", "string", "Event type (alias: type)"},
+		{"geofence", "query", "string", "Ingest geofence name"},
+		{"status", "query", "string", "active or cleared"},
+		{"bbox", "query", "string", "minLon,minLat,maxLon,maxLat"},
+		{"since", "query", "string", "Start time, RFC 3339 or YYYY-MM-DD"},
+		{"until", "query", "string", "End time, RFC 3339 or YYYY-MM-DD"},
+		{"q", "query", "string", "Full-text search, e.g. jackknifed tractor trailer I-95"},
+	}
+	pageParams = []apiParam{
+		{"limit", "query", "integer", "Maximum results"},
+		{"offset", "query", "integer", "Results to skip"},
+	}
+	streamParams = []apiParam{
+		{"county", "query", "string", "County name"},
+		{"road", "query", "string", "Normalized road name"},
+		{"event_type", "query", "string", "Event type"},
+	}
+	corridorParams = []apiParam{
+		{"polyline", "query", "string", "Encoded polyline of the route"},
+		{"precision", "query", "integer", "Polyline precision, 5 (default) or 6"},
+		{"route", "query", "string", "Name of a saved route, instead of a polyline"},
+		{"buffer", "query", "number", "Meters either side of the route, default 150"},
+	}
+	incidentKeyParams = []apiParam{
+		{"source", "path", "string", "Feed the incident came from, e.g. NCDOT"},
+		{"id", "path", "string", "The source's incident ID"},
+	}
+)
+
+func params(lists ...[]apiParam) []apiParam {
+	var all []apiParam
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	return all
+}
+
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/incidents", Tag: "incidents", Summary: "List incidents, newest first",
+		Params: params(incidentFilterParams, pageParams), Response: incidentList{}},
+	{Method: "GET", Path: "/search", Tag: "incidents", Summary: "Full-text search, best match first (q is required)",
+		Params: params(incidentFilterParams, pageParams), Response: incidentList{}},
+	{Method: "GET", Path: "/incidents/near", Tag: "incidents", Summary: "Incidents within a radius, nearest first",
+		Params: params([]apiParam{
+			{"lat", "query", "number", "Latitude (required)"},
+			{"lon", "query", "number", "Longitude (required)"},
+			{"radius", "query", "number", "Meters, default 10000, at most 100000"},
+			{"heading", "query", "number", "Only incidents within 60 degrees of this compass heading"},
+		}, incidentFilterParams, pageParams), Response: nearbyList{}},
+	{Method: "GET", Path: "/incidents/corridor", Tag: "incidents", Summary: "Incidents along a route, in order",
+		Params: params(corridorParams, incidentFilterParams, []apiParam{{"limit", "query", "integer", "Maximum results"}}), Response: corridorList{}},
+	{Method: "POST", Path: "/incidents/corridor", Tag: "incidents", Summary: "Incidents along a route given in the body, in order",
+		Params: params(incidentFilterParams, []apiParam{{"limit", "query", "integer", "Maximum results"}}), Body: corridorRequest{}, Response: corridorList{}},
+	{Method: "GET", Path: "/incidents/{source}/{id}", Tag: "incidents", Summary: "Get one incident with its details",
+		Params: incidentKeyParams, Response: IncidentPayload{}},
+	{Method: "GET", Path: "/incidents/{source}/{id}/history", Tag: "incidents", Summary: "An incident's changes, each update with a JSON Patch of its details",
+		Params: incidentKeyParams, Response: incidentHistory{}},
+	{Method: "GET", Path: "/stats/summary", Tag: "incidents", Summary: "Current and last-24-hour counts", Response: statsSummary{}},
+	{Method: "GET", Path: "/stats/location", Tag: "incidents", Summary: "Incident history at a point or stretch of road",
+		Params: []apiParam{
+			{"lat", "query", "number", "Latitude"},
+			{"lon", "query", "number", "Longitude"},
+			{"radius", "query", "number", "Meters around the point, default 250"},
+			{"road", "query", "string", "Normalized road name, instead of a point"},
+			{"milepost_from", "query", "number", "Start of the stretch of road"},
+			{"milepost_to", "query", "number", "End of the stretch of road"},
+			{"event_type", "query", "string", "Event type"},
+			{"since", "query", "string", "Start time, RFC 3339 or YYYY-MM-DD"},
+			{"until", "query", "string", "End time, RFC 3339 or YYYY-MM-DD"},
+		}, Response: locationHistory{}},
+	{Method: "GET", Path: "/stats/clearance", Tag: "incidents", Summary: "Clearance times by event type and road, and active incidents past their SLA",
+		Params: incidentFilterParams, Response: clearanceReport{}},
+	{Method: "GET", Path: "/stats/corridors", Tag: "incidents", Summary: "Roads with the most incidents and lane-hours lost over a window",
+		Params: params(incidentFilterParams, []apiParam{
+			{"segment_miles", "query", "number", "Rank stretches of road this many miles long instead of whole roads"},
+			{"limit", "query", "integer", "Length of each ranking, default 10"},
+		}), Response: corridorLeaderboard{}},
+	{Method: "GET", Path: "/risk", Tag: "incidents", Summary: "Predicted incident risk by stretch of road for the next few hours",
+		Params: []apiParam{
+			{"road", "query", "string", "Normalized road name"},
+			{"county", "query", "string", "County name"},
+			{"hours", "query", "integer", "Hours ahead to consider, default all scored"},
+			{"min_probability", "query", "number", "Leave out segments whose peak is lower"},
+			{"limit", "query", "integer", "Maximum results"},
+		}, Response: riskList{}},
+	{Method: "GET", Path: "/incidents.geojson", Tag: "incidents", Summary: "Incidents as GeoJSON, active by default",
+		Params:   params(incidentFilterParams, pageParams, []apiParam{{"details", "query", "boolean", "Include the details object"}}),
+		Response: incidentFeatureCollection{}, ContentType: "application/geo+json"},
+	{Method: "GET", Path: "/tiles/density/{z}/{x}/{y}", Tag: "incidents", Summary: "Incident density as a Mapbox Vector Tile (y may end in .mvt)",
+		Params:      params([]apiParam{{"z", "path", "integer", "Zoom"}, {"x", "path", "integer", "Tile column"}, {"y", "path", "string", "Tile row"}}, incidentFilterParams),
+		ContentType: "application/vnd.mapbox-vector-tile"},
+	{Method: "GET", Path: "/stream", Tag: "live", Summary: "Incident changes as Server-Sent Events",
+		Params: streamParams, ContentType: "text/event-stream"},
+	{Method: "GET", Path: "/ws", Tag: "live", Summary: "Incident changes over a WebSocket, one JSON event per text frame",
+		Params: streamParams},
+	{Method: "GET", Path: "/graphql", Tag: "graphql", Summary: "GraphQL query, or subscription with Accept: text/event-stream",
+		Params:   []apiParam{{"query", "query", "string", "GraphQL document"}, {"operationName", "query", "string", ""}, {"variables", "query", "string", "JSON object"}},
+		Response: map[string]interface{}{}},
+	{Method: "POST", Path: "/graphql", Tag: "graphql", Summary: "GraphQL query", Body: graphQLRequest{}, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/calendar.ics", Tag: "feeds", Summary: "Planned closures as iCalendar",
+		Params: []apiParam{{"county", "query", "string", "County name"}, {"road", "query", "string", "Normalized road name"}}, ContentType: "text/calendar"},
+	{Method: "GET", Path: "/feed.rss", Tag: "feeds", Summary: "Recent incidents as RSS", Params: incidentFilterParams, ContentType: "application/rss+xml"},
+	{Method: "GET", Path: "/feed.atom", Tag: "feeds", Summary: "Recent incidents as Atom", Params: incidentFilterParams, ContentType: "application/atom+xml"},
+	{Method: "GET", Path: "/open511/events", Tag: "open data", Summary: "Open511 events; status is ACTIVE, ARCHIVED or ALL",
+		Params: params(incidentFilterParams, pageParams), Response: open511Response{}},
+	{Method: "GET", Path: "/open511/events/{source}/{id}", Tag: "open data", Summary: "One Open511 event",
+		Params: incidentKeyParams, Response: open511Response{}},
+	{Method: "GET", Path: "/wzdx", Tag: "open data", Summary: "Planned closures as a WZDx 4.2 feed", Params: incidentFilterParams, Response: wzdxFeed{}},
+
+	{Method: "GET", Path: "/admin/geofences", Tag: "admin", Summary: "List geofences", Admin: true, Response: map[string][]geofence{}},
+	{Method: "PUT", Path: "/admin/geofences/{key}", Tag: "admin", Summary: "Create or replace a geofence", Admin: true,
+		Params: []apiParam{{"key", "path", "string", "Geofence name"}}, Body: geofenceInput{}, Response: geofence{}},
+	{Method: "DELETE", Path: "/admin/geofences/{key}", Tag: "admin", Summary: "Delete a geofence", Admin: true,
+		Params: []apiParam{{"key", "path", "string", "Geofence name"}}},
+	{Method: "GET", Path: "/admin/event-types", Tag: "admin", Summary: "List the event types ingested", Admin: true, Response: map[string]interface{}{}},
+	{Method: "PUT", Path: "/admin/event-types/{key}", Tag: "admin", Summary: "Ingest an event type", Admin: true,
+		Params: []apiParam{{"key", "path", "string", "Event type"}}, Response: map[string]string{}},
+	{Method: "DELETE", Path: "/admin/event-types/{key}", Tag: "admin", Summary: "Stop ingesting an event type", Admin: true,
+		Params: []apiParam{{"key", "path", "string", "Event type"}}},
+	{Method: "GET", Path: "/admin/notification-rules", Tag: "admin", Summary: "List notification rules", Admin: true, Response: map[string][]notificationRule{}},
+	{Method: "PUT", Path: "/admin/notification-rules/{key}", Tag: "admin", Summary: "Create or replace a notification rule", Admin: true,
+		Params: []apiParam{{"key", "path", "string", "Rule name"}}, Body: notificationRuleInput{}, Response: notificationRule{}},
+	{Method: "DELETE", Path: "/admin/notification-rules/{key}", Tag: "admin", Summary: "Delete a notification rule", Admin: true,
+		Params: []apiParam{{"key", "path", "string", "Rule name"}}},
+}
+
+// openAPISpec builds the document for an API served under basePath.
+func openAPISpec(basePath string) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+	for _, op := range apiOperations {
+		operation := map[string]interface{}{
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"operationId": operationID(op),
+		}
+		var parameters []map[string]interface{}
+		for _, p := range op.Params {
+			parameters = append(parameters, map[string]interface{}{
+				"name": p.Name, "in": p.In, "required": p.In == "path",
+				"description": p.Description, "schema": map[string]string{"type": p.Type},
+			})
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		if op.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(op.Body), schemas)}},
+			}
+		}
+		ok := map[string]interface{}{"description": "OK"}
+		switch {
+		case op.Response != nil:
+			contentType := op.ContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			ok["content"] = map[string]interface{}{contentType: map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(op.Response), schemas)}}
+		case op.ContentType != "":
+			ok["content"] = map[string]interface{}{op.ContentType: map[string]interface{}{"schema": map[string]string{"type": "string"}}}
+		}
+		responses := map[string]interface{}{"200": ok, "400": map[string]string{"description": "Invalid parameters"}}
+		switch {
+		case op.Path == "/ws":
+			responses = map[string]interface{}{"101": map[string]string{"description": "Switched to WebSocket"}}
+		case op.Method == "DELETE":
+			responses = map[string]interface{}{"204": map[string]string{"description": "Deleted"}, "404": map[string]string{"description": "Not found"}}
+		}
+		responses["401"] = map[string]string{"description": "Missing or invalid API key"}
+		responses["429"] = map[string]string{"description": "Rate limit exceeded; see Retry-After"}
+		if op.Admin {
+			responses["403"] = map[string]string{"description": "Needs an admin key"}
+		}
+		operation["responses"] = responses
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]interface{}{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":       "NC traffic incidents",
+			"version":     "1",
+			"description": "Read API over the unified incident table. API keys, when required, go in an Authorization: Bearer header, X-API-Key or ?api_key=.",
+		},
+		"servers": []map[string]string{{"url": basePath + "/"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+				"header": map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"query":  map[string]string{"type": "apiKey", "in": "query", "name": "api_key"},
+			},
+		},
+		"security": []map[string][]string{{"bearer": {}}, {"header": {}}, {"query": {}}},
+	}
+}
+
+// operationID is e.g. getIncidentsSourceId for GET /incidents/{source}/{id}.
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// jsonSchema describes how encoding/json encodes t, adding named structs
+// to schemas and referring to them.
+func jsonSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := jsonSchema(t.Elem(), schemas)
+		if _, ref := s["$ref"]; ref {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := schemaName(t)
+		if name == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = nil // placeholder for recursive types
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// schemaName exports a Go type name: incidentList becomes IncidentList.
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if name == "" {
+		return ""
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = jsonSchema(f.Type, schemas)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	s := map[string]interface{}{"type": "object", "properties": properties}
+	if required != nil {
+		s["required"] = required
+	}
+	return s
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.MarshalIndent(openAPISpec(s.cfg.APIBasePath), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(openAPIJSON)
+}
+
+func apiDocsHandler() http.Handler {
+	files, err := fs.Sub(apiDocsFiles, "apidocs")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/docs/", http.FileServerFS(files))
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Standard-format exports of unified_incidents for navigation vendors and
+// other agencies: Open511 events at GET /open511/events (one at
+// /open511/events/{source}/{id}), and planned work zones as a WZDx 4.2
+// feed at GET /wzdx.
+
+const (
+	open511Jurisdiction = "ncdot.gov"
+	wzdxVersion         = "4.2"
+	openDataMaxEntries  = 500
+)
+
+type open511Response struct {
+	Events     []open511Event    `json:"events"`
+	Pagination open511Pagination `json:"pagination"`
+	Meta       open511Meta       `json:"meta"`
+}
+
+type open511Pagination struct {
+	Offset      int    `json:"offset"`
+	NextURL     string `json:"next_url,omitempty"`
+	PreviousURL string `json:"previous_url,omitempty"`
+	Limit       int    `json:"limit"`
+}
+
+type open511Meta struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+}
+
+type open511Event struct {
+	ID           string          `json:"id"`
+	URL          string          `json:"url"`
+	Jurisdiction string          `json:"jurisdiction_url"`
+	Status       string          `json:"status"`
+	Headline     string          `json:"headline"`
+	Description  string          `json:"description,omitempty"`
+	EventType    string          `json:"event_type"`
+	Subtypes     []string        `json:"event_subtypes,omitempty"`
+	Severity     string          `json:"severity"`
+	Created      string          `json:"created"`
+	Updated      string          `json:"updated"`
+	Schedule     open511Schedule `json:"schedule"`
+	Geography    open511Geometry `json:"geography"`
+	Roads        []open511Road   `json:"roads,omitempty"`
+	Areas        []open511Area   `json:"areas,omitempty"`
+}
+
+type open511Schedule struct {
+	// Intervals are ISO 8601 "start/end", with the end omitted while it's
+	// unknown.
+	Intervals []string `json:"intervals"`
+}
+
+type open511Geometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type open511Road struct {
+	Name      string `json:"name"`
+	Direction string `json:"direction,omitempty"`
+	State     string `json:"state,omitempty"`
+}
+
+type open511Area struct {
+	Name string `json:"name"`
+}
+
+// open511EventType maps an incident onto Open511's event types: planned
+// work is CONSTRUCTION, except special events.
+func (s *server) open511EventType(p IncidentPayload) string {
+	switch {
+	case strings.EqualFold(p.EventType, "Special Event"):
+		return "SPECIAL_EVENT"
+	case containsFold(s.cfg.PlannedEventTypes, p.EventType):
+		return "CONSTRUCTION"
+	case strings.Contains(strings.ToLower(p.EventType), "weather"):
+		return "WEATHER_CONDITION"
+	}
+	return "INCIDENT"
+}
+
+func open511Severity(normalized int) string {
+	switch {
+	case normalized >= 4:
+		return "MAJOR"
+	case normalized == 3:
+		return "MODERATE"
+	case normalized >= 1:
+		return "MINOR"
+	}
+	return "UNKNOWN"
+}
+
+// open511Direction maps the feed's free-text direction ("North", "S",
+// "Both") onto Open511's.
+func open511Direction(direction string) string {
+	switch d := strings.ToUpper(strings.TrimSpace(direction)); {
+	case d == "":
+		return ""
+	case strings.HasPrefix(d, "B"), strings.HasPrefix(d, "AL"):
+		return "BOTH"
+	case strings.HasPrefix(d, "N"), strings.HasPrefix(d, "S"), strings.HasPrefix(d, "E"), strings.HasPrefix(d, "W"):
+		return d[:1]
+	}
+	return ""
+}
+
+// open511RoadState says how much of the road is closed, when we know.
+func open511RoadState(p IncidentPayload) string {
+	switch {
+	case p.LanesTotal > 0 && p.LanesClosed >= p.LanesTotal:
+		return "CLOSED"
+	case p.LanesClosed > 0:
+		return "SOME_LANES_CLOSED"
+	}
+	return ""
+}
+
+func (s *server) open511Event(p IncidentPayload) open511Event {
+	id := fmt.Sprintf("%s/%s-%s", open511Jurisdiction, strings.ToLower(p.Source), p.SourceID)
+	status := "ACTIVE"
+	if p.Status == StatusCleared {
+		status = "ARCHIVED"
+	}
+	interval := p.StartTime.UTC().Format(time.RFC3339) + "/"
+	if p.EndTime != nil {
+		interval += p.EndTime.UTC().Format(time.RFC3339)
+	}
+	e := open511Event{
+		ID:           id,
+		URL:          "/open511/events/" + p.Source + "/" + p.SourceID,
+		Jurisdiction: open511Jurisdiction,
+		Status:       status,
+		Headline:     truncate(incidentTitle(p), 500),
+		Description:  incidentDescription(p),
+		EventType:    s.open511EventType(p),
+		Severity:     open511Severity(p.NormalizedSeverity),
+		Created:      p.StartTime.UTC().Format(time.RFC3339),
+		Updated:      incidentUpdated(p).UTC().Format(time.RFC3339),
+		Schedule:     open511Schedule{Intervals: []string{interval}},
+		Geography:    open511Geometry{Type: "Point", Coordinates: []float64{p.Longitude, p.Latitude}},
+	}
+	if p.EventType != "" {
+		e.Subtypes = []string{strings.ToUpper(strings.ReplaceAll(p.EventType, " ", "_"))}
+	}
+	if road := firstNonEmpty(p.RoadNormalized, p.Road); road != "" {
+		e.Roads = []open511Road{{Name: road, Direction: open511Direction(p.Direction), State: open511RoadState(p)}}
+	}
+	if p.County != "" {
+		e.Areas = []open511Area{{Name: p.County + " County"}}
+	}
+	return e
+}
+
+// handleOpen511Events lists events, active ones by default; ?status=ARCHIVED
+// or ALL widens it, and the usual incident filters and limit/offset apply.
+func (s *server) handleOpen511Events(w http.ResponseWriter, r *http.Request) {
+	f, err := parseIncidentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch strings.ToUpper(f.Status) {
+	case "", "ACTIVE":
+		f.Status = StatusActive
+	case "ARCHIVED", "CLEARED":
+		f.Status = StatusCleared
+	case "ALL":
+		f.Status = ""
+	default:
+		http.Error(w, fmt.Sprintf("invalid status %q", f.Status), http.StatusBadRequest)
+		return
+	}
+	if f.Limit == 0 || f.Limit > openDataMaxEntries {
+		f.Limit = openDataMaxEntries
+	}
+	incidents, err := queryIncidents(r.Context(), s.db, f)
+	if err != nil {
+		logFor("api").Error("Error loading Open511 events", "err", err)
+		http.Error(w, "could not load events", http.StatusInternalServerError)
+		return
+	}
+
+	resp := open511Response{
+		Events:     []open511Event{},
+		Pagination: open511Pagination{Offset: f.Offset, Limit: f.Limit},
+		Meta:       open511Meta{Version: "v1", URL: r.RequestURI},
+	}
+	for _, p := range incidents {
+		resp.Events = append(resp.Events, s.open511Event(p))
+	}
+	page := func(offset int) string {
+		q := r.URL.Query()
+		q.Set("offset", fmt.Sprint(offset))
+		q.Set("limit", fmt.Sprint(f.Limit))
+		return s.cfg.APIBasePath + r.URL.Path + "?" + q.Encode()
+	}
+	if len(incidents) == f.Limit {
+		resp.Pagination.NextURL = page(f.Offset + f.Limit)
+	}
+	if f.Offset > 0 {
+		resp.Pagination.PreviousURL = page(max(f.Offset-f.Limit, 0))
+	}
+	writeJSON(w, "application/json", resp)
+}
+
+func (s *server) handleOpen511Event(w http.ResponseWriter, r *http.Request) {
+	incidents, err := queryIncidents(r.Context(), s.db, incidentFilter{Source: r.PathValue("source"), SourceID: r.PathValue("id"), Limit: 1})
+	if err != nil {
+		logFor("api").Error("Error loading Open511 event", "err", err)
+		http.Error(w, "could not load event", http.StatusInternalServerError)
+		return
+	}
+	if len(incidents) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, "application/json", open511Response{
+		Events: []open511Event{s.open511Event(incidents[0])},
+		Meta:   open511Meta{Version: "v1", URL: r.RequestURI},
+	})
+}
+
+type wzdxFeed struct {
+	FeedInfo wzdxFeedInfo  `json:"feed_info"`
+	Type     string        `json:"type"`
+	Features []wzdxFeature `json:"features"`
+}
+
+type wzdxFeedInfo struct {
+	Publisher       string           `json:"publisher"`
+	Version         string           `json:"version"`
+	License         string           `json:"license"`
+	UpdateDate      string           `json:"update_date"`
+	UpdateFrequency int              `json:"update_frequency,omitempty"`
+	DataSources     []wzdxDataSource `json:"data_sources"`
+}
+
+type wzdxDataSource struct {
+	DataSourceID     string `json:"data_source_id"`
+	OrganizationName string `json:"organization_name"`
+	UpdateDate       string `json:"update_date"`
+}
+
+type wzdxFeature struct {
+	ID         string       `json:"id"`
+	Type       string       `json:"type"`
+	Properties wzdxWorkZone `json:"properties"`
+	Geometry   wzdxGeometry `json:"geometry"`
+}
+
+type wzdxGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates [][]float64 `json:"coordinates"`
+}
+
+type wzdxWorkZone struct {
+	CoreDetails             wzdxCoreDetails `json:"core_details"`
+	StartDate               string          `json:"start_date"`
+	EndDate                 string          `json:"end_date"`
+	IsStartDateVerified     bool            `json:"is_start_date_verified"`
+	IsEndDateVerified       bool            `json:"is_end_date_verified"`
+	IsStartPositionVerified bool            `json:"is_start_position_verified"`
+	IsEndPositionVerified   bool            `json:"is_end_position_verified"`
+	LocationMethod          string          `json:"location_method"`
+	VehicleImpact           string          `json:"vehicle_impact"`
+}
+
+type wzdxCoreDetails struct {
+	EventType    string   `json:"event_type"`
+	DataSourceID string   `json:"data_source_id"`
+	RoadNames    []string `json:"road_names"`
+	Direction    string   `json:"direction"`
+	Description  string   `json:"description,omitempty"`
+	CreationDate string   `json:"creation_date"`
+	UpdateDate   string   `json:"update_date"`
+}
+
+func wzdxDirection(direction string) string {
+	switch open511Direction(direction) {
+	case "N":
+		return "northbound"
+	case "S":
+		return "southbound"
+	case "E":
+		return "eastbound"
+	case "W":
+		return "westbound"
+	}
+	return "unknown"
+}
+
+func wzdxVehicleImpact(p IncidentPayload) string {
+	switch open511RoadState(p) {
+	case "CLOSED":
+		return "all-lanes-closed"
+	case "SOME_LANES_CLOSED":
+		return "some-lanes-closed"
+	}
+	return "unknown"
+}
+
+// handleWZDx serves active planned closures (PLANNED_EVENT_TYPES) as a WZDx
+// work zone feed. WZDx requires an end date, so closures without one are
+// left out. The feed only has a point per closure, so each work zone's
+// start and end positions are the same.
+func (s *server) handleWZDx(w http.ResponseWriter, r *http.Request) {
+	f, err := parseIncidentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Status = StatusActive
+	f.EventTypes = s.cfg.PlannedEventTypes
+	if f.Limit == 0 || f.Limit > openDataMaxEntries {
+		f.Limit = openDataMaxEntries
+	}
+	incidents, err := queryIncidents(r.Context(), s.db, f)
+	if err != nil {
+		logFor("api").Error("Error loading work zones", "err", err)
+		http.Error(w, "could not load work zones", http.StatusInternalServerError)
+		return
+	}
+
+	updated := time.Time{}
+	feed := wzdxFeed{Type: "FeatureCollection", Features: []wzdxFeature{}}
+	for _, p := range incidents {
+		if p.EndTime == nil {
+			continue
+		}
+		source := strings.ToLower(p.Source)
+		point := []float64{p.Longitude, p.Latitude}
+		t := incidentUpdated(p)
+		if t.After(updated) {
+			updated = t
+		}
+		var roads []string
+		if road := firstNonEmpty(p.RoadNormalized, p.Road); road != "" {
+			roads = []string{road}
+		}
+		feed.Features = append(feed.Features, wzdxFeature{
+			ID:   source + "-" + p.SourceID,
+			Type: "Feature",
+			Properties: wzdxWorkZone{
+				CoreDetails: wzdxCoreDetails{
+					EventType:    "work-zone",
+					DataSourceID: source,
+					RoadNames:    roads,
+					Direction:    wzdxDirection(p.Direction),
+					Description:  incidentDescription(p),
+					CreationDate: p.StartTime.UTC().Format(time.RFC3339),
+					UpdateDate:   t.UTC().Format(time.RFC3339),
+				},
+				StartDate:      p.StartTime.UTC().Format(time.RFC3339),
+				EndDate:        p.EndTime.UTC().Format(time.RFC3339),
+				LocationMethod: "unknown",
+				VehicleImpact:  wzdxVehicleImpact(p),
+			},
+			Geometry: wzdxGeometry{Type: "MultiPoint", Coordinates: [][]float64{point, point}},
+		})
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.FeedInfo = wzdxFeedInfo{
+		Publisher:       "ncdot-ingester",
+		Version:         wzdxVersion,
+		License:         "https://creativecommons.org/publicdomain/zero/1.0/",
+		UpdateDate:      updated.UTC().Format(time.RFC3339),
+		UpdateFrequency: int(s.cfg.PollInterval.Seconds()),
+		DataSources: []wzdxDataSource{{
+			DataSourceID:     "ncdot",
+			OrganizationName: "North Carolina Department of Transportation",
+			UpdateDate:       updated.UTC().Format(time.RFC3339),
+		}},
+	}
+	writeJSON(w, "application/geo+json", feed)
+}
+
+func writeJSON(w http.ResponseWriter, contentType string, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		logFor("api").Error("Error encoding JSON", "err", err)
+		http.Error(w, "could not encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Write(out)
+}
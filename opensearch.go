@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openSearchTemplate is the index template the sink keeps in place for its
+// monthly indexes, so the fields Kibana filters and maps on get keyword and
+// geo_point types rather than whatever dynamic mapping would guess. Details
+// are stored but not indexed; their keys vary too much by source.
+const openSearchTemplate = `{
+  "index_patterns": ["%s-*"],
+  "template": {
+    "settings": {"number_of_shards": 1},
+    "mappings": {
+      "dynamic": false,
+      "properties": {
+        "change": {"type": "keyword"},
+        "occurred_at": {"type": "date"},
+        "source": {"type": "keyword"},
+        "source_id": {"type": "keyword"},
+        "event_type": {"type": "keyword"},
+        "status": {"type": "keyword"},
+        "address": {"type": "text"},
+        "city": {"type": "keyword"},
+        "county": {"type": "keyword"},
+        "road": {"type": "keyword"},
+        "road_normalized": {"type": "keyword"},
+        "direction": {"type": "keyword"},
+        "location": {"type": "geo_point"},
+        "start_time": {"type": "date"},
+        "end_time": {"type": "date"},
+        "problem_detail": {"type": "text"},
+        "summary": {"type": "text"},
+        "severity": {"type": "integer"},
+        "normalized_severity": {"type": "integer"},
+        "risk_score": {"type": "float"},
+        "lanes_closed": {"type": "integer"},
+        "lanes_total": {"type": "integer"},
+        "weather": {"properties": {
+          "temperature": {"type": "integer"},
+          "wind_speed": {"type": "keyword"},
+          "short_forecast": {"type": "text"}
+        }},
+        "details": {"type": "object", "enabled": false}
+      }
+    }
+  }
+}`
+
+// openSearchSink indexes incidents into OpenSearch (or Elasticsearch),
+// one index per month of the incident's start time, e.g.
+// patrolx-incidents-2024.06. Each incident is one document, keyed by
+// source and source ID, overwritten on every change.
+type openSearchSink struct {
+	url      string
+	prefix   string
+	username string
+	password string
+	apiKey   string
+	client   *http.Client
+
+	mu          sync.Mutex
+	templateSet bool
+}
+
+func newOpenSearchSink(cfg *Config) *openSearchSink {
+	return &openSearchSink{
+		url:      strings.TrimRight(cfg.OpenSearchURL, "/"),
+		prefix:   cfg.OpenSearchIndexPrefix,
+		username: cfg.OpenSearchUsername,
+		password: cfg.OpenSearchPassword,
+		apiKey:   cfg.OpenSearchAPIKey,
+		client:   &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *openSearchSink) Name() string { return "opensearch " + s.prefix }
+
+// openSearchDoc is an incident event as indexed.
+type openSearchDoc struct {
+	IncidentPayload
+	Change     ChangeType `json:"change"`
+	OccurredAt time.Time  `json:"occurred_at"`
+	Location   [2]float64 `json:"location"`
+}
+
+func (s *openSearchSink) Publish(ctx context.Context, event IncidentEvent) error {
+	if err := s.ensureTemplate(ctx); err != nil {
+		return err
+	}
+	p := event.Incident
+	doc, err := json.Marshal(openSearchDoc{
+		IncidentPayload: p,
+		Change:          event.Change,
+		OccurredAt:      event.OccurredAt,
+		// GeoJSON order: lon, lat.
+		Location: [2]float64{p.Longitude, p.Latitude},
+	})
+	if err != nil {
+		return permanentError{err}
+	}
+	index := s.prefix + "-" + p.StartTime.UTC().Format("2006.01")
+	id := url.PathEscape(strings.ToLower(p.Source) + "-" + p.SourceID)
+	return s.do(ctx, "PUT", "/"+index+"/_doc/"+id, doc)
+}
+
+// ensureTemplate installs the index template the first time through,
+// replacing whatever version the cluster has.
+func (s *openSearchSink) ensureTemplate(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.templateSet {
+		return nil
+	}
+	body := fmt.Sprintf(openSearchTemplate, s.prefix)
+	if err := s.do(ctx, "PUT", "/_index_template/"+s.prefix, []byte(body)); err != nil {
+		return fmt.Errorf("could not install index template: %w", err)
+	}
+	s.templateSet = true
+	return nil
+}
+
+func (s *openSearchSink) do(ctx context.Context, method, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch {
+	case s.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	case s.username != "":
+		req.SetBasicAuth(s.username, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("opensearch request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("opensearch returned %s: %s", resp.Status, truncate(string(respBody), 200))
+		// A bad mapping or document won't get better with retries; auth
+		// failures, throttling and outages might.
+		if resp.StatusCode == http.StatusBadRequest {
+			return permanentError{err}
+		}
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// A minimal Parquet writer: one row group of optional, flat columns,
+// PLAIN-encoded and uncompressed, which every reader understands. The file
+// metadata is Thrift's compact protocol, written by hand.
+
+// columnKind is the type of a tabular export column.
+type columnKind int
+
+const (
+	kindString columnKind = iota
+	kindInt
+	kindFloat
+	kindBool
+	kindTime
+)
+
+// Parquet physical types, converted types, encodings and Thrift compact
+// field types used below.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetOptional = 1
+	encodingPlain   = 0
+	encodingRLE     = 3
+
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter writes Thrift compact protocol structs.
+type thriftWriter struct {
+	buf    bytes.Buffer
+	lastID []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) beginStruct() { t.lastID = append(t.lastID, 0) }
+
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0)
+	t.lastID = t.lastID[:len(t.lastID)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.lastID[len(t.lastID)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xF0 | elem)
+		t.varint(uint64(n))
+	}
+}
+
+// parquetColumn is one column's values for the row group; nil is null.
+type parquetColumn struct {
+	name   string
+	kind   columnKind
+	values []interface{}
+}
+
+func (c parquetColumn) physicalType() int32 {
+	switch c.kind {
+	case kindInt, kindTime:
+		return parquetInt64
+	case kindFloat:
+		return parquetDouble
+	case kindBool:
+		return parquetBoolean
+	}
+	return parquetByteArray
+}
+
+// page encodes the column as a v1 data page: RLE definition levels, then
+// the non-null values.
+func (c parquetColumn) page() ([]byte, error) {
+	var levels bytes.Buffer
+	for i := 0; i < len(c.values); {
+		run := 1
+		for i+run < len(c.values) && (c.values[i+run] == nil) == (c.values[i] == nil) {
+			run++
+		}
+		levels.Write(binary.AppendUvarint(nil, uint64(run)<<1))
+		if c.values[i] == nil {
+			levels.WriteByte(0)
+		} else {
+			levels.WriteByte(1)
+		}
+		i += run
+	}
+
+	var page bytes.Buffer
+	binary.Write(&page, binary.LittleEndian, uint32(levels.Len()))
+	page.Write(levels.Bytes())
+
+	var bits, nbits byte
+	for _, v := range c.values {
+		if v == nil {
+			continue
+		}
+		switch c.kind {
+		case kindString:
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("column %s: %T is not a string", c.name, v)
+			}
+			binary.Write(&page, binary.LittleEndian, uint32(len(s)))
+			page.WriteString(s)
+		case kindInt:
+			n, ok := v.(int64)
+			if !ok {
+				return nil, fmt.Errorf("column %s: %T is not an int64", c.name, v)
+			}
+			binary.Write(&page, binary.LittleEndian, n)
+		case kindTime:
+			t, ok := v.(time.Time)
+			if !ok {
+				return nil, fmt.Errorf("column %s: %T is not a time", c.name, v)
+			}
+			binary.Write(&page, binary.LittleEndian, t.UnixMilli())
+		case kindFloat:
+			f, ok := v.(float64)
+			if !ok {
+				return nil, fmt.Errorf("column %s: %T is not a float64", c.name, v)
+			}
+			binary.Write(&page, binary.LittleEndian, math.Float64bits(f))
+		case kindBool:
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("column %s: %T is not a bool", c.name, v)
+			}
+			// Booleans are bit-packed, least significant bit first.
+			if b {
+				bits |= 1 << nbits
+			}
+			if nbits++; nbits == 8 {
+				page.WriteByte(bits)
+				bits, nbits = 0, 0
+			}
+		}
+	}
+	if nbits > 0 {
+		page.WriteByte(bits)
+	}
+	return page.Bytes(), nil
+}
+
+// writeParquet writes the columns, which must all be the same length, as
+// a Parquet file.
+func writeParquet(w io.Writer, columns []parquetColumn) error {
+	rows := 0
+	if len(columns) > 0 {
+		rows = len(columns[0].values)
+	}
+
+	out := &countingWriter{w: w}
+	if _, err := io.WriteString(out, "PAR1"); err != nil {
+		return err
+	}
+	type chunk struct {
+		offset, size int64
+	}
+	chunks := make([]chunk, len(columns))
+	var total int64
+	for i, c := range columns {
+		if len(c.values) != rows {
+			return fmt.Errorf("column %s has %d values, want %d", c.name, len(c.values), rows)
+		}
+		data, err := c.page()
+		if err != nil {
+			return err
+		}
+		var header thriftWriter
+		header.beginStruct()
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(data)))
+		header.i32(3, int32(len(data)))
+		header.field(5, thriftStruct)
+		header.beginStruct()
+		header.i32(1, int32(rows))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunks[i].offset = out.n
+		if _, err := out.Write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+		chunks[i].size = out.n - chunks[i].offset
+		total += chunks[i].size
+	}
+
+	var meta thriftWriter
+	meta.beginStruct()
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(columns)+1)
+	meta.beginStruct()
+	meta.str(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.endStruct()
+	for _, c := range columns {
+		meta.beginStruct()
+		meta.i32(1, c.physicalType())
+		meta.i32(3, parquetOptional)
+		meta.str(4, c.name)
+		switch c.kind {
+		case kindString:
+			meta.i32(6, parquetUTF8)
+		case kindTime:
+			meta.i32(6, parquetTimestampMillis)
+		}
+		meta.endStruct()
+	}
+	meta.i64(3, int64(rows))
+	meta.list(4, thriftStruct, 1)
+	meta.beginStruct()
+	meta.list(1, thriftStruct, len(columns))
+	for i, c := range columns {
+		meta.beginStruct()
+		meta.i64(2, chunks[i].offset)
+		meta.field(3, thriftStruct)
+		meta.beginStruct()
+		meta.i32(1, c.physicalType())
+		meta.list(2, thriftI32, 2)
+		meta.zigzag(encodingPlain)
+		meta.zigzag(encodingRLE)
+		meta.list(3, thriftBinary, 1)
+		meta.varint(uint64(len(c.name)))
+		meta.buf.WriteString(c.name)
+		meta.i32(4, 0) // UNCOMPRESSED
+		meta.i64(5, int64(rows))
+		meta.i64(6, chunks[i].size)
+		meta.i64(7, chunks[i].size)
+		meta.i64(9, chunks[i].offset)
+		meta.endStruct()
+		meta.endStruct()
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(rows))
+	meta.endStruct()
+	meta.str(6, "ncdot-ingester")
+	meta.endStruct()
+
+	if _, err := out.Write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := binary.Write(out, binary.LittleEndian, uint32(meta.buf.Len())); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "PAR1")
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+// The summaries job writes daily and weekly aggregates to
+// incident_summaries: counts and mean clearance time overall and by event
+// type, county, road and forecast. Each pass redoes yesterday and today so
+// far, and the last full week (Monday to Sunday, Eastern), so late
+// clearances are counted. Yesterday's and last week's reports go, once
+// each, to SUMMARY_SLACK_CHANNEL and SUMMARY_RECIPIENTS, whichever are
+// set.
+
+// summaryDimensions are the breakdowns kept, by the column behind each.
+var summaryDimensions = []struct{ name, expr string }{
+	{"total", "'all'"},
+	{"type", "event_type"},
+	{"county", "county_name"},
+	{"road", "road_normalized"},
+	{"weather", "weather_forecast"},
+}
+
+// summaryPeriod is a day or week starting at Eastern midnight.
+type summaryPeriod struct {
+	Kind       string
+	Start, End time.Time
+}
+
+func dayPeriod(t time.Time) summaryPeriod {
+	t = t.In(easternTime)
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, easternTime)
+	return summaryPeriod{Kind: "day", Start: start, End: start.AddDate(0, 0, 1)}
+}
+
+// weekPeriod is the Monday-to-Sunday week t falls in.
+func weekPeriod(t time.Time) summaryPeriod {
+	day := dayPeriod(t)
+	start := day.Start.AddDate(0, 0, -(int(day.Start.Weekday())+6)%7)
+	return summaryPeriod{Kind: "week", Start: start, End: start.AddDate(0, 0, 7)}
+}
+
+// key identifies the period, as "day/2024-03-01".
+func (p summaryPeriod) key() string {
+	return p.Kind + "/" + p.Start.Format(time.DateOnly)
+}
+
+func (p summaryPeriod) label() string {
+	if p.Kind == "week" {
+		return "week of " + p.Start.Format("Mon Jan 2, 2006")
+	}
+	return p.Start.Format("Mon Jan 2, 2006")
+}
+
+// summaryRow is one line of a breakdown.
+type summaryRow struct {
+	Key       string
+	Incidents int
+	// MeanClearance is over the incidents that have cleared; zero if none
+	// have.
+	MeanClearance time.Duration
+}
+
+// periodSummary is every breakdown for a period.
+type periodSummary struct {
+	Period     summaryPeriod
+	Dimensions map[string][]summaryRow
+}
+
+func buildPeriodSummary(ctx context.Context, db *sql.DB, p summaryPeriod) (*periodSummary, error) {
+	s := &periodSummary{Period: p, Dimensions: map[string][]summaryRow{}}
+	for _, d := range summaryDimensions {
+		rows, err := db.QueryContext(ctx, `
+			SELECT coalesce(`+d.expr+`, 'unknown'), count(*),
+				coalesce(avg(extract(epoch FROM cleared_at - timestamp)) FILTER (WHERE cleared_at IS NOT NULL), 0)
+			FROM unified_incidents
+			WHERE timestamp >= $1 AND timestamp < $2
+			GROUP BY 1
+			ORDER BY 2 DESC, 1`, p.Start, p.End)
+		if err != nil {
+			return nil, fmt.Errorf("could not summarize by %s: %w", d.name, err)
+		}
+		for rows.Next() {
+			var r summaryRow
+			var seconds float64
+			if err := rows.Scan(&r.Key, &r.Incidents, &seconds); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			r.MeanClearance = time.Duration(seconds * float64(time.Second)).Round(time.Minute)
+			s.Dimensions[d.name] = append(s.Dimensions[d.name], r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// save replaces the period's rows in incident_summaries.
+func (s *periodSummary) save(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	start := s.Period.Start.Format(time.DateOnly)
+	if _, err := tx.ExecContext(ctx, `DELETE FROM incident_summaries WHERE period = $1 AND period_start = $2`, s.Period.Kind, start); err != nil {
+		return fmt.Errorf("could not replace the %s summary: %w", s.Period.Kind, err)
+	}
+	for dimension, rows := range s.Dimensions {
+		for _, r := range rows {
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO incident_summaries (period, period_start, dimension, key, incidents, mean_clearance_minutes)
+				VALUES ($1, $2, $3, $4, $5, $6)`,
+				s.Period.Kind, start, dimension, r.Key, r.Incidents, sql.NullFloat64{Float64: r.MeanClearance.Minutes(), Valid: r.MeanClearance > 0}); err != nil {
+				return fmt.Errorf("could not save the %s summary: %w", s.Period.Kind, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// total is the period's incident count.
+func (s *periodSummary) total() summaryRow {
+	if rows := s.Dimensions["total"]; len(rows) > 0 {
+		return rows[0]
+	}
+	return summaryRow{}
+}
+
+// report is the summary as plain text.
+func (s *periodSummary) report() string {
+	var b strings.Builder
+	total := s.total()
+	fmt.Fprintf(&b, "Traffic summary, %s: %d incidents", s.Period.label(), total.Incidents)
+	if total.MeanClearance > 0 {
+		fmt.Fprintf(&b, ", cleared in %.0f min on average", total.MeanClearance.Minutes())
+	}
+	b.WriteString(".\n")
+	for _, d := range []struct{ name, title string }{{"type", "By type"}, {"county", "Top counties"}, {"road", "Top roads"}} {
+		rows := s.Dimensions[d.name]
+		if len(rows) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n", d.title)
+		for i, r := range rows {
+			if i == 5 {
+				break
+			}
+			fmt.Fprintf(&b, "  %s: %d", r.Key, r.Incidents)
+			if r.MeanClearance > 0 {
+				fmt.Fprintf(&b, " (cleared in %.0f min)", r.MeanClearance.Minutes())
+			}
+			b.WriteString("\n")
+		}
+	}
+	adverse := 0
+	for _, r := range s.Dimensions["weather"] {
+		if r.Key != "unknown" && weatherRiskFactor(&WeatherData{ShortForecast: r.Key}) > 1 {
+			adverse += r.Incidents
+		}
+	}
+	if total.Incidents > 0 {
+		fmt.Fprintf(&b, "\n%d of %d (%.0f%%) happened in adverse weather.\n", adverse, total.Incidents, 100*float64(adverse)/float64(total.Incidents))
+	}
+	return b.String()
+}
+
+// sendReport posts the report to Slack and emails it, as configured, and
+// records that it was sent.
+func (s *periodSummary) sendReport(ctx context.Context, cfg *Config, db *sql.DB) error {
+	text := s.report()
+	if cfg.SummarySlackChannel != "" && cfg.SlackBotToken != "" {
+		slack := newSlackSink(db, cfg.SlackBotToken, cfg.SummarySlackChannel, nil, "")
+		if err := slack.post(ctx, slackMessage{Channel: cfg.SummarySlackChannel, Text: text}); err != nil {
+			return fmt.Errorf("could not post the %s summary: %w", s.Period.Kind, err)
+		}
+	}
+	if len(cfg.SummaryRecipients) > 0 && cfg.SMTPHost != "" {
+		var msg bytes.Buffer
+		fmt.Fprintf(&msg, "From: %s\r\n", cfg.SMTPFrom)
+		fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.SummaryRecipients, ", "))
+		fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Traffic summary, "+s.Period.label()))
+		fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+		msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+		msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+		if err := sendMail(cfg, cfg.SummaryRecipients, msg.Bytes()); err != nil {
+			return fmt.Errorf("could not email the %s summary: %w", s.Period.Kind, err)
+		}
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO summary_reports (period, period_start) VALUES ($1, $2)
+		ON CONFLICT (period, period_start) DO UPDATE SET reported_at = now()`,
+		s.Period.Kind, s.Period.Start.Format(time.DateOnly))
+	return err
+}
+
+func summaryReported(ctx context.Context, db *sql.DB, p summaryPeriod) (bool, error) {
+	var reported bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM summary_reports WHERE period = $1 AND period_start = $2)`,
+		p.Kind, p.Start.Format(time.DateOnly)).Scan(&reported)
+	return reported, err
+}
+
+func summaryJob(cfg *Config, db *sql.DB, fs *flag.FlagSet) analyticsJob {
+	date := fs.String("date", "", "summarize this day (YYYY-MM-DD) and its week, and report on them, instead")
+	return func(ctx context.Context, _ *sinkDispatcher) error {
+		now := time.Now()
+		yesterday := dayPeriod(now.AddDate(0, 0, -1))
+		lastWeek := weekPeriod(now.AddDate(0, 0, -7))
+		periods := []summaryPeriod{yesterday, dayPeriod(now), lastWeek}
+		report := map[string]bool{yesterday.key(): true, lastWeek.key(): true}
+		force := false
+		if *date != "" {
+			day, err := time.ParseInLocation(time.DateOnly, *date, easternTime)
+			if err != nil {
+				return fmt.Errorf("invalid -date: %w", err)
+			}
+			periods = []summaryPeriod{dayPeriod(day), weekPeriod(day)}
+			report, force = map[string]bool{periods[0].key(): true, periods[1].key(): true}, true
+		}
+		reportable := cfg.SummarySlackChannel != "" || len(cfg.SummaryRecipients) > 0
+		for _, p := range periods {
+			s, err := buildPeriodSummary(ctx, db, p)
+			if err != nil {
+				return err
+			}
+			if err := s.save(ctx, db); err != nil {
+				return err
+			}
+			logFor("analytics").Info("Summary saved", "period", p.Kind, "start", p.Start.Format(time.DateOnly), "incidents", s.total().Incidents)
+			if !reportable || !report[p.key()] {
+				continue
+			}
+			if !force {
+				done, err := summaryReported(ctx, db, p)
+				if err != nil {
+					return err
+				}
+				if done {
+					continue
+				}
+			}
+			if err := s.sendReport(ctx, cfg, db); err != nil {
+				return err
+			}
+			logFor("analytics").Info("Summary report sent", "period", p.Kind, "start", p.Start.Format(time.DateOnly))
+		}
+		return nil
+	}
+}
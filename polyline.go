@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// decodePolyline decodes a Google encoded polyline. precision is 5 for
+// Google/OSRM polylines and 6 for Valhalla's.
+func decodePolyline(s string, precision int) ([]LatLon, error) {
+	factor := math.Pow10(precision)
+	var pts []LatLon
+	var lat, lon int
+	for i := 0; i < len(s); {
+		var deltas [2]int
+		for k := range deltas {
+			var result, shift int
+			for {
+				if i >= len(s) {
+					return nil, fmt.Errorf("truncated polyline at byte %d", i)
+				}
+				b := int(s[i]) - 63
+				i++
+				result |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+			}
+			if result&1 != 0 {
+				deltas[k] = ^(result >> 1)
+			} else {
+				deltas[k] = result >> 1
+			}
+		}
+		lat += deltas[0]
+		lon += deltas[1]
+		pts = append(pts, LatLon{Lat: float64(lat) / factor, Lon: float64(lon) / factor})
+	}
+	return pts, nil
+}
+
+// destinationPoint travels meters from p along bearing (degrees from north).
+func destinationPoint(p LatLon, bearing, meters float64) LatLon {
+	angular := meters / earthRadiusMeters
+	theta := bearing * math.Pi / 180
+	lat1 := p.Lat * math.Pi / 180
+	lon1 := p.Lon * math.Pi / 180
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(angular) + math.Cos(lat1)*math.Sin(angular)*math.Cos(theta))
+	lon2 := lon1 + math.Atan2(math.Sin(theta)*math.Sin(angular)*math.Cos(lat1), math.Cos(angular)-math.Sin(lat1)*math.Sin(lat2))
+	return LatLon{Lat: lat2 * 180 / math.Pi, Lon: lon2 * 180 / math.Pi}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// One ingest daemon can run several profiles, e.g. PROFILES=triangle,
+// charlotte,statewide, each a full configuration of its own: its own
+// filters, sinks and, optionally, database or schema. A profile's settings
+// are the base ones with PROFILE_<NAME>_<KEY> overriding KEY, so it only
+// spells out what differs:
+//
+//	PROFILE_TRIANGLE_GEOFENCES_FILE=/etc/ncdot/triangle.json
+//	PROFILE_TRIANGLE_DATABASE_SCHEMA=triangle
+//	PROFILE_TRIANGLE_SLACK_CHANNEL=#triangle-traffic
+//
+// A profile with a schema of its own gets its own unified_incidents there,
+// shaped like public's, and the bot's tables beside it. Profiles on the
+// same database and schema share its connection pool, and each clears only
+// the incidents it last saw.
+// Each polls on its own, and its log lines carry its name. Metrics and
+// health checks are the process's, across profiles.
+
+// loadProfile loads the named profile's configuration.
+func loadProfile(name string) (*Config, error) {
+	prefix := "PROFILE_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_"
+	getenv = func(key string) string {
+		if v, ok := os.LookupEnv(prefix + key); ok {
+			return v
+		}
+		return os.Getenv(key)
+	}
+	defer func() { getenv = os.Getenv }()
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", name, err)
+	}
+	cfg.Profile, cfg.Profiles = name, nil
+	return cfg, nil
+}
+
+// runProfiles is runIngest for PROFILES: every profile is polled, once or
+// every interval, from this process.
+func runProfiles(base *Config, db *sql.DB, interval time.Duration, metricsAddr, httpAddr string) {
+	if httpAddr != "" {
+		log.Fatalf("Error: -http isn't supported with PROFILES; run serve against each profile's database")
+	}
+	ingesters := map[string]*ingester{}
+	dbs := map[string]*sql.DB{base.psqlInfo(): db}
+	for _, name := range base.Profiles {
+		cfg, err := loadProfile(name)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		if cfg.DotURL == "" {
+			log.Fatalf("Error: profile %s: DOT_URL must be set", name)
+		}
+		profileDB, ok := dbs[cfg.psqlInfo()]
+		if !ok {
+			if profileDB, err = openDatabase(cfg); err != nil {
+				log.Fatalf("Error: profile %s: %s", name, err)
+			}
+			defer profileDB.Close()
+			dbs[cfg.psqlInfo()] = profileDB
+		}
+		in, err := newIngester(cfg, profileDB)
+		if err != nil {
+			log.Fatalf("Error: profile %s: %s", name, err)
+		}
+		defer in.sinks.Close()
+		ingesters[name] = in
+	}
+	stopTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Error configuring tracing: %s", err)
+	}
+	defer stopTracing(context.Background())
+
+	if interval <= 0 {
+		failed := false
+		for _, name := range base.Profiles {
+			// Already logged with the run.
+			if err := ingesters[name].once(withProfile(context.Background(), name)); err != nil {
+				failed = true
+			}
+		}
+		if failed {
+			for _, in := range ingesters {
+				in.sinks.Close()
+			}
+			stopTracing(context.Background())
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if metricsAddr != "" {
+		go func() {
+			if err := serveMetrics(ctx, metricsAddr, newReadiness(base, db, interval), nil); err != nil {
+				log.Fatalf("Error serving metrics: %s", err)
+			}
+		}()
+	}
+	logFor("ingest").Info("Polling NC DOT", "interval", interval.String(), "profiles", strings.Join(base.Profiles, ","))
+	var wg sync.WaitGroup
+	for name, in := range ingesters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			in.poll(withProfile(ctx, name), interval)
+		}()
+	}
+	wg.Wait()
+	logFor("ingest").Info("Shutting down")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// poi is a named point of interest from a reference dataset.
+type poi struct {
+	name string
+	pt   LatLon
+}
+
+// POISet is a list of points of interest. The statewide datasets are a few
+// thousand points at most, so a linear scan is fast enough.
+type POISet struct {
+	points []poi
+}
+
+// loadPOISet reads Point features from a GeoJSON file, naming each by its
+// "name" or "NAME" property. Non-point features are skipped.
+func loadPOISet(path string) (*POISet, error) {
+	fc, err := loadGeoJSON(path)
+	if err != nil {
+		return nil, err
+	}
+	set := &POISet{}
+	for i := range fc.Features {
+		f := &fc.Features[i]
+		pt, err := f.Geometry.point()
+		if err != nil {
+			continue
+		}
+		set.points = append(set.points, poi{name: firstNonEmpty(f.stringProp("name"), f.stringProp("NAME")), pt: pt})
+	}
+	if len(set.points) == 0 {
+		return nil, fmt.Errorf("%s contains no Point features", path)
+	}
+	return set, nil
+}
+
+// Nearest returns the closest point of interest and its distance in meters.
+func (s *POISet) Nearest(pt LatLon) (*NearbyPOI, bool) {
+	if s == nil || len(s.points) == 0 {
+		return nil, false
+	}
+	best, bestDist := 0, math.Inf(1)
+	for i, p := range s.points {
+		if d := haversineMeters(pt, p.pt); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return &NearbyPOI{Name: s.points[best].name, DistanceMeters: math.Round(bestDist)}, true
+}
+
+// NearbyPOI is the nearest point of interest of one kind.
+type NearbyPOI struct {
+	Name           string  `json:"name"`
+	DistanceMeters float64 `json:"distance_m"`
+}
+
+// Proximity is what the proximity enricher found around an incident.
+type Proximity struct {
+	Hospital    *NearbyPOI `json:"hospital,omitempty"`
+	FireStation *NearbyPOI `json:"fire_station,omitempty"`
+	School      *NearbyPOI `json:"school,omitempty"`
+	SchoolZone  bool       `json:"school_zone"`
+}
+
+// proximityEnricher records the nearest hospital and fire station, and
+// flags incidents within schoolZoneMeters of a school.
+type proximityEnricher struct {
+	hospitals        *POISet
+	fireStations     *POISet
+	schools          *POISet
+	schoolZoneMeters float64
+}
+
+func newProximityEnricher(cfg *Config) (*proximityEnricher, error) {
+	e := &proximityEnricher{schoolZoneMeters: cfg.SchoolZoneMeters}
+	for _, ds := range []struct {
+		path string
+		set  **POISet
+	}{
+		{cfg.HospitalsFile, &e.hospitals},
+		{cfg.FireStationsFile, &e.fireStations},
+		{cfg.SchoolsFile, &e.schools},
+	} {
+		if ds.path == "" {
+			continue
+		}
+		set, err := loadPOISet(ds.path)
+		if err != nil {
+			return nil, err
+		}
+		*ds.set = set
+	}
+	if e.hospitals == nil && e.fireStations == nil && e.schools == nil {
+		return nil, nil
+	}
+	return e, nil
+}
+
+func (e *proximityEnricher) Name() string { return "proximity" }
+
+func (e *proximityEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	pt := LatLon{Lat: incident.Latitude, Lon: incident.Longitude}
+	p := &Proximity{}
+	p.Hospital, _ = e.hospitals.Nearest(pt)
+	p.FireStation, _ = e.fireStations.Nearest(pt)
+	p.School, _ = e.schools.Nearest(pt)
+	p.SchoolZone = p.School != nil && p.School.DistanceMeters <= e.schoolZoneMeters
+	incident.Proximity = p
+	return nil
+}
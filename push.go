@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PushTarget is one person's phone alert subscription: a rule plus where
+// to send matches. For example:
+//
+//	[
+//	  {"name": "alice", "service": "ntfy", "topic": "alice-traffic-8f3k", "counties": ["Wake", "Durham"]},
+//	  {"name": "bob", "service": "pushover", "user_key": "u...", "roads": ["I-85"], "min_severity": 3}
+//	]
+//
+// ntfy targets may override the server and add an access token.
+type PushTarget struct {
+	NotifyRule
+	Service string `json:"service"`
+	Topic   string `json:"topic,omitempty"`
+	Server  string `json:"server,omitempty"`
+	Token   string `json:"token,omitempty"`
+	UserKey string `json:"user_key,omitempty"`
+}
+
+func loadPushTargets(path string) ([]PushTarget, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read push targets: %w", err)
+	}
+	var targets []PushTarget
+	if err := json.Unmarshal(raw, &targets); err != nil {
+		return nil, fmt.Errorf("could not parse push targets %s: %w", path, err)
+	}
+	for i, t := range targets {
+		switch {
+		case t.Name == "":
+			return nil, fmt.Errorf("push target %d needs a name", i+1)
+		case t.Service == "ntfy" && t.Topic == "":
+			return nil, fmt.Errorf("ntfy push target %q needs a topic", t.Name)
+		case t.Service == "pushover" && t.UserKey == "":
+			return nil, fmt.Errorf("pushover push target %q needs a user_key", t.Name)
+		case t.Service != "ntfy" && t.Service != "pushover":
+			return nil, fmt.Errorf("push target %q has unknown service %q", t.Name, t.Service)
+		}
+	}
+	return targets, nil
+}
+
+// pushSink sends a phone notification for each new incident matching its
+// target's rule.
+type pushSink struct {
+	target        PushTarget
+	pushoverToken string
+	client        *http.Client
+}
+
+func newPushSink(target PushTarget, pushoverToken string) *pushSink {
+	if target.Server == "" {
+		target.Server = "https://ntfy.sh"
+	}
+	return &pushSink{target: target, pushoverToken: pushoverToken, client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (s *pushSink) Name() string { return s.target.Service + " " + s.target.Name }
+func (s *pushSink) alerts()      {}
+
+func (s *pushSink) Publish(ctx context.Context, event IncidentEvent) error {
+	if event.Change != ChangeCreated || (event.Rule == "" && !s.target.Matches(event)) {
+		return nil
+	}
+	return s.send(ctx, event)
+}
+
+// send notifies the target of the event unconditionally.
+func (s *pushSink) send(ctx context.Context, event IncidentEvent) error {
+	p := event.Incident
+	title := incidentTitle(p)
+	message := firstNonEmpty(event.Message, incidentDescription(p)+"\nLanes "+lanesLabel(p))
+
+	var req *http.Request
+	var err error
+	if s.target.Service == "ntfy" {
+		req, err = http.NewRequestWithContext(ctx, "POST", strings.TrimRight(s.target.Server, "/")+"/"+s.target.Topic, strings.NewReader(message))
+		if err != nil {
+			return permanentError{err}
+		}
+		req.Header.Set("Title", title)
+		req.Header.Set("Priority", strconv.Itoa(ntfyPriority(p.NormalizedSeverity)))
+		req.Header.Set("Tags", "rotating_light")
+		req.Header.Set("Click", mapURL(p.Latitude, p.Longitude))
+		if s.target.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.target.Token)
+		}
+	} else {
+		priority := "0"
+		if p.NormalizedSeverity >= 5 {
+			priority = "1"
+		}
+		form := url.Values{
+			"token":     {s.pushoverToken},
+			"user":      {s.target.UserKey},
+			"title":     {truncate(title, 250)},
+			"message":   {truncate(message, 1024)},
+			"url":       {mapURL(p.Latitude, p.Longitude)},
+			"url_title": {"Open map"},
+			"priority":  {priority},
+		}
+		req, err = http.NewRequestWithContext(ctx, "POST", "https://api.pushover.net/1/messages.json", strings.NewReader(form.Encode()))
+		if err != nil {
+			return permanentError{err}
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", s.target.Service, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	err = fmt.Errorf("%s returned %s: %s", s.target.Service, resp.Status, truncate(string(body), 200))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return permanentError{err}
+}
+
+// ntfyPriority maps the 1–5 severity onto ntfy's 1 (min) to 5 (urgent),
+// never going below the default of 3.
+func ntfyPriority(severity int) int {
+	return max(3, min(5, severity))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Feed records that can't be ingested as they are go to
+// incident_quarantine instead of failing the run or being saved wrong: the
+// raw record, which stage turned it away and why. They are counted in the
+// run report and listed by GET /admin/quarantine.
+
+// Quarantine stages.
+const (
+	quarantineDecode     = "decode"
+	quarantineTimestamp  = "timestamp"
+	quarantineValidation = "validation"
+)
+
+// rejectedRecord is a feed record that didn't make it through ingest.
+type rejectedRecord struct {
+	Source   string          `json:"source"`
+	SourceID string          `json:"source_id,omitempty"`
+	Stage    string          `json:"stage"`
+	Reason   string          `json:"reason"`
+	Raw      json.RawMessage `json:"raw"`
+	RunID    string          `json:"run_id,omitempty"`
+	At       time.Time       `json:"quarantined_at"`
+}
+
+// quarantine saves a rejected record.
+func quarantine(ctx context.Context, db *sql.DB, rec rejectedRecord) error {
+	metricQuarantined.inc(rec.Source, rec.Stage)
+	// Keep the record even when it isn't valid JSON.
+	raw := rec.Raw
+	if !json.Valid(raw) {
+		raw, _ = json.Marshal(string(raw))
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO incident_quarantine (source, source_id, stage, reason, raw, run_id)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, NULLIF($6, ''))`,
+		rec.Source, rec.SourceID, rec.Stage, rec.Reason, []byte(raw), rec.RunID)
+	return err
+}
+
+// rawRecordID pulls the "id" out of a record that didn't decode, if it can.
+func rawRecordID(raw json.RawMessage) string {
+	var probe struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal(raw, &probe) != nil || len(probe.ID) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(probe.ID, &s) == nil {
+		return s
+	}
+	return string(probe.ID)
+}
+
+func listQuarantine(ctx context.Context, db *sql.DB, source, stage string, limit int) ([]rejectedRecord, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT source, coalesce(source_id, ''), stage, reason, raw, coalesce(run_id, ''), quarantined_at
+		FROM incident_quarantine
+		WHERE ($1 = '' OR source = $1) AND ($2 = '' OR stage = $2)
+		ORDER BY quarantined_at DESC
+		LIMIT $3`, source, stage, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []rejectedRecord{}
+	for rows.Next() {
+		var rec rejectedRecord
+		var raw []byte
+		if err := rows.Scan(&rec.Source, &rec.SourceID, &rec.Stage, &rec.Reason, &raw, &rec.RunID, &rec.At); err != nil {
+			return nil, err
+		}
+		rec.Raw = raw
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func (s *server) handleListQuarantine(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	q := r.URL.Query()
+	records, err := listQuarantine(r.Context(), s.db, q.Get("source"), q.Get("stage"), limit)
+	if err != nil {
+		logFor("admin").Error("Error listing quarantined records", "err", err)
+		http.Error(w, "could not load quarantined records", http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"records": records})
+}
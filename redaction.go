@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Some sources carry fields that shouldn't be kept, caller names and
+// numbers in CAD feeds for instance. REDACTION_FILE lists, per source, the
+// details fields to drop and those to hash:
+//
+//	{"NCDOT": {"drop": ["raw_incident.reportedBy"], "hash": ["raw_incident.callerPhone"]},
+//	 "*": {"drop": ["geocode.raw"]}}
+//
+// Paths are dot-separated keys into the details object, with "*" for every
+// key or array element at that level. A hashed value becomes "sha256:" and
+// the hex HMAC of it under REDACTION_HASH_KEY (plain SHA-256 without one),
+// so the same caller still matches across incidents. The "*" entry is for
+// sources without their own. Redaction applies to the details as stored
+// and as sent to sinks.
+
+// detailsRedaction is one source's redaction rules.
+type detailsRedaction struct {
+	Drop []string `json:"drop"`
+	Hash []string `json:"hash"`
+
+	key []byte
+}
+
+// readDetailsRedaction reads source's entry, or the "*" one, from
+// REDACTION_FILE. It returns nil if there is nothing to redact.
+func readDetailsRedaction(file, source, hashKey string) (*detailsRedaction, error) {
+	if file == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read redaction rules: %w", err)
+	}
+	var rules map[string]*detailsRedaction
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, fmt.Errorf("could not parse redaction rules %s: %w", file, err)
+	}
+	r, ok := rules[source]
+	if !ok {
+		r = rules["*"]
+	}
+	if r == nil || len(r.Drop)+len(r.Hash) == 0 {
+		return nil, nil
+	}
+	for _, p := range append(append([]string{}, r.Drop...), r.Hash...) {
+		if p == "" || strings.Contains(p, "..") || strings.HasPrefix(p, ".") || strings.HasSuffix(p, ".") {
+			return nil, fmt.Errorf("%s: invalid path %q", file, p)
+		}
+	}
+	r.key = []byte(hashKey)
+	return r, nil
+}
+
+// apply returns the details with the fields dropped and hashed. They go
+// through JSON first, so struct values can be walked like the rest.
+func (r *detailsRedaction) apply(details map[string]interface{}) map[string]interface{} {
+	raw, err := json.Marshal(details)
+	if err != nil {
+		return details
+	}
+	var generic map[string]interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return details
+	}
+	for _, p := range r.Hash {
+		redactPath(generic, strings.Split(p, "."), r.hash)
+	}
+	for _, p := range r.Drop {
+		redactPath(generic, strings.Split(p, "."), nil)
+	}
+	return generic
+}
+
+func (r *detailsRedaction) hash(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		b, _ := json.Marshal(v)
+		s = string(b)
+	}
+	var sum []byte
+	if len(r.key) > 0 {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(s))
+		sum = mac.Sum(nil)
+	} else {
+		digest := sha256.Sum256([]byte(s))
+		sum = digest[:]
+	}
+	return "sha256:" + hex.EncodeToString(sum)
+}
+
+// redactPath drops the values at path under v, or replaces them with
+// replace's result if replace is set.
+func redactPath(v interface{}, path []string, replace func(interface{}) interface{}) {
+	key, rest := path[0], path[1:]
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			if key != "*" && k != key {
+				continue
+			}
+			switch {
+			case len(rest) > 0:
+				redactPath(child, rest, replace)
+			case replace != nil:
+				node[k] = replace(child)
+			default:
+				delete(node, k)
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			if key != "*" && key != strconv.Itoa(i) {
+				continue
+			}
+			switch {
+			case len(rest) > 0:
+				redactPath(child, rest, replace)
+			default:
+				// Dropping an element would renumber the rest, so it's
+				// nulled instead.
+				var value interface{}
+				if replace != nil {
+					value = replace(child)
+				}
+				node[i] = value
+			}
+		}
+	}
+}
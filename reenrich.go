@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// enrichTargets are the unified_incidents columns and details keys each
+// enricher fills in, which `enrich` rewrites.
+var enrichTargets = map[string]struct {
+	columns []string
+	details []string
+}{
+	"time":                {columns: []string{"time_bucket", "day_type", "is_holiday", "holiday_name"}},
+	"event-type":          {columns: []string{"event_type", "raw_event_type"}},
+	"classify":            {columns: []string{"event_type", "raw_event_type", "event_type_confidence"}, details: []string{"classification"}},
+	"road-name":           {columns: []string{"road_normalized", "exit_number", "exit_suffix"}},
+	"darkness":            {columns: []string{"light_condition"}},
+	"weather":             {columns: []string{"weather_temp", "weather_wind_speed", "weather_forecast"}, details: []string{"weather"}},
+	"location-validation": {columns: []string{"city", "county_name", "county_id", "county_validation", "city_validation"}, details: []string{"location_validation"}},
+	"geocode":             {columns: []string{"address", "city", "county_name"}, details: []string{"geocode"}},
+	"road-match":          {columns: []string{"osm_way_id", "road_class", "speed_limit_mph", "road_match_distance_m"}, details: []string{"road_match"}},
+	"milepost":            {columns: []string{"milepost"}, details: []string{"milepost"}},
+	"proximity":           {columns: []string{"nearest_hospital", "nearest_hospital_m", "nearest_fire_station", "nearest_fire_station_m", "school_zone"}, details: []string{"proximity"}},
+	"detour":              {details: []string{"detour"}},
+	"traffic-flow":        {columns: []string{"traffic_speed_mph", "traffic_free_flow_mph", "traffic_speed_ratio"}, details: []string{"traffic_flow"}},
+	"air-quality":         {columns: []string{"aqi", "aqi_category", "aqi_parameter"}, details: []string{"air_quality"}},
+	"risk":                {columns: []string{"normalized_severity", "risk_score"}, details: []string{"risk"}},
+	"route-impact":        {},
+	"summary":             {columns: []string{"summary"}},
+}
+
+// runEnrich re-runs chosen enrichers over incidents already stored, after
+// adding one to the pipeline or fixing one, and rewrites just what they
+// fill in:
+//
+//	enrich -enrichers darkness,milepost -since 2024-01-01 -filter 'county=Wake&status=cleared'
+//
+// -filter takes the HTTP API's incident filters as a query string. Each
+// incident starts from its raw record with the stored location, type and
+// road filled back in, so an enricher sees what earlier ones found at
+// ingest; enrichers that depend on others (summary, risk) should be run
+// with them. Content hashes and history are left alone, as the source
+// record hasn't changed.
+func runEnrich(cfg *Config, db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("enrich", flag.ExitOnError)
+	names := fs.String("enrichers", "", "comma-separated enrichers to re-run")
+	since := fs.String("since", "", "only incidents starting at or after this (RFC 3339 or YYYY-MM-DD)")
+	until := fs.String("until", "", "only incidents starting before this")
+	filter := fs.String("filter", "", "incident filters, as a query string (county=Wake&road=I-40)")
+	dryRun := fs.Bool("dry-run", false, "enrich but don't write anything")
+	fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx = withNWSBudget(ctx, newRequestBudget(cfg.NWSRequestBudget))
+	logger := logFor("enrich")
+
+	all, err := buildEnrichers(cfg, db)
+	if err != nil {
+		log.Fatalf("Error building enrichers: %s", err)
+	}
+	var available []string
+	byName := map[string]Enricher{}
+	for _, e := range all {
+		byName[e.Name()] = e
+		available = append(available, e.Name())
+	}
+	sort.Strings(available)
+	// Enrichers run in pipeline order, whatever order they were named in.
+	chosen := map[string]bool{}
+	for _, name := range strings.Split(*names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := byName[name]; !ok {
+			log.Fatalf("Error: unknown or unconfigured enricher %q (configured: %s)", name, strings.Join(available, ", "))
+		}
+		chosen[name] = true
+	}
+	if len(chosen) == 0 {
+		log.Fatalf("Usage: enrich -enrichers NAME[,NAME...] [-since T] [-until T] [-filter QUERY] [-dry-run]")
+	}
+	var enrichers []Enricher
+	for _, e := range all {
+		if chosen[e.Name()] {
+			enrichers = append(enrichers, e)
+		}
+	}
+
+	q, err := url.ParseQuery(*filter)
+	if err != nil {
+		log.Fatalf("Error: -filter: %s", err)
+	}
+	if *since != "" {
+		q.Set("since", *since)
+	}
+	if *until != "" {
+		q.Set("until", *until)
+	}
+	f, err := parseIncidentFilter(q)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	keys, err := matchingIncidentKeys(ctx, db, f)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	logger.Info("Re-enriching incidents", "incidents", len(keys), "enrichers", *names, "dry_run", *dryRun)
+
+	for _, e := range enrichers {
+		if r, ok := e.(runScoped); ok {
+			r.BeginRun()
+		}
+	}
+	start := time.Now()
+	updated, failed := 0, 0
+	redactions := map[string]*detailsRedaction{}
+	for i, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		redaction, ok := redactions[key.Source]
+		if !ok {
+			if redaction, err = readDetailsRedaction(cfg.RedactionFile, key.Source, cfg.RedactionHashKey); err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+			redactions[key.Source] = redaction
+		}
+		u, err := loadStoredIncident(ctx, db, key)
+		if err == nil {
+			u.Redaction = redaction
+			runEnrichers(ctx, enrichers, u)
+			if !*dryRun {
+				err = updateEnrichment(ctx, db, u, chosen)
+			}
+		}
+		if err != nil {
+			logger.Error("Could not re-enrich incident", "source", key.Source, "incident_id", key.SourceID, "err", err)
+			failed++
+			continue
+		}
+		updated++
+		if (i+1)%500 == 0 {
+			logger.Info("Progress", "done", i+1, "of", len(keys))
+		}
+	}
+	logger.Info("Re-enrichment complete", "updated", updated, "failed", failed, "duration", time.Since(start).Round(time.Millisecond).String())
+	for _, e := range enrichers {
+		if r, ok := e.(reporter); ok {
+			if line := r.Report(); line != "" {
+				logger.Info("Run report", "from", e.Name(), "report", line)
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		log.Fatalf("Interrupted after %d of %d incidents", updated+failed, len(keys))
+	}
+}
+
+// matchingIncidentKeys lists the incidents matching f, oldest first.
+func matchingIncidentKeys(ctx context.Context, db *sql.DB, f incidentFilter) ([]incidentKey, error) {
+	where, args := f.where()
+	rows, err := db.QueryContext(ctx, `SELECT source, source_id FROM unified_incidents `+where+` ORDER BY timestamp, source, source_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not list incidents: %w", err)
+	}
+	defer rows.Close()
+	var keys []incidentKey
+	for rows.Next() {
+		var k incidentKey
+		if err := rows.Scan(&k.Source, &k.SourceID); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// loadStoredIncident rebuilds an incident from its row: the raw record
+// normalized again, then the stored location, type and road over it.
+func loadStoredIncident(ctx context.Context, db *sql.DB, key incidentKey) (*UnifiedIncident, error) {
+	found, err := queryIncidents(ctx, db, incidentFilter{Source: key.Source, SourceID: key.SourceID, Limit: 1, WithDetails: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, errIncidentNotFound
+	}
+	p := found[0]
+	u := UnifiedIncident{Source: p.Source, SourceID: p.SourceID}
+	if raw, ok := p.Details["raw_incident"]; ok && p.Source == "NCDOT" {
+		b, _ := json.Marshal(raw)
+		var incident Incident
+		if err := json.Unmarshal(b, &incident); err != nil {
+			return nil, fmt.Errorf("could not decode the raw record: %w", err)
+		}
+		if u, err = normalizeIncident(incident); err != nil {
+			return nil, err
+		}
+	}
+	u.Source, u.SourceID = p.Source, p.SourceID
+	u.EventType, u.Address, u.City, u.CountyName = p.EventType, p.Address, p.City, p.County
+	u.Latitude, u.Longitude, u.Timestamp = p.Latitude, p.Longitude, p.StartTime
+	u.ProblemDetail, u.LanesClosed, u.LanesTotal = p.ProblemDetail, p.LanesClosed, p.LanesTotal
+	u.RoadNormalized, u.Summary, u.Geofences = p.RoadNormalized, p.Summary, p.Geofences
+	if u.Road == "" {
+		u.Road = p.Road
+	}
+	if p.EndTime != nil {
+		u.EndTime = *p.EndTime
+	}
+	u.Weather = p.Weather
+	u.Risk = &RiskScore{NormalizedSeverity: p.NormalizedSeverity, Score: p.RiskScore}
+	return &u, nil
+}
+
+// updateEnrichment writes the columns and details keys of the chosen
+// enrichers, and route impacts if route-impact is one of them.
+func updateEnrichment(ctx context.Context, db *sql.DB, u *UnifiedIncident, chosen map[string]bool) error {
+	wanted := map[string]bool{}
+	var detailKeys []string
+	for name := range chosen {
+		for _, c := range enrichTargets[name].columns {
+			wanted[c] = true
+		}
+		detailKeys = append(detailKeys, enrichTargets[name].details...)
+	}
+	cols, err := u.columns()
+	if err != nil {
+		return err
+	}
+	var sets []string
+	args := []interface{}{u.Source, u.SourceID}
+	for _, c := range cols {
+		if wanted[c.name] {
+			args = append(args, c.value)
+			sets = append(sets, fmt.Sprintf("%s = $%d", c.name, len(args)))
+		}
+	}
+	if len(detailKeys) > 0 {
+		details := u.details()
+		fresh := map[string]interface{}{}
+		for _, k := range detailKeys {
+			if v, ok := details[k]; ok {
+				fresh[k] = v
+			}
+		}
+		b, err := json.Marshal(fresh)
+		if err != nil {
+			return err
+		}
+		args = append(args, pq.Array(detailKeys), b)
+		sets = append(sets, fmt.Sprintf("details = (details - $%d::text[]) || $%d::jsonb", len(args)-1, len(args)))
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if len(sets) > 0 {
+		if _, err := tx.ExecContext(ctx, `UPDATE unified_incidents SET `+strings.Join(sets, ", ")+` WHERE source = $1 AND source_id = $2`, args...); err != nil {
+			return fmt.Errorf("could not update incident: %w", err)
+		}
+	}
+	if chosen["route-impact"] && u.RouteImpacts != nil {
+		if err := saveRouteImpacts(tx, u); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// SeverityScale maps each source's severity values onto a common 1–5
+// scale, loaded from the severity_scales table.
+type SeverityScale map[string]map[int]int
+
+func loadSeverityScale(db *sql.DB) (SeverityScale, error) {
+	rows, err := db.Query(`SELECT source, source_severity, normalized_severity FROM severity_scales`)
+	if err != nil {
+		return nil, fmt.Errorf("could not load severity scales: %w", err)
+	}
+	defer rows.Close()
+
+	scale := SeverityScale{}
+	for rows.Next() {
+		var source string
+		var from, to int
+		if err := rows.Scan(&source, &from, &to); err != nil {
+			return nil, err
+		}
+		if scale[source] == nil {
+			scale[source] = map[int]int{}
+		}
+		scale[source][from] = to
+	}
+	return scale, rows.Err()
+}
+
+// Normalize returns the 1–5 severity for a source's value. Unmapped values
+// are clamped into range so a new value never drops the incident's score
+// to zero.
+func (s SeverityScale) Normalize(source string, severity int) int {
+	if n, ok := s[source][severity]; ok {
+		return n
+	}
+	return max(1, min(5, severity))
+}
+
+// weatherRiskFactor scores the NWS short forecast: precipitation and low
+// visibility make the same incident more dangerous.
+func weatherRiskFactor(w *WeatherData) float64 {
+	if w == nil {
+		return 1
+	}
+	f := strings.ToLower(w.ShortForecast)
+	switch {
+	case strings.Contains(f, "freezing") || strings.Contains(f, "ice") || strings.Contains(f, "sleet"):
+		return 2.0
+	case strings.Contains(f, "snow"):
+		return 1.8
+	case strings.Contains(f, "fog") || strings.Contains(f, "smoke") || strings.Contains(f, "haze"):
+		return 1.5
+	case strings.Contains(f, "thunderstorm") || strings.Contains(f, "heavy rain"):
+		return 1.5
+	case strings.Contains(f, "rain") || strings.Contains(f, "showers") || strings.Contains(f, "drizzle"):
+		return 1.3
+	}
+	return 1
+}
+
+// darknessRiskFactor weights unlit conditions.
+func darknessRiskFactor(light string) float64 {
+	switch light {
+	case LightDark:
+		return 1.3
+	case LightDusk:
+		return 1.15
+	}
+	return 1
+}
+
+// RiskScore is the composite, comparable risk for an incident along with
+// the factors it was built from.
+type RiskScore struct {
+	Score              float64 `json:"score"`
+	NormalizedSeverity int     `json:"normalized_severity"`
+	LanesFactor        float64 `json:"lanes_factor"`
+	WeatherFactor      float64 `json:"weather_factor"`
+	DarknessFactor     float64 `json:"darkness_factor"`
+}
+
+// riskEnricher computes severity × lanes-closed ratio × weather × darkness.
+// It must run after the weather and darkness enrichers.
+type riskEnricher struct {
+	scale SeverityScale
+}
+
+func (e *riskEnricher) Name() string { return "risk" }
+
+func (e *riskEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	r := &RiskScore{
+		NormalizedSeverity: e.scale.Normalize(incident.Source, incident.Severity),
+		LanesFactor:        1,
+		WeatherFactor:      weatherRiskFactor(incident.Weather),
+		DarknessFactor:     darknessRiskFactor(incident.LightCondition),
+	}
+	if incident.LanesTotal > 0 {
+		r.LanesFactor = 1 + float64(min(incident.LanesClosed, incident.LanesTotal))/float64(incident.LanesTotal)
+	}
+	r.Score = math.Round(float64(r.NormalizedSeverity)*r.LanesFactor*r.WeatherFactor*r.DarknessFactor*100) / 100
+	incident.Risk = r
+	return nil
+}
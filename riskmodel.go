@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The risk job predicts, for each stretch of road, the chance of an
+// unplanned incident in each of the next RISK_HORIZON_HOURS hours, and
+// keeps the predictions in segment_risk for GET /risk.
+//
+// A segment is a road in a county, split into RISK_SEGMENT_MILES milepost
+// bands (incidents without a milepost make one segment for the road in
+// the county). The model is a logistic regression on segment-hours over
+// the last RISK_TRAINING_WEEKS weeks: an hour is positive if the segment
+// had an incident start in it. Every positive hour is kept, and a sample
+// of the negative ones, weighted back up so the probabilities come out
+// right. The features are the segment's base rate, the hour of the day,
+// weekend, holiday, darkness and the weather factor of the forecast.
+// Weather for past hours is what was recorded then: the forecasts saved by
+// earlier refreshes in risk_weather, or else the conditions stored with
+// the county's incidents in that hour.
+//
+// With RISK_SCORING_URL set, an external service does the modelling
+// instead (gradient boosting, say):
+//
+//	POST {url}/train  {"features": [...], "rows": [{"x": [...], "label": 1, "weight": 1}]}
+//	POST {url}/score  {"features": [...], "rows": [[...], ...]}  ->  {"scores": [0.02, ...]}
+//
+// The model is retrained every RISK_RETRAIN_INTERVAL, or on -retrain; the
+// scores are refreshed every pass.
+
+// riskFeatureNames label the features, in order.
+var riskFeatureNames = []string{"intercept", "log_base_rate", "hour_sin", "hour_cos", "weekend", "holiday", "dark", "log_weather_factor"}
+
+const (
+	// riskMinIncidents leaves out segments with too little history to say
+	// anything about.
+	riskMinIncidents = 2
+	// riskNegativeRatio is how many negative segment-hours are sampled per
+	// positive one.
+	riskNegativeRatio = 5
+	// riskL2 keeps the fit stable when a feature doesn't vary (no
+	// holidays in the window, say).
+	riskL2 = 1.0
+)
+
+// riskSegment is a stretch of road with its history.
+type riskSegment struct {
+	Road   string
+	County string
+	// Band is the milepost band, or -1 for incidents with no milepost.
+	Band      int
+	Center    LatLon
+	Incidents int
+}
+
+func (s riskSegment) key() string {
+	return s.Road + "|" + s.County + "|" + strconv.Itoa(s.Band)
+}
+
+// riskModel is a trained model. Coefficients are empty for an external
+// one.
+type riskModel struct {
+	Source       string    `json:"source"`
+	TrainedAt    time.Time `json:"trained_at"`
+	Examples     int       `json:"examples"`
+	Features     []string  `json:"features"`
+	Coefficients []float64 `json:"coefficients,omitempty"`
+}
+
+func (m *riskModel) predict(x []float64) float64 {
+	var z float64
+	for i, c := range m.Coefficients {
+		z += c * x[i]
+	}
+	return 1 / (1 + math.Exp(-z))
+}
+
+// riskExample is one segment-hour for training.
+type riskExample struct {
+	X      []float64 `json:"x"`
+	Label  int       `json:"label"`
+	Weight float64   `json:"weight"`
+}
+
+// riskFeatures is the feature vector for a segment in the hour starting
+// at hour, with baseRate its incidents per hour.
+func riskFeatures(seg riskSegment, baseRate float64, hour time.Time, forecast string) []float64 {
+	local := hour.In(easternTime)
+	angle := 2 * math.Pi * (float64(local.Hour()) + 0.5) / 24
+	var weekend, holiday, dark float64
+	if local.Weekday() == time.Saturday || local.Weekday() == time.Sunday {
+		weekend = 1
+	}
+	if _, ok := holidayName(local); ok {
+		holiday = 1
+	}
+	if lightCondition(solarElevation(seg.Center, hour.Add(30*time.Minute))) != LightDaylight {
+		dark = 1
+	}
+	weather := weatherRiskFactor(&WeatherData{ShortForecast: forecast})
+	return []float64{1, math.Log(baseRate), math.Sin(angle), math.Cos(angle), weekend, holiday, dark, math.Log(weather)}
+}
+
+// riskHistory is the segments and their incident hours over the training
+// window.
+type riskHistory struct {
+	Since    time.Time
+	Hours    int
+	Segments []riskSegment
+	// positive holds segment index and hour (Unix seconds) for every hour
+	// a segment had an incident start.
+	positive map[[2]int64]bool
+	// weather is the forecast by county and hour (Unix seconds).
+	weather map[string]string
+}
+
+func (h *riskHistory) baseRate(seg riskSegment) float64 {
+	return (float64(seg.Incidents) + 0.5) / float64(h.Hours)
+}
+
+func weatherKey(county string, hour time.Time) string {
+	return county + "|" + strconv.FormatInt(hour.Unix(), 10)
+}
+
+// riskSegmentSQL is the segment of an incident, from its road, county and
+// milepost band ($1 is the band length).
+const riskSegmentSQL = `road_normalized, coalesce(county_name, ''), coalesce(floor(milepost / $1)::int, -1)`
+
+func loadRiskHistory(ctx context.Context, cfg *Config, db *sql.DB, now time.Time) (*riskHistory, error) {
+	h := &riskHistory{Hours: cfg.RiskTrainingWeeks * 7 * 24, positive: map[[2]int64]bool{}, weather: map[string]string{}}
+	h.Since = now.Add(-time.Duration(h.Hours) * time.Hour)
+	where := `WHERE timestamp >= $2 AND timestamp < $3 AND road_normalized IS NOT NULL
+		AND NOT (latitude = 0 AND longitude = 0)
+		AND NOT (event_type = ANY($4) OR coalesce(raw_event_type, '') = ANY($4))`
+	args := []interface{}{cfg.RiskSegmentMiles, h.Since, now, pq.Array(cfg.PlannedEventTypes)}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+riskSegmentSQL+`, avg(latitude), avg(longitude), count(*)
+		FROM unified_incidents `+where+`
+		GROUP BY 1, 2, 3
+		HAVING count(*) >= `+strconv.Itoa(riskMinIncidents)+`
+		ORDER BY 1, 2, 3`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load road segments: %w", err)
+	}
+	index := map[string]int{}
+	for rows.Next() {
+		var s riskSegment
+		if err := rows.Scan(&s.Road, &s.County, &s.Band, &s.Center.Lat, &s.Center.Lon, &s.Incidents); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[s.key()] = len(h.Segments)
+		h.Segments = append(h.Segments, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT DISTINCT `+riskSegmentSQL+`, date_trunc('hour', timestamp::timestamptz)
+		FROM unified_incidents `+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load incident hours: %w", err)
+	}
+	for rows.Next() {
+		var s riskSegment
+		var hour time.Time
+		if err := rows.Scan(&s.Road, &s.County, &s.Band, &hour); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if i, ok := index[s.key()]; ok {
+			h.positive[[2]int64{int64(i), hour.Unix()}] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Saved forecasts come second so they win over incident weather.
+	rows, err = db.QueryContext(ctx, `
+		SELECT county_name, date_trunc('hour', timestamp::timestamptz), mode() WITHIN GROUP (ORDER BY weather_forecast), 0
+		FROM unified_incidents
+		WHERE timestamp >= $1 AND county_name IS NOT NULL AND weather_forecast IS NOT NULL
+		GROUP BY 1, 2
+		UNION ALL
+		SELECT county_name, hour, forecast, 1 FROM risk_weather WHERE hour >= $1
+		ORDER BY 4`, h.Since)
+	if err != nil {
+		return nil, fmt.Errorf("could not load past weather: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var county, forecast string
+		var hour time.Time
+		var saved int
+		if err := rows.Scan(&county, &hour, &forecast, &saved); err != nil {
+			return nil, err
+		}
+		h.weather[weatherKey(county, hour)] = forecast
+	}
+	return h, rows.Err()
+}
+
+// examples is every positive segment-hour and a weighted sample of the
+// negative ones.
+func (h *riskHistory) examples() []riskExample {
+	hourAt := func(i int) time.Time { return h.Since.Add(time.Duration(i) * time.Hour) }
+	example := func(seg int, hour time.Time, label int, weight float64) riskExample {
+		s := h.Segments[seg]
+		return riskExample{X: riskFeatures(s, h.baseRate(s), hour, h.weather[weatherKey(s.County, hour)]), Label: label, Weight: weight}
+	}
+	var examples []riskExample
+	for k := range h.positive {
+		examples = append(examples, example(int(k[0]), time.Unix(k[1], 0), 1, 1))
+	}
+	space := len(h.Segments) * h.Hours
+	negatives := space - len(h.positive)
+	want := min(negatives, riskNegativeRatio*len(h.positive))
+	if want == 0 {
+		return examples
+	}
+	// A fixed seed keeps retraining on the same data reproducible.
+	rng := rand.New(rand.NewPCG(1, 2))
+	weight := float64(negatives) / float64(want)
+	sampled := map[[2]int64]bool{}
+	for len(sampled) < want {
+		seg, i := rng.IntN(len(h.Segments)), rng.IntN(h.Hours)
+		k := [2]int64{int64(seg), hourAt(i).Unix()}
+		if h.positive[k] || sampled[k] {
+			continue
+		}
+		sampled[k] = true
+		examples = append(examples, example(seg, hourAt(i), 0, weight))
+	}
+	return examples
+}
+
+// fitLogistic fits weighted, L2-regularized logistic regression by
+// Newton's method. The intercept, the first feature, isn't regularized.
+func fitLogistic(examples []riskExample, l2 float64) ([]float64, error) {
+	if len(examples) == 0 {
+		return nil, fmt.Errorf("no training examples")
+	}
+	d := len(examples[0].X)
+	beta := make([]float64, d)
+	for iter := 0; iter < 50; iter++ {
+		grad := make([]float64, d)
+		hess := make([][]float64, d)
+		for j := range hess {
+			hess[j] = make([]float64, d)
+		}
+		for _, e := range examples {
+			var z float64
+			for j, x := range e.X {
+				z += beta[j] * x
+			}
+			p := 1 / (1 + math.Exp(-z))
+			g, w := e.Weight*(p-float64(e.Label)), e.Weight*p*(1-p)
+			for j, xj := range e.X {
+				grad[j] += g * xj
+				for k, xk := range e.X {
+					hess[j][k] += w * xj * xk
+				}
+			}
+		}
+		for j := 1; j < d; j++ {
+			grad[j] += l2 * beta[j]
+			hess[j][j] += l2
+		}
+		step, err := solveLinear(hess, grad)
+		if err != nil {
+			return nil, err
+		}
+		var largest float64
+		for j := range beta {
+			beta[j] -= step[j]
+			largest = math.Max(largest, math.Abs(step[j]))
+		}
+		if largest < 1e-6 {
+			break
+		}
+	}
+	return beta, nil
+}
+
+// solveLinear solves a x = b by Gaussian elimination with partial
+// pivoting. a and b are overwritten.
+func solveLinear(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for r := col + 1; r < n; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, fmt.Errorf("singular system")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for r := col + 1; r < n; r++ {
+			f := a[r][col] / a[col][col]
+			for c := col; c < n; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+			b[r] -= f * b[col]
+		}
+	}
+	x := make([]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		sum := b[r]
+		for c := r + 1; c < n; c++ {
+			sum -= a[r][c] * x[c]
+		}
+		x[r] = sum / a[r][r]
+	}
+	return x, nil
+}
+
+// riskScorer calls the external scoring service.
+type riskScorer struct {
+	url    string
+	client *http.Client
+}
+
+func (s *riskScorer) post(ctx context.Context, path string, body, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("risk scoring request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("risk scoring service returned %s", resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return fmt.Errorf("failed to unmarshal risk scoring response: %w", err)
+	}
+	return nil
+}
+
+func (s *riskScorer) train(ctx context.Context, examples []riskExample) error {
+	return s.post(ctx, "/train", map[string]interface{}{"features": riskFeatureNames, "rows": examples}, nil)
+}
+
+func (s *riskScorer) score(ctx context.Context, rows [][]float64) ([]float64, error) {
+	var result struct {
+		Scores []float64 `json:"scores"`
+	}
+	if err := s.post(ctx, "/score", map[string]interface{}{"features": riskFeatureNames, "rows": rows}, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Scores) != len(rows) {
+		return nil, fmt.Errorf("risk scoring service returned %d scores for %d rows", len(result.Scores), len(rows))
+	}
+	return result.Scores, nil
+}
+
+func newRiskScorer(cfg *Config) *riskScorer {
+	if cfg.RiskScoringURL == "" {
+		return nil
+	}
+	return &riskScorer{url: cfg.RiskScoringURL, client: &http.Client{Timeout: 2 * time.Minute}}
+}
+
+// trainRiskModel trains on the history and saves the model.
+func trainRiskModel(ctx context.Context, cfg *Config, db *sql.DB, scorer *riskScorer) (*riskModel, error) {
+	history, err := loadRiskHistory(ctx, cfg, db, time.Now().Truncate(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	examples := history.examples()
+	model := &riskModel{Source: "builtin", TrainedAt: time.Now().UTC(), Examples: len(examples), Features: riskFeatureNames}
+	if scorer != nil {
+		model.Source = "external"
+		if err := scorer.train(ctx, examples); err != nil {
+			return nil, err
+		}
+	} else if model.Coefficients, err = fitLogistic(examples, riskL2); err != nil {
+		return nil, fmt.Errorf("could not fit the risk model: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO risk_models (trained_at, source, examples, features, coefficients) VALUES ($1, $2, $3, $4, $5)`,
+		model.TrainedAt, model.Source, model.Examples, pq.Array(model.Features), pq.Array(model.Coefficients)); err != nil {
+		return nil, fmt.Errorf("could not save the risk model: %w", err)
+	}
+	logFor("analytics").Info("Risk model trained", "source", model.Source, "segments", len(history.Segments),
+		"positive_hours", len(history.positive), "examples", len(examples))
+	return model, nil
+}
+
+// latestRiskModel is the last model trained, or nil.
+func latestRiskModel(ctx context.Context, db *sql.DB) (*riskModel, error) {
+	m := &riskModel{}
+	err := db.QueryRowContext(ctx, `
+		SELECT source, trained_at, examples, features, coefficients FROM risk_models ORDER BY trained_at DESC LIMIT 1`).
+		Scan(&m.Source, &m.TrainedAt, &m.Examples, pq.Array(&m.Features), pq.Array(&m.Coefficients))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load the risk model: %w", err)
+	}
+	return m, nil
+}
+
+// countyForecasts fetches the hourly forecast at the middle of each
+// county's segments, keyed as weatherKey, and saves the current hour's to
+// risk_weather for later training. A county whose forecast fails goes
+// without.
+func countyForecasts(ctx context.Context, cfg *Config, db *sql.DB, segments []riskSegment, now time.Time) map[string]string {
+	centers := map[string]LatLon{}
+	counts := map[string]int{}
+	for _, s := range segments {
+		if s.County == "" {
+			continue
+		}
+		c := centers[s.County]
+		n := float64(counts[s.County])
+		c.Lat, c.Lon = (c.Lat*n+s.Center.Lat)/(n+1), (c.Lon*n+s.Center.Lon)/(n+1)
+		centers[s.County] = c
+		counts[s.County]++
+	}
+	timeouts := nwsTimeouts{points: cfg.NWSPointsTimeout, hourly: cfg.NWSHourlyTimeout}
+	forecasts := map[string]string{}
+	for county, at := range centers {
+		periods, err := getHourlyForecast(ctx, at.Lat, at.Lon, timeouts)
+		if err != nil {
+			logFor("analytics").Warn("Could not fetch forecast for risk scores", "county", county, "err", err)
+			continue
+		}
+		for _, p := range periods {
+			hour := p.StartTime.Truncate(time.Hour)
+			forecasts[weatherKey(county, hour)] = p.ShortForecast
+			if hour.Equal(now) {
+				if _, err := db.ExecContext(ctx, `
+					INSERT INTO risk_weather (county_name, hour, forecast) VALUES ($1, $2, $3)
+					ON CONFLICT (county_name, hour) DO UPDATE SET forecast = EXCLUDED.forecast`,
+					county, hour, p.ShortForecast); err != nil {
+					logFor("analytics").Warn("Could not save forecast", "county", county, "err", err)
+				}
+			}
+		}
+	}
+	return forecasts
+}
+
+// refreshRiskScores scores every segment for the next hours and replaces
+// segment_risk.
+func refreshRiskScores(ctx context.Context, cfg *Config, db *sql.DB, model *riskModel, scorer *riskScorer) (int, error) {
+	now := time.Now().Truncate(time.Hour)
+	history, err := loadRiskHistory(ctx, cfg, db, now)
+	if err != nil {
+		return 0, err
+	}
+	forecasts := countyForecasts(ctx, cfg, db, history.Segments, now)
+
+	var roads, counties, forecastCol []string
+	var bands []int64
+	var lats, lons, probabilities []float64
+	var hours []time.Time
+	var rows [][]float64
+	for _, s := range history.Segments {
+		for i := 0; i < cfg.RiskHorizonHours; i++ {
+			hour := now.Add(time.Duration(i) * time.Hour)
+			forecast := forecasts[weatherKey(s.County, hour)]
+			rows = append(rows, riskFeatures(s, history.baseRate(s), hour, forecast))
+			roads, counties, bands = append(roads, s.Road), append(counties, s.County), append(bands, int64(s.Band))
+			lats, lons = append(lats, s.Center.Lat), append(lons, s.Center.Lon)
+			hours, forecastCol = append(hours, hour), append(forecastCol, forecast)
+		}
+	}
+	if scorer != nil && len(rows) > 0 {
+		if probabilities, err = scorer.score(ctx, rows); err != nil {
+			return 0, err
+		}
+	} else {
+		for _, x := range rows {
+			probabilities = append(probabilities, model.predict(x))
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM segment_risk`); err != nil {
+		return 0, fmt.Errorf("could not clear risk scores: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO segment_risk (road_normalized, county_name, band, latitude, longitude, hour_start, probability, forecast)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::int[], $4::float8[], $5::float8[], $6::timestamptz[], $7::float8[], $8::text[])`,
+		pq.Array(roads), pq.Array(counties), pq.Array(bands), pq.Array(lats), pq.Array(lons),
+		pq.Array(hours), pq.Array(probabilities), pq.Array(forecastCol)); err != nil {
+		return 0, fmt.Errorf("could not save risk scores: %w", err)
+	}
+	return len(history.Segments), tx.Commit()
+}
+
+func riskJob(cfg *Config, db *sql.DB, fs *flag.FlagSet) analyticsJob {
+	retrain := fs.Bool("retrain", false, "train the model now, however recent it is")
+	scorer := newRiskScorer(cfg)
+	return func(ctx context.Context, _ *sinkDispatcher) error {
+		model, err := latestRiskModel(ctx, db)
+		if err != nil {
+			return err
+		}
+		source := "builtin"
+		if scorer != nil {
+			source = "external"
+		}
+		if model == nil || *retrain || model.Source != source || time.Since(model.TrainedAt) >= cfg.RiskRetrainInterval {
+			if model, err = trainRiskModel(ctx, cfg, db, scorer); err != nil {
+				return err
+			}
+			*retrain = false
+		}
+		segments, err := refreshRiskScores(ctx, cfg, db, model, scorer)
+		if err != nil {
+			return err
+		}
+		logFor("analytics").Info("Risk scores refreshed", "segments", segments, "hours", cfg.RiskHorizonHours)
+		return nil
+	}
+}
+
+// segmentRisk is a segment's predicted risk over the coming hours.
+type segmentRisk struct {
+	Road         string     `json:"road"`
+	County       string     `json:"county,omitempty"`
+	MilepostFrom *float64   `json:"milepost_from,omitempty"`
+	MilepostTo   *float64   `json:"milepost_to,omitempty"`
+	Latitude     float64    `json:"latitude"`
+	Longitude    float64    `json:"longitude"`
+	Peak         float64    `json:"peak_probability"`
+	Hours        []riskHour `json:"hours"`
+}
+
+type riskHour struct {
+	Start       time.Time `json:"start"`
+	Probability float64   `json:"probability"`
+	Forecast    string    `json:"forecast,omitempty"`
+}
+
+type riskList struct {
+	Model       *riskModel    `json:"model"`
+	RefreshedAt *time.Time    `json:"refreshed_at"`
+	Segments    []segmentRisk `json:"segments"`
+}
+
+// handleRisk lists the segments by their peak predicted risk over the
+// next hours (hours=, default all that were scored), highest first.
+// road=, county= and min_probability= narrow the list; limit= caps it.
+func (s *server) handleRisk(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, hours, minProbability := apiDefaultLimit, s.cfg.RiskHorizonHours, 0.0
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("hours"); v != "" {
+		if hours, err = strconv.Atoi(v); err != nil || hours <= 0 {
+			http.Error(w, fmt.Sprintf("invalid hours %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("min_probability"); v != "" {
+		if minProbability, err = strconv.ParseFloat(v, 64); err != nil || minProbability < 0 || minProbability > 1 {
+			http.Error(w, fmt.Sprintf("invalid min_probability %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	resp, err := s.loadRisk(r.Context(), q.Get("road"), q.Get("county"), hours, minProbability, min(limit, apiMaxLimit))
+	if err != nil {
+		logFor("api").Error("Error loading risk scores", "err", err)
+		http.Error(w, "could not load risk scores", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "application/json", resp)
+}
+
+func (s *server) loadRisk(ctx context.Context, road, county string, hours int, minProbability float64, limit int) (*riskList, error) {
+	resp := &riskList{Segments: []segmentRisk{}}
+	var err error
+	if resp.Model, err = latestRiskModel(ctx, s.db); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT road_normalized, county_name, band, latitude, longitude, hour_start, probability,
+			coalesce(forecast, ''), refreshed_at
+		FROM segment_risk
+		WHERE hour_start >= date_trunc('hour', now()) AND hour_start < date_trunc('hour', now()) + make_interval(hours => $1)
+			AND ($2 = '' OR lower(road_normalized) = lower($2)) AND ($3 = '' OR lower(county_name) = lower($3))
+		ORDER BY 1, 2, 3, hour_start`, hours, road, county)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	index := map[string]int{}
+	for rows.Next() {
+		var seg riskSegment
+		var lat, lon float64
+		var h riskHour
+		var refreshed time.Time
+		if err := rows.Scan(&seg.Road, &seg.County, &seg.Band, &lat, &lon, &h.Start, &h.Probability, &h.Forecast, &refreshed); err != nil {
+			return nil, err
+		}
+		if resp.RefreshedAt == nil {
+			resp.RefreshedAt = &refreshed
+		}
+		i, ok := index[seg.key()]
+		if !ok {
+			sr := segmentRisk{Road: seg.Road, County: seg.County, Latitude: lat, Longitude: lon}
+			if seg.Band >= 0 {
+				from, to := float64(seg.Band)*s.cfg.RiskSegmentMiles, float64(seg.Band+1)*s.cfg.RiskSegmentMiles
+				sr.MilepostFrom, sr.MilepostTo = &from, &to
+			}
+			i = len(resp.Segments)
+			index[seg.key()] = i
+			resp.Segments = append(resp.Segments, sr)
+		}
+		sr := &resp.Segments[i]
+		sr.Hours = append(sr.Hours, h)
+		sr.Peak = math.Max(sr.Peak, h.Probability)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	kept := resp.Segments[:0]
+	for _, sr := range resp.Segments {
+		if sr.Peak >= minProbability {
+			kept = append(kept, sr)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Peak > kept[j].Peak })
+	resp.Segments = kept[:min(limit, len(kept))]
+	return resp, nil
+}
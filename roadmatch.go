@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RoadMatch is the OSM way an incident was snapped to.
+type RoadMatch struct {
+	WayID          int64   `json:"way_id"`
+	Name           string  `json:"name,omitempty"`
+	Ref            string  `json:"ref,omitempty"`
+	RoadClass      string  `json:"road_class"`
+	SpeedLimitMPH  int     `json:"speed_limit_mph,omitempty"`
+	DistanceMeters float64 `json:"distance_m"`
+}
+
+// roadWay is one OSM way from the preloaded road network.
+type roadWay struct {
+	id            int64
+	name          string
+	ref           string
+	class         string
+	speedLimitMPH int
+	geometry      []LatLon
+}
+
+// RoadNetwork is a preloaded set of OSM highway ways with a spatial index
+// over their segments.
+type RoadNetwork struct {
+	ways     []roadWay
+	segments []roadSegment
+	index    *gridIndex
+}
+
+type roadSegment struct {
+	way int
+	a   LatLon
+	b   LatLon
+}
+
+// loadRoadNetwork reads an Overpass API JSON extract produced with
+// `out geom;`, for example:
+//
+//	[out:json];way["highway"~"motorway|trunk|primary|secondary"](area:3600224045);out geom;
+func loadRoadNetwork(path string) (*RoadNetwork, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read road network: %w", err)
+	}
+	var extract struct {
+		Elements []struct {
+			Type     string            `json:"type"`
+			ID       int64             `json:"id"`
+			Tags     map[string]string `json:"tags"`
+			Geometry []LatLon          `json:"geometry"`
+		} `json:"elements"`
+	}
+	if err := json.Unmarshal(raw, &extract); err != nil {
+		return nil, fmt.Errorf("could not parse road network %s: %w", path, err)
+	}
+
+	n := &RoadNetwork{index: newGridIndex(0.01)}
+	for _, el := range extract.Elements {
+		if el.Type != "way" || el.Tags["highway"] == "" || len(el.Geometry) < 2 {
+			continue
+		}
+		wayIdx := len(n.ways)
+		n.ways = append(n.ways, roadWay{
+			id:            el.ID,
+			name:          el.Tags["name"],
+			ref:           el.Tags["ref"],
+			class:         el.Tags["highway"],
+			speedLimitMPH: parseMaxSpeed(el.Tags["maxspeed"]),
+			geometry:      el.Geometry,
+		})
+		for i := 1; i < len(el.Geometry); i++ {
+			seg := roadSegment{way: wayIdx, a: el.Geometry[i-1], b: el.Geometry[i]}
+			n.index.insertBox(len(n.segments), seg.a, seg.b)
+			n.segments = append(n.segments, seg)
+		}
+	}
+	if len(n.ways) == 0 {
+		return nil, fmt.Errorf("road network %s contains no highway ways", path)
+	}
+	return n, nil
+}
+
+// parseMaxSpeed converts an OSM maxspeed tag ("45 mph", or bare km/h) to mph.
+func parseMaxSpeed(tag string) int {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return 0
+	}
+	if v, ok := strings.CutSuffix(tag, "mph"); ok {
+		n, _ := strconv.Atoi(strings.TrimSpace(v))
+		return n
+	}
+	kmh, err := strconv.ParseFloat(tag, 64)
+	if err != nil {
+		return 0
+	}
+	return int(math.Round(kmh / 1.609344))
+}
+
+// Nearest returns the way closest to p within maxMeters.
+func (n *RoadNetwork) Nearest(p LatLon, maxMeters float64) (*RoadMatch, bool) {
+	best, bestDist := -1, math.Inf(1)
+	for _, s := range n.index.near(p) {
+		seg := n.segments[s]
+		if d, _ := pointSegmentDistance(p, seg.a, seg.b); d < bestDist {
+			best, bestDist = seg.way, d
+		}
+	}
+	if best < 0 || bestDist > maxMeters {
+		return nil, false
+	}
+	w := n.ways[best]
+	return &RoadMatch{
+		WayID:          w.id,
+		Name:           w.name,
+		Ref:            w.ref,
+		RoadClass:      w.class,
+		SpeedLimitMPH:  w.speedLimitMPH,
+		DistanceMeters: math.Round(bestDist*10) / 10,
+	}, true
+}
+
+// roadMatchEnricher snaps the incident to the nearest OSM way.
+type roadMatchEnricher struct {
+	network   *RoadNetwork
+	maxMeters float64
+}
+
+func (e *roadMatchEnricher) Name() string { return "road-match" }
+
+func (e *roadMatchEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	match, ok := e.network.Nearest(LatLon{Lat: incident.Latitude, Lon: incident.Longitude}, e.maxMeters)
+	if !ok {
+		return nil
+	}
+	incident.RoadMatch = match
+	return nil
+}
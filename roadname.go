@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// routePattern matches the many ways a numbered route is written in the
+// feed: "I-40", "I40", "Interstate 40", "US 70 Bus", "NC-54", "SR 1010".
+var routePattern = regexp.MustCompile(`(?i)\b(interstate|i|us|u\.s\.|nc|sr)[\s-]*(\d{1,4})([a-z])?\b(?:\s+(bus(?:iness)?|byp(?:ass)?|alt|conn|spur|truck))?`)
+
+// exitPattern matches "Exit 283", "Exit 283A", "Exit #13", and "Exits 12-13".
+var exitPattern = regexp.MustCompile(`(?i)\bexits?\s*#?\s*(\d{1,3})\s*([a-d])?\b`)
+
+var routeQualifiers = map[string]string{
+	"bus": "BUS", "business": "BUS",
+	"byp": "BYP", "bypass": "BYP",
+	"alt": "ALT", "conn": "CONN", "spur": "SPUR", "truck": "TRUCK",
+}
+
+// normalizeRouteName rewrites the first route reference in s into the
+// canonical "I-40" / "US-70 BUS" / "NC-54" / "SR-1010" form. It returns ""
+// when s contains no recognizable route.
+func normalizeRouteName(s string) string {
+	m := routePattern.FindStringSubmatch(s)
+	if m == nil {
+		return ""
+	}
+
+	var prefix string
+	switch strings.ToLower(strings.TrimSuffix(m[1], ".")) {
+	case "interstate", "i":
+		prefix = "I"
+	case "us", "u.s":
+		prefix = "US"
+	case "nc":
+		prefix = "NC"
+	case "sr":
+		prefix = "SR"
+	}
+
+	number, err := strconv.Atoi(m[2])
+	if err != nil {
+		return ""
+	}
+	name := prefix + "-" + strconv.Itoa(number) + strings.ToUpper(m[3])
+	if q := routeQualifiers[strings.ToLower(m[4])]; q != "" {
+		name += " " + q
+	}
+	return name
+}
+
+// extractExit pulls the first exit number (and optional letter suffix)
+// from free text such as "I-40 West near Exit 289A (Wade Avenue)".
+func extractExit(s string) (int, string, bool) {
+	m := exitPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, "", false
+	}
+	return n, strings.ToUpper(m[2]), true
+}
+
+// roadNameEnricher fills the normalized road name and exit number from
+// the road, common name, and location text, in that order of preference.
+type roadNameEnricher struct{}
+
+func (roadNameEnricher) Name() string { return "road-name" }
+
+func (roadNameEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	texts := []string{incident.Road, incident.CommonName, incident.Address}
+
+	for _, t := range texts {
+		if name := normalizeRouteName(t); name != "" {
+			incident.RoadNormalized = name
+			break
+		}
+	}
+	for _, t := range texts {
+		if n, suffix, ok := extractExit(t); ok {
+			incident.ExitNumber = n
+			incident.ExitSuffix = suffix
+			break
+		}
+	}
+	return nil
+}
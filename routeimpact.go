@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// SavedRoute is a user-defined commute route from the saved_routes table.
+// A route is either an ordered polyline, a list of road names, or both.
+type SavedRoute struct {
+	ID           int
+	Name         string
+	Polyline     []LatLon
+	Roads        []string
+	BufferMeters float64
+	cumulative   []float64
+	roadKeys     map[string]bool
+}
+
+// RouteImpact is one saved route an incident affects.
+type RouteImpact struct {
+	RouteID        int     `json:"route_id"`
+	RouteName      string  `json:"route_name"`
+	Score          float64 `json:"score"`
+	DistanceMeters float64 `json:"distance_m"`
+	// PositionMeters is how far along the route's polyline the incident
+	// sits, or -1 when it matched by road name only.
+	PositionMeters float64 `json:"position_m"`
+}
+
+// loadSavedRoutes reads the active saved routes. Polylines are stored as a
+// JSON array of [lat, lon] pairs in travel order.
+func loadSavedRoutes(db *sql.DB) ([]*SavedRoute, error) {
+	rows, err := db.Query(`SELECT id, name, polyline, roads, buffer_m FROM saved_routes WHERE active`)
+	if err != nil {
+		return nil, fmt.Errorf("could not load saved routes: %w", err)
+	}
+	defer rows.Close()
+
+	var routes []*SavedRoute
+	for rows.Next() {
+		r := &SavedRoute{roadKeys: map[string]bool{}}
+		var polyline []byte
+		if err := rows.Scan(&r.ID, &r.Name, &polyline, pq.Array(&r.Roads), &r.BufferMeters); err != nil {
+			return nil, err
+		}
+		if len(polyline) > 0 {
+			var pairs [][2]float64
+			if err := json.Unmarshal(polyline, &pairs); err != nil {
+				return nil, fmt.Errorf("saved route %q has an invalid polyline: %w", r.Name, err)
+			}
+			for _, p := range pairs {
+				r.Polyline = append(r.Polyline, LatLon{Lat: p[0], Lon: p[1]})
+			}
+		}
+		r.measure()
+		for _, road := range r.Roads {
+			r.roadKeys[routeNameKey(firstNonEmpty(normalizeRouteName(road), road))] = true
+		}
+		routes = append(routes, r)
+	}
+	return routes, rows.Err()
+}
+
+// measure computes the distance along the polyline to each vertex.
+func (r *SavedRoute) measure() {
+	r.cumulative = make([]float64, len(r.Polyline))
+	for i := 1; i < len(r.Polyline); i++ {
+		r.cumulative[i] = r.cumulative[i-1] + haversineMeters(r.Polyline[i-1], r.Polyline[i])
+	}
+}
+
+// locate returns the distance from pt to the route polyline and the
+// position along it, or ok=false when the route has no polyline.
+func (r *SavedRoute) locate(pt LatLon) (dist, position float64, ok bool) {
+	dist = math.Inf(1)
+	for i := 1; i < len(r.Polyline); i++ {
+		d, t := pointSegmentDistance(pt, r.Polyline[i-1], r.Polyline[i])
+		if d < dist {
+			dist = d
+			position = r.cumulative[i-1] + t*(r.cumulative[i]-r.cumulative[i-1])
+			ok = true
+		}
+	}
+	return dist, position, ok
+}
+
+// impactScore weights an incident's effect on a route: its severity, scaled
+// up by the share of lanes closed and down by distance from the route.
+func impactScore(incident *UnifiedIncident, distance, buffer float64) float64 {
+	score := math.Max(1, float64(incident.Severity))
+	if incident.LanesTotal > 0 {
+		score *= 1 + float64(min(incident.LanesClosed, incident.LanesTotal))/float64(incident.LanesTotal)
+	}
+	if buffer > 0 {
+		score *= 1 - 0.5*math.Min(1, distance/buffer)
+	}
+	return math.Round(score*100) / 100
+}
+
+// routeImpactEnricher finds the saved routes an incident affects.
+type routeImpactEnricher struct {
+	routes []*SavedRoute
+}
+
+func (e *routeImpactEnricher) Name() string { return "route-impact" }
+
+func (e *routeImpactEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	pt := LatLon{Lat: incident.Latitude, Lon: incident.Longitude}
+	roadKey := routeNameKey(firstNonEmpty(incident.RoadNormalized, incident.Road))
+
+	impacts := []RouteImpact{}
+	for _, r := range e.routes {
+		if dist, pos, ok := r.locate(pt); ok && dist <= r.BufferMeters {
+			impacts = append(impacts, RouteImpact{
+				RouteID:        r.ID,
+				RouteName:      r.Name,
+				Score:          impactScore(incident, dist, r.BufferMeters),
+				DistanceMeters: math.Round(dist),
+				PositionMeters: math.Round(pos),
+			})
+			continue
+		}
+		if roadKey != "" && r.roadKeys[roadKey] {
+			impacts = append(impacts, RouteImpact{
+				RouteID:        r.ID,
+				RouteName:      r.Name,
+				Score:          impactScore(incident, 0, 0),
+				PositionMeters: -1,
+			})
+		}
+	}
+	incident.RouteImpacts = impacts
+	return nil
+}
+
+// saveRouteImpacts replaces the incident's rows in incident_route_impacts.
+func saveRouteImpacts(tx *sql.Tx, incident *UnifiedIncident) error {
+	if _, err := tx.Exec(`DELETE FROM incident_route_impacts WHERE source = $1 AND source_id = $2`,
+		incident.Source, incident.SourceID); err != nil {
+		return fmt.Errorf("could not clear route impacts: %w", err)
+	}
+	if len(incident.RouteImpacts) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(incident.RouteImpacts))
+	args := []interface{}{incident.Source, incident.SourceID}
+	for _, ri := range incident.RouteImpacts {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($1, $2, $%d, $%d, $%d, $%d, now())", n+1, n+2, n+3, n+4))
+		// Road-name matches have no polyline to measure against.
+		var distance, position sql.NullFloat64
+		if ri.PositionMeters >= 0 {
+			distance = sql.NullFloat64{Float64: ri.DistanceMeters, Valid: true}
+			position = sql.NullFloat64{Float64: ri.PositionMeters, Valid: true}
+		}
+		args = append(args, ri.RouteID, ri.Score, distance, position)
+	}
+	_, err := tx.Exec(`
+		INSERT INTO incident_route_impacts (source, source_id, route_id, impact_score, distance_m, position_m, computed_at)
+		VALUES `+strings.Join(values, ", "), args...)
+	if err != nil {
+		return fmt.Errorf("could not save route impacts: %w", err)
+	}
+	return nil
+}
+
+// loadRouteImpacts reads an incident's saved route impacts, worst first.
+func loadRouteImpacts(ctx context.Context, db *sql.DB, source, sourceID string) ([]RouteImpact, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT i.route_id, r.name, i.impact_score, i.distance_m, i.position_m
+		FROM incident_route_impacts i JOIN saved_routes r ON r.id = i.route_id
+		WHERE i.source = $1 AND i.source_id = $2
+		ORDER BY i.impact_score DESC`, source, sourceID)
+	if err != nil {
+		return nil, fmt.Errorf("could not load route impacts: %w", err)
+	}
+	defer rows.Close()
+	impacts := []RouteImpact{}
+	for rows.Next() {
+		var ri RouteImpact
+		var distance, position sql.NullFloat64
+		if err := rows.Scan(&ri.RouteID, &ri.RouteName, &ri.Score, &distance, &position); err != nil {
+			return nil, err
+		}
+		ri.DistanceMeters = distance.Float64
+		ri.PositionMeters = -1
+		if position.Valid {
+			ri.PositionMeters = position.Float64
+		}
+		impacts = append(impacts, ri)
+	}
+	return impacts, rows.Err()
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// NotifyRule selects the incidents a notification sink posts. Every field
+// that is set must match; an empty rule matches everything. For example:
+//
+//	[
+//	  {"name": "wake-severe", "counties": ["Wake"], "min_severity": 3},
+//	  {"name": "i40-closures", "roads": ["I-40"], "full_closure": true},
+//	  {"name": "icy-mornings", "weather": ["snow", "ice"], "hours": "05:00-10:00", "days": ["Mon", "Tue", "Wed", "Thu", "Fri"]}
+//	]
+//
+// MinSeverity compares against the normalized 1–5 severity. Weather
+// matches words in the NWS short forecast. Hours ("HH:MM-HH:MM", Eastern,
+// may wrap midnight) and Days restrict when the event happens. Changes
+// limits the rule to created, updated and/or cleared events.
+type NotifyRule struct {
+	Name        string       `json:"name"`
+	Counties    []string     `json:"counties,omitempty"`
+	Roads       []string     `json:"roads,omitempty"`
+	EventTypes  []string     `json:"event_types,omitempty"`
+	MinSeverity int          `json:"min_severity,omitempty"`
+	FullClosure bool         `json:"full_closure,omitempty"`
+	Interstate  bool         `json:"interstate,omitempty"`
+	Weather     []string     `json:"weather,omitempty"`
+	Hours       string       `json:"hours,omitempty"`
+	Days        []string     `json:"days,omitempty"`
+	Changes     []ChangeType `json:"changes,omitempty"`
+}
+
+// Matches reports whether the event satisfies the rule.
+func (r NotifyRule) Matches(event IncidentEvent) bool {
+	p := event.Incident
+	if len(r.Counties) > 0 && !containsFold(r.Counties, p.County) {
+		return false
+	}
+	if len(r.Roads) > 0 && !containsFold(r.Roads, p.RoadNormalized) && !containsFold(r.Roads, p.Road) {
+		return false
+	}
+	if len(r.EventTypes) > 0 && !containsFold(r.EventTypes, p.EventType) {
+		return false
+	}
+	if r.MinSeverity > 0 && p.NormalizedSeverity < r.MinSeverity {
+		return false
+	}
+	if r.FullClosure && !p.fullClosure() {
+		return false
+	}
+	if r.Interstate && !strings.HasPrefix(p.RoadNormalized, "I-") {
+		return false
+	}
+	if len(r.Weather) > 0 && !weatherMatches(r.Weather, p.Weather) {
+		return false
+	}
+	if r.Hours != "" {
+		start, end, _ := strings.Cut(r.Hours, "-")
+		if !inQuietHours(start, end, event.OccurredAt) {
+			return false
+		}
+	}
+	if len(r.Days) > 0 && !containsFold(r.Days, event.OccurredAt.In(easternTime).Format("Mon")) {
+		return false
+	}
+	if len(r.Changes) > 0 && !containsChange(r.Changes, event.Change) {
+		return false
+	}
+	return true
+}
+
+// validate checks the parts of a rule that can be malformed.
+func (r NotifyRule) validate() error {
+	if r.Hours != "" {
+		start, end, ok := strings.Cut(r.Hours, "-")
+		if !ok {
+			return fmt.Errorf("rule %q: hours must look like 06:00-10:00", r.Name)
+		}
+		for _, hhmm := range []string{start, end} {
+			if _, err := parseClock(hhmm); err != nil {
+				return fmt.Errorf("rule %q: invalid hours: %w", r.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p IncidentPayload) fullClosure() bool {
+	return p.LanesTotal > 0 && p.LanesClosed >= p.LanesTotal
+}
+
+func weatherMatches(words []string, w *WeatherData) bool {
+	if w == nil {
+		return false
+	}
+	forecast := strings.ToLower(w.ShortForecast)
+	for _, word := range words {
+		if strings.Contains(forecast, strings.ToLower(word)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsChange(list []ChangeType, c ChangeType) bool {
+	for _, v := range list {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// NotifyRules is a set of rules, any one of which selects an incident.
+// No rules at all selects every incident.
+type NotifyRules []NotifyRule
+
+// Match returns the first matching rule.
+func (rs NotifyRules) Match(event IncidentEvent) (NotifyRule, bool) {
+	if len(rs) == 0 {
+		return NotifyRule{Name: "all"}, true
+	}
+	for _, r := range rs {
+		if r.Matches(event) {
+			return r, true
+		}
+	}
+	return NotifyRule{}, false
+}
+
+func loadNotifyRules(path string) (NotifyRules, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read notification rules: %w", err)
+	}
+	var rules NotifyRules
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, fmt.Errorf("could not parse notification rules %s: %w", path, err)
+	}
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutingRule is a central alert routing rule: a match condition, the
+// sinks (by name, globs allowed, e.g. "slack" or "discord *") that matching
+// events go to, and an optional text/template message body executed with
+// notifyTemplateData. For example:
+//
+//	{"name": "i40-closures", "roads": ["I-40"], "full_closure": true,
+//	 "sinks": ["slack", "sms"], "template": "{{.Title}}: all lanes closed. {{.MapURL}}"}
+type RoutingRule struct {
+	NotifyRule
+	Sinks    []string `json:"sinks"`
+	Template string   `json:"template,omitempty"`
+
+	tmpl *template.Template
+}
+
+// notifyRouter decides which sinks each event goes to. A sink named by any
+// routing rule only receives events a rule routes to it (with the rule's
+// name and rendered message attached, and its own filtering bypassed);
+// sinks no rule mentions receive every event as before.
+type notifyRouter struct {
+	rules []RoutingRule
+}
+
+// loadRoutingRules reads rules from the file (if set) followed by the
+// enabled rows of notification_rules, whose definition column holds the
+// same JSON object as a file entry.
+func loadRoutingRules(db *sql.DB, path string) (*notifyRouter, error) {
+	var rules []RoutingRule
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read routing rules: %w", err)
+		}
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			return nil, fmt.Errorf("could not parse routing rules %s: %w", path, err)
+		}
+	}
+
+	rows, err := db.Query(`SELECT name, definition FROM notification_rules WHERE enabled ORDER BY priority, name`)
+	if err != nil {
+		return nil, fmt.Errorf("could not load notification rules: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var definition []byte
+		if err := rows.Scan(&name, &definition); err != nil {
+			return nil, err
+		}
+		var r RoutingRule
+		if err := json.Unmarshal(definition, &r); err != nil {
+			return nil, fmt.Errorf("notification rule %q has an invalid definition: %w", name, err)
+		}
+		r.Name = name
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range rules {
+		if err := rules[i].prepare(); err != nil {
+			return nil, err
+		}
+	}
+	return &notifyRouter{rules: rules}, nil
+}
+
+// prepare validates the rule and parses its template.
+func (r *RoutingRule) prepare() error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if len(r.Sinks) == 0 {
+		return fmt.Errorf("routing rule %q names no sinks", r.Name)
+	}
+	if r.Template != "" {
+		var err error
+		if r.tmpl, err = template.New(r.Name).Parse(r.Template); err != nil {
+			return fmt.Errorf("routing rule %q has an invalid template: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (rt *notifyRouter) targets(rule RoutingRule, sink string) bool {
+	for _, pattern := range rule.Sinks {
+		if ok, _ := path.Match(pattern, sink); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the event as the named sink should receive it, or false
+// if the sink shouldn't get it at all.
+func (rt *notifyRouter) route(sink string, event IncidentEvent) (IncidentEvent, bool) {
+	if rt == nil {
+		return event, true
+	}
+	routed := false
+	for _, r := range rt.rules {
+		if !rt.targets(r, sink) {
+			continue
+		}
+		routed = true
+		if !r.Matches(event) {
+			continue
+		}
+		event.Rule = r.Name
+		if r.tmpl != nil {
+			var b bytes.Buffer
+			if err := r.tmpl.Execute(&b, newNotifyTemplateData(event)); err != nil {
+				logFor("sinks").Warn("Routing rule template failed", "rule", r.Name, "err", err)
+			} else {
+				event.Message = strings.TrimSpace(b.String())
+			}
+		}
+		return event, true
+	}
+	return event, !routed
+}
+
+// notifyTemplateData is what message templates are executed with.
+type notifyTemplateData struct {
+	Change      ChangeType
+	Title       string
+	Description string
+	EventType   string
+	Road        string
+	County      string
+	Lanes       string
+	Severity    int
+	Weather     string
+	Started     string
+	MapURL      string
+	Incident    IncidentPayload
+}
+
+func newNotifyTemplateData(event IncidentEvent) notifyTemplateData {
+	p := event.Incident
+	return notifyTemplateData{
+		Change:      event.Change,
+		Title:       incidentTitle(p),
+		Description: incidentDescription(p),
+		EventType:   p.EventType,
+		Road:        firstNonEmpty(p.RoadNormalized, p.Road),
+		County:      p.County,
+		Lanes:       lanesLabel(p),
+		Severity:    p.NormalizedSeverity,
+		Weather:     weatherLabel(p.Weather),
+		Started:     localTimeLabel(p.StartTime),
+		MapURL:      mapURL(p.Latitude, p.Longitude),
+		Incident:    p,
+	}
+}
+
+// ruleMatches applies a sink's own rules unless the router already picked
+// the event for it.
+func ruleMatches(rules NotifyRules, event IncidentEvent) bool {
+	if event.Rule != "" {
+		return true
+	}
+	_, ok := rules.Match(event)
+	return ok
+}
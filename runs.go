@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Every ingest run is recorded in ingest_runs: what it fetched and saved,
+// how long it took and how it ended, plus a hash of the feed payload so
+// runs that saw identical data can be told apart from ones that didn't.
+// The readiness check reads the last success from it, and it is listed by
+// GET /admin/runs.
+
+// ingestRun is a row of ingest_runs.
+type ingestRun struct {
+	RunID       string    `json:"run_id"`
+	Source      string    `json:"source"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	DurationMS  int64     `json:"duration_ms"`
+	Outcome     string    `json:"outcome"`
+	Fetched     int       `json:"fetched"`
+	Saved       int       `json:"saved"`
+	Created     int       `json:"created"`
+	Updated     int       `json:"updated"`
+	Cleared     int       `json:"cleared"`
+	Errors      int       `json:"errors"`
+	Quarantined int       `json:"quarantined"`
+	PayloadHash string    `json:"payload_hash,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// finish fills in the outcome of the run: success, error, or unchanged if
+// it was cut short by an unmodified feed.
+func (r *ingestRun) finish(err error) {
+	r.FinishedAt = time.Now()
+	r.DurationMS = r.FinishedAt.Sub(r.StartedAt).Milliseconds()
+	if r.Outcome == "" {
+		r.Outcome = "success"
+	}
+	if err != nil {
+		r.Outcome = "error"
+		r.Error = err.Error()
+	}
+}
+
+func recordIngestRun(db *sql.DB, r *ingestRun) error {
+	// The run's own context may be what ended it.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO ingest_runs (run_id, source, started_at, finished_at, duration_ms, outcome,
+			fetched, saved, created, updated, cleared, errors, quarantined, payload_hash, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NULLIF($14, ''), NULLIF($15, ''))`,
+		r.RunID, r.Source, r.StartedAt, r.FinishedAt, r.DurationMS, r.Outcome,
+		r.Fetched, r.Saved, r.Created, r.Updated, r.Cleared, r.Errors, r.Quarantined, r.PayloadHash, r.Error)
+	return err
+}
+
+// lastSuccessfulRun is when the most recent successful run finished, zero
+// if there hasn't been one.
+func lastSuccessfulRun(ctx context.Context, db *sql.DB) (time.Time, error) {
+	var t sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT max(finished_at) FROM ingest_runs WHERE outcome IN ('success', 'unchanged')`).Scan(&t)
+	return t.Time, err
+}
+
+// listIngestRuns returns the latest runs, newest first, optionally for one
+// source.
+func listIngestRuns(ctx context.Context, db *sql.DB, source string, limit int) ([]ingestRun, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT run_id, source, started_at, finished_at, duration_ms, outcome,
+			fetched, saved, created, updated, cleared, errors, quarantined, coalesce(payload_hash, ''), coalesce(error, '')
+		FROM ingest_runs
+		WHERE $1 = '' OR source = $1
+		ORDER BY started_at DESC
+		LIMIT $2`, source, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := []ingestRun{}
+	for rows.Next() {
+		var r ingestRun
+		if err := rows.Scan(&r.RunID, &r.Source, &r.StartedAt, &r.FinishedAt, &r.DurationMS, &r.Outcome,
+			&r.Fetched, &r.Saved, &r.Created, &r.Updated, &r.Cleared, &r.Errors, &r.Quarantined, &r.PayloadHash, &r.Error); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (s *server) handleListRuns(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	runs, err := listIngestRuns(r.Context(), s.db, r.URL.Query().Get("source"), limit)
+	if err != nil {
+		logFor("admin").Error("Error listing ingest runs", "err", err)
+		http.Error(w, "could not load runs", http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"runs": runs})
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// schemaMigrations bring unified_incidents (and the tables this bot owns) up
+// to date. The unified table is shared with the other ingestors, so every
+// statement must be idempotent and additive.
+var schemaMigrations = []string{
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS time_bucket TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS day_type TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS is_holiday BOOLEAN`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS holiday_name TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS city TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS county_name TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS osm_way_id BIGINT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS road_class TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS speed_limit_mph INTEGER`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS road_match_distance_m DOUBLE PRECISION`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS milepost DOUBLE PRECISION`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS road_normalized TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS exit_number INTEGER`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS exit_suffix TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS county_id INTEGER`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS county_validation TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS city_validation TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS nearest_hospital TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS nearest_hospital_m DOUBLE PRECISION`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS nearest_fire_station TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS nearest_fire_station_m DOUBLE PRECISION`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS school_zone BOOLEAN`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS traffic_speed_mph DOUBLE PRECISION`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS traffic_free_flow_mph DOUBLE PRECISION`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS traffic_speed_ratio DOUBLE PRECISION`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS aqi INTEGER`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS aqi_category TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS aqi_parameter TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS summary TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS raw_event_type TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS event_type_confidence DOUBLE PRECISION`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS light_condition TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS normalized_severity INTEGER`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS risk_score DOUBLE PRECISION`,
+	`CREATE TABLE IF NOT EXISTS geocode_cache (
+		provider   TEXT NOT NULL,
+		lat_key    TEXT NOT NULL,
+		lon_key    TEXT NOT NULL,
+		result     JSONB NOT NULL,
+		fetched_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (provider, lat_key, lon_key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS llm_summary_cache (
+		input_hash TEXT PRIMARY KEY,
+		summary    TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS severity_scales (
+		source              TEXT NOT NULL,
+		source_severity     INTEGER NOT NULL,
+		normalized_severity INTEGER NOT NULL CHECK (normalized_severity BETWEEN 1 AND 5),
+		PRIMARY KEY (source, source_severity)
+	)`,
+	// NCDOT reports 1 (minor) to 3 (major); stretch it over the 1–5 scale.
+	`INSERT INTO severity_scales (source, source_severity, normalized_severity) VALUES
+		('NCDOT', 0, 1), ('NCDOT', 1, 2), ('NCDOT', 2, 3), ('NCDOT', 3, 5)
+		ON CONFLICT DO NOTHING`,
+	`CREATE TABLE IF NOT EXISTS event_type_mappings (
+		source             TEXT NOT NULL,
+		source_event_type  TEXT NOT NULL,
+		unified_event_type TEXT NOT NULL,
+		PRIMARY KEY (source, source_event_type)
+	)`,
+	`INSERT INTO event_type_mappings (source, source_event_type, unified_event_type) VALUES
+		('NCDOT', 'Vehicle Crash', 'Vehicle Crash'),
+		('NCDOT', 'Disabled Vehicle', 'Disabled Vehicle'),
+		('NCDOT', 'Construction', 'Road Construction'),
+		('NCDOT', 'Night Time Construction', 'Road Construction'),
+		('NCDOT', 'Emergency Road Work', 'Road Construction'),
+		('NCDOT', 'Road Obstruction', 'Debris'),
+		('NCDOT', 'Weather Event', 'Weather Event'),
+		('NCDOT', 'Congestion', 'Congestion'),
+		('NCDOT', 'Special Event', 'Special Event'),
+		('NCDOT', 'Vehicle Fire', 'Vehicle Fire'),
+		('NCDOT', 'Other', 'Other')
+		ON CONFLICT DO NOTHING`,
+	`CREATE TABLE IF NOT EXISTS saved_routes (
+		id       SERIAL PRIMARY KEY,
+		name     TEXT NOT NULL UNIQUE,
+		polyline JSONB,
+		roads    TEXT[],
+		buffer_m DOUBLE PRECISION NOT NULL DEFAULT 150,
+		active   BOOLEAN NOT NULL DEFAULT true
+	)`,
+	`CREATE TABLE IF NOT EXISTS incident_route_impacts (
+		source       TEXT NOT NULL,
+		source_id    TEXT NOT NULL,
+		route_id     INTEGER NOT NULL REFERENCES saved_routes (id) ON DELETE CASCADE,
+		impact_score DOUBLE PRECISION NOT NULL,
+		distance_m   DOUBLE PRECISION,
+		position_m   DOUBLE PRECISION,
+		computed_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (source, source_id, route_id)
+	)`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS content_hash TEXT`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS cleared_at TIMESTAMPTZ`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS lanes_closed INTEGER`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS lanes_total INTEGER`,
+	`CREATE TABLE IF NOT EXISTS sink_dead_letters (
+		id          BIGSERIAL PRIMARY KEY,
+		sink        TEXT NOT NULL,
+		source      TEXT NOT NULL,
+		source_id   TEXT NOT NULL,
+		change_type TEXT NOT NULL,
+		payload     JSONB NOT NULL,
+		error       TEXT NOT NULL,
+		attempts    INTEGER NOT NULL,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS notification_messages (
+		sink       TEXT NOT NULL,
+		source     TEXT NOT NULL,
+		source_id  TEXT NOT NULL,
+		channel    TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (sink, source, source_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS sms_sends (
+		number    TEXT NOT NULL,
+		source    TEXT NOT NULL,
+		source_id TEXT NOT NULL,
+		sent_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS sms_sends_number_sent_at ON sms_sends (number, sent_at)`,
+	`CREATE TABLE IF NOT EXISTS notification_rules (
+		name       TEXT PRIMARY KEY,
+		definition JSONB NOT NULL,
+		enabled    BOOLEAN NOT NULL DEFAULT true,
+		priority   INTEGER NOT NULL DEFAULT 100,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS notification_state (
+		sink          TEXT NOT NULL,
+		source        TEXT NOT NULL,
+		source_id     TEXT NOT NULL,
+		last_change   TEXT NOT NULL,
+		last_severity INTEGER NOT NULL,
+		notified_at   TIMESTAMPTZ NOT NULL,
+		notifications INTEGER NOT NULL DEFAULT 1,
+		PRIMARY KEY (sink, source, source_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS subscribers (
+		id          SERIAL PRIMARY KEY,
+		name        TEXT NOT NULL,
+		quiet_start TEXT,
+		quiet_end   TEXT,
+		active      BOOLEAN NOT NULL DEFAULT true,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS subscriber_channels (
+		subscriber_id INTEGER NOT NULL REFERENCES subscribers (id) ON DELETE CASCADE,
+		kind          TEXT NOT NULL CHECK (kind IN ('email', 'sms', 'ntfy', 'pushover')),
+		address       TEXT NOT NULL,
+		verified      BOOLEAN NOT NULL DEFAULT false,
+		PRIMARY KEY (subscriber_id, kind, address)
+	)`,
+	`CREATE TABLE IF NOT EXISTS subscriptions (
+		id            SERIAL PRIMARY KEY,
+		subscriber_id INTEGER NOT NULL REFERENCES subscribers (id) ON DELETE CASCADE,
+		county        TEXT,
+		road          TEXT,
+		min_severity  INTEGER NOT NULL DEFAULT 1
+	)`,
+	`CREATE INDEX IF NOT EXISTS subscriptions_subscriber_id ON subscriptions (subscriber_id)`,
+	`CREATE TABLE IF NOT EXISTS subscriber_sends (
+		subscriber_id INTEGER NOT NULL REFERENCES subscribers (id) ON DELETE CASCADE,
+		kind          TEXT NOT NULL,
+		address       TEXT NOT NULL,
+		source        TEXT NOT NULL,
+		source_id     TEXT NOT NULL,
+		sent_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (subscriber_id, kind, address, source, source_id)
+	)`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS end_time TIMESTAMPTZ`,
+	// Announce changes on unified_incidents_changes, classified the way
+	// saveToUnifiedDB does. NOTIFY is delivered on commit.
+	`CREATE OR REPLACE FUNCTION unified_incidents_notify() RETURNS trigger AS $$
+	DECLARE
+		change TEXT;
+	BEGIN
+		IF TG_OP = 'INSERT' THEN
+			change := 'created';
+		ELSIF coalesce(OLD.status, 'active') = 'active' AND NEW.status = 'cleared' THEN
+			change := 'cleared';
+		ELSIF OLD.status = 'cleared' AND coalesce(NEW.status, 'active') = 'active' THEN
+			change := 'updated';
+		ELSIF OLD.content_hash IS NOT NULL AND OLD.content_hash IS DISTINCT FROM NEW.content_hash THEN
+			change := 'updated';
+		ELSE
+			RETURN NULL;
+		END IF;
+		PERFORM pg_notify('unified_incidents_changes', json_build_object(
+			'source', NEW.source, 'source_id', NEW.source_id, 'change', change)::text);
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql`,
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'unified_incidents_notify'
+				AND tgrelid = 'unified_incidents'::regclass) THEN
+			CREATE TRIGGER unified_incidents_notify AFTER INSERT OR UPDATE ON unified_incidents
+				FOR EACH ROW EXECUTE FUNCTION unified_incidents_notify();
+		END IF;
+	END $$`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		name            TEXT PRIMARY KEY,
+		key_hash        TEXT NOT NULL UNIQUE,
+		scope           TEXT NOT NULL DEFAULT 'read' CHECK (scope IN ('read', 'admin')),
+		rate_per_minute INTEGER NOT NULL DEFAULT 0,
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at    TIMESTAMPTZ,
+		revoked_at      TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS geofences (
+		name       TEXT PRIMARY KEY,
+		geometry   JSONB NOT NULL,
+		enabled    BOOLEAN NOT NULL DEFAULT true,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS ingest_event_types (
+		event_type TEXT PRIMARY KEY,
+		added_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS ingest_runs (
+		id           BIGSERIAL PRIMARY KEY,
+		run_id       TEXT NOT NULL,
+		source       TEXT NOT NULL,
+		started_at   TIMESTAMPTZ NOT NULL,
+		finished_at  TIMESTAMPTZ NOT NULL,
+		duration_ms  BIGINT NOT NULL,
+		outcome      TEXT NOT NULL CHECK (outcome IN ('success', 'error', 'unchanged')),
+		fetched      INTEGER NOT NULL DEFAULT 0,
+		saved        INTEGER NOT NULL DEFAULT 0,
+		created      INTEGER NOT NULL DEFAULT 0,
+		updated      INTEGER NOT NULL DEFAULT 0,
+		cleared      INTEGER NOT NULL DEFAULT 0,
+		errors       INTEGER NOT NULL DEFAULT 0,
+		payload_hash TEXT,
+		error        TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS ingest_runs_source_started ON ingest_runs (source, started_at DESC)`,
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'ingest_runs_outcome_check'
+				AND conrelid = 'ingest_runs'::regclass
+				AND pg_get_constraintdef(oid) LIKE '%unchanged%') THEN
+			ALTER TABLE ingest_runs DROP CONSTRAINT IF EXISTS ingest_runs_outcome_check;
+			ALTER TABLE ingest_runs ADD CONSTRAINT ingest_runs_outcome_check
+				CHECK (outcome IN ('success', 'error', 'unchanged'));
+		END IF;
+	END $$`,
+	`ALTER TABLE ingest_runs ADD COLUMN IF NOT EXISTS quarantined INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS incident_quarantine (
+		id             BIGSERIAL PRIMARY KEY,
+		source         TEXT NOT NULL,
+		source_id      TEXT,
+		stage          TEXT NOT NULL,
+		reason         TEXT NOT NULL,
+		raw            JSONB NOT NULL,
+		run_id         TEXT,
+		quarantined_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS incident_quarantine_at ON incident_quarantine (quarantined_at DESC)`,
+	`CREATE TABLE IF NOT EXISTS feed_state (
+		source        TEXT PRIMARY KEY,
+		etag          TEXT,
+		last_modified TEXT,
+		updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	// Each profile keeps its own validators: one's 304 says nothing about
+	// what another has ingested.
+	`ALTER TABLE feed_state ADD COLUMN IF NOT EXISTS profile TEXT NOT NULL DEFAULT ''`,
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'feed_state_pkey'
+				AND conrelid = 'feed_state'::regclass
+				AND pg_get_constraintdef(oid) LIKE '%profile%') THEN
+			ALTER TABLE feed_state DROP CONSTRAINT IF EXISTS feed_state_pkey;
+			ALTER TABLE feed_state ADD CONSTRAINT feed_state_pkey PRIMARY KEY (source, profile);
+		END IF;
+	END $$`,
+	// Full-text search: roads and type weigh most, then the reason and
+	// location, then the summary.
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', coalesce(road_normalized, '') || ' ' || coalesce(details->'raw_incident'->>'road', '') || ' ' || coalesce(event_type, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce(problem_detail, '') || ' ' || coalesce(address, '')), 'B') ||
+		setweight(to_tsvector('english', coalesce(summary, '')), 'C')
+	) STORED`,
+	`CREATE INDEX IF NOT EXISTS unified_incidents_search_vector ON unified_incidents USING GIN (search_vector)`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS geofences TEXT[]`,
+	`CREATE INDEX IF NOT EXISTS unified_incidents_geofences ON unified_incidents USING GIN (geofences)`,
+	`CREATE TABLE IF NOT EXISTS hotspots (
+		id              BIGSERIAL PRIMARY KEY,
+		latitude        DOUBLE PRECISION NOT NULL,
+		longitude       DOUBLE PRECISION NOT NULL,
+		incident_count  INT NOT NULL,
+		dominant_type   TEXT NOT NULL,
+		county_name     TEXT,
+		road_normalized TEXT,
+		incident_ids    TEXT[] NOT NULL,
+		first_seen_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_seen_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+		ended_at        TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS hotspots_open ON hotspots (id) WHERE ended_at IS NULL`,
+	`CREATE TABLE IF NOT EXISTS incident_baselines (
+		county_name TEXT NOT NULL,
+		dow         INT NOT NULL,
+		hour        INT NOT NULL,
+		mean_count  DOUBLE PRECISION NOT NULL,
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (county_name, dow, hour)
+	)`,
+	`CREATE TABLE IF NOT EXISTS incident_summaries (
+		period                 TEXT NOT NULL CHECK (period IN ('day', 'week')),
+		period_start           DATE NOT NULL,
+		dimension              TEXT NOT NULL,
+		key                    TEXT NOT NULL,
+		incidents              INT NOT NULL,
+		mean_clearance_minutes DOUBLE PRECISION,
+		PRIMARY KEY (period, period_start, dimension, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS summary_reports (
+		period       TEXT NOT NULL,
+		period_start DATE NOT NULL,
+		reported_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (period, period_start)
+	)`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS first_seen_at TIMESTAMPTZ`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS overdue_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS risk_models (
+		id           BIGSERIAL PRIMARY KEY,
+		trained_at   TIMESTAMPTZ NOT NULL,
+		source       TEXT NOT NULL,
+		examples     INT NOT NULL,
+		features     TEXT[] NOT NULL,
+		coefficients DOUBLE PRECISION[]
+	)`,
+	`CREATE TABLE IF NOT EXISTS risk_weather (
+		county_name TEXT NOT NULL,
+		hour        TIMESTAMPTZ NOT NULL,
+		forecast    TEXT NOT NULL,
+		PRIMARY KEY (county_name, hour)
+	)`,
+	`CREATE TABLE IF NOT EXISTS segment_risk (
+		road_normalized TEXT NOT NULL,
+		county_name     TEXT NOT NULL,
+		band            INT NOT NULL,
+		latitude        DOUBLE PRECISION NOT NULL,
+		longitude       DOUBLE PRECISION NOT NULL,
+		hour_start      TIMESTAMPTZ NOT NULL,
+		probability     DOUBLE PRECISION NOT NULL,
+		forecast        TEXT,
+		refreshed_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (road_normalized, county_name, band, hour_start)
+	)`,
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS merged_from TEXT[]`,
+	// The ingest profile that last saw each incident, so a profile only
+	// clears its own (see clearMissingIncidents).
+	`ALTER TABLE unified_incidents ADD COLUMN IF NOT EXISTS profile TEXT`,
+	`CREATE TABLE IF NOT EXISTS incident_merges (
+		source             TEXT NOT NULL,
+		source_id          TEXT NOT NULL,
+		survivor_source    TEXT NOT NULL,
+		survivor_source_id TEXT NOT NULL,
+		merged_by          TEXT NOT NULL,
+		reason             TEXT,
+		snapshot           JSONB NOT NULL,
+		merged_at          TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (source, source_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS duplicate_suggestions (
+		id                BIGSERIAL PRIMARY KEY,
+		source            TEXT NOT NULL,
+		source_id         TEXT NOT NULL,
+		other_source      TEXT NOT NULL,
+		other_source_id   TEXT NOT NULL,
+		distance_m        DOUBLE PRECISION NOT NULL,
+		start_gap_seconds DOUBLE PRECISION NOT NULL,
+		status            TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'merged', 'dismissed')),
+		created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+		resolved_at       TIMESTAMPTZ,
+		UNIQUE (source, source_id, other_source, other_source_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS duplicate_suggestions_pending ON duplicate_suggestions (created_at) WHERE status = 'pending'`,
+	`CREATE TABLE IF NOT EXISTS incident_history (
+		id         BIGSERIAL PRIMARY KEY,
+		source     TEXT NOT NULL,
+		source_id  TEXT NOT NULL,
+		change     TEXT NOT NULL,
+		patch      JSONB,
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS incident_history_incident ON incident_history (source, source_id, changed_at)`,
+	// Changes made by hand (see incidentedit.go) say who made them and why.
+	`ALTER TABLE incident_history ADD COLUMN IF NOT EXISTS changed_by TEXT`,
+	`ALTER TABLE incident_history ADD COLUMN IF NOT EXISTS note TEXT`,
+	// The first ingestors made unified_incidents.timestamp a plain
+	// timestamp holding Eastern wall-clock times; make it timestamptz,
+	// reading those as Eastern (see timefix.go).
+	`DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = 'unified_incidents'
+				AND column_name = 'timestamp' AND data_type = 'timestamp without time zone') THEN
+			ALTER TABLE unified_incidents ALTER COLUMN "timestamp" TYPE TIMESTAMPTZ
+				USING "timestamp" AT TIME ZONE 'America/New_York';
+		END IF;
+	END $$`,
+}
+
+// ensureSchema applies schemaMigrations in order.
+func ensureSchema(db *sql.DB) error {
+	for _, stmt := range schemaMigrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("schema migration failed (%s): %w", stmt, err)
+		}
+	}
+	return nil
+}
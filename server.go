@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// server is the read side: feeds and APIs over unified_incidents for
+// consumers that shouldn't talk to Postgres directly.
+type server struct {
+	cfg *Config
+	db  *sql.DB
+	hub *streamHub
+	// keys resolves and rate-limits API keys.
+	keys *apiKeyStore
+}
+
+func newServer(cfg *Config, db *sql.DB) *server {
+	return &server{cfg: cfg, db: db, hub: newStreamHub(), keys: newAPIKeyStore(cfg, db)}
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /incidents", s.handleIncidents)
+	mux.HandleFunc("GET /incidents/near", s.handleIncidentsNear)
+	mux.HandleFunc("GET /search", s.handleSearch)
+	mux.HandleFunc("GET /incidents/corridor", s.handleCorridor)
+	mux.HandleFunc("POST /incidents/corridor", s.handleCorridor)
+	mux.HandleFunc("GET /incidents/{source}/{id}", s.handleIncident)
+	mux.HandleFunc("GET /incidents/{source}/{id}/history", s.handleIncidentHistory)
+	mux.HandleFunc("GET /stats/summary", s.handleStatsSummary)
+	mux.HandleFunc("GET /stats/location", s.handleLocationHistory)
+	mux.HandleFunc("GET /stats/clearance", s.handleClearanceStats)
+	mux.HandleFunc("GET /stats/corridors", s.handleCorridorStats)
+	mux.HandleFunc("GET /risk", s.handleRisk)
+	graphQL := s.handleGraphQL(s.graphQLSchema())
+	mux.HandleFunc("GET /graphql", graphQL)
+	mux.HandleFunc("POST /graphql", graphQL)
+	mux.HandleFunc("GET /stream", s.handleStream)
+	mux.HandleFunc("GET /ws", s.handleWebSocket)
+	mux.HandleFunc("GET /calendar.ics", s.handleCalendar)
+	mux.HandleFunc("GET /feed.rss", s.handleRSS)
+	mux.HandleFunc("GET /feed.atom", s.handleAtom)
+	mux.HandleFunc("GET /incidents.geojson", s.handleGeoJSON)
+	mux.HandleFunc("GET /open511/events", s.handleOpen511Events)
+	mux.HandleFunc("GET /open511/events/{source}/{id}", s.handleOpen511Event)
+	mux.HandleFunc("GET /wzdx", s.handleWZDx)
+	mux.HandleFunc("GET /tiles/density/{z}/{x}/{y}", s.handleDensityTile)
+	s.adminRoutes(mux)
+	mux.Handle("GET /dashboard/", dashboardHandler())
+	mux.HandleFunc("GET /openapi.json", s.handleOpenAPI)
+	mux.Handle("GET /docs/", apiDocsHandler())
+	mux.Handle("GET /{$}", http.RedirectHandler(s.cfg.APIBasePath+"/dashboard/", http.StatusFound))
+	return s.proxyHeaders(logRequests(s.withBasePath(s.cors(s.authenticate(s.compress(mux))))))
+}
+
+// runServe serves HTTP on HTTP_ADDR (or -addr), and gRPC on GRPC_ADDR (or
+// -grpc-addr) if set, until interrupted.
+func runServe(cfg *Config, db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", cfg.HTTPAddr, "address to listen on")
+	grpcAddr := fs.String("grpc-addr", cfg.GRPCAddr, "address to serve gRPC on, if any")
+	fs.Parse(args)
+
+	s := newServer(cfg, db)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// Standalone, the live streams follow the database's change
+	// notifications.
+	go func() {
+		err := listenIncidentChanges(ctx, cfg, func(change incidentChange) {
+			event, err := loadIncidentEvent(ctx, db, change)
+			if err != nil {
+				logFor("stream").Error("Error loading incident for the stream", "source", change.Source, "incident_id", change.SourceID, "err", err)
+				return
+			}
+			if event != nil {
+				s.hub.broadcast(*event)
+			}
+		})
+		if err != nil {
+			logFor("stream").Error("Live streams won't update", "err", err)
+		}
+	}()
+	if *grpcAddr != "" {
+		go func() {
+			if err := s.serveGRPC(ctx, *grpcAddr); err != nil {
+				log.Fatalf("Error serving gRPC: %s", err)
+			}
+		}()
+	}
+	if err := s.serve(ctx, *addr); err != nil {
+		log.Fatalf("Error serving HTTP: %s", err)
+	}
+}
+
+// serve serves the routes on addr until ctx is done.
+func (s *server) serve(ctx context.Context, addr string) error {
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	s.warnUnplannedIngest(ctx)
+	logFor("api").Info("Serving HTTP", "addr", addr)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
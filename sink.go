@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChangeType says what a run did to an incident's row.
+type ChangeType string
+
+const (
+	ChangeCreated   ChangeType = "created"
+	ChangeUpdated   ChangeType = "updated"
+	ChangeUnchanged ChangeType = "unchanged"
+	ChangeCleared   ChangeType = "cleared"
+)
+
+// Incident statuses in unified_incidents.
+const (
+	StatusActive  = "active"
+	StatusCleared = "cleared"
+)
+
+// IncidentPayload is the JSON form of an incident handed to sinks. It is a
+// stable contract for outside consumers, so fields are only ever added.
+type IncidentPayload struct {
+	Source             string                 `json:"source"`
+	SourceID           string                 `json:"source_id"`
+	EventType          string                 `json:"event_type"`
+	Status             string                 `json:"status"`
+	Address            string                 `json:"address"`
+	City               string                 `json:"city,omitempty"`
+	County             string                 `json:"county,omitempty"`
+	Road               string                 `json:"road,omitempty"`
+	RoadNormalized     string                 `json:"road_normalized,omitempty"`
+	Direction          string                 `json:"direction,omitempty"`
+	Latitude           float64                `json:"latitude"`
+	Longitude          float64                `json:"longitude"`
+	StartTime          time.Time              `json:"start_time"`
+	EndTime            *time.Time             `json:"end_time,omitempty"`
+	ProblemDetail      string                 `json:"problem_detail,omitempty"`
+	Severity           int                    `json:"severity"`
+	NormalizedSeverity int                    `json:"normalized_severity,omitempty"`
+	RiskScore          float64                `json:"risk_score,omitempty"`
+	LanesClosed        int                    `json:"lanes_closed"`
+	LanesTotal         int                    `json:"lanes_total"`
+	SourceUpdated      string                 `json:"source_updated,omitempty"`
+	Summary            string                 `json:"summary,omitempty"`
+	Geofences          []string               `json:"geofences,omitempty"`
+	MergedFrom         []string               `json:"merged_from,omitempty"`
+	Weather            *WeatherData           `json:"weather,omitempty"`
+	Details            map[string]interface{} `json:"details"`
+}
+
+func (u *UnifiedIncident) payload() IncidentPayload {
+	p := IncidentPayload{
+		Source:         u.Source,
+		SourceID:       u.SourceID,
+		EventType:      u.EventType,
+		Status:         StatusActive,
+		Address:        u.Address,
+		City:           u.City,
+		County:         u.CountyName,
+		Road:           u.Road,
+		RoadNormalized: u.RoadNormalized,
+		Direction:      u.Direction,
+		Latitude:       u.Latitude,
+		Longitude:      u.Longitude,
+		StartTime:      u.Timestamp,
+		ProblemDetail:  u.ProblemDetail,
+		Severity:       u.Severity,
+		LanesClosed:    u.LanesClosed,
+		LanesTotal:     u.LanesTotal,
+		SourceUpdated:  u.SourceUpdated,
+		Summary:        u.Summary,
+		Geofences:      u.Geofences,
+		Weather:        u.Weather,
+		Details:        u.details(),
+	}
+	if !u.EndTime.IsZero() {
+		end := u.EndTime
+		p.EndTime = &end
+	}
+	if u.Risk != nil {
+		p.NormalizedSeverity = u.Risk.NormalizedSeverity
+		p.RiskScore = u.Risk.Score
+	}
+	return p
+}
+
+// IncidentEvent is one change to an incident, as delivered to sinks.
+type IncidentEvent struct {
+	// ID is the same each time this version of the incident is published
+	// (see eventid.go).
+	ID         string          `json:"id"`
+	Change     ChangeType      `json:"change"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Incident   IncidentPayload `json:"incident"`
+	// Reopened marks the update that brings a cleared incident back.
+	Reopened bool `json:"reopened,omitempty"`
+	// ChangedBy is who made a change by hand (see incidentedit.go).
+	ChangedBy string `json:"changed_by,omitempty"`
+	// Rule and Message are set when a routing rule selected the event for
+	// a sink; Message is the rule's rendered template, if it has one.
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Patch is the JSON Patch from the previous details to these, on an
+	// update (see jsonpatch.go).
+	Patch []jsonPatchOp `json:"patch,omitempty"`
+}
+
+func newIncidentEvent(change ChangeType, incident *UnifiedIncident) IncidentEvent {
+	event := IncidentEvent{Change: change, OccurredAt: time.Now().UTC(), Incident: incident.payload(), Patch: incident.DetailsPatch,
+		Reopened: change == ChangeUpdated && incident.Reopened}
+	if change == ChangeCleared {
+		event.Incident.Status = StatusCleared
+	}
+	event.ID = eventID(event)
+	return event
+}
+
+var topicUnsafe = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// topicSegment turns a value into a single safe MQTT topic level or NATS
+// subject token: "Vehicle Crash" becomes "vehicle-crash".
+func topicSegment(s string) string {
+	s = strings.Trim(topicUnsafe.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// expandTopic fills the {source}, {source_id}, {county}, {event_type} and
+// {change} placeholders of a topic or subject template.
+func expandTopic(template string, event IncidentEvent) string {
+	p := event.Incident
+	return strings.NewReplacer(
+		"{source}", topicSegment(p.Source),
+		"{source_id}", topicSegment(p.SourceID),
+		"{county}", topicSegment(p.County),
+		"{event_type}", topicSegment(p.EventType),
+		"{change}", topicSegment(string(event.Change)),
+	).Replace(template)
+}
+
+// Sink delivers incident events somewhere outside the database. Publish is
+// retried by the dispatcher, so a sink should return a permanentError for
+// failures that retrying can't fix.
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, event IncidentEvent) error
+}
+
+// permanentError marks a delivery failure that shouldn't be retried, such
+// as the receiver rejecting the request outright.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// buildSinks assembles the configured sinks. mqtt is nil unless MQTT is
+// configured.
+func buildSinks(cfg *Config, db *sql.DB, mqtt *mqttClient) ([]Sink, error) {
+	var sinks []Sink
+	maps := newMapImager(cfg)
+	for _, url := range cfg.WebhookURLs {
+		sinks = append(sinks, newWebhookSink(url, cfg.WebhookSecret))
+	}
+	if cfg.SlackBotToken != "" {
+		rules, err := loadNotifyRules(cfg.SlackRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, newSlackSink(db, cfg.SlackBotToken, cfg.SlackChannel, rules, cfg.StaticMapURL))
+	}
+	var discordRoutes []DiscordRoute
+	if cfg.DiscordWebhookURL != "" {
+		discordRoutes = append(discordRoutes, DiscordRoute{NotifyRule: NotifyRule{Name: "default"}, WebhookURL: cfg.DiscordWebhookURL})
+	}
+	if cfg.DiscordRoutesFile != "" {
+		routes, err := loadDiscordRoutes(cfg.DiscordRoutesFile)
+		if err != nil {
+			return nil, err
+		}
+		discordRoutes = append(discordRoutes, routes...)
+	}
+	for _, r := range discordRoutes {
+		sinks = append(sinks, newDiscordSink(db, r, cfg.StaticMapURL, maps))
+	}
+	if cfg.KafkaRESTURL != "" {
+		sinks = append(sinks, newKafkaSink(cfg.KafkaRESTURL, cfg.KafkaTopic))
+	}
+	if cfg.OpenSearchURL != "" {
+		sinks = append(sinks, newOpenSearchSink(cfg))
+	}
+	if cfg.ClickHouseURL != "" {
+		sinks = append(sinks, newClickHouseSink(cfg))
+	}
+	if cfg.BigQueryProject != "" && cfg.BigQueryDataset != "" {
+		s, err := newBigQuerySink(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up BigQuery: %w", err)
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.InfluxURL != "" || cfg.RemoteWriteURL != "" {
+		sinks = append(sinks, newTimeSeriesPusher(cfg, db))
+	}
+	if cfg.GrafanaURL != "" {
+		rules, err := loadNotifyRules(cfg.GrafanaRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, newGrafanaSink(cfg, rules))
+	}
+	if cfg.NATSURL != "" {
+		client, err := newNATSClient(cfg.NATSURL, "ncdot-ingester")
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, &natsSink{client: client, subject: cfg.NATSSubject, stream: cfg.NATSStream})
+	}
+	if cfg.TwilioAccountSID != "" && cfg.SMSRecipientsFile != "" {
+		recipients, err := loadSMSRecipients(cfg.SMSRecipientsFile)
+		if err != nil {
+			return nil, err
+		}
+		rules, err := loadNotifyRules(cfg.SMSRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, newSMSSink(db, cfg, recipients, rules))
+	}
+	if cfg.PushTargetsFile != "" {
+		targets, err := loadPushTargets(cfg.PushTargetsFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range targets {
+			if t.Service == "pushover" && cfg.PushoverAppToken == "" {
+				return nil, fmt.Errorf("PUSHOVER_APP_TOKEN must be set for Pushover target %q", t.Name)
+			}
+			sinks = append(sinks, newPushSink(t, cfg.PushoverAppToken))
+		}
+	}
+	if cfg.SubscriptionsEnabled {
+		sinks = append(sinks, newSubscriberSink(db, cfg, maps))
+	}
+	if cfg.MastodonInstance != "" || cfg.BlueskyHandle != "" {
+		rules, err := loadNotifyRules(cfg.SocialRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{Timeout: 30 * time.Second}
+		if cfg.MastodonInstance != "" {
+			poster := &mastodonPoster{instance: cfg.MastodonInstance, token: cfg.MastodonToken, client: client}
+			s, err := newSocialSink("mastodon", db, poster, cfg, rules, maps)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		}
+		if cfg.BlueskyHandle != "" {
+			poster := &blueskyPoster{service: cfg.BlueskyService, identifier: cfg.BlueskyHandle, password: cfg.BlueskyAppPassword, client: client}
+			s, err := newSocialSink("bluesky", db, poster, cfg, rules, maps)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, s)
+		}
+	}
+	if cfg.CAPURL != "" || cfg.CAPDir != "" {
+		sinks = append(sinks, newCAPSink(db, cfg))
+	}
+	if mqtt != nil {
+		sinks = append(sinks, newMQTTSink(mqtt, cfg.MQTTTopic, cfg.MQTTQoS))
+	}
+	return sinks, nil
+}
+
+// sinkDispatcher fans events out to every sink. Each sink gets its own
+// queue and goroutine so a slow or failing receiver never holds up the
+// ingest or the other sinks; when a queue is full, further events wait in
+// order in the sink's spill. Deliveries that still fail after maxAttempts
+// are written to sink_dead_letters. Alerting sinks are throttled first.
+type sinkDispatcher struct {
+	db          *sql.DB
+	router      *notifyRouter
+	throttle    *notifyThrottle
+	maxAttempts int
+	backoff     time.Duration
+
+	sinks   []Sink
+	queues  []chan IncidentEvent
+	wg      sync.WaitGroup
+	pending sync.WaitGroup
+
+	spillMu sync.Mutex
+	spill   [][]IncidentEvent
+
+	mu         sync.Mutex
+	delivered  int
+	suppressed int
+	failed     int
+}
+
+func newSinkDispatcher(db *sql.DB, sinks []Sink, router *notifyRouter, throttle *notifyThrottle, maxAttempts int, backoff time.Duration) *sinkDispatcher {
+	d := &sinkDispatcher{db: db, router: router, throttle: throttle, maxAttempts: max(1, maxAttempts), backoff: backoff, sinks: sinks,
+		spill: make([][]IncidentEvent, len(sinks))}
+	for i, s := range sinks {
+		q := make(chan IncidentEvent, 256)
+		d.queues = append(d.queues, q)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for event := range q {
+				d.refill(i)
+				d.deliver(s, event)
+				d.pending.Done()
+			}
+		}()
+	}
+	return d
+}
+
+// Publish queues an event for every sink the routing rules send it to.
+func (d *sinkDispatcher) Publish(event IncidentEvent) {
+	if event.ID == "" {
+		event.ID = eventID(event)
+	}
+	for i := range d.queues {
+		if routed, ok := d.router.route(d.sinks[i].Name(), event); ok {
+			d.pending.Add(1)
+			d.enqueue(i, routed)
+		}
+	}
+}
+
+// enqueue hands an event to sink i's worker without holding up the
+// publisher: if the queue is full, or events are already waiting, it joins
+// the end of the sink's spill.
+func (d *sinkDispatcher) enqueue(i int, event IncidentEvent) {
+	d.spillMu.Lock()
+	defer d.spillMu.Unlock()
+	if len(d.spill[i]) == 0 {
+		select {
+		case d.queues[i] <- event:
+			return
+		default:
+			logFor("sinks").Warn("Sink queue full; holding events until it catches up", "sink", d.sinks[i].Name())
+		}
+	}
+	d.spill[i] = append(d.spill[i], event)
+}
+
+// refill moves sink i's spilled events into its queue while there's room.
+// The worker calls it each time it takes an event, so the spill drains as
+// the queue does.
+func (d *sinkDispatcher) refill(i int) {
+	d.spillMu.Lock()
+	defer d.spillMu.Unlock()
+	for len(d.spill[i]) > 0 {
+		select {
+		case d.queues[i] <- d.spill[i][0]:
+			d.spill[i][0] = IncidentEvent{}
+			d.spill[i] = d.spill[i][1:]
+		default:
+			return
+		}
+	}
+}
+
+// queueDepths is how many events are waiting for each sink.
+func (d *sinkDispatcher) queueDepths() map[string]int {
+	d.spillMu.Lock()
+	defer d.spillMu.Unlock()
+	depths := make(map[string]int, len(d.sinks))
+	for i, s := range d.sinks {
+		depths[s.Name()] = len(d.queues[i]) + len(d.spill[i])
+	}
+	return depths
+}
+
+// setRouter replaces the routing rules. Only call it between runs, from
+// the goroutine that publishes.
+func (d *sinkDispatcher) setRouter(router *notifyRouter) {
+	d.router = router
+}
+
+// Flush waits for everything published so far to be delivered (or
+// dead-lettered), leaving the dispatcher open for the next run.
+func (d *sinkDispatcher) Flush() {
+	d.pending.Wait()
+}
+
+// Close waits for queued events to be delivered (or dead-lettered), then
+// closes any sinks holding connections open.
+func (d *sinkDispatcher) Close() {
+	// The spills drain through the queues, so they must be empty before
+	// the queues close.
+	d.pending.Wait()
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+	for _, s := range d.sinks {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				logFor("sinks").Warn("Error closing sink", "sink", s.Name(), "err", err)
+			}
+		}
+	}
+}
+
+func (d *sinkDispatcher) deliver(s Sink, event IncidentEvent) {
+	_, throttled := s.(alerter)
+	throttled = throttled && d.throttle != nil
+	if throttled {
+		send, err := d.throttle.allow(s.Name(), event)
+		if err != nil {
+			// Better a repeat alert than a missed one.
+			logFor("sinks").Warn("Throttle check failed", "sink", s.Name(), "err", err)
+		} else if !send {
+			d.mu.Lock()
+			d.suppressed++
+			d.mu.Unlock()
+			metricSinkDeliveries.inc(s.Name(), "suppressed")
+			return
+		}
+	}
+
+	wait := d.backoff
+	var err error
+	attempts := 0
+	for attempts < d.maxAttempts {
+		attempts++
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = s.Publish(ctx, event)
+		cancel()
+		if err == nil {
+			d.mu.Lock()
+			d.delivered++
+			d.mu.Unlock()
+			metricSinkDeliveries.inc(s.Name(), "delivered")
+			if throttled {
+				if err := d.throttle.record(s.Name(), event); err != nil {
+					logFor("sinks").Warn("Could not record notification", "sink", s.Name(), "err", err)
+				}
+			}
+			return
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || attempts == d.maxAttempts {
+			break
+		}
+		// Exponential backoff with jitter, capped at a minute.
+		time.Sleep(wait/2 + rand.N(wait/2+1))
+		wait = min(2*wait, time.Minute)
+	}
+
+	logFor("sinks").Warn("Delivery failed", "sink", s.Name(), "source", event.Incident.Source,
+		"incident_id", event.Incident.SourceID, "attempts", attempts, "err", err)
+	d.mu.Lock()
+	d.failed++
+	d.mu.Unlock()
+	metricSinkDeliveries.inc(s.Name(), "failed")
+	if err := recordDeadLetter(d.db, s.Name(), event, attempts, err); err != nil {
+		logFor("sinks").Error("Error recording dead letter", "sink", s.Name(), "err", err)
+	}
+}
+
+// Report summarizes the deliveries since the last report.
+func (d *sinkDispatcher) Report() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivered, suppressed, failed := d.delivered, d.suppressed, d.failed
+	d.delivered, d.suppressed, d.failed = 0, 0, 0
+	if delivered == 0 && suppressed == 0 && failed == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d delivered, %d suppressed, %d dead-lettered", delivered, suppressed, failed)
+}
+
+func recordDeadLetter(db *sql.DB, sink string, event IncidentEvent, attempts int, cause error) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO sink_dead_letters (sink, source, source_id, change_type, payload, error, attempts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		sink, event.Incident.Source, event.Incident.SourceID, string(event.Change), payload, cause.Error(), attempts)
+	return err
+}
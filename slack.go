@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// slackSink posts incidents matching its rules to a Slack channel through
+// the Web API (a bot token is needed rather than an incoming webhook, since
+// only chat.postMessage returns the timestamp that threads hang off).
+// Updates and clearances are posted as replies in the incident's thread.
+type slackSink struct {
+	db           *sql.DB
+	token        string
+	channel      string
+	rules        NotifyRules
+	staticMapURL string
+	apiURL       string
+	client       *http.Client
+}
+
+func newSlackSink(db *sql.DB, token, channel string, rules NotifyRules, staticMapURL string) *slackSink {
+	return &slackSink{
+		db:           db,
+		token:        token,
+		channel:      channel,
+		rules:        rules,
+		staticMapURL: staticMapURL,
+		apiURL:       "https://slack.com/api/chat.postMessage",
+		client:       &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *slackSink) Name() string { return "slack" }
+func (s *slackSink) alerts()      {}
+
+func (s *slackSink) Publish(ctx context.Context, event IncidentEvent) error {
+	p := event.Incident
+	thread, err := loadNotificationMessage(s.db, s.Name(), p)
+	if err != nil {
+		return err
+	}
+
+	if thread != nil {
+		// Once an incident has been posted, every change to it follows up
+		// in its thread whether or not it still matches.
+		return s.post(ctx, slackMessage{
+			Channel:  thread.Channel,
+			ThreadTS: thread.MessageID,
+			Text:     slackFollowUp(event),
+		})
+	}
+	if event.Change == ChangeCleared {
+		return nil
+	}
+	if !ruleMatches(s.rules, event) {
+		return nil
+	}
+
+	blocks := slackBlocks(p, event.Message)
+	if s.staticMapURL != "" {
+		// Slack fetches block images itself, so only a URL will do here.
+		blocks = append(blocks[:2:2], append([]interface{}{map[string]interface{}{
+			"type":      "image",
+			"image_url": staticMapImageURL(s.staticMapURL, p.Latitude, p.Longitude),
+			"alt_text":  "Map of " + incidentTitle(p),
+		}}, blocks[2:]...)...)
+	}
+	msg := slackMessage{Channel: s.channel, Text: incidentTitle(p), Blocks: blocks}
+	ts, err := s.postWithTS(ctx, msg)
+	if err != nil {
+		return err
+	}
+	return saveNotificationMessage(s.db, s.Name(), p, notificationMessage{Channel: s.channel, MessageID: ts})
+}
+
+type slackMessage struct {
+	Channel  string        `json:"channel"`
+	Text     string        `json:"text"`
+	ThreadTS string        `json:"thread_ts,omitempty"`
+	Blocks   []interface{} `json:"blocks,omitempty"`
+}
+
+func (s *slackSink) post(ctx context.Context, msg slackMessage) error {
+	_, err := s.postWithTS(ctx, msg)
+	return err
+}
+
+func (s *slackSink) postWithTS(ctx context.Context, msg slackMessage) (string, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return "", permanentError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.apiURL, bytes.NewReader(payload))
+	if err != nil {
+		return "", permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("slack request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("slack returned %s", resp.Status)
+	}
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		TS    string `json:"ts"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to unmarshal slack response: %w", err)
+	}
+	if !result.OK {
+		err := fmt.Errorf("slack error: %s", result.Error)
+		if result.Error == "ratelimited" || result.Error == "internal_error" || result.Error == "service_unavailable" {
+			return "", err
+		}
+		return "", permanentError{err}
+	}
+	return result.TS, nil
+}
+
+// slackBlocks lays out an incident; a routing rule's message, if there is
+// one, replaces the description.
+func slackBlocks(p IncidentPayload, message string) []interface{} {
+	field := func(label, value string) map[string]string {
+		return map[string]string{"type": "mrkdwn", "text": "*" + label + "*\n" + slackEscape(value)}
+	}
+	return []interface{}{
+		map[string]interface{}{
+			"type": "header",
+			"text": map[string]string{"type": "plain_text", "text": incidentTitle(p)},
+		},
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": slackEscape(firstNonEmpty(message, incidentDescription(p)))},
+		},
+		map[string]interface{}{
+			"type": "section",
+			"fields": []map[string]string{
+				field("Road", firstNonEmpty(p.RoadNormalized, p.Road, p.Address)),
+				field("Severity", severityLabel(p)),
+				field("Lanes", lanesLabel(p)),
+				field("Weather", weatherLabel(p.Weather)),
+				field("Started", localTimeLabel(p.StartTime)),
+				field("Location", p.Address),
+			},
+		},
+		map[string]interface{}{
+			"type": "actions",
+			"elements": []interface{}{
+				map[string]interface{}{
+					"type": "button",
+					"text": map[string]string{"type": "plain_text", "text": "Open map"},
+					"url":  mapURL(p.Latitude, p.Longitude),
+				},
+			},
+		},
+	}
+}
+
+func slackFollowUp(event IncidentEvent) string {
+	p := event.Incident
+	if event.Change == ChangeCleared {
+		return ":white_check_mark: Cleared at " + localTimeLabel(event.OccurredAt)
+	}
+	return fmt.Sprintf(":arrows_counterclockwise: Updated: %s\nSeverity %s · Lanes %s",
+		slackEscape(incidentDescription(p)), severityLabel(p), lanesLabel(p))
+}
+
+// slackEscape escapes the characters mrkdwn treats as control sequences.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SMSRecipient is a phone number that receives SMS alerts. Messages that
+// would arrive during its quiet hours ("HH:MM", Eastern; the window may
+// wrap midnight) are dropped, and no more than DailyCap are sent per day.
+type SMSRecipient struct {
+	Number     string `json:"number"`
+	QuietStart string `json:"quiet_start,omitempty"`
+	QuietEnd   string `json:"quiet_end,omitempty"`
+	DailyCap   int    `json:"daily_cap,omitempty"`
+}
+
+// defaultSMSRules only texts for the most serious incidents.
+var defaultSMSRules = NotifyRules{
+	{Name: "fatality-level", MinSeverity: 5},
+	{Name: "interstate-closure", Interstate: true, FullClosure: true},
+}
+
+func loadSMSRecipients(path string) ([]SMSRecipient, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read SMS recipients: %w", err)
+	}
+	var recipients []SMSRecipient
+	if err := json.Unmarshal(raw, &recipients); err != nil {
+		return nil, fmt.Errorf("could not parse SMS recipients %s: %w", path, err)
+	}
+	for _, r := range recipients {
+		for _, hhmm := range []string{r.QuietStart, r.QuietEnd} {
+			if _, err := parseClock(hhmm); hhmm != "" && err != nil {
+				return nil, fmt.Errorf("invalid quiet hours for %s: %w", r.Number, err)
+			}
+		}
+	}
+	return recipients, nil
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inQuietHours reports whether t (converted to Eastern) falls between
+// start and end, wrapping past midnight when end is earlier than start.
+func inQuietHours(start, end string, t time.Time) bool {
+	if start == "" || end == "" {
+		return false
+	}
+	s, _ := parseClock(start)
+	e, _ := parseClock(end)
+	local := t.In(easternTime)
+	now := local.Hour()*60 + local.Minute()
+	if s <= e {
+		return now >= s && now < e
+	}
+	return now >= s || now < e
+}
+
+// smsSink texts new incidents matching its rules through Twilio. Each
+// incident is texted to a number at most once; sends are recorded in
+// sms_sends, which is also what the daily caps count.
+type smsSink struct {
+	db         *sql.DB
+	accountSID string
+	authToken  string
+	from       string
+	recipients []SMSRecipient
+	rules      NotifyRules
+	apiURL     string
+	client     *http.Client
+}
+
+func newSMSSink(db *sql.DB, cfg *Config, recipients []SMSRecipient, rules NotifyRules) *smsSink {
+	if len(rules) == 0 {
+		rules = defaultSMSRules
+	}
+	return &smsSink{
+		db:         db,
+		accountSID: cfg.TwilioAccountSID,
+		authToken:  cfg.TwilioAuthToken,
+		from:       cfg.TwilioFrom,
+		recipients: recipients,
+		rules:      rules,
+		apiURL:     "https://api.twilio.com/2010-04-01/Accounts/" + cfg.TwilioAccountSID + "/Messages.json",
+		client:     &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *smsSink) Name() string { return "sms" }
+func (s *smsSink) alerts()      {}
+
+func (s *smsSink) Publish(ctx context.Context, event IncidentEvent) error {
+	p := event.Incident
+	if event.Change == ChangeCleared {
+		return nil
+	}
+	if !ruleMatches(s.rules, event) {
+		return nil
+	}
+
+	body := event.Message
+	if body == "" {
+		body = fmt.Sprintf("%s: %s. Lanes %s. %s", p.Source, incidentTitle(p), lanesLabel(p), mapURL(p.Latitude, p.Longitude))
+	}
+	body = truncate(body, 320)
+	for _, r := range s.recipients {
+		if inQuietHours(r.QuietStart, r.QuietEnd, event.OccurredAt) {
+			continue
+		}
+		send, err := s.shouldSend(r, p)
+		if err != nil {
+			return err
+		}
+		if !send {
+			continue
+		}
+		if err := s.send(ctx, r.Number, body); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(`INSERT INTO sms_sends (number, source, source_id) VALUES ($1, $2, $3)`,
+			r.Number, p.Source, p.SourceID); err != nil {
+			return fmt.Errorf("could not record SMS send: %w", err)
+		}
+	}
+	return nil
+}
+
+// shouldSend checks that the number hasn't had this incident yet and is
+// under its daily cap (counted from Eastern midnight).
+func (s *smsSink) shouldSend(r SMSRecipient, p IncidentPayload) (bool, error) {
+	now := time.Now().In(easternTime)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, easternTime)
+	var already bool
+	var today int
+	err := s.db.QueryRow(`
+		SELECT
+			EXISTS (SELECT 1 FROM sms_sends WHERE number = $1 AND source = $2 AND source_id = $3),
+			(SELECT count(*) FROM sms_sends WHERE number = $1 AND sent_at >= $4)`,
+		r.Number, p.Source, p.SourceID, midnight).Scan(&already, &today)
+	if err != nil {
+		return false, fmt.Errorf("could not check SMS history: %w", err)
+	}
+	return !already && (r.DailyCap <= 0 || today < r.DailyCap), nil
+}
+
+func (s *smsSink) send(ctx context.Context, to, body string) error {
+	form := url.Values{"To": {to}, "From": {s.from}, "Body": {body}}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.apiURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.SetBasicAuth(s.accountSID, s.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("twilio request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	err = fmt.Errorf("twilio returned %s: %s", resp.Status, truncate(string(respBody), 200))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return permanentError{err}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Default social post templates; see notifyTemplateData for the fields.
+const (
+	defaultSocialTemplate        = "🚨 {{.Title}}\n{{.Description}}\nLanes: {{.Lanes}}\n{{.MapURL}}"
+	defaultSocialClearedTemplate = "✅ Cleared: {{.Title}}"
+)
+
+// defaultSocialRules keeps the timeline to major incidents.
+var defaultSocialRules = NotifyRules{{Name: "major", MinSeverity: 4}}
+
+// socialPoster is one social network account.
+type socialPoster interface {
+	// post publishes text with an optional PNG, optionally as a reply to a
+	// post ID it returned earlier, and returns the new post's ID.
+	post(ctx context.Context, text string, image []byte, alt string, replyTo string) (string, error)
+	maxChars() int
+}
+
+// socialSink posts new incidents matching its rules to a social account,
+// with a static map image, and replies to its own post when the incident
+// clears. To keep timelines readable it makes at most maxPerHour new posts
+// an hour; incidents over the limit are skipped rather than queued.
+type socialSink struct {
+	name        string
+	db          *sql.DB
+	poster      socialPoster
+	rules       NotifyRules
+	tmpl        *template.Template
+	clearedTmpl *template.Template
+	maxPerHour  int
+	maps        *mapImager
+}
+
+func newSocialSink(name string, db *sql.DB, poster socialPoster, cfg *Config, rules NotifyRules, maps *mapImager) (*socialSink, error) {
+	if len(rules) == 0 {
+		rules = defaultSocialRules
+	}
+	tmpl, err := template.New("post").Parse(firstNonEmpty(cfg.SocialTemplate, defaultSocialTemplate))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCIAL_TEMPLATE: %w", err)
+	}
+	clearedTmpl, err := template.New("cleared").Parse(firstNonEmpty(cfg.SocialClearedTemplate, defaultSocialClearedTemplate))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOCIAL_CLEARED_TEMPLATE: %w", err)
+	}
+	return &socialSink{
+		name:        name,
+		db:          db,
+		poster:      poster,
+		rules:       rules,
+		tmpl:        tmpl,
+		clearedTmpl: clearedTmpl,
+		maxPerHour:  cfg.SocialMaxPerHour,
+		maps:        maps,
+	}, nil
+}
+
+func (s *socialSink) Name() string { return s.name }
+func (s *socialSink) alerts()      {}
+
+func (s *socialSink) Publish(ctx context.Context, event IncidentEvent) error {
+	p := event.Incident
+	data := newNotifyTemplateData(event)
+
+	if event.Change == ChangeCleared {
+		original, err := loadNotificationMessage(s.db, s.Name(), p)
+		if err != nil || original == nil {
+			return err
+		}
+		text, err := s.render(s.clearedTmpl, data)
+		if err != nil {
+			return permanentError{err}
+		}
+		_, err = s.poster.post(ctx, text, nil, "", original.MessageID)
+		return err
+	}
+
+	if event.Change != ChangeCreated {
+		return nil
+	}
+	if !ruleMatches(s.rules, event) {
+		return nil
+	}
+	var recent int
+	if err := s.db.QueryRow(`
+		SELECT count(*) FROM notification_messages
+		WHERE sink = $1 AND created_at > now() - interval '1 hour'`, s.Name()).Scan(&recent); err != nil {
+		return fmt.Errorf("could not check post rate: %w", err)
+	}
+	if s.maxPerHour > 0 && recent >= s.maxPerHour {
+		logFor("sinks").Info("Hourly post limit reached, skipping", "sink", s.Name(), "source", p.Source, "incident_id", p.SourceID)
+		return nil
+	}
+
+	text := truncate(event.Message, s.poster.maxChars())
+	if text == "" {
+		var err error
+		if text, err = s.render(s.tmpl, data); err != nil {
+			return permanentError{err}
+		}
+	}
+	image, err := s.maps.Image(ctx, p)
+	if err != nil {
+		// Post without the map rather than not at all.
+		logFor("sinks").Warn("Could not fetch map image", "sink", s.Name(), "err", err)
+	}
+	id, err := s.poster.post(ctx, text, image, "Map of "+data.Title+". "+mapAttribution, "")
+	if err != nil {
+		return err
+	}
+	return saveNotificationMessage(s.db, s.Name(), p, notificationMessage{Channel: s.Name(), MessageID: id})
+}
+
+func (s *socialSink) render(tmpl *template.Template, data notifyTemplateData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return truncate(strings.TrimSpace(b.String()), s.poster.maxChars()), nil
+}
+
+// socialHTTPError classifies an API failure for the dispatcher's retries.
+func socialHTTPError(service string, resp *http.Response, body []byte) error {
+	err := fmt.Errorf("%s returned %s: %s", service, resp.Status, truncate(string(body), 200))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return permanentError{err}
+}
+
+// mastodonPoster posts statuses to a Mastodon account with an access
+// token that has the write:statuses and write:media scopes.
+type mastodonPoster struct {
+	instance string
+	token    string
+	client   *http.Client
+}
+
+func (m *mastodonPoster) maxChars() int { return 500 }
+
+func (m *mastodonPoster) post(ctx context.Context, text string, image []byte, alt string, replyTo string) (string, error) {
+	form := url.Values{"status": {text}, "visibility": {"public"}}
+	if replyTo != "" {
+		form.Set("in_reply_to_id", replyTo)
+	}
+	if len(image) > 0 {
+		mediaID, err := m.uploadMedia(ctx, image, alt)
+		if err != nil {
+			logFor("sinks").Warn("Media upload failed", "sink", "mastodon", "err", err)
+		} else {
+			form.Add("media_ids[]", mediaID)
+		}
+	}
+
+	var status struct {
+		ID string `json:"id"`
+	}
+	if err := m.do(ctx, "/api/v1/statuses", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), &status); err != nil {
+		return "", err
+	}
+	return status.ID, nil
+}
+
+func (m *mastodonPoster) uploadMedia(ctx context.Context, image []byte, alt string) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("description", alt)
+	part, err := w.CreateFormFile("file", "map.png")
+	if err != nil {
+		return "", err
+	}
+	part.Write(image)
+	w.Close()
+
+	var media struct {
+		ID string `json:"id"`
+	}
+	if err := m.do(ctx, "/api/v2/media", w.FormDataContentType(), &body, &media); err != nil {
+		return "", err
+	}
+	return media.ID, nil
+}
+
+func (m *mastodonPoster) do(ctx context.Context, path, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(m.instance, "/")+path, body)
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Content-Type", contentType)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("mastodon request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// Media uploads answer 202 while the server processes the file.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return socialHTTPError("mastodon", resp, respBody)
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to unmarshal mastodon response: %w", err)
+	}
+	return nil
+}
+
+// blueskyPoster posts to a Bluesky account using an app password. Post IDs
+// are "uri|cid", which is what a reply needs to reference its parent.
+type blueskyPoster struct {
+	service    string
+	identifier string
+	password   string
+	client     *http.Client
+
+	mu      sync.Mutex
+	did     string
+	jwt     string
+	expires time.Time
+}
+
+func (b *blueskyPoster) maxChars() int { return 300 }
+
+type blueskyRef struct {
+	URI string `json:"uri"`
+	CID string `json:"cid"`
+}
+
+func (b *blueskyPoster) post(ctx context.Context, text string, image []byte, alt string, replyTo string) (string, error) {
+	if err := b.login(ctx); err != nil {
+		return "", err
+	}
+	record := map[string]interface{}{
+		"$type":     "app.bsky.feed.post",
+		"text":      text,
+		"createdAt": time.Now().UTC().Format(time.RFC3339),
+	}
+	if facets := blueskyLinkFacets(text); len(facets) > 0 {
+		record["facets"] = facets
+	}
+	if replyTo != "" {
+		if uri, cid, ok := strings.Cut(replyTo, "|"); ok {
+			parent := blueskyRef{URI: uri, CID: cid}
+			record["reply"] = map[string]blueskyRef{"root": parent, "parent": parent}
+		}
+	}
+	if len(image) > 0 {
+		var uploaded struct {
+			Blob json.RawMessage `json:"blob"`
+		}
+		if err := b.xrpc(ctx, "com.atproto.repo.uploadBlob", "image/png", image, &uploaded); err != nil {
+			logFor("sinks").Warn("Image upload failed", "sink", "bluesky", "err", err)
+		} else {
+			record["embed"] = map[string]interface{}{
+				"$type":  "app.bsky.embed.images",
+				"images": []map[string]interface{}{{"alt": alt, "image": uploaded.Blob}},
+			}
+		}
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"repo":       b.did,
+		"collection": "app.bsky.feed.post",
+		"record":     record,
+	})
+	if err != nil {
+		return "", permanentError{err}
+	}
+	var created blueskyRef
+	if err := b.xrpc(ctx, "com.atproto.repo.createRecord", "application/json", payload, &created); err != nil {
+		return "", err
+	}
+	return created.URI + "|" + created.CID, nil
+}
+
+// login creates a session, reusing it while it's fresh (access tokens
+// last a couple of hours).
+func (b *blueskyPoster) login(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.jwt != "" && time.Now().Before(b.expires) {
+		return nil
+	}
+	payload, _ := json.Marshal(map[string]string{"identifier": b.identifier, "password": b.password})
+	var session struct {
+		DID       string `json:"did"`
+		AccessJWT string `json:"accessJwt"`
+	}
+	b.jwt = ""
+	if err := b.xrpc(ctx, "com.atproto.server.createSession", "application/json", payload, &session); err != nil {
+		return err
+	}
+	b.did, b.jwt, b.expires = session.DID, session.AccessJWT, time.Now().Add(90*time.Minute)
+	return nil
+}
+
+func (b *blueskyPoster) xrpc(ctx context.Context, method, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(b.service, "/")+"/xrpc/"+method, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	if b.jwt != "" {
+		req.Header.Set("Authorization", "Bearer "+b.jwt)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("bluesky request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return socialHTTPError("bluesky", resp, respBody)
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to unmarshal bluesky response: %w", err)
+	}
+	return nil
+}
+
+// blueskyLinkFacets marks up the URLs in text; Bluesky doesn't linkify
+// plain text on its own. Offsets are in UTF-8 bytes.
+func blueskyLinkFacets(text string) []map[string]interface{} {
+	var facets []map[string]interface{}
+	offset := 0
+	for _, word := range strings.Fields(text) {
+		start := offset + strings.Index(text[offset:], word)
+		offset = start + len(word)
+		if !strings.HasPrefix(word, "https://") && !strings.HasPrefix(word, "http://") {
+			continue
+		}
+		facets = append(facets, map[string]interface{}{
+			"index": map[string]int{"byteStart": start, "byteEnd": offset},
+			"features": []map[string]string{
+				{"$type": "app.bsky.richtext.facet#link", "uri": word},
+			},
+		})
+	}
+	return facets
+}
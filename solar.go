@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// solarElevation returns the sun's elevation in degrees above the horizon
+// at p and t, using the NOAA low-accuracy solar position equations (good to
+// a fraction of a degree, plenty for day/night decisions).
+func solarElevation(p LatLon, t time.Time) float64 {
+	t = t.UTC()
+	const rad = math.Pi / 180
+
+	dayOfYear := float64(t.YearDay())
+	hour := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	gamma := 2 * math.Pi / 365 * (dayOfYear - 1 + (hour-12)/24)
+
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(gamma) - 0.032077*math.Sin(gamma) -
+		0.014615*math.Cos(2*gamma) - 0.040849*math.Sin(2*gamma))
+	decl := 0.006918 - 0.399912*math.Cos(gamma) + 0.070257*math.Sin(gamma) -
+		0.006758*math.Cos(2*gamma) + 0.000907*math.Sin(2*gamma) -
+		0.002697*math.Cos(3*gamma) + 0.00148*math.Sin(3*gamma)
+
+	trueSolarMinutes := hour*60 + eqTime + 4*p.Lon
+	hourAngle := (trueSolarMinutes/4 - 180) * rad
+
+	lat := p.Lat * rad
+	cosZenith := math.Sin(lat)*math.Sin(decl) + math.Cos(lat)*math.Cos(decl)*math.Cos(hourAngle)
+	return 90 - math.Acos(math.Max(-1, math.Min(1, cosZenith)))/rad
+}
+
+// Light conditions, following the crash-report categories.
+const (
+	LightDaylight = "daylight"
+	LightDusk     = "dusk_dawn"
+	LightDark     = "dark"
+)
+
+// lightCondition classifies the sun's elevation: civil twilight (sun less
+// than 6° below the horizon) counts as dusk/dawn.
+func lightCondition(elevation float64) string {
+	switch {
+	case elevation > -0.833:
+		return LightDaylight
+	case elevation > -6:
+		return LightDusk
+	default:
+		return LightDark
+	}
+}
+
+// darknessEnricher records whether the incident started in daylight,
+// twilight, or darkness.
+type darknessEnricher struct{}
+
+func (darknessEnricher) Name() string { return "darkness" }
+
+func (darknessEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	elevation := solarElevation(LatLon{Lat: incident.Latitude, Lon: incident.Longitude}, incident.Timestamp)
+	incident.LightCondition = lightCondition(elevation)
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Regional deployments can narrow ingest to the counties and routes they
+// cover, and to the incidents that matter operationally, per source, with
+// INGEST_FILTERS_FILE:
+//
+//	{"NCDOT": {"counties": ["Wake", "Durham", "92"], "exclude_routes": ["SR-*"],
+//	           "thresholds": {"Disabled Vehicle": {"min_lanes_closed": 1}}},
+//	 "*": {"routes": ["I-40", "US-70*"], "thresholds": {"*": {"min_severity": 1}}}}
+//
+// Counties are names or county IDs. Routes are route IDs, or patterns
+// matched against the normalized road name ("I-40", "US-70 BUS"), with *
+// and ? as in a glob. Thresholds are by the source's event type, with "*"
+// for the rest; the one above drops disabled vehicles on the shoulder. The
+// "*" entry is for sources without their own. Incidents filtered out are
+// dropped before enrichment, so they cost no NWS or geocoding calls, and
+// count as gone from the feed: one whose lanes reopen is cleared.
+
+// sourceFilter is one source's county and route lists and thresholds.
+// Empty allow lists allow everything.
+type sourceFilter struct {
+	Counties        []string             `json:"counties"`
+	ExcludeCounties []string             `json:"exclude_counties"`
+	Routes          []string             `json:"routes"`
+	ExcludeRoutes   []string             `json:"exclude_routes"`
+	Thresholds      map[string]threshold `json:"thresholds"`
+}
+
+// threshold is the least an incident of a type must have to be ingested.
+type threshold struct {
+	MinSeverity    int `json:"min_severity"`
+	MinLanesClosed int `json:"min_lanes_closed"`
+}
+
+// thresholdFor finds eventType's threshold, case-insensitively, or the
+// "*" one.
+func (f sourceFilter) thresholdFor(eventType string) threshold {
+	for t, th := range f.Thresholds {
+		if strings.EqualFold(t, eventType) {
+			return th
+		}
+	}
+	return f.Thresholds["*"]
+}
+
+// readSourceFilter reads source's entry, or the "*" one, from
+// INGEST_FILTERS_FILE.
+func readSourceFilter(file, source string) (sourceFilter, error) {
+	if file == "" {
+		return sourceFilter{}, nil
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return sourceFilter{}, fmt.Errorf("could not read ingest filters: %w", err)
+	}
+	var filters map[string]sourceFilter
+	if err := json.Unmarshal(raw, &filters); err != nil {
+		return sourceFilter{}, fmt.Errorf("could not parse ingest filters %s: %w", file, err)
+	}
+	f, ok := filters[source]
+	if !ok {
+		f = filters["*"]
+	}
+	for _, list := range [][]string{f.Routes, f.ExcludeRoutes} {
+		for i, p := range list {
+			if _, err := strconv.Atoi(p); err == nil {
+				continue
+			}
+			if _, err := path.Match(p, ""); err != nil {
+				return sourceFilter{}, fmt.Errorf("%s: invalid route pattern %q", file, p)
+			}
+			// Write plain names the way the enricher will.
+			if !strings.ContainsAny(p, "*?[") {
+				if name := normalizeRouteName(p); name != "" {
+					p = name
+				}
+			}
+			list[i] = strings.ToUpper(p)
+		}
+	}
+	return f, nil
+}
+
+func (f sourceFilter) allows(incident Incident) bool {
+	th := f.thresholdFor(incident.IncidentType)
+	if incident.Severity < th.MinSeverity || incident.LanesClosed < th.MinLanesClosed {
+		return false
+	}
+	if len(f.Counties) > 0 && !matchesCounty(f.Counties, incident) {
+		return false
+	}
+	if matchesCounty(f.ExcludeCounties, incident) {
+		return false
+	}
+	if len(f.Routes) == 0 && len(f.ExcludeRoutes) == 0 {
+		return true
+	}
+	road := incidentRouteName(incident)
+	if len(f.Routes) > 0 && !matchesRoute(f.Routes, incident.RouteID, road) {
+		return false
+	}
+	return !matchesRoute(f.ExcludeRoutes, incident.RouteID, road)
+}
+
+func matchesCounty(list []string, incident Incident) bool {
+	for _, c := range list {
+		if id, err := strconv.Atoi(c); err == nil {
+			if id == incident.CountyID {
+				return true
+			}
+		} else if strings.EqualFold(strings.TrimSuffix(strings.TrimSpace(c), " County"), incident.CountyName) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesRoute(list []string, routeID int, road string) bool {
+	for _, p := range list {
+		if id, err := strconv.Atoi(p); err == nil {
+			if id == routeID {
+				return true
+			}
+		} else if ok, _ := path.Match(p, road); ok && road != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// incidentRouteName is the normalized road name the road-name enricher
+// would give the record.
+func incidentRouteName(incident Incident) string {
+	for _, t := range []string{incident.Road, incident.CommonName, incident.Location} {
+		if name := normalizeRouteName(t); name != "" {
+			return name
+		}
+	}
+	return ""
+}
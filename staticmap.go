@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mapAttribution must accompany any image rendered from OpenStreetMap
+// tiles.
+const mapAttribution = "Map © OpenStreetMap contributors"
+
+// staticMapRenderer draws small PNG maps from slippy-map tiles: the
+// incident as a marker, and for full closures with a detour, the detour
+// route in blue and the closed stretch (between the detour's ends) in red.
+// Tiles are cached in memory, since successive incidents tend to share
+// them.
+type staticMapRenderer struct {
+	tileURL       string
+	width, height int
+	maxZoom       int
+	client        *http.Client
+
+	mu    sync.Mutex
+	tiles map[string]image.Image
+}
+
+const staticMapTileCacheSize = 512
+
+func newStaticMapRenderer(tileURL string) *staticMapRenderer {
+	return &staticMapRenderer{
+		tileURL: tileURL,
+		width:   600,
+		height:  300,
+		maxZoom: 15,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		tiles:   make(map[string]image.Image),
+	}
+}
+
+// mercatorPixel converts a coordinate to global pixel space at zoom z.
+func mercatorPixel(p LatLon, z int) (float64, float64) {
+	scale := 256 * math.Exp2(float64(z))
+	lat := p.Lat * math.Pi / 180
+	x := (p.Lon + 180) / 360 * scale
+	y := (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * scale
+	return x, y
+}
+
+// Render draws the map for an incident.
+func (r *staticMapRenderer) Render(ctx context.Context, p IncidentPayload) ([]byte, error) {
+	center := LatLon{Lat: p.Latitude, Lon: p.Longitude}
+	var detour []LatLon
+	if d, ok := p.Details["detour"].(*Detour); ok && d != nil {
+		for _, c := range d.Geometry {
+			if len(c) >= 2 {
+				detour = append(detour, LatLon{Lat: c[1], Lon: c[0]})
+			}
+		}
+	}
+
+	// Zoom out until the detour fits with some margin.
+	zoom := r.maxZoom
+	for ; zoom > 8 && len(detour) > 0; zoom-- {
+		cx, cy := mercatorPixel(center, zoom)
+		fits := true
+		for _, pt := range detour {
+			x, y := mercatorPixel(pt, zoom)
+			if math.Abs(x-cx) > float64(r.width)/2-20 || math.Abs(y-cy) > float64(r.height)/2-20 {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			break
+		}
+	}
+
+	cx, cy := mercatorPixel(center, zoom)
+	left, top := cx-float64(r.width)/2, cy-float64(r.height)/2
+	img := image.NewRGBA(image.Rect(0, 0, r.width, r.height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0xe5, 0xe3, 0xdf, 0xff}), image.Point{}, draw.Src)
+
+	n := 1 << zoom
+	for ty := int(math.Floor(top / 256)); ty <= int(math.Floor((top+float64(r.height))/256)); ty++ {
+		if ty < 0 || ty >= n {
+			continue
+		}
+		for tx := int(math.Floor(left / 256)); tx <= int(math.Floor((left+float64(r.width))/256)); tx++ {
+			tile, err := r.tile(ctx, zoom, (tx%n+n)%n, ty)
+			if err != nil {
+				return nil, err
+			}
+			at := image.Pt(int(math.Round(float64(tx*256)-left)), int(math.Round(float64(ty*256)-top)))
+			draw.Draw(img, image.Rectangle{Min: at, Max: at.Add(image.Pt(256, 256))}, tile, tile.Bounds().Min, draw.Over)
+		}
+	}
+
+	toImage := func(pt LatLon) (float64, float64) {
+		x, y := mercatorPixel(pt, zoom)
+		return x - left, y - top
+	}
+	if len(detour) > 1 {
+		blue := color.RGBA{0x1f, 0x6f, 0xeb, 0xff}
+		for i := 1; i < len(detour); i++ {
+			x0, y0 := toImage(detour[i-1])
+			x1, y1 := toImage(detour[i])
+			drawThickLine(img, x0, y0, x1, y1, 2, blue)
+		}
+		x0, y0 := toImage(detour[0])
+		x1, y1 := toImage(detour[len(detour)-1])
+		drawThickLine(img, x0, y0, x1, y1, 3, color.RGBA{0xd0, 0x21, 0x21, 0xff})
+	}
+	mx, my := toImage(center)
+	fillCircle(img, mx, my, 9, color.White)
+	fillCircle(img, mx, my, 7, color.RGBA{0xd0, 0x21, 0x21, 0xff})
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (r *staticMapRenderer) tile(ctx context.Context, z, x, y int) (image.Image, error) {
+	url := strings.NewReplacer("{z}", strconv.Itoa(z), "{x}", strconv.Itoa(x), "{y}", strconv.Itoa(y)).Replace(r.tileURL)
+	r.mu.Lock()
+	cached, ok := r.tiles[url]
+	r.mu.Unlock()
+	if ok {
+		metricCacheLookups.inc("map-tiles", "hit")
+		return cached, nil
+	}
+	metricCacheLookups.inc("map-tiles", "miss")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The OSM tile policy requires an identifying User-Agent.
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("tile request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tile server returned %s for %d/%d/%d", resp.Status, z, x, y)
+	}
+	tile, _, err := image.Decode(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode tile %d/%d/%d: %w", z, x, y, err)
+	}
+
+	r.mu.Lock()
+	if len(r.tiles) >= staticMapTileCacheSize {
+		r.tiles = make(map[string]image.Image)
+	}
+	r.tiles[url] = tile
+	r.mu.Unlock()
+	return tile, nil
+}
+
+func fillCircle(img *image.RGBA, cx, cy, radius float64, c color.Color) {
+	for y := int(cy - radius); y <= int(cy+radius); y++ {
+		for x := int(cx - radius); x <= int(cx+radius); x++ {
+			if math.Hypot(float64(x)-cx, float64(y)-cy) <= radius {
+				img.Set(x, y, c)
+			}
+		}
+	}
+}
+
+// drawThickLine stamps discs along the segment; plenty for a few route
+// lines on a small image.
+func drawThickLine(img *image.RGBA, x0, y0, x1, y1, width float64, c color.Color) {
+	steps := int(math.Max(1, math.Hypot(x1-x0, y1-y0)))
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		fillCircle(img, x0+t*(x1-x0), y0+t*(y1-y0), width, c)
+	}
+}
+
+// mapImager produces the map image for a notification: rendered locally
+// when MAP_TILE_URL is set, otherwise fetched from the STATIC_MAP_URL
+// service. It returns nil when neither is configured.
+type mapImager struct {
+	renderer   *staticMapRenderer
+	serviceURL string
+	client     *http.Client
+}
+
+func newMapImager(cfg *Config) *mapImager {
+	m := &mapImager{serviceURL: cfg.StaticMapURL, client: &http.Client{Timeout: 15 * time.Second}}
+	if cfg.MapTileURL != "" {
+		m.renderer = newStaticMapRenderer(cfg.MapTileURL)
+	}
+	return m
+}
+
+func (m *mapImager) Image(ctx context.Context, p IncidentPayload) ([]byte, error) {
+	if m == nil {
+		return nil, nil
+	}
+	if m.renderer != nil {
+		return m.renderer.Render(ctx, p)
+	}
+	if m.serviceURL == "" {
+		return nil, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", staticMapImageURL(m.serviceURL, p.Latitude, p.Longitude), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("static map returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 5<<20))
+}
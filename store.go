@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// column pairs a unified_incidents column with the value to write to it.
+// Columns marked immutable are set on insert only; the rest are refreshed
+// on every upsert.
+type column struct {
+	name      string
+	value     interface{}
+	immutable bool
+}
+
+// columns lists the unified_incidents values for an incident.
+// NCDOT doesn't have "jurisdiction", so we omit that column.
+func (u *UnifiedIncident) columns() ([]column, error) {
+	detailsJSON, err := json.Marshal(u.details())
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal unified details to JSON: %w", err)
+	}
+
+	var weatherTemp sql.NullInt32
+	var weatherWind, weatherForecast sql.NullString
+	if u.Weather != nil {
+		weatherTemp = sql.NullInt32{Int32: int32(u.Weather.Temperature), Valid: true}
+		weatherWind = nullString(u.Weather.WindSpeed)
+		weatherForecast = nullString(u.Weather.ShortForecast)
+	}
+
+	cols := []column{
+		{name: "source", value: u.Source, immutable: true},
+		{name: "source_id", value: u.SourceID, immutable: true},
+		// A mapped type follows event_type_mappings as it changes.
+		{name: "event_type", value: u.EventType, immutable: !u.EventTypeMapped},
+		{name: "status", value: StatusActive},
+		{name: "cleared_at", value: nil},
+		{name: "address", value: u.Address, immutable: true},
+		{name: "latitude", value: u.Latitude, immutable: true},
+		{name: "longitude", value: u.Longitude, immutable: true},
+		// Both columns are timestamptz (see timefix.go).
+		{name: "timestamp", value: u.Timestamp.UTC(), immutable: true},
+		{name: "first_seen_at", value: time.Now().UTC(), immutable: true},
+		{name: "end_time", value: sql.NullTime{Time: u.EndTime.UTC(), Valid: !u.EndTime.IsZero()}},
+		{name: "details", value: detailsJSON},
+		{name: "problem_detail", value: u.ProblemDetail},
+		{name: "lanes_closed", value: u.LanesClosed},
+		{name: "lanes_total", value: u.LanesTotal},
+		{name: "city", value: nullString(u.City)},
+		{name: "county_name", value: nullString(u.CountyName)},
+		{name: "county_id", value: sql.NullInt32{Int32: int32(u.CountyID), Valid: u.CountyID > 0}},
+		{name: "weather_temp", value: weatherTemp},
+		{name: "weather_wind_speed", value: weatherWind},
+		{name: "weather_forecast", value: weatherForecast},
+		{name: "time_bucket", value: nullString(u.Period.TimeBucket)},
+		{name: "day_type", value: nullString(u.Period.DayType)},
+		{name: "is_holiday", value: u.Period.IsHoliday},
+		{name: "holiday_name", value: nullString(u.Period.HolidayName)},
+	}
+
+	var wayID sql.NullInt64
+	var roadClass sql.NullString
+	var speedLimit sql.NullInt32
+	var matchDistance sql.NullFloat64
+	if u.RoadMatch != nil {
+		wayID = sql.NullInt64{Int64: u.RoadMatch.WayID, Valid: true}
+		roadClass = nullString(u.RoadMatch.RoadClass)
+		speedLimit = sql.NullInt32{Int32: int32(u.RoadMatch.SpeedLimitMPH), Valid: u.RoadMatch.SpeedLimitMPH > 0}
+		matchDistance = sql.NullFloat64{Float64: u.RoadMatch.DistanceMeters, Valid: true}
+	}
+	cols = append(cols,
+		column{name: "osm_way_id", value: wayID},
+		column{name: "road_class", value: roadClass},
+		column{name: "speed_limit_mph", value: speedLimit},
+		column{name: "road_match_distance_m", value: matchDistance},
+	)
+
+	var milepost sql.NullFloat64
+	if u.Milepost != nil {
+		milepost = sql.NullFloat64{Float64: u.Milepost.Milepost, Valid: true}
+	}
+	cols = append(cols, column{name: "milepost", value: milepost})
+
+	cols = append(cols,
+		column{name: "road_normalized", value: nullString(u.RoadNormalized)},
+		column{name: "exit_number", value: sql.NullInt32{Int32: int32(u.ExitNumber), Valid: u.ExitNumber > 0}},
+		column{name: "exit_suffix", value: nullString(u.ExitSuffix)},
+	)
+
+	var countyValidation, cityValidation sql.NullString
+	if u.LocationValidation != nil {
+		countyValidation = nullString(u.LocationValidation.County)
+		cityValidation = nullString(u.LocationValidation.City)
+	}
+	cols = append(cols,
+		column{name: "county_validation", value: countyValidation},
+		column{name: "city_validation", value: cityValidation},
+	)
+
+	var hospital, fireStation sql.NullString
+	var hospitalDist, fireStationDist sql.NullFloat64
+	var schoolZone sql.NullBool
+	if p := u.Proximity; p != nil {
+		if p.Hospital != nil {
+			hospital = nullString(p.Hospital.Name)
+			hospitalDist = sql.NullFloat64{Float64: p.Hospital.DistanceMeters, Valid: true}
+		}
+		if p.FireStation != nil {
+			fireStation = nullString(p.FireStation.Name)
+			fireStationDist = sql.NullFloat64{Float64: p.FireStation.DistanceMeters, Valid: true}
+		}
+		if p.School != nil {
+			schoolZone = sql.NullBool{Bool: p.SchoolZone, Valid: true}
+		}
+	}
+	cols = append(cols,
+		column{name: "nearest_hospital", value: hospital},
+		column{name: "nearest_hospital_m", value: hospitalDist},
+		column{name: "nearest_fire_station", value: fireStation},
+		column{name: "nearest_fire_station_m", value: fireStationDist},
+		column{name: "school_zone", value: schoolZone},
+	)
+
+	var currentSpeed, freeFlowSpeed, speedRatio sql.NullFloat64
+	if f := u.TrafficFlow; f != nil {
+		currentSpeed = sql.NullFloat64{Float64: f.CurrentSpeedMPH, Valid: true}
+		freeFlowSpeed = sql.NullFloat64{Float64: f.FreeFlowMPH, Valid: true}
+		speedRatio = sql.NullFloat64{Float64: f.SpeedRatio, Valid: f.FreeFlowMPH > 0}
+	}
+	cols = append(cols,
+		column{name: "traffic_speed_mph", value: currentSpeed},
+		column{name: "traffic_free_flow_mph", value: freeFlowSpeed},
+		column{name: "traffic_speed_ratio", value: speedRatio},
+	)
+
+	var aqi sql.NullInt32
+	var aqiCategory, aqiParameter sql.NullString
+	if a := u.AirQuality; a != nil {
+		aqi = sql.NullInt32{Int32: int32(a.AQI), Valid: true}
+		aqiCategory = nullString(a.Category)
+		aqiParameter = nullString(a.Parameter)
+	}
+	cols = append(cols,
+		column{name: "aqi", value: aqi},
+		column{name: "aqi_category", value: aqiCategory},
+		column{name: "aqi_parameter", value: aqiParameter},
+	)
+
+	cols = append(cols, column{name: "summary", value: nullString(u.Summary)})
+	cols = append(cols, column{name: "geofences", value: pq.Array(u.Geofences)})
+	cols = append(cols, column{name: "profile", value: nullString(u.Profile)})
+
+	var normalizedSeverity sql.NullInt32
+	var riskScore sql.NullFloat64
+	if u.Risk != nil {
+		normalizedSeverity = sql.NullInt32{Int32: int32(u.Risk.NormalizedSeverity), Valid: true}
+		riskScore = sql.NullFloat64{Float64: u.Risk.Score, Valid: true}
+	}
+	cols = append(cols,
+		column{name: "light_condition", value: nullString(u.LightCondition)},
+		column{name: "normalized_severity", value: normalizedSeverity},
+		column{name: "risk_score", value: riskScore},
+	)
+
+	var confidence sql.NullFloat64
+	if u.Classification != nil {
+		confidence = sql.NullFloat64{Float64: u.Classification.Confidence, Valid: true}
+	}
+	cols = append(cols,
+		column{name: "raw_event_type", value: nullString(u.RawEventType)},
+		column{name: "event_type_confidence", value: confidence},
+	)
+
+	hash, err := u.contentHash()
+	if err != nil {
+		return nil, err
+	}
+	cols = append(cols, column{name: "content_hash", value: hash})
+
+	return cols, nil
+}
+
+// contentHash fingerprints the source record, so a run can tell an update
+// from the feed apart from the same incident seen again. Enrichment output
+// (weather in particular) is left out: it changes between runs on its own.
+func (u *UnifiedIncident) contentHash() (string, error) {
+	raw, err := json.Marshal(u.Raw)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal raw incident: %w", err)
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// details builds the JSON blob stored in unified_incidents.details.
+func (u *UnifiedIncident) details() map[string]interface{} {
+	details := map[string]interface{}{
+		"raw_incident": u.Raw,
+		"weather":      u.Weather,
+	}
+	if u.Geocode != nil {
+		details["geocode"] = u.Geocode
+	}
+	if u.RoadMatch != nil {
+		details["road_match"] = u.RoadMatch
+	}
+	if u.Milepost != nil {
+		details["milepost"] = u.Milepost
+	}
+	if u.LocationValidation != nil {
+		details["location_validation"] = u.LocationValidation
+	}
+	if u.Proximity != nil {
+		details["proximity"] = u.Proximity
+	}
+	if u.Detour != nil {
+		details["detour"] = u.Detour
+	}
+	if u.TrafficFlow != nil {
+		details["traffic_flow"] = u.TrafficFlow
+	}
+	if u.Risk != nil {
+		details["risk"] = u.Risk
+	}
+	if u.Classification != nil {
+		details["classification"] = u.Classification
+	}
+	if u.AirQuality != nil {
+		details["air_quality"] = u.AirQuality
+	}
+	if u.Redaction != nil {
+		return u.Redaction.apply(details)
+	}
+	return details
+}
+
+// upsertStatements holds the statements saveToUnifiedDB prepares, for the
+// length of one run, so each is parsed and planned once rather than once
+// per incident. They are keyed by their SQL: the upsert's text only
+// changes if the column list does.
+type upsertStatements struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newUpsertStatements(db *sql.DB) *upsertStatements {
+	return &upsertStatements{db: db, stmts: map[string]*sql.Stmt{}}
+}
+
+// in returns query prepared and bound to tx. database/sql keeps the
+// statement prepared on each connection it has been used on.
+func (s *upsertStatements) in(tx *sql.Tx, query string) (*sql.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stmt, ok := s.stmts[query]
+	if !ok {
+		var err error
+		if stmt, err = s.db.Prepare(query); err != nil {
+			return nil, err
+		}
+		s.stmts[query] = stmt
+	}
+	return tx.Stmt(stmt), nil
+}
+
+// Close releases the prepared statements.
+func (s *upsertStatements) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for query, stmt := range s.stmts {
+		stmt.Close()
+		delete(s.stmts, query)
+	}
+	return nil
+}
+
+const insertHistorySQL = `INSERT INTO incident_history (source, source_id, change, patch) VALUES ($1, $2, $3, $4)`
+
+// activeContentHashes maps each of the source's active incidents to its
+// stored content hash. It is read at the start of every run rather than
+// kept between runs, since the admin API and other processes change rows
+// too.
+func activeContentHashes(ctx context.Context, db *sql.DB, source string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT source_id, content_hash FROM unified_incidents
+		WHERE source = $1 AND status = 'active' AND content_hash IS NOT NULL`, source)
+	if err != nil {
+		return nil, fmt.Errorf("could not load content hashes: %w", err)
+	}
+	defer rows.Close()
+	hashes := map[string]string{}
+	for rows.Next() {
+		var id, hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = hash
+	}
+	return hashes, rows.Err()
+}
+
+// saveConflictAttempts is how many times saveWithRetry tries an upsert
+// that keeps failing on a serialization failure or deadlock.
+const saveConflictAttempts = 4
+
+// saveWithRetry is saveToUnifiedDB, retried after a short, growing pause
+// when concurrent writers conflict. Any other error is returned at once.
+func saveWithRetry(ctx context.Context, db *sql.DB, stmts *upsertStatements, incident *UnifiedIncident) (ChangeType, error) {
+	wait := 50 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		change, err := saveToUnifiedDB(db, stmts, incident)
+		if err == nil || !writeConflict(err) || attempt >= saveConflictAttempts {
+			return change, err
+		}
+		logFor("store").Debug("Retrying conflicting upsert", "source", incident.Source, "incident_id", incident.SourceID, "attempt", attempt, "err", err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(wait/2 + rand.N(wait/2+1)):
+		}
+		wait *= 2
+	}
+}
+
+// writeConflict reports whether err is a Postgres serialization failure
+// or deadlock, which succeed when tried again.
+func writeConflict(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
+
+// saveToUnifiedDB upserts a normalized, enriched incident into the unified
+// table and reports whether the source record is new, changed, or the same
+// as last time.
+func saveToUnifiedDB(db *sql.DB, stmts *upsertStatements, incident *UnifiedIncident) (ChangeType, error) {
+	delayDBWrite()
+	cols, err := incident.columns()
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, len(cols))
+	placeholders := make([]string, len(cols))
+	args := make([]interface{}, len(cols))
+	var updates []string
+	var hashPlaceholder string
+	var newDetails []byte
+	for i, c := range cols {
+		names[i] = c.name
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = c.value
+		if !c.immutable {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", c.name, c.name))
+		}
+		switch c.name {
+		case "content_hash":
+			hashPlaceholder = placeholders[i]
+		case "details":
+			newDetails = c.value.([]byte)
+		}
+	}
+
+	// prev sees the row as it was before the upsert, giving us the old
+	// hash and status to compare against, and the old details when the
+	// record changed. $1 and $2 are source and source_id.
+	sqlStatement := fmt.Sprintf(`
+		WITH prev AS (
+			SELECT content_hash, status, details FROM unified_incidents WHERE source = $1 AND source_id = $2
+		)
+		INSERT INTO unified_incidents (%s)
+		VALUES (%s)
+		ON CONFLICT (source, source_id) DO UPDATE SET %s
+		RETURNING EXISTS (SELECT 1 FROM prev), (SELECT content_hash FROM prev), (SELECT status FROM prev),
+			(SELECT details FROM prev WHERE content_hash IS DISTINCT FROM %s OR status = 'cleared');`,
+		strings.Join(names, ", "), strings.Join(placeholders, ", "), strings.Join(updates, ", "), hashPlaceholder)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var existed bool
+	var prevHash, prevStatus sql.NullString
+	var prevDetails []byte
+	upsert, err := stmts.in(tx, sqlStatement)
+	if err != nil {
+		return "", fmt.Errorf("could not prepare upsert: %w", err)
+	}
+	if err := upsert.QueryRow(args...).Scan(&existed, &prevHash, &prevStatus, &prevDetails); err != nil {
+		return "", err
+	}
+	if incident.RouteImpacts != nil {
+		if err := saveRouteImpacts(tx, incident); err != nil {
+			return "", err
+		}
+	}
+
+	hash, _ := incident.contentHash()
+	// Rows saved before hashes were recorded have none; treat the first
+	// sighting since then as the baseline rather than a change. A cleared
+	// incident coming back counts as an update.
+	change := ChangeUnchanged
+	switch {
+	case !existed:
+		change = ChangeCreated
+	case prevStatus.String == StatusCleared:
+		change = ChangeUpdated
+	case prevHash.Valid && prevHash.String != hash:
+		change = ChangeUpdated
+	}
+	incident.DetailsPatch = nil
+	incident.Reopened = existed && prevStatus.String == StatusCleared
+	if change == ChangeUpdated && prevDetails != nil {
+		var before, after interface{}
+		if json.Unmarshal(prevDetails, &before) == nil && json.Unmarshal(newDetails, &after) == nil {
+			incident.DetailsPatch = diffJSON(before, after)
+		}
+	}
+	if change != ChangeUnchanged {
+		var patch interface{}
+		if incident.DetailsPatch != nil {
+			if patch, err = json.Marshal(incident.DetailsPatch); err != nil {
+				return "", err
+			}
+		}
+		insertHistory, err := stmts.in(tx, insertHistorySQL)
+		if err != nil {
+			return "", fmt.Errorf("could not prepare history insert: %w", err)
+		}
+		if _, err := insertHistory.Exec(incident.Source, incident.SourceID, string(change), patch); err != nil {
+			return "", fmt.Errorf("could not record history: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return change, nil
+}
+
+// clearMissingIncidents marks the source's active incidents that weren't in
+// this run's feed as cleared and returns them, with enough of their last
+// state for notification rules to match on. Under a profile, only the
+// incidents that profile last saw (or that none has) are candidates:
+// profiles sharing a table each see only their part of the feed.
+func clearMissingIncidents(db *sql.DB, source, profile string, seen []string) ([]UnifiedIncident, error) {
+	rows, err := db.Query(`
+		WITH cleared AS (
+			UPDATE unified_incidents SET status = 'cleared', cleared_at = now()
+			WHERE source = $1 AND status = 'active' AND NOT (source_id = ANY(coalesce($2::text[], '{}')))
+				AND ($3 = '' OR profile = $3 OR profile IS NULL)
+			RETURNING *
+		), history AS (
+			INSERT INTO incident_history (source, source_id, change)
+			SELECT source, source_id, 'cleared' FROM cleared
+		)
+		SELECT source_id, event_type, address, latitude, longitude, timestamp,
+			coalesce(problem_detail, ''), coalesce(city, ''), coalesce(county_name, ''),
+			coalesce(road_normalized, ''), coalesce(summary, ''),
+			coalesce(normalized_severity, 0), coalesce(risk_score, 0),
+			coalesce(lanes_closed, 0), coalesce(lanes_total, 0),
+			coalesce(details->'raw_incident'->>'lastUpdate', '')
+		FROM cleared`,
+		source, pq.Array(seen), profile)
+	if err != nil {
+		return nil, fmt.Errorf("could not clear missing incidents: %w", err)
+	}
+	defer rows.Close()
+
+	var cleared []UnifiedIncident
+	for rows.Next() {
+		u := UnifiedIncident{Source: source, Risk: &RiskScore{}}
+		if err := rows.Scan(&u.SourceID, &u.EventType, &u.Address, &u.Latitude, &u.Longitude, &u.Timestamp,
+			&u.ProblemDetail, &u.City, &u.CountyName, &u.RoadNormalized, &u.Summary,
+			&u.Risk.NormalizedSeverity, &u.Risk.Score, &u.LanesClosed, &u.LanesTotal, &u.SourceUpdated); err != nil {
+			return nil, err
+		}
+		cleared = append(cleared, u)
+	}
+	return cleared, rows.Err()
+}
+
+// nullString maps "" to SQL NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
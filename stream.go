@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Live incident changes for the dashboard map: GET /stream (Server-Sent
+// Events) and GET /ws (WebSocket), each optionally narrowed with ?county=,
+// ?road= and ?event_type=. Both are fed by a streamHub, which is a sink of
+// the ingest loop when serve runs inside it (ingest -http), and otherwise
+// follows the database's change notifications.
+
+const (
+	streamBuffer    = 64
+	streamHeartbeat = 30 * time.Second
+	wsMaxFrame      = 64 << 10
+	wsGUID          = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// streamHub fans incident events out to the connected stream clients. A
+// client that falls a buffer behind is disconnected rather than allowed to
+// hold up the others.
+type streamHub struct {
+	mu      sync.Mutex
+	clients map[chan IncidentEvent]struct{}
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{clients: map[chan IncidentEvent]struct{}{}}
+}
+
+func (h *streamHub) Name() string { return "stream" }
+
+func (h *streamHub) Publish(ctx context.Context, event IncidentEvent) error {
+	h.broadcast(event)
+	return nil
+}
+
+func (h *streamHub) broadcast(event IncidentEvent) {
+	// Clients get the typed fields; the details are a lookup away.
+	event.Incident.Details = nil
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- event:
+		default:
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a client. Its channel is closed when it is
+// unsubscribed or falls behind.
+func (h *streamHub) subscribe() (<-chan IncidentEvent, func()) {
+	ch := make(chan IncidentEvent, streamBuffer)
+	h.mu.Lock()
+	h.clients[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.clients[ch]; ok {
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// streamFilter is the subset of the incident filters a stream can apply
+// to each event as it arrives.
+type streamFilter struct {
+	county, road, eventType string
+}
+
+func parseStreamFilter(r *http.Request) streamFilter {
+	q := r.URL.Query()
+	return streamFilter{county: q.Get("county"), road: q.Get("road"), eventType: firstNonEmpty(q.Get("event_type"), q.Get("type"))}
+}
+
+func (f streamFilter) matches(p IncidentPayload) bool {
+	return (f.county == "" || strings.EqualFold(f.county, p.County)) &&
+		(f.road == "" || strings.EqualFold(f.road, p.RoadNormalized)) &&
+		(f.eventType == "" || strings.EqualFold(f.eventType, p.EventType))
+}
+
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	filter := parseStreamFilter(r)
+	events, unsubscribe := s.hub.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if !filter.matches(event.Incident) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logFor("stream").Error("Error encoding stream event", "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %s-%s-%d\nevent: %s\ndata: %s\n\n",
+				strings.ToLower(event.Incident.Source), event.Incident.SourceID, event.OccurredAt.UnixMilli(), event.Change, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// handleWebSocket speaks just enough RFC 6455 to push text frames: it
+// answers pings and closes, and ignores anything else the client sends.
+func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websockets unsupported", http.StatusInternalServerError)
+		return
+	}
+	filter := parseStreamFilter(r)
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logFor("stream").Error("Error upgrading to WebSocket", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	ws := &wsConn{conn: conn, w: rw.Writer}
+	events, unsubscribe := s.hub.subscribe()
+	defer unsubscribe()
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		ws.readLoop(rw.Reader)
+	}()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			if err := ws.writeFrame(0x9, nil); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				ws.writeFrame(0x8, []byte{0x03, 0xF0}) // 1008: fell behind
+				return
+			}
+			if !filter.matches(event.Incident) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logFor("stream").Error("Error encoding stream event", "err", err)
+				continue
+			}
+			if err := ws.writeFrame(0x1, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type wsConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	w    *bufio.Writer
+}
+
+// writeFrame writes one unmasked, unfragmented frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.w.Write(header)
+	c.w.Write(payload)
+	return c.w.Flush()
+}
+
+// readLoop reads client frames until the connection closes or the client
+// sends a close frame.
+func (c *wsConn) readLoop(r *bufio.Reader) {
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return
+		}
+		opcode := head[0] & 0x0F
+		n := uint64(head[1] & 0x7F)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > wsMaxFrame {
+			c.writeFrame(0x8, []byte{0x03, 0xF1}) // 1009: too big
+			return
+		}
+		var mask [4]byte
+		if head[1]&0x80 != 0 {
+			if _, err := io.ReadFull(r, mask[:]); err != nil {
+				return
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case 0x8:
+			c.writeFrame(0x8, payload)
+			return
+		case 0x9:
+			if c.writeFrame(0xA, payload) != nil {
+				return
+			}
+		}
+	}
+}
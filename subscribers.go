@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"time"
+)
+
+// Subscription channel kinds, as stored in subscriber_channels.kind.
+const (
+	channelEmail    = "email"
+	channelSMS      = "sms"
+	channelNtfy     = "ntfy"
+	channelPushover = "pushover"
+)
+
+// subscriberSink fans incidents out to the residents who have signed up
+// for them. The tables are meant to be managed by a sign-up website:
+//
+//   - subscribers: one row per person, with optional quiet hours
+//     ("HH:MM", Eastern) and an active flag;
+//   - subscriber_channels: where to reach them (email, sms, ntfy topic or
+//     Pushover user key); only verified channels are used;
+//   - subscriptions: counties and/or roads of interest, each with a
+//     minimum normalized severity. A NULL county or road matches any.
+//
+// Each incident goes to a channel at most once, recorded in
+// subscriber_sends. Updates are considered too, so an incident that
+// escalates into someone's minimum severity still reaches them.
+type subscriberSink struct {
+	db            *sql.DB
+	cfg           *Config
+	sms           *smsSink
+	pushoverToken string
+	maps          *mapImager
+}
+
+func newSubscriberSink(db *sql.DB, cfg *Config, maps *mapImager) *subscriberSink {
+	s := &subscriberSink{db: db, cfg: cfg, pushoverToken: cfg.PushoverAppToken, maps: maps}
+	if cfg.TwilioAccountSID != "" {
+		s.sms = newSMSSink(db, cfg, nil, nil)
+	}
+	return s
+}
+
+func (s *subscriberSink) Name() string { return "subscribers" }
+func (s *subscriberSink) alerts()      {}
+
+type subscriberChannel struct {
+	SubscriberID int
+	Name         string
+	QuietStart   string
+	QuietEnd     string
+	Kind         string
+	Address      string
+}
+
+func (s *subscriberSink) Publish(ctx context.Context, event IncidentEvent) error {
+	if event.Change == ChangeCleared {
+		return nil
+	}
+	channels, err := s.matchingChannels(event.Incident)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, c := range channels {
+		if inQuietHours(c.QuietStart, c.QuietEnd, event.OccurredAt) {
+			continue
+		}
+		sent, err := s.send(ctx, c, event)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subscriber %d %s: %w", c.SubscriberID, c.Kind, err))
+			continue
+		}
+		if !sent {
+			continue
+		}
+		if _, err := s.db.Exec(`
+			INSERT INTO subscriber_sends (subscriber_id, kind, address, source, source_id)
+			VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+			c.SubscriberID, c.Kind, c.Address, event.Incident.Source, event.Incident.SourceID); err != nil {
+			return fmt.Errorf("could not record subscriber send: %w", err)
+		}
+	}
+	// Whatever did go out is recorded, so a retry only repeats the
+	// failures.
+	return errors.Join(errs...)
+}
+
+// matchingChannels returns the verified channels of active subscribers
+// with a subscription covering the incident that haven't had it yet.
+func (s *subscriberSink) matchingChannels(p IncidentPayload) ([]subscriberChannel, error) {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT s.id, s.name, coalesce(s.quiet_start, ''), coalesce(s.quiet_end, ''), c.kind, c.address
+		FROM subscriptions sub
+		JOIN subscribers s ON s.id = sub.subscriber_id AND s.active
+		JOIN subscriber_channels c ON c.subscriber_id = s.id AND c.verified
+		WHERE (sub.county IS NULL OR lower(sub.county) = lower($1))
+			AND (sub.road IS NULL OR lower(sub.road) = lower($2) OR lower(sub.road) = lower($3))
+			AND sub.min_severity <= $4
+			AND NOT EXISTS (
+				SELECT 1 FROM subscriber_sends ss
+				WHERE ss.subscriber_id = s.id AND ss.kind = c.kind AND ss.address = c.address
+					AND ss.source = $5 AND ss.source_id = $6)`,
+		p.County, p.RoadNormalized, p.Road, p.NormalizedSeverity, p.Source, p.SourceID)
+	if err != nil {
+		return nil, fmt.Errorf("could not match subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var channels []subscriberChannel
+	for rows.Next() {
+		var c subscriberChannel
+		if err := rows.Scan(&c.SubscriberID, &c.Name, &c.QuietStart, &c.QuietEnd, &c.Kind, &c.Address); err != nil {
+			return nil, err
+		}
+		channels = append(channels, c)
+	}
+	return channels, rows.Err()
+}
+
+// send delivers to one channel, returning false if the channel's service
+// isn't configured.
+func (s *subscriberSink) send(ctx context.Context, c subscriberChannel, event IncidentEvent) (bool, error) {
+	p := event.Incident
+	switch c.Kind {
+	case channelSMS:
+		if s.sms == nil {
+			return false, nil
+		}
+		body := firstNonEmpty(event.Message, fmt.Sprintf("%s: %s. Lanes %s. %s", p.Source, incidentTitle(p), lanesLabel(p), mapURL(p.Latitude, p.Longitude)))
+		return true, s.sms.send(ctx, c.Address, truncate(body, 320))
+	case channelNtfy, channelPushover:
+		if c.Kind == channelPushover && s.pushoverToken == "" {
+			return false, nil
+		}
+		target := PushTarget{NotifyRule: NotifyRule{Name: c.Name}, Service: c.Kind, Topic: c.Address, UserKey: c.Address}
+		return true, newPushSink(target, s.pushoverToken).send(ctx, event)
+	case channelEmail:
+		if s.cfg.SMTPHost == "" || s.cfg.SMTPFrom == "" {
+			return false, nil
+		}
+		image, err := s.maps.Image(ctx, p)
+		if err != nil {
+			logFor("sinks").Warn("Subscriber email map failed", "err", err)
+		}
+		return true, sendMail(s.cfg, []string{c.Address}, subscriberEmail(s.cfg.SMTPFrom, c.Address, event, image))
+	default:
+		logFor("sinks").Warn("Subscriber has unknown channel kind", "subscriber", c.SubscriberID, "kind", c.Kind)
+		return false, nil
+	}
+}
+
+// subscriberEmail builds a plain-text alert, with the map image attached
+// when there is one.
+func subscriberEmail(from, to string, event IncidentEvent, image []byte) []byte {
+	p := event.Incident
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "%s\r\n\r\n", firstNonEmpty(event.Message, incidentDescription(p)))
+	fmt.Fprintf(&text, "Lanes: %s\r\nSeverity: %s\r\nStarted: %s\r\nMap: %s\r\n",
+		lanesLabel(p), severityLabel(p), localTimeLabel(p.StartTime), mapURL(p.Latitude, p.Longitude))
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Traffic alert: "+incidentTitle(p)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	if image == nil {
+		msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+		msg.Write(text.Bytes())
+		return msg.Bytes()
+	}
+
+	fmt.Fprintf(&text, "\r\n%s\r\n", mapAttribution)
+	var parts bytes.Buffer
+	w := multipart.NewWriter(&parts)
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+	part, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}})
+	part.Write(text.Bytes())
+	part, _ = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"image/png"},
+		"Content-Disposition":       {`attachment; filename="map.png"`},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	enc := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: part})
+	enc.Write(image)
+	enc.Close()
+	w.Close()
+	msg.Write(parts.Bytes())
+	return msg.Bytes()
+}
+
+// lineWrapper breaks base64 output into the 76-column lines mail expects.
+type lineWrapper struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if l.col == 76 {
+			if _, err := l.w.Write([]byte("\r\n")); err != nil {
+				return 0, err
+			}
+			l.col = 0
+		}
+		if _, err := l.w.Write([]byte{b}); err != nil {
+			return 0, err
+		}
+		l.col++
+	}
+	return len(p), nil
+}
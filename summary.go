@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const summarySystemPrompt = `You write one-sentence traffic alerts for North Carolina drivers.
+Use only the facts given. Mention the road, direction, lanes affected, nearby exit or cross street,
+the cause, and notable weather if present. No more than 30 words. No preamble.`
+
+// summaryEnricher asks an OpenAI-compatible chat completions endpoint for a
+// plain-English summary of the incident. Summaries are cached by a hash of
+// the prompt so unchanged incidents don't cost a call every run.
+type summaryEnricher struct {
+	url    string
+	apiKey string
+	model  string
+	client *http.Client
+	db     *sql.DB
+}
+
+func newSummaryEnricher(cfg *Config, db *sql.DB) *summaryEnricher {
+	return &summaryEnricher{
+		url:    strings.TrimSuffix(cfg.LLMAPIURL, "/") + "/chat/completions",
+		apiKey: cfg.LLMAPIKey,
+		model:  cfg.LLMModel,
+		client: &http.Client{Timeout: 30 * time.Second},
+		db:     db,
+	}
+}
+
+func (e *summaryEnricher) Name() string { return "summary" }
+
+func (e *summaryEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	facts := summaryFacts(incident)
+	sum := sha256.Sum256([]byte(e.model + "\n" + summarySystemPrompt + "\n" + facts))
+	hash := hex.EncodeToString(sum[:])
+
+	var cached string
+	err := e.db.QueryRowContext(ctx, `SELECT summary FROM llm_summary_cache WHERE input_hash = $1`, hash).Scan(&cached)
+	if err == nil {
+		metricCacheLookups.inc("summary", "hit")
+		incident.Summary = cached
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("summary cache read failed: %w", err)
+	}
+	metricCacheLookups.inc("summary", "miss")
+
+	summary, err := e.complete(ctx, facts)
+	if err != nil {
+		return err
+	}
+	incident.Summary = summary
+	_, err = e.db.ExecContext(ctx, `
+		INSERT INTO llm_summary_cache (input_hash, summary, created_at) VALUES ($1, $2, now())
+		ON CONFLICT (input_hash) DO NOTHING`, hash, summary)
+	return err
+}
+
+// summaryFacts lists the structured fields the model may draw on.
+func summaryFacts(u *UnifiedIncident) string {
+	var b strings.Builder
+	line := func(label, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", label, value)
+		}
+	}
+	line("Event", u.EventType)
+	line("Road", firstNonEmpty(u.RoadNormalized, u.Road))
+	line("Direction", u.Direction)
+	line("Location", u.Address)
+	if u.ExitNumber > 0 {
+		line("Nearest exit", fmt.Sprintf("%d%s", u.ExitNumber, u.ExitSuffix))
+	}
+	line("City", u.City)
+	line("County", u.CountyName)
+	line("Reason", u.ProblemDetail)
+	if u.LanesTotal > 0 {
+		line("Lanes closed", fmt.Sprintf("%d of %d", u.LanesClosed, u.LanesTotal))
+	}
+	if u.Weather != nil {
+		line("Weather", fmt.Sprintf("%s, %d°F", u.Weather.ShortForecast, u.Weather.Temperature))
+	}
+	return b.String()
+}
+
+func (e *summaryEnricher) complete(ctx context.Context, facts string) (string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"model": e.model,
+		"messages": []map[string]string{
+			{"role": "system", "content": summarySystemPrompt},
+			{"role": "user", "content": facts},
+		},
+		"temperature": 0.2,
+		"max_tokens":  80,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("LLM request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("LLM endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return "", fmt.Errorf("failed to unmarshal LLM response: %w", err)
+	}
+	if len(completion.Choices) == 0 {
+		return "", fmt.Errorf("LLM response contained no choices")
+	}
+	summary := strings.TrimSpace(completion.Choices[0].Message.Content)
+	if summary == "" {
+		return "", fmt.Errorf("LLM returned an empty summary")
+	}
+	return summary, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// alerter is implemented by sinks that alert people rather than feed
+// other systems. Only these are throttled; a webhook or message bus
+// consumer wants every change.
+type alerter interface {
+	alerts()
+}
+
+// notifyThrottle keeps alerting sinks from repeating themselves. It
+// remembers, per sink and incident, the last change and severity passed
+// on (in notification_state) and lets an event through only when:
+//
+//   - the sink hasn't seen the incident, or it has reopened;
+//   - the incident has cleared, once;
+//   - the normalized severity has gone up since the last alert; or
+//   - the sink has a cooldown and it has passed since the last alert, in
+//     which case an update goes out again as a reminder.
+//
+// Without a cooldown, updates that don't escalate are never repeated.
+type notifyThrottle struct {
+	db        *sql.DB
+	cooldowns map[string]time.Duration
+}
+
+func newNotifyThrottle(db *sql.DB, cooldowns map[string]time.Duration) *notifyThrottle {
+	return &notifyThrottle{db: db, cooldowns: cooldowns}
+}
+
+// cooldown returns the sink's cooldown. Keys are sink names and may be
+// globs ("discord *").
+func (t *notifyThrottle) cooldown(sink string) time.Duration {
+	if d, ok := t.cooldowns[sink]; ok {
+		return d
+	}
+	for pattern, d := range t.cooldowns {
+		if ok, _ := path.Match(pattern, sink); ok {
+			return d
+		}
+	}
+	return 0
+}
+
+// allow reports whether the sink should be given the event.
+func (t *notifyThrottle) allow(sink string, event IncidentEvent) (bool, error) {
+	p := event.Incident
+	var lastChange string
+	var lastSeverity int
+	var notifiedAt time.Time
+	err := t.db.QueryRow(`
+		SELECT last_change, last_severity, notified_at FROM notification_state
+		WHERE sink = $1 AND source = $2 AND source_id = $3`,
+		sink, p.Source, p.SourceID).Scan(&lastChange, &lastSeverity, &notifiedAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not load notification state: %w", err)
+	}
+
+	wasCleared := ChangeType(lastChange) == ChangeCleared
+	switch {
+	case event.Change == ChangeCleared:
+		return !wasCleared, nil
+	case wasCleared:
+		return true, nil
+	case p.NormalizedSeverity > lastSeverity:
+		return true, nil
+	}
+	cooldown := t.cooldown(sink)
+	return cooldown > 0 && event.OccurredAt.Sub(notifiedAt) >= cooldown, nil
+}
+
+// record notes that the sink was given the event.
+func (t *notifyThrottle) record(sink string, event IncidentEvent) error {
+	p := event.Incident
+	_, err := t.db.Exec(`
+		INSERT INTO notification_state (sink, source, source_id, last_change, last_severity, notified_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (sink, source, source_id) DO UPDATE SET
+			last_change = EXCLUDED.last_change,
+			-- A clearance carries whatever severity was last stored, so
+			-- don't let it lower the bar for a reopened incident.
+			last_severity = GREATEST(notification_state.last_severity, EXCLUDED.last_severity),
+			notified_at = EXCLUDED.notified_at,
+			notifications = notification_state.notifications + 1`,
+		sink, p.Source, p.SourceID, string(event.Change), p.NormalizedSeverity, event.OccurredAt)
+	if err != nil {
+		return fmt.Errorf("could not record notification state: %w", err)
+	}
+	return nil
+}
+
+// parseCooldowns parses "slack=30m,sms=2h,discord *=15m".
+func parseCooldowns(entries []string) (map[string]time.Duration, error) {
+	cooldowns := map[string]time.Duration{}
+	for _, entry := range entries {
+		sink, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid cooldown %q (expected sink=duration)", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cooldown for %s: %w", sink, err)
+		}
+		cooldowns[strings.TrimSpace(sink)] = d
+	}
+	return cooldowns, nil
+}
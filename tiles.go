@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Density tiles: GET /tiles/density/{z}/{x}/{y}.mvt serves a Mapbox Vector
+// Tile with one point per grid cell that had incidents, so a map can render
+// a heatmap of months of history without fetching every row. Cells are a
+// fixed fraction of the tile, so they shrink as you zoom in. The usual
+// incident filters apply; the time window defaults to the last 90 days.
+
+const (
+	tileExtent       = 4096
+	tileCellsPerSide = 64
+	tileMaxZoom      = 18
+	tileDefaultDays  = 90
+	tileLayerName    = "incident_density"
+)
+
+// densityCell is one grid cell's incidents, at tile-local coordinates.
+type densityCell struct {
+	X, Y        int
+	Count       int
+	MaxSeverity int
+	LanesClosed int
+}
+
+func (s *server) handleDensityTile(w http.ResponseWriter, r *http.Request) {
+	z, errZ := strconv.Atoi(r.PathValue("z"))
+	x, errX := strconv.Atoi(r.PathValue("x"))
+	y, errY := strconv.Atoi(strings.TrimSuffix(r.PathValue("y"), ".mvt"))
+	if errZ != nil || errX != nil || errY != nil || z < 0 || z > tileMaxZoom || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := parseIncidentFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Since.IsZero() {
+		f.Since = time.Now().AddDate(0, 0, -tileDefaultDays)
+	}
+	cells, err := s.loadDensityCells(r.Context(), f, z, x, y)
+	if err != nil {
+		logFor("api").Error("Error building density tile", "z", z, "x", x, "y", y, "err", err)
+		http.Error(w, "could not build tile", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(densityTile(cells))
+}
+
+// tileBounds returns the lon/lat bounds of tile z/x/y.
+func tileBounds(z, x, y int) (minLon, minLat, maxLon, maxLat float64) {
+	n := float64(int(1) << z)
+	lat := func(ty float64) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*ty/n))) * 180 / math.Pi
+	}
+	return float64(x)/n*360 - 180, lat(float64(y + 1)), float64(x+1)/n*360 - 180, lat(float64(y))
+}
+
+// loadDensityCells counts the matching incidents in each cell of the tile,
+// doing the Web Mercator projection in SQL so only the cells come back.
+func (s *server) loadDensityCells(ctx context.Context, f incidentFilter, z, x, y int) ([]densityCell, error) {
+	minLon, minLat, maxLon, maxLat := tileBounds(z, x, y)
+	f.BBox = []float64{minLon, minLat, maxLon, maxLat}
+	where, args := f.where()
+	world := float64(int(1)<<z) * tileCellsPerSide
+	args = append(args, world, x*tileCellsPerSide, y*tileCellsPerSide)
+	n := len(args)
+	query := fmt.Sprintf(`
+		SELECT cx, cy, count(*), max(coalesce(normalized_severity, 0)), coalesce(sum(lanes_closed), 0)
+		FROM (
+			SELECT normalized_severity, lanes_closed,
+				floor((longitude + 180) / 360 * $%[2]d)::int - $%[3]d AS cx,
+				floor((1 - ln(tan(pi() / 4 + radians(latitude) / 2)) / pi()) / 2 * $%[2]d)::int - $%[4]d AS cy
+			FROM unified_incidents
+			%[1]s
+		) cells
+		WHERE cx BETWEEN 0 AND %[5]d AND cy BETWEEN 0 AND %[5]d
+		GROUP BY cx, cy`, where, n-2, n-1, n, tileCellsPerSide-1)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cells []densityCell
+	for rows.Next() {
+		var c densityCell
+		if err := rows.Scan(&c.X, &c.Y, &c.Count, &c.MaxSeverity, &c.LanesClosed); err != nil {
+			return nil, err
+		}
+		cells = append(cells, c)
+	}
+	return cells, rows.Err()
+}
+
+// densityTile encodes the cells as a single-layer vector tile, each a
+// point at its cell's centre with count, max_severity and lanes_closed
+// properties. See https://github.com/mapbox/vector-tile-spec/tree/master/2.1.
+func densityTile(cells []densityCell) []byte {
+	keys := []string{"count", "max_severity", "lanes_closed"}
+	var values []uint64
+	valueIndex := map[uint64]uint32{}
+	tag := func(v int) uint32 {
+		u := uint64(v)
+		i, ok := valueIndex[u]
+		if !ok {
+			i = uint32(len(values))
+			valueIndex[u] = i
+			values = append(values, u)
+		}
+		return i
+	}
+
+	var layer []byte
+	layer = protowire.AppendTag(layer, 15, protowire.VarintType) // version
+	layer = protowire.AppendVarint(layer, 2)
+	layer = protowire.AppendTag(layer, 1, protowire.BytesType) // name
+	layer = protowire.AppendString(layer, tileLayerName)
+	cellSize := tileExtent / tileCellsPerSide
+	for i, c := range cells {
+		var tags, geometry []byte
+		for k, v := range []int{c.Count, c.MaxSeverity, c.LanesClosed} {
+			tags = protowire.AppendVarint(tags, uint64(k))
+			tags = protowire.AppendVarint(tags, uint64(tag(v)))
+		}
+		geometry = protowire.AppendVarint(geometry, 1|1<<3) // MoveTo, one point
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(int64(c.X*cellSize+cellSize/2)))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(int64(c.Y*cellSize+cellSize/2)))
+
+		var feature []byte
+		feature = protowire.AppendTag(feature, 1, protowire.VarintType) // id
+		feature = protowire.AppendVarint(feature, uint64(i+1))
+		feature = protowire.AppendTag(feature, 2, protowire.BytesType) // tags
+		feature = protowire.AppendBytes(feature, tags)
+		feature = protowire.AppendTag(feature, 3, protowire.VarintType) // type
+		feature = protowire.AppendVarint(feature, 1)                    // POINT
+		feature = protowire.AppendTag(feature, 4, protowire.BytesType)  // geometry
+		feature = protowire.AppendBytes(feature, geometry)
+		layer = protowire.AppendTag(layer, 2, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, feature)
+	}
+	for _, k := range keys {
+		layer = protowire.AppendTag(layer, 3, protowire.BytesType)
+		layer = protowire.AppendString(layer, k)
+	}
+	for _, v := range values {
+		var value []byte
+		value = protowire.AppendTag(value, 5, protowire.VarintType) // uint_value
+		value = protowire.AppendVarint(value, v)
+		layer = protowire.AppendTag(layer, 4, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, value)
+	}
+	layer = protowire.AppendTag(layer, 5, protowire.VarintType) // extent
+	layer = protowire.AppendVarint(layer, tileExtent)
+
+	var tile []byte
+	tile = protowire.AppendTag(tile, 3, protowire.BytesType)
+	return protowire.AppendBytes(tile, layer)
+}
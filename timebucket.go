@@ -0,0 +1,78 @@
+package main
+
+import (
+	"time"
+	_ "time/tzdata"
+)
+
+// Traffic-period buckets stored in unified_incidents.time_bucket.
+const (
+	BucketAMPeak    = "am_peak"
+	BucketMidday    = "midday"
+	BucketPMPeak    = "pm_peak"
+	BucketOvernight = "overnight"
+	BucketWeekend   = "weekend"
+)
+
+// Day types stored in unified_incidents.day_type.
+const (
+	DayTypeWeekday = "weekday"
+	DayTypeWeekend = "weekend"
+	DayTypeHoliday = "holiday"
+)
+
+// easternTime is the zone NCDOT reports in and the one commuters live in.
+var easternTime = mustLoadLocation("America/New_York")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// TimeClassification is the derived traffic period for an incident's start time.
+type TimeClassification struct {
+	TimeBucket  string
+	DayType     string
+	IsHoliday   bool
+	HolidayName string
+}
+
+// classifyTime buckets t (converted to Eastern time) into a traffic period.
+// Weekends get their own bucket regardless of hour; holidays keep their
+// weekday bucket but are flagged so dashboards can choose how to treat them.
+func classifyTime(t time.Time) TimeClassification {
+	local := t.In(easternTime)
+
+	var c TimeClassification
+	c.HolidayName, c.IsHoliday = holidayName(local)
+
+	switch local.Weekday() {
+	case time.Saturday, time.Sunday:
+		c.TimeBucket = BucketWeekend
+		c.DayType = DayTypeWeekend
+	default:
+		c.TimeBucket = weekdayBucket(local.Hour())
+		c.DayType = DayTypeWeekday
+	}
+	if c.IsHoliday {
+		c.DayType = DayTypeHoliday
+	}
+	return c
+}
+
+// weekdayBucket maps a local hour to a weekday traffic period.
+func weekdayBucket(hour int) string {
+	switch {
+	case hour >= 6 && hour < 10:
+		return BucketAMPeak
+	case hour >= 10 && hour < 15:
+		return BucketMidday
+	case hour >= 15 && hour < 19:
+		return BucketPMPeak
+	default:
+		return BucketOvernight
+	}
+}
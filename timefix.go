@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"log"
+	"time"
+)
+
+// Feed times are Eastern. They are parsed into absolute times (see
+// feedtime.go) and stored as such: unified_incidents.timestamp, which the
+// first ingestors made a plain timestamp of Eastern wall-clock times, is
+// converted to timestamptz at startup, reading the old values as Eastern.
+// Other ingestors sharing the table keep working as long as they send an
+// offset or run their sessions in America/New_York, as they did before.
+//
+// fix-times rewrites NCDOT rows whose start or end time doesn't match the
+// raw feed record kept in details, such as those written before the
+// feed's times were parsed with their zone.
+
+func runFixTimes(cfg *Config, db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("fix-times", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would change without changing it")
+	fs.Parse(args)
+	ctx := context.Background()
+	logger := logFor("main")
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT source_id, timestamp, end_time, coalesce(details->'raw_incident', 'null')
+		FROM unified_incidents
+		WHERE source = 'NCDOT'`)
+	if err != nil {
+		log.Fatalf("Error reading incidents: %s", err)
+	}
+	type fix struct {
+		sourceID   string
+		start      time.Time
+		end        sql.NullTime
+		oldStart   time.Time
+		endChanged bool
+	}
+	var fixes []fix
+	unparsed := 0
+	for rows.Next() {
+		var sourceID string
+		var start time.Time
+		var end sql.NullTime
+		var raw []byte
+		if err := rows.Scan(&sourceID, &start, &end, &raw); err != nil {
+			log.Fatalf("Error reading incidents: %s", err)
+		}
+		var incident Incident
+		if err := json.Unmarshal(raw, &incident); err != nil || incident.StartTime == "" {
+			unparsed++
+			continue
+		}
+		wantStart, err := parseFeedTime(incident.StartTime)
+		if err != nil || wantStart.IsZero() {
+			unparsed++
+			continue
+		}
+		wantEnd, err := parseFeedTime(incident.EndTime)
+		if err != nil {
+			unparsed++
+			continue
+		}
+		f := fix{sourceID: sourceID, start: wantStart.UTC(), end: sql.NullTime{Time: wantEnd.UTC(), Valid: !wantEnd.IsZero()}, oldStart: start}
+		f.endChanged = f.end.Valid != end.Valid || (end.Valid && !end.Time.Equal(f.end.Time))
+		if !start.Equal(f.start) || f.endChanged {
+			fixes = append(fixes, f)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Error reading incidents: %s", err)
+	}
+	rows.Close()
+	logger.Info("Checked NCDOT incident times", "to_fix", len(fixes), "unparsed", unparsed)
+
+	if *dryRun {
+		for _, f := range fixes {
+			logger.Info("Would fix", "incident_id", f.sourceID, "timestamp", f.oldStart.Format(time.RFC3339), "to", f.start.Format(time.RFC3339), "end_time_changed", f.endChanged)
+		}
+		return
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Fatalf("Error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+	for _, f := range fixes {
+		// classifyTime depends on the start too.
+		period := classifyTime(f.start)
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE unified_incidents
+			SET timestamp = $3, end_time = $4, time_bucket = $5, day_type = $6, is_holiday = $7, holiday_name = NULLIF($8, '')
+			WHERE source = $1 AND source_id = $2`,
+			"NCDOT", f.sourceID, f.start, f.end, period.TimeBucket, period.DayType, period.IsHoliday, period.HolidayName); err != nil {
+			log.Fatalf("Error fixing incident %s: %s", f.sourceID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Error committing: %s", err)
+	}
+	logger.Info("Fixed NCDOT incident times", "fixed", len(fixes))
+}
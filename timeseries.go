@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Incident load as time series, pushed every TIMESERIES_INTERVAL to
+// InfluxDB (v2 line protocol) and/or a Prometheus remote-write endpoint
+// (Prometheus, Mimir, Thanos, VictoriaMetrics...):
+//
+//	patrolx_incidents_active{county, event_type, severity}  gauge
+//	patrolx_lanes_closed                                    gauge
+//	patrolx_incident_events_total{change}                   counter
+//
+// New incidents per minute is rate(patrolx_incident_events_total
+// {change="created"}[1m]) in PromQL, or derivative() of the total in Flux.
+// The counters start from zero when the process does.
+
+// tsSample is one point of one series.
+type tsSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// seriesKey identifies a series regardless of its value.
+func (s tsSample) seriesKey() string {
+	keys := make([]string, 0, len(s.labels))
+	for k := range s.labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(s.name)
+	for _, k := range keys {
+		b.WriteString("\x00" + k + "=" + s.labels[k])
+	}
+	return b.String()
+}
+
+// timeSeriesPusher is a sink, so it sees every event to count, and runs
+// its own loop to sample the active incidents and push.
+type timeSeriesPusher struct {
+	cfg    *Config
+	db     *sql.DB
+	client *http.Client
+
+	mu     sync.Mutex
+	events map[ChangeType]int64
+	// active holds the gauge series sent last time, so a county whose
+	// incidents have all cleared is pushed as zero rather than left at
+	// its last value.
+	active map[string]tsSample
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newTimeSeriesPusher(cfg *Config, db *sql.DB) *timeSeriesPusher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &timeSeriesPusher{
+		cfg:    cfg,
+		db:     db,
+		client: &http.Client{Timeout: 15 * time.Second},
+		events: map[ChangeType]int64{ChangeCreated: 0, ChangeUpdated: 0, ChangeCleared: 0},
+		active: map[string]tsSample{},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go p.loop(ctx)
+	return p
+}
+
+func (p *timeSeriesPusher) Name() string { return "timeseries" }
+
+func (p *timeSeriesPusher) Publish(ctx context.Context, event IncidentEvent) error {
+	p.mu.Lock()
+	p.events[event.Change]++
+	p.mu.Unlock()
+	return nil
+}
+
+// Close stops the loop after one last push.
+func (p *timeSeriesPusher) Close() error {
+	p.cancel()
+	<-p.done
+	return nil
+}
+
+func (p *timeSeriesPusher) loop(ctx context.Context) {
+	defer close(p.done)
+	ticker := time.NewTicker(p.cfg.TimeSeriesInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.push(context.Background())
+			return
+		case <-ticker.C:
+			p.push(ctx)
+		}
+	}
+}
+
+func (p *timeSeriesPusher) push(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	samples, err := p.sample(ctx)
+	if err != nil {
+		logFor("timeseries").Warn("Could not sample incident metrics", "err", err)
+		return
+	}
+	now := time.Now()
+	if p.cfg.InfluxURL != "" {
+		if err := p.writeInflux(ctx, samples, now); err != nil {
+			logFor("timeseries").Warn("InfluxDB write failed", "err", err)
+		}
+	}
+	if p.cfg.RemoteWriteURL != "" {
+		if err := p.writeRemote(ctx, samples, now); err != nil {
+			logFor("timeseries").Warn("Prometheus remote write failed", "err", err)
+		}
+	}
+}
+
+func (p *timeSeriesPusher) sample(ctx context.Context) ([]tsSample, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT coalesce(county_name, ''), event_type, coalesce(normalized_severity, 0), count(*), coalesce(sum(lanes_closed), 0)
+		FROM unified_incidents
+		WHERE status = 'active'
+		GROUP BY 1, 2, 3`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var samples []tsSample
+	active := map[string]tsSample{}
+	var lanes float64
+	for rows.Next() {
+		var county, eventType string
+		var severity, n, closed int
+		if err := rows.Scan(&county, &eventType, &severity, &n, &closed); err != nil {
+			return nil, err
+		}
+		s := tsSample{
+			name:   "patrolx_incidents_active",
+			labels: map[string]string{"county": firstNonEmpty(county, "unknown"), "event_type": eventType, "severity": strconv.Itoa(severity)},
+			value:  float64(n),
+		}
+		active[s.seriesKey()] = s
+		samples = append(samples, s)
+		lanes += float64(closed)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	samples = append(samples, tsSample{name: "patrolx_lanes_closed", labels: map[string]string{}, value: lanes})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, s := range p.active {
+		if _, ok := active[key]; !ok {
+			s.value = 0
+			samples = append(samples, s)
+		}
+	}
+	p.active = active
+	for change, n := range p.events {
+		samples = append(samples, tsSample{name: "patrolx_incident_events_total", labels: map[string]string{"change": string(change)}, value: float64(n)})
+	}
+	return samples, nil
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// writeInflux writes the samples in line protocol, one measurement per
+// metric with the value as its "value" field.
+func (p *timeSeriesPusher) writeInflux(ctx context.Context, samples []tsSample, now time.Time) error {
+	var body bytes.Buffer
+	for _, s := range samples {
+		body.WriteString(s.name)
+		keys := make([]string, 0, len(s.labels))
+		for k := range s.labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&body, ",%s=%s", influxEscaper.Replace(k), influxEscaper.Replace(s.labels[k]))
+		}
+		fmt.Fprintf(&body, " value=%s %d\n", strconv.FormatFloat(s.value, 'f', -1, 64), now.Unix())
+	}
+	q := url.Values{"org": {p.cfg.InfluxOrg}, "bucket": {p.cfg.InfluxBucket}, "precision": {"s"}}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(p.cfg.InfluxURL, "/")+"/api/v2/write?"+q.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.cfg.InfluxToken != "" {
+		req.Header.Set("Authorization", "Token "+p.cfg.InfluxToken)
+	}
+	return p.send(req)
+}
+
+// writeRemote sends the samples as a remote-write 1.0 WriteRequest.
+func (p *timeSeriesPusher) writeRemote(ctx context.Context, samples []tsSample, now time.Time) error {
+	var msg []byte
+	for _, s := range samples {
+		labels := map[string]string{"__name__": s.name}
+		for k, v := range s.labels {
+			labels[k] = v
+		}
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		// Receivers require labels sorted by name.
+		sort.Strings(keys)
+		var series []byte
+		for _, k := range keys {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, k)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, labels[k])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(now.UnixMilli()))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, series)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.cfg.RemoteWriteURL, bytes.NewReader(snappyLiteral(msg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if p.cfg.RemoteWriteUsername != "" {
+		req.SetBasicAuth(p.cfg.RemoteWriteUsername, p.cfg.RemoteWritePassword)
+	}
+	return p.send(req)
+}
+
+func (p *timeSeriesPusher) send(req *http.Request) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, truncate(strings.TrimSpace(string(body)), 200))
+	}
+	return nil
+}
+
+// snappyLiteral encodes src in the Snappy block format remote write
+// requires, as literals only. That gives up the compression but is valid
+// for any decoder, and these payloads are a few kilobytes.
+func snappyLiteral(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		chunk := src[:min(len(src), 65536)]
+		src = src[len(chunk):]
+		switch n := len(chunk) - 1; {
+		case n < 60:
+			dst = append(dst, byte(n)<<2)
+		case n < 1<<8:
+			dst = append(dst, 60<<2, byte(n))
+		default:
+			dst = append(dst, 61<<2, byte(n), byte(n>>8))
+		}
+		dst = append(dst, chunk...)
+	}
+	return dst
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Ingest runs are traced with OpenTelemetry: a span per run, with the
+// feed fetch, each incident (its enrichers and upsert, and the NWS lookups
+// under the weather enricher), clearing and sink delivery beneath it.
+// Spans are exported over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT) is set, configured by the standard
+// OTEL_* variables; otherwise tracing is a no-op.
+
+// tracer is the ingestor's tracer. It resolves through the global
+// provider, so it is safe to use before setupTracing.
+var tracer = otel.Tracer("github.com/mtickle/ncdot-ingestor-bot")
+
+// tracingEnabled reports whether an OTLP endpoint is configured.
+func tracingEnabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTracing installs the OTLP exporter, if one is configured, and
+// returns a function that flushes and stops it.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if !tracingEnabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(envDefault("OTEL_SERVICE_NAME", "ncdot-ingestor"))))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	logFor("tracing").Info("Exporting traces over OTLP")
+	return provider.Shutdown, nil
+}
+
+// endSpan records err, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// incidentAttrs identify an incident on a span.
+func incidentAttrs(source, sourceID string) trace.SpanStartOption {
+	return trace.WithAttributes(attribute.String("incident.source", source), attribute.String("incident.id", sourceID))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Feed records are sanity-checked before they are saved: they must have
+// an ID and a type, sit inside the region (North Carolina, or
+// VALIDATE_BBOX), and have a severity in VALIDATE_SEVERITY_MIN..MAX and no
+// negative lane counts. Records that fail are quarantined with every
+// problem found, rather than putting points at (0,0) on the map.
+
+// ncBBox is North Carolina with a little room for incidents at the state
+// line.
+var ncBBox = bbox{MinLat: 33.7, MinLon: -84.4, MaxLat: 36.65, MaxLon: -75.3}
+
+// incidentValidator holds the limits a record is checked against.
+type incidentValidator struct {
+	region                   bbox
+	minSeverity, maxSeverity int
+}
+
+func newIncidentValidator(cfg *Config) *incidentValidator {
+	return &incidentValidator{region: cfg.ValidateRegion, minSeverity: cfg.ValidateSeverityMin, maxSeverity: cfg.ValidateSeverityMax}
+}
+
+// check returns every problem with the record, or nil.
+func (v *incidentValidator) check(incident Incident) error {
+	var problems []string
+	if incident.ID <= 0 {
+		problems = append(problems, "missing id")
+	}
+	if strings.TrimSpace(incident.IncidentType) == "" {
+		problems = append(problems, "missing incidentType")
+	}
+	if incident.Latitude == 0 && incident.Longitude == 0 {
+		problems = append(problems, "missing coordinates")
+	} else if !v.region.contains(LatLon{Lat: incident.Latitude, Lon: incident.Longitude}) {
+		problems = append(problems, fmt.Sprintf("coordinates %.5f,%.5f outside the region", incident.Latitude, incident.Longitude))
+	}
+	if incident.Severity < v.minSeverity || incident.Severity > v.maxSeverity {
+		problems = append(problems, fmt.Sprintf("severity %d outside %d..%d", incident.Severity, v.minSeverity, v.maxSeverity))
+	}
+	if incident.LanesClosed < 0 || incident.LanesTotal < 0 {
+		problems = append(problems, fmt.Sprintf("negative lane count (%d of %d closed)", incident.LanesClosed, incident.LanesTotal))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// parseBBox parses "minLon,minLat,maxLon,maxLat", the order the API's
+// bbox parameter uses.
+func parseBBox(entries []string) (bbox, error) {
+	if len(entries) != 4 {
+		return bbox{}, fmt.Errorf("expected minLon,minLat,maxLon,maxLat")
+	}
+	var n [4]float64
+	for i, e := range entries {
+		f, err := strconv.ParseFloat(strings.TrimSpace(e), 64)
+		if err != nil {
+			return bbox{}, fmt.Errorf("invalid number %q", e)
+		}
+		n[i] = f
+	}
+	b := bbox{MinLon: n[0], MinLat: n[1], MaxLon: n[2], MaxLat: n[3]}
+	if b.MinLon >= b.MaxLon || b.MinLat >= b.MaxLat {
+		return bbox{}, fmt.Errorf("minimums must be below maximums")
+	}
+	return b, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// userAgent identifies the bot to the public APIs it calls; NWS and
+// Nominatim both require a contact in it (see setupHTTPClient).
+var userAgent = "patrolx"
+
+// nwsBaseURL is where the NWS API is: NWS_URL points it elsewhere, at
+// mock-server for instance.
+var nwsBaseURL = "https://api.weather.gov"
+
+// Each ingester has an NWS budget that caps the requests a run makes at
+// NWS_REQUEST_BUDGET, so a storm's worth of incidents in new grid cells
+// can't flood api.weather.gov. Under PROFILES every profile has its own.
+// Every attempt counts, retries included. Once it's spent, lookups fail
+// until the next run. The enrich and import commands have one budget for
+// the whole command.
+
+var errBudgetSpent = errors.New("request budget for this run spent")
+
+type nwsBudgetKey struct{}
+
+// withNWSBudget makes b the NWS budget for lookups made with ctx.
+func withNWSBudget(ctx context.Context, b *requestBudget) context.Context {
+	return context.WithValue(ctx, nwsBudgetKey{}, b)
+}
+
+// nwsBudgetFrom is ctx's NWS budget, or nil for none.
+func nwsBudgetFrom(ctx context.Context) *requestBudget {
+	b, _ := ctx.Value(nwsBudgetKey{}).(*requestBudget)
+	return b
+}
+
+// requestBudget counts requests against a per-run limit; zero is no
+// limit.
+type requestBudget struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+}
+
+func newRequestBudget(limit int) *requestBudget {
+	return &requestBudget{limit: limit}
+}
+
+// reset starts a new run's count.
+func (b *requestBudget) reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used = 0
+}
+
+// take spends one request, reporting false if none are left.
+func (b *requestBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used >= b.limit {
+		return false
+	}
+	b.used++
+	return true
+}
+
+// --- Structs for the National Weather Service (NWS) API ---
+type NWSPointsResponse struct {
+	Properties struct {
+		ForecastHourly string `json:"forecastHourly"`
+	} `json:"properties"`
+}
+
+type NWSHourlyResponse struct {
+	Properties struct {
+		Periods []nwsHourlyPeriod `json:"periods"`
+	} `json:"properties"`
+}
+
+// nwsHourlyPeriod is one hour of the forecast.
+type nwsHourlyPeriod struct {
+	WeatherData
+	StartTime time.Time `json:"startTime"`
+}
+
+type WeatherData struct {
+	Temperature   int    `json:"temperature"`
+	WindSpeed     string `json:"windSpeed"`
+	ShortForecast string `json:"shortForecast"`
+	Icon          string `json:"icon"`
+}
+
+// nwsTimeouts bound each attempt at the two NWS calls.
+type nwsTimeouts struct {
+	points, hourly time.Duration
+}
+
+// getWeatherForIncident fetches current weather conditions from the NWS API.
+func getWeatherForIncident(ctx context.Context, lat, lon float64, timeouts nwsTimeouts) (*WeatherData, error) {
+	periods, err := getHourlyForecast(ctx, lat, lon, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	return &periods[0].WeatherData, nil
+}
+
+// getHourlyForecast fetches the NWS hourly forecast at a point, starting
+// with the current hour.
+func getHourlyForecast(ctx context.Context, lat, lon float64, timeouts nwsTimeouts) (_ []nwsHourlyPeriod, err error) {
+	ctx, span := tracer.Start(ctx, "nws.lookup")
+	defer func() {
+		endSpan(span, err)
+		if err != nil {
+			metricNWSRequests.inc("error")
+		} else {
+			metricNWSRequests.inc("ok")
+		}
+	}()
+	// Each attempt at either request is charged to the run's budget.
+	ctx = withRequestBudget(ctx, nwsBudgetFrom(ctx))
+	pointsURL := fmt.Sprintf("%s/points/%.4f,%.4f", nwsBaseURL, lat, lon)
+	req, err := http.NewRequestWithContext(withAttemptTimeout(ctx, timeouts.points), "GET", pointsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	pointsResp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch NWS points data: %w", err)
+	}
+	defer pointsResp.Body.Close()
+	if pointsResp.StatusCode != 200 {
+		return nil, fmt.Errorf("NWS points API returned non-200 status: %s", pointsResp.Status)
+	}
+	body, err := io.ReadAll(pointsResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NWS points response body: %w", err)
+	}
+	var pointsResponse NWSPointsResponse
+	if err := json.Unmarshal(body, &pointsResponse); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal NWS points JSON: %w", err)
+	}
+	if pointsResponse.Properties.ForecastHourly == "" {
+		return nil, fmt.Errorf("NWS points response did not contain a forecast URL")
+	}
+
+	req, err = http.NewRequestWithContext(withAttemptTimeout(ctx, timeouts.hourly), "GET", pointsResponse.Properties.ForecastHourly+"?units=us", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	hourlyResp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch NWS hourly data: %w", err)
+	}
+	defer hourlyResp.Body.Close()
+	if hourlyResp.StatusCode != 200 {
+		return nil, fmt.Errorf("NWS hourly API returned non-200 status: %s", hourlyResp.Status)
+	}
+	hourlyBody, err := io.ReadAll(hourlyResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NWS hourly response body: %w", err)
+	}
+	var hourlyResponse NWSHourlyResponse
+	if err := json.Unmarshal(hourlyBody, &hourlyResponse); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal NWS hourly JSON: %w", err)
+	}
+	if len(hourlyResponse.Properties.Periods) > 0 {
+		return hourlyResponse.Properties.Periods, nil
+	}
+	return nil, fmt.Errorf("no weather periods returned from NWS")
+}
+
+// weatherEnricher attaches current NWS conditions at the incident location.
+// Incidents are grouped by grid cell so a multi-vehicle pileup costs one
+// pair of NWS calls rather than one per vehicle; the cache is cleared at the
+// start of every run so conditions never go stale.
+type weatherEnricher struct {
+	gridDegrees float64
+	timeouts    nwsTimeouts
+
+	mu    sync.Mutex
+	cells map[[2]int]*weatherCell
+	calls int
+	hits  int
+}
+
+type weatherCell struct {
+	once sync.Once
+	data *WeatherData
+	err  error
+}
+
+func newWeatherEnricher(gridDegrees float64, timeouts nwsTimeouts) *weatherEnricher {
+	return &weatherEnricher{gridDegrees: gridDegrees, timeouts: timeouts, cells: map[[2]int]*weatherCell{}}
+}
+
+func (e *weatherEnricher) Name() string { return "weather" }
+
+func (e *weatherEnricher) BeginRun() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cells = map[[2]int]*weatherCell{}
+	e.calls, e.hits = 0, 0
+}
+
+func (e *weatherEnricher) Enrich(ctx context.Context, incident *UnifiedIncident) error {
+	if e.gridDegrees <= 0 {
+		weatherData, err := getWeatherForIncident(ctx, incident.Latitude, incident.Longitude, e.timeouts)
+		if err != nil {
+			return err
+		}
+		incident.Weather = weatherData
+		return nil
+	}
+
+	key := [2]int{int(math.Floor(incident.Latitude / e.gridDegrees)), int(math.Floor(incident.Longitude / e.gridDegrees))}
+	e.mu.Lock()
+	cell, ok := e.cells[key]
+	if !ok {
+		cell = &weatherCell{}
+		e.cells[key] = cell
+		e.calls++
+		metricCacheLookups.inc("weather", "miss")
+	} else {
+		e.hits++
+		metricCacheLookups.inc("weather", "hit")
+	}
+	e.mu.Unlock()
+
+	// Look up weather at the cell centre so every incident in it agrees.
+	cell.once.Do(func() {
+		lat := (float64(key[0]) + 0.5) * e.gridDegrees
+		lon := (float64(key[1]) + 0.5) * e.gridDegrees
+		cell.data, cell.err = getWeatherForIncident(ctx, lat, lon, e.timeouts)
+	})
+	if cell.err != nil {
+		return cell.err
+	}
+	incident.Weather = cell.data
+	return nil
+}
+
+// Report summarizes how many lookups the grid saved.
+func (e *weatherEnricher) Report() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.hits == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d NWS lookups, %d incidents served from an already-fetched grid cell", e.calls, e.hits)
+}
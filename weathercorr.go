@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// runReport implements the report command:
+//
+//	report weather-correlation [-since 2024-01-01] [-until ...] [-event-type "Vehicle Crash"] [-format csv|json] [-o file]
+//
+// weather-correlation breaks the incidents that started in the window down
+// by the weather stored with them: temperature band, precipitation in the
+// forecast, and daylight, each band with its count, share and mean
+// normalized severity.
+func runReport(cfg *Config, db *sql.DB, args []string) {
+	if len(args) == 0 || args[0] != "weather-correlation" {
+		log.Fatal("Usage: report weather-correlation [-since date] [-until date] [-event-type types] [-format csv|json] [-o file]")
+	}
+	fs := flag.NewFlagSet("report weather-correlation", flag.ExitOnError)
+	since := fs.String("since", "", "start of the window, RFC 3339 or YYYY-MM-DD (default 90 days ago)")
+	until := fs.String("until", "", "end of the window, RFC 3339 or YYYY-MM-DD (default now)")
+	eventTypes := fs.String("event-type", "", "only these event types, comma-separated")
+	format := fs.String("format", "csv", "output format: csv or json")
+	output := fs.String("o", "-", "file to write, or - for stdout")
+	fs.Parse(args[1:])
+
+	from, err := parseTimeParam(*since)
+	if err != nil {
+		log.Fatalf("Error: invalid -since: %s", err)
+	}
+	to, err := parseTimeParam(*until)
+	if err != nil {
+		log.Fatalf("Error: invalid -until: %s", err)
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -90)
+	}
+	var types []string
+	for _, t := range strings.Split(*eventTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	var write func(io.Writer, []weatherBand) error
+	switch *format {
+	case "csv":
+		write = writeWeatherBandsCSV
+	case "json":
+		write = func(w io.Writer, bands []weatherBand) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(map[string]interface{}{"since": from, "until": to, "event_types": types, "bands": bands})
+		}
+	default:
+		log.Fatalf("Unknown report format %q", *format)
+	}
+
+	bands, err := weatherCorrelation(context.Background(), db, from, to, types)
+	if err != nil {
+		log.Fatalf("Error building report: %s", err)
+	}
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+	}
+	w := bufio.NewWriter(out)
+	if err := write(w, bands); err != nil {
+		log.Fatalf("Error writing report: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Error writing report: %s", err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalf("Error writing report: %s", err)
+	}
+}
+
+// weatherBand is one row of the weather correlation report.
+type weatherBand struct {
+	Dimension    string  `json:"dimension"`
+	Band         string  `json:"band"`
+	Incidents    int     `json:"incidents"`
+	SharePct     float64 `json:"share_pct"`
+	MeanSeverity float64 `json:"mean_severity"`
+}
+
+// temperatureBands are the temperature bands, by their lower bound in °F.
+var temperatureBands = []struct {
+	min  int
+	name string
+}{
+	{90, "90°F and up"},
+	{75, "75-89°F"},
+	{60, "60-74°F"},
+	{45, "45-59°F"},
+	{33, "33-44°F"},
+	{-1000, "32°F and below"},
+}
+
+func temperatureBand(temp sql.NullInt32) string {
+	if !temp.Valid {
+		return "unknown"
+	}
+	for _, b := range temperatureBands {
+		if int(temp.Int32) >= b.min {
+			return b.name
+		}
+	}
+	return "unknown"
+}
+
+// precipitationType names the precipitation (or obscured visibility) in an
+// NWS short forecast, using the words weatherRiskFactor does.
+func precipitationType(forecast string) string {
+	f := strings.ToLower(forecast)
+	switch {
+	case f == "":
+		return "unknown"
+	case strings.Contains(f, "freezing") || strings.Contains(f, "ice") || strings.Contains(f, "sleet"):
+		return "freezing rain, sleet or ice"
+	case strings.Contains(f, "snow"):
+		return "snow"
+	case strings.Contains(f, "thunderstorm"):
+		return "thunderstorms"
+	case strings.Contains(f, "rain") || strings.Contains(f, "showers") || strings.Contains(f, "drizzle"):
+		return "rain"
+	case strings.Contains(f, "fog") || strings.Contains(f, "smoke") || strings.Contains(f, "haze"):
+		return "fog, smoke or haze"
+	}
+	return "none"
+}
+
+func weatherCorrelation(ctx context.Context, db *sql.DB, since, until time.Time, eventTypes []string) ([]weatherBand, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT weather_temp, coalesce(weather_forecast, ''), coalesce(light_condition, ''), count(*),
+			coalesce(sum(normalized_severity), 0), count(normalized_severity)
+		FROM unified_incidents
+		WHERE timestamp >= $1 AND timestamp < $2
+			AND (cardinality($3::text[]) = 0 OR event_type = ANY($3) OR raw_event_type = ANY($3))
+		GROUP BY 1, 2, 3`, since, until, pq.Array(eventTypes))
+	if err != nil {
+		return nil, fmt.Errorf("could not load incidents: %w", err)
+	}
+	defer rows.Close()
+	type key struct{ dimension, band string }
+	type tally struct{ incidents, severitySum, severityCount int }
+	tallies := map[key]*tally{}
+	total := 0
+	for rows.Next() {
+		var temp sql.NullInt32
+		var forecast, light string
+		var n, severitySum, severityCount int
+		if err := rows.Scan(&temp, &forecast, &light, &n, &severitySum, &severityCount); err != nil {
+			return nil, err
+		}
+		total += n
+		if light == "" {
+			light = "unknown"
+		}
+		for _, k := range []key{{"temperature", temperatureBand(temp)}, {"precipitation", precipitationType(forecast)}, {"light", light}} {
+			t := tallies[k]
+			if t == nil {
+				t = &tally{}
+				tallies[k] = t
+			}
+			t.incidents += n
+			t.severitySum += severitySum
+			t.severityCount += severityCount
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	bands := []weatherBand{}
+	for k, t := range tallies {
+		b := weatherBand{Dimension: k.dimension, Band: k.band, Incidents: t.incidents}
+		b.SharePct = math.Round(1000*float64(t.incidents)/float64(total)) / 10
+		if t.severityCount > 0 {
+			b.MeanSeverity = math.Round(100*float64(t.severitySum)/float64(t.severityCount)) / 100
+		}
+		bands = append(bands, b)
+	}
+	order := map[string]int{"temperature": 0, "precipitation": 1, "light": 2}
+	sort.Slice(bands, func(i, j int) bool {
+		if bands[i].Dimension != bands[j].Dimension {
+			return order[bands[i].Dimension] < order[bands[j].Dimension]
+		}
+		if bands[i].Incidents != bands[j].Incidents {
+			return bands[i].Incidents > bands[j].Incidents
+		}
+		return bands[i].Band < bands[j].Band
+	})
+	return bands, nil
+}
+
+func writeWeatherBandsCSV(w io.Writer, bands []weatherBand) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"dimension", "band", "incidents", "share_pct", "mean_severity"})
+	for _, b := range bands {
+		cw.Write([]string{b.Dimension, b.Band, strconv.Itoa(b.Incidents),
+			strconv.FormatFloat(b.SharePct, 'f', 1, 64), strconv.FormatFloat(b.MeanSeverity, 'f', 2, 64)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,167 @@
+// Live incident map: loads the active incidents, then follows /stream.
+(function () {
+  "use strict";
+
+  // Normalized severity 0 (unknown) to 5.
+  const severityColors = ["#9e9e9e", "#4caf50", "#cddc39", "#ffc107", "#ff5722", "#d50000"];
+  const adverseWeather = /snow|ice|sleet|freezing|rain|storm|fog|thunder/i;
+
+  const map = L.map("map").setView([35.5, -79.4], 7);
+  L.tileLayer("https://tile.openstreetmap.org/{z}/{x}/{y}.png", {
+    maxZoom: 18,
+    attribution: "&copy; OpenStreetMap contributors",
+  }).addTo(map);
+
+  const countySelect = document.getElementById("county");
+  const list = document.getElementById("list");
+  const statusEl = document.getElementById("status");
+  const countEl = document.getElementById("count");
+  // With API_AUTH on, open the dashboard as /dashboard/?key=... and the
+  // key is passed on to the API.
+  const apiKey = new URLSearchParams(location.search).get("key");
+  const incidents = new Map();
+  let stream = null;
+
+  const key = (p) => p.source + "/" + p.source_id;
+
+  function escape(s) {
+    return String(s == null ? "" : s).replace(/[&<>"']/g, (c) => "&#" + c.charCodeAt(0) + ";");
+  }
+
+  function title(p) {
+    let t = p.event_type;
+    if (p.road) t += " on " + p.road + (p.direction ? " " + p.direction : "");
+    if (p.county) t += " in " + p.county + " County";
+    return t;
+  }
+
+  function lanes(p) {
+    if (!p.lanes_total) return "unknown";
+    if (p.lanes_closed >= p.lanes_total) return "all " + p.lanes_total + " closed";
+    return p.lanes_closed + " of " + p.lanes_total + " closed";
+  }
+
+  function weatherBadge(p) {
+    if (!p.weather) return "";
+    const w = p.weather;
+    const cls = adverseWeather.test(w.shortForecast || "") ? "badge adverse" : "badge";
+    return '<span class="' + cls + '">' + escape(w.temperature + "°F " + (w.shortForecast || "")) + "</span>";
+  }
+
+  function popup(p) {
+    return "<strong>" + escape(title(p)) + "</strong>" +
+      "<p>" + escape(p.summary || p.problem_detail || p.address) + "</p>" +
+      weatherBadge(p) +
+      "<dl>" +
+      "<dt>Severity</dt><dd>" + escape(p.normalized_severity || "unknown") + "</dd>" +
+      "<dt>Lanes</dt><dd>" + escape(lanes(p)) + "</dd>" +
+      "<dt>Started</dt><dd>" + escape(new Date(p.start_time).toLocaleString()) + "</dd>" +
+      (p.end_time ? "<dt>Ends</dt><dd>" + escape(new Date(p.end_time).toLocaleString()) + "</dd>" : "") +
+      "<dt>Address</dt><dd>" + escape(p.address) + "</dd>" +
+      "</dl>";
+  }
+
+  function upsert(p, flash) {
+    const k = key(p);
+    let entry = incidents.get(k);
+    if (p.status === "cleared") {
+      if (entry) {
+        entry.marker.remove();
+        entry.item.remove();
+        incidents.delete(k);
+      }
+      updateCount();
+      return;
+    }
+    const color = severityColors[p.normalized_severity] || severityColors[0];
+    if (!entry) {
+      entry = {
+        marker: L.circleMarker([p.latitude, p.longitude], { radius: 8, weight: 2, fillOpacity: 0.8 }).addTo(map),
+        item: document.createElement("li"),
+      };
+      entry.item.addEventListener("click", () => {
+        map.setView(entry.marker.getLatLng(), 13);
+        entry.marker.openPopup();
+      });
+      incidents.set(k, entry);
+    }
+    entry.marker.setLatLng([p.latitude, p.longitude]);
+    entry.marker.setStyle({ color: color, fillColor: color });
+    entry.marker.bindPopup(popup(p));
+    entry.item.style.borderLeftColor = color;
+    entry.item.innerHTML = '<div class="title">' + escape(title(p)) + "</div>" +
+      '<div class="meta">' + weatherBadge(p) + "Lanes " + escape(lanes(p)) + " · " +
+      escape(new Date(p.start_time).toLocaleTimeString()) + "</div>";
+    list.prepend(entry.item);
+    if (flash) {
+      entry.item.classList.remove("flash");
+      void entry.item.offsetWidth;
+      entry.item.classList.add("flash");
+    }
+    updateCount();
+  }
+
+  function updateCount() {
+    countEl.textContent = incidents.size + " active";
+  }
+
+  function clear() {
+    for (const entry of incidents.values()) {
+      entry.marker.remove();
+      entry.item.remove();
+    }
+    incidents.clear();
+  }
+
+  function query(withCounty) {
+    const params = new URLSearchParams();
+    if (withCounty && countySelect.value) params.set("county", countySelect.value);
+    if (apiKey) params.set("api_key", apiKey);
+    const q = params.toString();
+    return q ? "?" + q : "";
+  }
+
+  async function load() {
+    clear();
+    const resp = await fetch("../incidents.geojson" + query(true));
+    const fc = await resp.json();
+    // Oldest first, so the newest end up at the top of the list.
+    fc.features.reverse().forEach((f) => upsert(f.properties, false));
+  }
+
+  function follow() {
+    if (stream) stream.close();
+    stream = new EventSource("../stream" + query(true));
+    stream.onopen = () => {
+      statusEl.textContent = "live";
+      statusEl.classList.add("live");
+    };
+    stream.onerror = () => {
+      statusEl.textContent = "reconnecting…";
+      statusEl.classList.remove("live");
+    };
+    for (const change of ["created", "updated", "cleared"]) {
+      stream.addEventListener(change, (e) => upsert(JSON.parse(e.data).incident, true));
+    }
+  }
+
+  async function loadCounties() {
+    const resp = await fetch("../stats/summary" + query(false));
+    const summary = await resp.json();
+    Object.keys(summary.active_by_county).sort().forEach((county) => {
+      const opt = document.createElement("option");
+      opt.value = opt.textContent = county;
+      countySelect.appendChild(opt);
+    });
+  }
+
+  countySelect.addEventListener("change", () => {
+    load();
+    follow();
+  });
+
+  loadCounties();
+  load().then(follow);
+  // Catch up after anything the stream missed, e.g. while reconnecting.
+  setInterval(load, 10 * 60 * 1000);
+})();
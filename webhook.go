@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// webhookSink POSTs each event as JSON to a receiver URL, with the event's
+// ID in X-Ingester-Event-Id. When a secret is configured the request
+// carries
+//
+//	X-Ingester-Timestamp: <unix seconds>
+//	X-Ingester-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// so receivers can verify the sender and reject replays.
+type webhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func newWebhookSink(url, secret string) *webhookSink {
+	return &webhookSink{url: url, secret: []byte(secret), client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (s *webhookSink) Name() string {
+	if u, err := url.Parse(s.url); err == nil && u.Host != "" {
+		return "webhook " + u.Host
+	}
+	return "webhook"
+}
+
+func (s *webhookSink) Publish(ctx context.Context, event IncidentEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return permanentError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Ingester-Event", string(event.Change))
+	req.Header.Set("X-Ingester-Event-Id", event.ID)
+	req.Header.Set("X-Ingester-Timestamp", timestamp)
+	if len(s.secret) > 0 {
+		req.Header.Set("X-Ingester-Signature", "sha256="+signPayload(s.secret, timestamp, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook returned %s", resp.Status)
+	// Apart from timeouts and rate limiting, a 4xx means the receiver
+	// rejected the payload and sending it again won't help.
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+func signPayload(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}